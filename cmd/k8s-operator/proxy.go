@@ -6,7 +6,9 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,10 +16,13 @@
 	"net/netip"
 	"net/url"
 	"os"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
 	"tailscale.com/client/tailscale"
@@ -152,12 +157,20 @@ func runAPIServerProxy(ts *tsnet.Server, rt http.RoundTripper, log *zap.SugaredL
 		log.Fatalf("could not get local client: %v", err)
 	}
 
+	var heartbeat time.Duration
+	if v := defaultEnv("APISERVER_PROXY_RECORDING_HEARTBEAT", ""); v != "" {
+		if heartbeat, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid APISERVER_PROXY_RECORDING_HEARTBEAT %q: %v", v, err)
+		}
+	}
+
 	ap := &apiserverProxy{
-		log:         log,
-		lc:          lc,
-		mode:        mode,
-		upstreamURL: u,
-		ts:          ts,
+		log:                log,
+		lc:                 lc,
+		mode:               mode,
+		upstreamURL:        u,
+		ts:                 ts,
+		recordingHeartbeat: heartbeat,
 	}
 	ap.rp = &httputil.ReverseProxy{
 		Rewrite: func(pr *httputil.ProxyRequest) {
@@ -196,6 +209,11 @@ type apiserverProxy struct {
 	mode        apiServerProxyMode
 	ts          *tsnet.Server
 	upstreamURL *url.URL
+
+	// recordingHeartbeat is how often recorded 'kubectl exec' sessions send
+	// heartbeats to the recorder, or zero for none. It's set by the
+	// APISERVER_PROXY_RECORDING_HEARTBEAT env var, as a duration.
+	recordingHeartbeat time.Duration
 }
 
 // serveDefault is the default handler for Kubernetes API server requests.
@@ -234,9 +252,11 @@ func (ap *apiserverProxy) serveExec(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
-	if r.Method != "POST" || r.Header.Get("Upgrade") != "SPDY/3.1" {
+	h := kubesessionrecording.New(ap.ts, r, who, w, r.PathValue("pod"), r.PathValue("namespace"), "", addrs, kubesessionrecording.FailOpen(failOpen), sessionrecording.ConnectToRecorder, nil, ap.log)
+	h.SetHeartbeatInterval(ap.recordingHeartbeat)
+	if h.Protocol() != kubesessionrecording.SPDYProtocol {
 		msg := "'kubectl exec' session recording is configured, but the request is not over SPDY. Session recording is currently only supported for SPDY based clients"
-		if failOpen {
+		if h.FailOpen() {
 			msg = msg + "; failure mode is 'fail open'; continuing session without recording."
 			ap.log.Warn(msg)
 			ap.rp.ServeHTTP(w, r.WithContext(whoIsKey.WithValue(r.Context(), who)))
@@ -247,9 +267,70 @@ func (ap *apiserverProxy) serveExec(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
-	spdyH := kubesessionrecording.New(ap.ts, r, who, w, r.PathValue("pod"), r.PathValue("namespace"), kubesessionrecording.SPDYProtocol, addrs, failOpen, sessionrecording.ConnectToRecorder, ap.log)
+	if pod, err := ap.lookupPod(r, who); err != nil {
+		// The Pod info is only metadata; record the session without it.
+		ap.log.Infof("error looking up Pod for session recording metadata: %v", err)
+	} else {
+		h.SetPodInfo(podRecordingInfo(pod, r.URL.Query().Get("container")))
+	}
+
+	ap.rp.ServeHTTP(h, r.WithContext(whoIsKey.WithValue(r.Context(), who)))
+}
+
+// podLookupTimeout bounds how long lookupPod delays a recorded 'kubectl exec'
+// session.
+const podLookupTimeout = 5 * time.Second
+
+// lookupPod gets the Pod that the 'kubectl exec' request r is for from the
+// Kubernetes API, as the requesting user who, the same way r is proxied. It
+// gives up after podLookupTimeout.
+func (ap *apiserverProxy) lookupPod(r *http.Request, who *apitype.WhoIsResponse) (*corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), podLookupTimeout)
+	defer cancel()
+	u := &url.URL{Path: path.Join("/api/v1/namespaces", r.PathValue("namespace"), "pods", r.PathValue("pod"))}
+	req, err := http.NewRequestWithContext(whoIsKey.WithValue(ctx, who), "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// In noauth mode, the caller's own credentials are used.
+	if a := r.Header.Get("Authorization"); a != "" {
+		req.Header.Set("Authorization", a)
+	}
+	req.Header.Set("Accept", "application/json")
+	ap.addImpersonationHeadersAsRequired(req)
+	resp, err := ap.rp.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting Pod %s/%s: %v", r.PathValue("namespace"), r.PathValue("pod"), resp.Status)
+	}
+	pod := new(corev1.Pod)
+	if err := json.NewDecoder(resp.Body).Decode(pod); err != nil {
+		return nil, fmt.Errorf("decoding Pod: %w", err)
+	}
+	return pod, nil
+}
 
-	ap.rp.ServeHTTP(spdyH, r.WithContext(whoIsKey.WithValue(r.Context(), who)))
+// podRecordingInfo returns the metadata of pod for the recording of a
+// 'kubectl exec' session into its container named container: the Pod's UID,
+// the container's runtime ID and the IP of the node the Pod runs on. If
+// container is empty, the Pod's only container, if it has just one, is
+// assumed, as by the API server. Any not known are returned empty or
+// invalid.
+func podRecordingInfo(pod *corev1.Pod, container string) (podUID, containerID string, nodeIP netip.Addr) {
+	if container == "" && len(pod.Spec.Containers) == 1 {
+		container = pod.Spec.Containers[0].Name
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == container {
+			containerID = cs.ContainerID
+			break
+		}
+	}
+	nodeIP, _ = netip.ParseAddr(pod.Status.HostIP)
+	return string(pod.UID), containerID, nodeIP
 }
 
 func (h *apiserverProxy) addImpersonationHeadersAsRequired(r *http.Request) {
@@ -6,13 +6,19 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
 	"net/netip"
+	"net/url"
 	"reflect"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
 	"tailscale.com/util/must"
@@ -180,6 +186,83 @@ func Test_determineRecorderConfig(t *testing.T) {
 	}
 }
 
+func TestLookupPod(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns", UID: "5f1e9a2c-7d1b-4c5e-9d2f-0a1b2c3d4e5f"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "sidecar"}}},
+		Status: corev1.PodStatus{
+			HostIP: "10.0.0.5",
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", ContainerID: "containerd://4c8f0e2d"},
+				{Name: "sidecar", ContainerID: "containerd://9a7b6c5d"},
+			},
+		},
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/ns/pods/pod" {
+			http.NotFound(w, r)
+			return
+		}
+		// The Pod is looked up as the requesting user.
+		if got := r.Header.Get("Impersonate-User"); got != "foo@example.com" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(pod)
+	}))
+	defer upstream.Close()
+
+	ap := &apiserverProxy{
+		log:         zl.Sugar(),
+		mode:        apiserverProxyModeEnabled,
+		upstreamURL: must.Get(url.Parse(upstream.URL)),
+		rp:          &httputil.ReverseProxy{Transport: http.DefaultTransport},
+	}
+	r := httptest.NewRequest("POST", "/api/v1/namespaces/ns/pods/pod/exec?container=sidecar", nil)
+	r.SetPathValue("namespace", "ns")
+	r.SetPathValue("pod", "pod")
+	who := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{},
+		UserProfile: &tailcfg.UserProfile{LoginName: "foo@example.com"},
+	}
+	got, err := ap.lookupPod(r, who)
+	if err != nil {
+		t.Fatalf("lookupPod: %v", err)
+	}
+	if got.UID != pod.UID {
+		t.Errorf("got Pod UID %q, want %q", got.UID, pod.UID)
+	}
+
+	tests := []struct {
+		container       string
+		wantContainerID string
+	}{
+		{"sidecar", "containerd://9a7b6c5d"},
+		{"app", "containerd://4c8f0e2d"},
+		{"", ""}, // ambiguous with two containers
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		podUID, containerID, nodeIP := podRecordingInfo(got, tt.container)
+		if podUID != string(pod.UID) || containerID != tt.wantContainerID || nodeIP != netip.MustParseAddr("10.0.0.5") {
+			t.Errorf("podRecordingInfo(%q) = %q, %q, %v; want %q, %q, 10.0.0.5", tt.container, podUID, containerID, nodeIP, pod.UID, tt.wantContainerID)
+		}
+	}
+	got.Spec.Containers = got.Spec.Containers[:1]
+	if _, containerID, _ := podRecordingInfo(got, ""); containerID != "containerd://4c8f0e2d" {
+		t.Errorf("podRecordingInfo of the only container = %q, want %q", containerID, "containerd://4c8f0e2d")
+	}
+
+	who.UserProfile.LoginName = "bar@example.com"
+	if _, err := ap.lookupPod(r, who); err == nil {
+		t.Error("lookupPod succeeded for a user that can't get the Pod")
+	}
+}
+
 func whoResp(capMap map[string][]string) *apitype.WhoIsResponse {
 	resp := &apitype.WhoIsResponse{
 		CapMap: tailcfg.PeerCapMap{},
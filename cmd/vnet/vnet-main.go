@@ -7,26 +7,31 @@
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"time"
 
 	"tailscale.com/tstest/natlab/vnet"
+	"tailscale.com/tsweb/varz"
 )
 
 var (
 	listen  = flag.String("listen", "/tmp/qemu.sock", "path to listen on")
+	tcp     = flag.String("tcp", "", "if non-empty, TCP address to listen on for QEMU stream clients instead of --listen")
 	nat     = flag.String("nat", "easy", "type of NAT to use")
 	portmap = flag.Bool("portmap", false, "enable portmapping")
 	dgram   = flag.Bool("dgram", false, "enable datagram mode; for use with macOS Hypervisor.Framework and VZFileHandleNetworkDeviceAttachment")
+	metrics = flag.String("metrics", "", "if non-empty, address to serve Prometheus metrics on at /debug/varz")
 )
 
 func main() {
 	flag.Parse()
 
-	if _, err := os.Stat(*listen); err == nil {
+	if _, err := os.Stat(*listen); err == nil && *tcp == "" {
 		os.Remove(*listen)
 	}
 
@@ -43,6 +48,8 @@ func main() {
 			log.Fatalf("ListenUnixgram: %v", err)
 		}
 		defer conn.Close()
+	} else if *tcp != "" {
+		srv, err = net.Listen("tcp", *tcp)
 	} else {
 		srv, err = net.Listen("unix", *listen)
 	}
@@ -68,6 +75,14 @@ func main() {
 
 	s.WriteStartingBanner(os.Stdout)
 
+	if *metrics != "" {
+		expvar.Publish("vnet", s.ExpVar())
+		http.HandleFunc("/debug/varz", varz.Handler)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metrics, nil))
+		}()
+	}
+
 	go func() {
 		getStatus := func() {
 			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -96,6 +111,6 @@ func main() {
 			log.Printf("Accept: %v", err)
 			continue
 		}
-		go s.ServeUnixConn(c.(*net.UnixConn), vnet.ProtocolQEMU)
+		go s.ServeConn(c, vnet.ProtocolQEMU)
 	}
 }
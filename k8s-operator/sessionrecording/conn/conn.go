@@ -7,7 +7,10 @@
 // connection of a 'kubectl exec' session that is being recorded.
 package conn
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 type Conn interface {
 	net.Conn
@@ -17,4 +20,12 @@ type Conn interface {
 	// connection state is failed- so set the state to failed when erroring
 	// out and failure policy is to fail closed.
 	Fail()
+	// LastActivity returns the time of the last stdin, stdout or stderr
+	// data of the session.
+	LastActivity() time.Time
+	// EndRecording finalizes the recording, noting reason as why it
+	// ended. The connection stays open but is no longer recorded.
+	EndRecording(reason string) error
+	// Done returns a channel that's closed once the connection is closed.
+	Done() <-chan struct{}
 }
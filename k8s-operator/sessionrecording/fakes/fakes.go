@@ -9,6 +9,8 @@
 
 import (
 	"bytes"
+	"compress/zlib"
+	"encoding/binary"
 	"encoding/json"
 	"net"
 	"sync"
@@ -116,3 +118,63 @@ func AsciinemaResizeMsg(t *testing.T, width, height int) []byte {
 	}
 	return append(bs, '\n')
 }
+
+// SPDYFramer builds SPDY frames as sent by the peers of a 'kubectl exec'
+// session. Control frame headers are compressed with a single zlib stream
+// shared by all frames, as SPDY requires. The zero value is ready to use.
+type SPDYFramer struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+// SynStream returns a SYN_STREAM control frame that opens the stream with
+// the given ID and 'Streamtype' header (for example "stdout").
+func (f *SPDYFramer) SynStream(t *testing.T, streamID uint32, streamType string) []byte {
+	t.Helper()
+	if f.zw == nil {
+		f.zw = zlib.NewWriter(&f.buf)
+	}
+	var hb bytes.Buffer
+	const name = "streamtype"
+	binary.Write(&hb, binary.BigEndian, uint32(1)) // number of headers
+	binary.Write(&hb, binary.BigEndian, uint32(len(name)))
+	hb.WriteString(name)
+	binary.Write(&hb, binary.BigEndian, uint32(len(streamType)))
+	hb.WriteString(streamType)
+	f.buf.Reset()
+	if _, err := f.zw.Write(hb.Bytes()); err != nil {
+		t.Fatalf("error compressing headers: %v", err)
+	}
+	if err := f.zw.Flush(); err != nil {
+		t.Fatalf("error flushing headers: %v", err)
+	}
+
+	// Stream ID, associated stream ID and priority precede the headers.
+	payload := binary.BigEndian.AppendUint32(nil, streamID)
+	payload = append(payload, make([]byte, 6)...)
+	payload = append(payload, f.buf.Bytes()...)
+	const synStream = 1
+	frame := []byte{0x80, 0x3, 0x0, synStream}
+	frame = appendLength(frame, len(payload))
+	return append(frame, payload...)
+}
+
+// DataFrame returns a SPDY data frame carrying p on the given stream.
+func DataFrame(streamID uint32, p []byte) []byte {
+	frame := binary.BigEndian.AppendUint32(nil, streamID&0x7fffffff)
+	frame = appendLength(frame, len(p))
+	return append(frame, p...)
+}
+
+// PingFrame returns a SPDY PING control frame with the given ID.
+func PingFrame(id uint32) []byte {
+	const ping = 6
+	frame := []byte{0x80, 0x3, 0x0, ping}
+	frame = appendLength(frame, 4)
+	return binary.BigEndian.AppendUint32(frame, id)
+}
+
+// appendLength appends zero flags and the 24 bit length n to b.
+func appendLength(b []byte, n int) []byte {
+	return append(b, 0x0, byte(n>>16), byte(n>>8), byte(n))
+}
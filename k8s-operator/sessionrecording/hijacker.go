@@ -11,16 +11,19 @@
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/netip"
 	"strings"
+	"time"
 
-	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"tailscale.com/client/tailscale/apitype"
+	srconn "tailscale.com/k8s-operator/sessionrecording/conn"
 	"tailscale.com/k8s-operator/sessionrecording/spdy"
 	"tailscale.com/k8s-operator/sessionrecording/tsrecorder"
 	"tailscale.com/sessionrecording"
@@ -31,12 +34,37 @@
 	"tailscale.com/util/multierr"
 )
 
-const SPDYProtocol protocol = "SPDY"
+const (
+	SPDYProtocol protocol = "SPDY"
+	WSProtocol   protocol = "WebSocket"
+)
 
 // protocol is the streaming protocol of the hijacked session. Supported
-// protocols are SPDY.
+// protocols are SPDY. WebSocket sessions are detected, but can't be recorded
+// yet.
 type protocol string
 
+// detectProtocol returns the streaming protocol that the 'kubectl exec'
+// request req asks to upgrade to, or the empty string if it's neither SPDY
+// nor WebSocket with a Kubernetes remotecommand subprotocol.
+func detectProtocol(req *http.Request) protocol {
+	upgrade := req.Header.Get("Upgrade")
+	switch {
+	case req.Method == "POST" && strings.EqualFold(upgrade, "SPDY/3.1"):
+		return SPDYProtocol
+	case req.Method == "GET" && strings.EqualFold(upgrade, "websocket"):
+		// For example v5.channel.k8s.io or v4.base64.channel.k8s.io.
+		for _, h := range req.Header.Values("Sec-WebSocket-Protocol") {
+			for _, p := range strings.Split(h, ",") {
+				if strings.HasSuffix(strings.TrimSpace(p), "channel.k8s.io") {
+					return WSProtocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
 var (
 	// CounterSessionRecordingsAttempted counts the number of session recording attempts.
 	CounterSessionRecordingsAttempted = clientmetric.NewCounter("k8s_auth_proxy_session_recordings_attempted")
@@ -45,7 +73,40 @@
 	counterSessionRecordingsUploaded = clientmetric.NewCounter("k8s_auth_proxy_session_recordings_uploaded")
 )
 
-func New(ts *tsnet.Server, req *http.Request, who *apitype.WhoIsResponse, w http.ResponseWriter, pod, ns string, proto protocol, addrs []netip.AddrPort, failOpen bool, connFunc RecorderDialFn, log *zap.SugaredLogger) *Hijacker {
+var (
+	// ErrNoRecorderReachable is wrapped by the error returned from Hijack
+	// when the session should be recorded, the failure mode is 'fail closed'
+	// and none of the recorders could be connected to.
+	ErrNoRecorderReachable = errors.New("no session recorder reachable")
+
+	// ErrRecorderRejected is wrapped by the error returned from Hijack when
+	// the session should be recorded, the failure mode is 'fail closed' and
+	// a recorder was reached but refused to accept the recording.
+	ErrRecorderRejected = errors.New("session recorder rejected the recording")
+)
+
+// FailOpenFunc reports whether a 'kubectl exec' session running command, the
+// command and arguments from the request's "command" query parameters, should
+// continue unrecorded if recording it fails ('fail open') rather than be
+// closed ('fail closed'). It lets safe, read-only commands proceed while
+// privileged ones strictly require recording.
+type FailOpenFunc func(command []string) bool
+
+// FailOpen returns a FailOpenFunc that applies the same failure mode, fail
+// open if v is true, to every session.
+func FailOpen(v bool) FailOpenFunc {
+	return func([]string) bool { return v }
+}
+
+// New returns a Hijacker for the given 'kubectl exec' request. If sink is
+// non-nil, the session is recorded to sink and addrs and connFunc are unused.
+// If proto is empty, it's detected from req's headers; see
+// [Hijacker.Protocol]. The session's failure mode is chosen by calling
+// failOpen with the request's command; a nil failOpen means fail closed.
+func New(ts *tsnet.Server, req *http.Request, who *apitype.WhoIsResponse, w http.ResponseWriter, pod, ns string, proto protocol, addrs []netip.AddrPort, failOpen FailOpenFunc, connFunc RecorderDialFn, sink io.WriteCloser, log *zap.SugaredLogger) *Hijacker {
+	if proto == "" {
+		proto = detectProtocol(req)
+	}
 	return &Hijacker{
 		ts:                ts,
 		req:               req,
@@ -54,13 +115,110 @@ func New(ts *tsnet.Server, req *http.Request, who *apitype.WhoIsResponse, w http
 		pod:               pod,
 		ns:                ns,
 		addrs:             addrs,
-		failOpen:          failOpen,
+		failOpen:          failOpen != nil && failOpen(req.URL.Query()["command"]),
 		connectToRecorder: connFunc,
+		sink:              sink,
 		proto:             proto,
 		log:               log,
+		connectTimeout:    defaultConnectTimeout,
 	}
 }
 
+// defaultConnectTimeout is how long a Hijacker created with New waits for a
+// recorder to accept the recording.
+const defaultConnectTimeout = 30 * time.Second
+
+// FailOpen reports whether the session continues unrecorded if recording it
+// fails, as chosen by the FailOpenFunc passed to New.
+func (h *Hijacker) FailOpen() bool {
+	return h.failOpen
+}
+
+// Protocol returns the streaming protocol of the session: the one passed to
+// New or, if none was, the one detected from the request's headers. It's
+// empty if the request is for neither SPDY nor WebSocket.
+func (h *Hijacker) Protocol() protocol {
+	return h.proto
+}
+
+// SetHeartbeatInterval sets how often an empty output event is written to
+// the recorder while a session is being recorded. Heartbeats are off by
+// default, as they add these events to the recording. A failed write is
+// handled like any other recorder error, so a recorder that closes the
+// connection during an idle session is noticed at the next heartbeat; one
+// that becomes unreachable is only noticed once the write times out in TCP.
+// A d of zero or less disables heartbeats. It must be called before Hijack.
+func (h *Hijacker) SetHeartbeatInterval(d time.Duration) {
+	h.heartbeatInterval = d
+}
+
+// SetConnectTimeout sets how long to wait for any of the recorders to accept
+// the recording before giving up and applying the failure policy. A d of zero
+// or less means no timeout. It must be called before Hijack.
+func (h *Hijacker) SetConnectTimeout(d time.Duration) {
+	h.connectTimeout = d
+}
+
+// SetPodInfo sets the UID of the Pod being exec-ed, the runtime ID of the
+// container being exec-ed and the IP address of the node the Pod runs on, to
+// be included in the recording's metadata. Any may be empty or invalid if not
+// known. It must be called before Hijack.
+func (h *Hijacker) SetPodInfo(podUID, containerID string, nodeIP netip.Addr) {
+	h.podUID = podUID
+	h.containerID = containerID
+	h.nodeIP = nodeIP
+}
+
+// SetIdleTimeout sets how long a session may go without stdin, stdout or
+// stderr data before its recording is finalized. If closeSession is true,
+// the session's connection is closed too; otherwise the session continues
+// unrecorded. A d of zero or less, the default, means no idle timeout. It
+// must be called before Hijack.
+func (h *Hijacker) SetIdleTimeout(d time.Duration, closeSession bool) {
+	h.idleTimeout = d
+	h.closeOnIdle = closeSession
+}
+
+// SetIdleTimeLimit caps the gap recorded between consecutive events in the
+// session's recording at d, like asciinema's idle_time_limit, so that long
+// pauses don't make playback tedious. The session itself is unaffected. A d
+// of zero or less, the default, means gaps are recorded as they happened. It
+// must be called before Hijack.
+func (h *Hijacker) SetIdleTimeLimit(d time.Duration) {
+	h.idleTimeLimit = d
+}
+
+// SetRecorderTLSConfig makes the Hijacker connect to recorders over TLS with
+// config c, such as one trusting a custom CA or with a client certificate for
+// mTLS. If c has no ServerName, the recorder's IP address is verified. A nil
+// c, the default, means connecting without TLS. It must be called before
+// Hijack or CheckRecorders.
+func (h *Hijacker) SetRecorderTLSConfig(c *tls.Config) {
+	h.recorderTLS = c
+}
+
+// SetTranscript makes the Hijacker write a plain-text transcript of the
+// session's stdout to w, with ANSI escape sequences such as colors removed,
+// alongside the asciicast recording, for searching with tools like grep. It's
+// only written while the session is recorded. If writing to w fails, the
+// transcript is abandoned but the session and its recording continue. A nil
+// w, the default, means no transcript. It must be called before Hijack.
+func (h *Hijacker) SetTranscript(w io.Writer) {
+	h.transcript = w
+}
+
+// SetOutputChunking makes the Hijacker coalesce the session's output into
+// recording events of up to size bytes, each held back for at most delay, so
+// that sessions writing many small bursts of output don't thrash the
+// connection to the recorder. Events are recorded at the time of their first
+// output, so the recording's timeline is off by at most delay. A size of zero
+// or less, the default, means each write of output is recorded as it
+// happens. It must be called before Hijack.
+func (h *Hijacker) SetOutputChunking(size int, delay time.Duration) {
+	h.chunkSize = size
+	h.chunkDelay = delay
+}
+
 // Hijacker implements [net/http.Hijacker] interface.
 // It must be configured with an http request for a 'kubectl exec' session that
 // needs to be recorded. It knows how to hijack the connection and configure for
@@ -73,10 +231,27 @@ type Hijacker struct {
 	log               *zap.SugaredLogger
 	pod               string           // pod being exec-d
 	ns                string           // namespace of the pod being exec-d
+	podUID            string           // UID of the pod being exec-d, if known
+	containerID       string           // runtime ID of the container being exec-d, if known
+	nodeIP            netip.Addr       // IP of the node the pod runs on, if known
 	addrs             []netip.AddrPort // tsrecorder addresses
 	failOpen          bool             // whether to fail open if recording fails
 	connectToRecorder RecorderDialFn
-	proto             protocol // streaming protocol
+	sink              io.WriteCloser // if non-nil, the recording is written here instead of to a recorder
+	proto             protocol       // streaming protocol
+	heartbeatInterval time.Duration  // how often to write heartbeats to the recorder; 0 disables
+	connectTimeout    time.Duration  // how long to wait for a recorder to accept the recording; 0 means forever
+	idleTimeout       time.Duration  // how long a session may be idle before recording ends; 0 means forever
+	closeOnIdle       bool           // whether to also close the session on idle timeout
+	idleTimeLimit     time.Duration  // max gap between recorded events; 0 means no limit
+	recorderTLS       *tls.Config    // if non-nil, recorders are connected to over TLS with this config
+	transcript        io.Writer      // if non-nil, a plain-text transcript of stdout is written here
+	chunkSize         int            // max bytes of output per recording event; 0 disables chunking
+	chunkDelay        time.Duration  // max time output is held back before being recorded
+
+	// dial, if non-nil, is used instead of ts.Dial to connect to recorders.
+	// Tests may set it.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 // RecorderDialFn dials the specified netip.AddrPorts that should be tsrecorder
@@ -102,38 +277,83 @@ func (h *Hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return conn, brw, nil
 }
 
+// CheckRecorders reports whether any of the recorders accepts a recording,
+// without hijacking the connection or starting a session. The returned error
+// wraps ErrNoRecorderReachable or ErrRecorderRejected.
+//
+// It uploads an empty recording and waits for the recorder's response to it,
+// so each check leaves an empty recording on the recorder. If the Hijacker
+// records to a local sink, it returns nil.
+func (h *Hijacker) CheckRecorders(ctx context.Context) error {
+	if h.sink != nil {
+		return nil
+	}
+	rw, errChan, err := h.dialRecorder(ctx)
+	if err != nil {
+		return fmt.Errorf("error connecting to session recorders: %w", recorderConnectError(err))
+	}
+	if err := rw.Close(); err != nil {
+		return fmt.Errorf("error ending upload to session recorder: %w", err)
+	}
+	if errChan == nil {
+		return nil
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			return fmt.Errorf("error uploading to session recorder: %w", recorderConnectError(err))
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // setupRecording attempts to connect to the recorders set via
 // spdyHijacker.addrs. Returns conn from provided opts, wrapped in recording
 // logic. If connecting to the recorder fails or an error is received during the
-// session and spdyHijacker.failOpen is false, connection will be closed.
+// session and spdyHijacker.failOpen is false, connection will be closed. If
+// h.sink is set, the session is recorded to it instead of to a recorder.
 func (h *Hijacker) setUpRecording(ctx context.Context, conn net.Conn) (net.Conn, error) {
 	const (
 		// https://docs.asciinema.org/manual/asciicast/v2/
 		asciicastv2 = 2
 	)
-	var wc io.WriteCloser
-	h.log.Infof("kubectl exec session will be recorded, recorders: %v, fail open policy: %t", h.addrs, h.failOpen)
-	// TODO (irbekrm): send client a message that session will be recorded.
-	rw, _, errChan, err := h.connectToRecorder(ctx, h.addrs, h.ts.Dial)
-	if err != nil {
-		msg := fmt.Sprintf("error connecting to session recorders: %v", err)
-		if h.failOpen {
-			msg = msg + "; failure mode is 'fail open'; continuing session without recording."
-			h.log.Warnf(msg)
-			return conn, nil
-		}
-		msg = msg + "; failure mode is 'fail closed'; closing connection."
-		if err := closeConnWithWarning(conn, msg); err != nil {
-			return nil, multierr.New(errors.New(msg), err)
+	var (
+		wc      io.WriteCloser
+		errChan <-chan error
+	)
+	if h.sink != nil {
+		h.log.Infof("kubectl exec session will be recorded to a local sink, fail open policy: %t", h.failOpen)
+		wc = h.sink
+	} else {
+		h.log.Infof("kubectl exec session will be recorded, recorders: %v, fail open policy: %t", h.addrs, h.failOpen)
+		// TODO (irbekrm): send client a message that session will be recorded.
+		rw, ec, err := h.dialRecorder(ctx)
+		if err != nil {
+			err = recorderConnectError(err)
+			msg := fmt.Sprintf("error connecting to session recorders: %v", err)
+			if h.failOpen {
+				msg = msg + "; failure mode is 'fail open'; continuing session without recording."
+				h.log.Warnf(msg)
+				return conn, nil
+			}
+			msg = msg + "; failure mode is 'fail closed'; closing connection."
+			err = fmt.Errorf("error connecting to session recorders: %w; failure mode is 'fail closed'; closing connection", err)
+			if cerr := closeConnWithWarning(conn, msg); cerr != nil {
+				return nil, multierr.New(err, cerr)
+			}
+			return nil, err
 		}
-		return nil, errors.New(msg)
-	}
 
-	// TODO (irbekrm): log which recorder
-	h.log.Info("successfully connected to a session recorder")
-	wc = rw
+		// TODO (irbekrm): log which recorder
+		h.log.Info("successfully connected to a session recorder")
+		wc, errChan = rw, ec
+	}
 	cl := tstime.DefaultClock{}
 	rec := tsrecorder.New(wc, cl, cl.Now(), h.failOpen)
+	rec.SetIdleTimeLimit(h.idleTimeLimit)
+	rec.SetChunking(h.chunkSize, h.chunkDelay)
 	qp := h.req.URL.Query()
 	ch := sessionrecording.CastHeader{
 		Version:   asciicastv2,
@@ -142,24 +362,52 @@ func (h *Hijacker) setUpRecording(ctx context.Context, conn net.Conn) (net.Conn,
 		SrcNode:   strings.TrimSuffix(h.who.Node.Name, "."),
 		SrcNodeID: h.who.Node.StableID,
 		Kubernetes: &sessionrecording.Kubernetes{
-			PodName:   h.pod,
-			Namespace: h.ns,
-			Container: strings.Join(qp["container"], " "),
+			PodName:     h.pod,
+			Namespace:   h.ns,
+			Container:   strings.Join(qp["container"], " "),
+			PodUID:      h.podUID,
+			ContainerID: h.containerID,
 		},
 	}
+	if h.nodeIP.IsValid() {
+		ch.Kubernetes.NodeIP = h.nodeIP.String()
+	}
 	if !h.who.Node.IsTagged() {
 		ch.SrcNodeUser = h.who.UserProfile.LoginName
 		ch.SrcNodeUserID = h.who.Node.User
 	} else {
 		ch.SrcNodeTags = h.who.Node.Tags
 	}
-	lc := spdy.New(conn, rec, ch, h.log)
+	lc := spdy.New(conn, rec, ch, h.transcript, h.log)
+	if h.idleTimeout > 0 {
+		go h.endRecordingWhenIdle(ctx, lc)
+	}
+	if errChan == nil {
+		// Recording to a local sink; write errors are handled by the
+		// recorder client according to the failure mode.
+		return lc, nil
+	}
 	go func() {
+		var heartbeat <-chan time.Time
+		if h.heartbeatInterval > 0 {
+			t := time.NewTicker(h.heartbeatInterval)
+			defer t.Stop()
+			heartbeat = t.C
+		}
 		var err error
-		select {
-		case <-ctx.Done():
-			return
-		case err = <-errChan:
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err = <-errChan:
+				break wait
+			case <-heartbeat:
+				if err = rec.Heartbeat(); err != nil {
+					err = fmt.Errorf("error sending heartbeat: %w", err)
+					break wait
+				}
+			}
 		}
 		if err == nil {
 			counterSessionRecordingsUploaded.Add(1)
@@ -184,6 +432,117 @@ func (h *Hijacker) setUpRecording(ctx context.Context, conn net.Conn) (net.Conn,
 	return lc, nil
 }
 
+// endRecordingWhenIdle finalizes the recording of lc, and closes lc if
+// h.closeOnIdle is set, once the session has been idle for h.idleTimeout. It
+// returns early if lc is closed first.
+func (h *Hijacker) endRecordingWhenIdle(ctx context.Context, lc srconn.Conn) {
+	closed := lc.Done()
+	t := time.NewTimer(h.idleTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		case <-t.C:
+		}
+		idle := time.Since(lc.LastActivity())
+		if idle >= h.idleTimeout {
+			break
+		}
+		t.Reset(h.idleTimeout - idle)
+	}
+	// If the session has ended meanwhile, this is a no-op.
+	h.log.Infof("kubectl exec session idle for %v; ending recording", h.idleTimeout)
+	if err := lc.EndRecording("idle timeout"); err != nil {
+		h.log.Infof("error ending recording: %v", err)
+	}
+	if h.closeOnIdle {
+		if err := lc.Close(); err != nil {
+			h.log.Infof("error closing idle session: %v", err)
+		}
+	}
+}
+
+// dialRecorder connects to one of h.addrs with h.connectToRecorder, giving up
+// after h.connectTimeout. The returned channel receives the result of the
+// upload once the returned writer is closed, as from a RecorderDialFn.
+func (h *Hijacker) dialRecorder(ctx context.Context) (io.WriteCloser, <-chan error, error) {
+	if h.connectTimeout <= 0 {
+		rw, _, errChan, err := h.connectToRecorder(ctx, h.addrs, h.recorderDial())
+		return rw, errChan, err
+	}
+	// The context is also used for the upload, so rather than giving it a
+	// deadline it is only canceled if connecting takes too long.
+	ctx, cancel := context.WithCancel(ctx)
+	t := time.AfterFunc(h.connectTimeout, cancel)
+	rw, _, errChan, err := h.connectToRecorder(ctx, h.addrs, h.recorderDial())
+	if !t.Stop() {
+		if err == nil {
+			rw.Close()
+			err = ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("timed out after %v: %w", h.connectTimeout, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	// Release the context once the upload has finished.
+	done := make(chan error, 1)
+	go func() {
+		err := <-errChan
+		cancel()
+		done <- err
+	}()
+	return rw, done, nil
+}
+
+// recorderDial returns the func that connects to recorder addresses: ts.Dial
+// (or h.dial), wrapped in TLS if h.recorderTLS is set.
+func (h *Hijacker) recorderDial() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := h.dial
+	if dial == nil {
+		dial = h.ts.Dial
+	}
+	if h.recorderTLS == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		config := h.recorderTLS
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			config = config.Clone()
+			config.ServerName = host
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with recorder %s: %w", addr, err)
+		}
+		return tc, nil
+	}
+}
+
+// recorderConnectError wraps err, returned by a RecorderDialFn, with
+// ErrRecorderRejected if any recorder refused the recording and with
+// ErrNoRecorderReachable otherwise.
+func recorderConnectError(err error) error {
+	if errors.Is(err, sessionrecording.ErrUnexpectedResponse) {
+		return fmt.Errorf("%w: %w", ErrRecorderRejected, err)
+	}
+	return fmt.Errorf("%w: %w", ErrNoRecorderReachable, err)
+}
+
 func closeConnWithWarning(conn net.Conn, msg string) error {
 	b := io.NopCloser(bytes.NewBuffer([]byte(msg)))
 	resp := http.Response{Status: http.StatusText(http.StatusForbidden), StatusCode: http.StatusForbidden, Body: b}
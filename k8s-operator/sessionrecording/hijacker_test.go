@@ -6,20 +6,30 @@
 package sessionrecording
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"go.uber.org/zap"
 	"tailscale.com/client/tailscale/apitype"
+	srconn "tailscale.com/k8s-operator/sessionrecording/conn"
 	"tailscale.com/k8s-operator/sessionrecording/fakes"
+	"tailscale.com/sessionrecording"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 	"tailscale.com/tstest"
@@ -110,3 +120,835 @@ func Test_Hijacker(t *testing.T) {
 		})
 	}
 }
+
+func Test_Hijacker_setUpRecordingErrors(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer rejecting.Close()
+
+	tests := []struct {
+		name    string
+		dial    func(context.Context, string, string) (net.Conn, error)
+		wantErr error
+	}{
+		{
+			name: "all_addrs_fail_to_dial",
+			dial: func(context.Context, string, string) (net.Conn, error) {
+				return nil, errors.New("dial failed")
+			},
+			wantErr: ErrNoRecorderReachable,
+		},
+		{
+			name: "recorder_rejects",
+			dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, rejecting.Listener.Addr().String())
+			},
+			wantErr: ErrRecorderRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &fakes.TestConn{}
+			h := &Hijacker{
+				connectToRecorder: func(ctx context.Context, addrs []netip.AddrPort, _ func(context.Context, string, string) (net.Conn, error)) (io.WriteCloser, []*tailcfg.SSHRecordingAttempt, <-chan error, error) {
+					return sessionrecording.ConnectToRecorder(ctx, addrs, tt.dial)
+				},
+				addrs: []netip.AddrPort{netip.MustParseAddrPort("100.64.0.1:80"), netip.MustParseAddrPort("100.64.0.2:80")},
+				who:   &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+				log:   zl.Sugar(),
+				ts:    &tsnet.Server{},
+				req:   &http.Request{URL: &url.URL{}},
+			}
+			_, err := h.setUpRecording(context.Background(), tc)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("setUpRecording() error = %v, want %v", err, tt.wantErr)
+			}
+			if !tc.IsClosed() {
+				t.Errorf("connection was not closed")
+			}
+		})
+	}
+}
+
+func Test_Hijacker_failOpenFunc(t *testing.T) {
+	readOnly := func(command []string) bool {
+		return len(command) > 0 && (command[0] == "ls" || command[0] == "cat")
+	}
+	tests := []struct {
+		name         string
+		query        string
+		wantFailOpen bool
+	}{
+		{name: "ls", query: "command=ls&command=-l", wantFailOpen: true},
+		{name: "cat", query: "command=cat&command=/etc/hostname", wantFailOpen: true},
+		{name: "rm", query: "command=rm&command=-rf&command=/data", wantFailOpen: false},
+		{name: "sh", query: "command=sh", wantFailOpen: false},
+		{name: "no_command", query: "", wantFailOpen: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/v1/namespaces/default/pods/foo/exec?"+tt.query, nil)
+			connFunc := func(context.Context, []netip.AddrPort, func(context.Context, string, string) (net.Conn, error)) (io.WriteCloser, []*tailcfg.SSHRecordingAttempt, <-chan error, error) {
+				return nil, nil, nil, errors.New("dial failed")
+			}
+			h := New(&tsnet.Server{}, req, &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}}, nil, "foo", "default", SPDYProtocol, []netip.AddrPort{netip.MustParseAddrPort("100.64.0.1:80")}, readOnly, connFunc, nil, zap.NewNop().Sugar())
+			if got := h.FailOpen(); got != tt.wantFailOpen {
+				t.Errorf("FailOpen() = %v, want %v", got, tt.wantFailOpen)
+			}
+
+			tc := &fakes.TestConn{}
+			conn, err := h.setUpRecording(context.Background(), tc)
+			if tt.wantFailOpen {
+				if err != nil || conn != tc {
+					t.Errorf("setUpRecording() = %v, %v; want the unrecorded conn", conn, err)
+				}
+				if tc.IsClosed() {
+					t.Errorf("connection was closed")
+				}
+				return
+			}
+			if !errors.Is(err, ErrNoRecorderReachable) {
+				t.Errorf("setUpRecording() error = %v, want %v", err, ErrNoRecorderReachable)
+			}
+			if !tc.IsClosed() {
+				t.Errorf("connection was not closed")
+			}
+		})
+	}
+
+	// A nil FailOpenFunc means fail closed.
+	req := httptest.NewRequest("POST", "/api/v1/namespaces/default/pods/foo/exec?command=ls", nil)
+	if h := New(nil, req, nil, nil, "foo", "default", "", nil, nil, nil, nil, zap.NewNop().Sugar()); h.FailOpen() {
+		t.Errorf("FailOpen() with a nil FailOpenFunc = true, want false")
+	}
+}
+
+// testSink is an in-memory local sink for recordings.
+type testSink struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (s *testSink) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(b)
+}
+
+func (s *testSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) lines(t *testing.T) [][]byte {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Split(bytes.TrimSuffix(s.buf.Bytes(), []byte("\n")), []byte("\n"))
+}
+
+func Test_Hijacker_sink(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &fakes.TestConn{}
+	sink := &testSink{}
+	h := &Hijacker{
+		connectToRecorder: func(context.Context, []netip.AddrPort, func(context.Context, string, string) (net.Conn, error)) (io.WriteCloser, []*tailcfg.SSHRecordingAttempt, <-chan error, error) {
+			t.Fatal("connectToRecorder called with a local sink configured")
+			return nil, nil, nil, nil
+		},
+		sink: sink,
+		pod:  "pod",
+		ns:   "ns",
+		who:  &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "node."}, UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"}},
+		log:  zl.Sugar(),
+		ts:   &tsnet.Server{},
+		req:  &http.Request{URL: &url.URL{RawQuery: "command=ls"}},
+	}
+	lc, err := h.setUpRecording(context.Background(), tc)
+	if err != nil {
+		t.Fatalf("setUpRecording: %v", err)
+	}
+
+	// The client opens the stdout stream, then the server writes to it.
+	var f fakes.SPDYFramer
+	if err := tc.WriteReadBufBytes(f.SynStream(t, 1, "stdout")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lc.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("reading SYN_STREAM: %v", err)
+	}
+	if _, err := lc.Write(fakes.DataFrame(1, []byte("hello"))); err != nil {
+		t.Fatalf("writing data frame: %v", err)
+	}
+	if err := lc.Close(); err != nil {
+		t.Fatalf("closing conn: %v", err)
+	}
+	if !sink.closed {
+		t.Errorf("sink was not closed")
+	}
+
+	lines := sink.lines(t)
+	if len(lines) != 3 {
+		t.Fatalf("got %d recording lines, want 3:\n%s", len(lines), bytes.Join(lines, []byte("\n")))
+	}
+	var ch sessionrecording.CastHeader
+	if err := json.Unmarshal(lines[0], &ch); err != nil {
+		t.Fatalf("unmarshalling CastHeader: %v", err)
+	}
+	if ch.Version != 2 || ch.Command != "ls" || ch.SrcNode != "node" || ch.SrcNodeUser != "user@example.com" {
+		t.Errorf("unexpected CastHeader: %+v", ch)
+	}
+	if ch.Kubernetes == nil || ch.Kubernetes.PodName != "pod" || ch.Kubernetes.Namespace != "ns" {
+		t.Errorf("unexpected Kubernetes metadata: %+v", ch.Kubernetes)
+	}
+	var ev []any
+	if err := json.Unmarshal(lines[1], &ev); err != nil {
+		t.Fatalf("unmarshalling event: %v", err)
+	}
+	if len(ev) != 3 || ev[1] != "o" || ev[2] != "hello" {
+		t.Errorf("unexpected event: %s", lines[1])
+	}
+	if err := json.Unmarshal(lines[2], &ev); err != nil {
+		t.Fatalf("unmarshalling end marker: %v", err)
+	}
+	if len(ev) != 3 || ev[1] != "m" || ev[2] != "session ended" {
+		t.Errorf("unexpected end marker: %s", lines[2])
+	}
+}
+
+func Test_Hijacker_transcript(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &fakes.TestConn{}
+	sink := &testSink{}
+	var transcript bytes.Buffer
+	h := &Hijacker{
+		sink: sink,
+		who:  &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+		log:  zl.Sugar(),
+		ts:   &tsnet.Server{},
+		req:  &http.Request{URL: &url.URL{RawQuery: "command=ls"}},
+	}
+	h.SetTranscript(&transcript)
+	lc, err := h.setUpRecording(context.Background(), tc)
+	if err != nil {
+		t.Fatalf("setUpRecording: %v", err)
+	}
+
+	var f fakes.SPDYFramer
+	if err := tc.WriteReadBufBytes(append(f.SynStream(t, 1, "stdout"), f.SynStream(t, 3, "stderr")...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lc.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("reading SYN_STREAMs: %v", err)
+	}
+	// Colored ls output, with an escape sequence split across frames, and
+	// some stderr, which isn't part of the transcript.
+	for _, frame := range [][]byte{
+		fakes.DataFrame(1, []byte("\x1b]0;user@pod: ~\x07\x1b[01;34mdir\x1b[0m  ")),
+		fakes.DataFrame(3, []byte("ls: warning\n")),
+		fakes.DataFrame(1, []byte("\x1b[01;")),
+		fakes.DataFrame(1, []byte("32mrun.sh\x1b[0m\r\n")),
+	} {
+		if _, err := lc.Write(frame); err != nil {
+			t.Fatalf("writing data frame: %v", err)
+		}
+	}
+	if err := lc.Close(); err != nil {
+		t.Fatalf("closing conn: %v", err)
+	}
+
+	if got, want := transcript.String(), "dir  run.sh\r\n"; got != want {
+		t.Errorf("transcript = %q, want %q", got, want)
+	}
+	// The asciicast recording is unchanged.
+	var ev []any
+	if err := json.Unmarshal(sink.lines(t)[1], &ev); err != nil {
+		t.Fatalf("unmarshalling event: %v", err)
+	}
+	if len(ev) != 3 || ev[2] != "\x1b]0;user@pod: ~\x07\x1b[01;34mdir\x1b[0m  " {
+		t.Errorf("unexpected first event: %v", ev)
+	}
+}
+
+// silentRecorder is a recorder connection that can be made to fail writes
+// without reporting an error on its error channel, like a recorder that has
+// gone away without closing the connection.
+type silentRecorder struct {
+	mu   sync.Mutex
+	dead bool
+}
+
+func (r *silentRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dead {
+		return 0, io.ErrClosedPipe
+	}
+	return len(b), nil
+}
+
+func (r *silentRecorder) Close() error { return nil }
+
+func (r *silentRecorder) kill() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dead = true
+}
+
+func Test_Hijacker_heartbeat(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const interval = 50 * time.Millisecond
+	tc := &fakes.TestConn{}
+	rec := &silentRecorder{}
+	h := &Hijacker{
+		connectToRecorder: func(context.Context, []netip.AddrPort, func(context.Context, string, string) (net.Conn, error)) (io.WriteCloser, []*tailcfg.SSHRecordingAttempt, <-chan error, error) {
+			return rec, nil, make(chan error), nil
+		},
+		who: &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+		log: zl.Sugar(),
+		ts:  &tsnet.Server{},
+		req: &http.Request{URL: &url.URL{}},
+	}
+	h.SetHeartbeatInterval(interval)
+	lc, err := h.setUpRecording(context.Background(), tc)
+	if err != nil {
+		t.Fatalf("setUpRecording: %v", err)
+	}
+	defer lc.Close()
+
+	// Write some output so that the recording has started, then go idle.
+	var f fakes.SPDYFramer
+	if err := tc.WriteReadBufBytes(f.SynStream(t, 1, "stdout")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lc.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("reading SYN_STREAM: %v", err)
+	}
+	if _, err := lc.Write(fakes.DataFrame(1, []byte("$ "))); err != nil {
+		t.Fatalf("writing data frame: %v", err)
+	}
+	time.Sleep(2 * interval)
+	if tc.IsClosed() {
+		t.Fatal("conn closed while recorder was healthy")
+	}
+
+	// The fail closed policy must trigger within a few intervals.
+	rec.kill()
+	deadline := time.Now().Add(10 * interval)
+	for !tc.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("conn not closed within %v of the recorder going away", 10*interval)
+		}
+		time.Sleep(interval / 10)
+	}
+}
+
+func Test_Hijacker_connectTimeout(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A recorder that accepts TCP connections but never responds.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, ln.Addr().String())
+	}
+
+	const timeout = 200 * time.Millisecond
+	tc := &fakes.TestConn{}
+	h := &Hijacker{
+		connectToRecorder: func(ctx context.Context, addrs []netip.AddrPort, _ func(context.Context, string, string) (net.Conn, error)) (io.WriteCloser, []*tailcfg.SSHRecordingAttempt, <-chan error, error) {
+			return sessionrecording.ConnectToRecorder(ctx, addrs, dial)
+		},
+		addrs: []netip.AddrPort{netip.MustParseAddrPort("100.64.0.1:80")},
+		who:   &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+		log:   zl.Sugar(),
+		ts:    &tsnet.Server{},
+		req:   &http.Request{URL: &url.URL{}},
+	}
+	h.SetConnectTimeout(timeout)
+
+	start := time.Now()
+	_, err = h.setUpRecording(context.Background(), tc)
+	if !errors.Is(err, ErrNoRecorderReachable) {
+		t.Fatalf("setUpRecording() error = %v, want %v", err, ErrNoRecorderReachable)
+	}
+	if d := time.Since(start); d > 10*timeout {
+		t.Errorf("setUpRecording took %v, want about %v", d, timeout)
+	}
+	if !tc.IsClosed() {
+		t.Errorf("connection was not closed")
+	}
+}
+
+func Test_Hijacker_connectTimeoutContextReleased(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploadCtx context.Context
+	errChan := make(chan error, 1)
+	tc := &fakes.TestConn{}
+	h := &Hijacker{
+		connectToRecorder: func(ctx context.Context, _ []netip.AddrPort, _ func(context.Context, string, string) (net.Conn, error)) (io.WriteCloser, []*tailcfg.SSHRecordingAttempt, <-chan error, error) {
+			uploadCtx = ctx
+			return &silentRecorder{}, nil, errChan, nil
+		},
+		who: &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+		log: zl.Sugar(),
+		ts:  &tsnet.Server{},
+		req: &http.Request{URL: &url.URL{}},
+	}
+	h.SetConnectTimeout(time.Minute)
+	lc, err := h.setUpRecording(context.Background(), tc)
+	if err != nil {
+		t.Fatalf("setUpRecording: %v", err)
+	}
+	if err := uploadCtx.Err(); err != nil {
+		t.Fatalf("upload context done while recording: %v", err)
+	}
+
+	// Once the session ends and the upload finishes, the context is
+	// released.
+	if err := lc.Close(); err != nil {
+		t.Fatalf("closing conn: %v", err)
+	}
+	errChan <- nil
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if uploadCtx.Err() == nil {
+			return errors.New("upload context not released")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Hijacker_idleTimeout(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const timeout = 100 * time.Millisecond
+	for _, closeSession := range []bool{false, true} {
+		t.Run(fmt.Sprintf("closeSession=%t", closeSession), func(t *testing.T) {
+			tc := &fakes.TestConn{}
+			sink := &testSink{}
+			h := &Hijacker{
+				sink: sink,
+				who:  &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+				log:  zl.Sugar(),
+				ts:   &tsnet.Server{},
+				req:  &http.Request{URL: &url.URL{}},
+			}
+			h.SetIdleTimeout(timeout, closeSession)
+			lc, err := h.setUpRecording(context.Background(), tc)
+			if err != nil {
+				t.Fatalf("setUpRecording: %v", err)
+			}
+			defer lc.Close()
+
+			var f fakes.SPDYFramer
+			if err := tc.WriteReadBufBytes(f.SynStream(t, 1, "stdout")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := lc.Read(make([]byte, 1024)); err != nil {
+				t.Fatalf("reading SYN_STREAM: %v", err)
+			}
+			// Activity keeps the session from timing out.
+			for range 4 {
+				if _, err := lc.Write(fakes.DataFrame(1, []byte("."))); err != nil {
+					t.Fatalf("writing data frame: %v", err)
+				}
+				time.Sleep(timeout / 2)
+			}
+			sink.mu.Lock()
+			closed := sink.closed
+			sink.mu.Unlock()
+			if closed {
+				t.Fatal("recording finalized while session was active")
+			}
+
+			if err := tstest.WaitFor(10*timeout, func() error {
+				sink.mu.Lock()
+				defer sink.mu.Unlock()
+				if !sink.closed {
+					return errors.New("recording not finalized")
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			lines := sink.lines(t)
+			var ev []any
+			if err := json.Unmarshal(lines[len(lines)-1], &ev); err != nil {
+				t.Fatalf("unmarshalling end marker: %v", err)
+			}
+			if len(ev) != 3 || ev[1] != "m" || ev[2] != "session ended (idle timeout)" {
+				t.Errorf("unexpected end marker: %s", lines[len(lines)-1])
+			}
+			if err := tstest.WaitFor(10*timeout, func() error {
+				if tc.IsClosed() != closeSession {
+					return fmt.Errorf("conn closed: %t, want %t", tc.IsClosed(), closeSession)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if closeSession {
+				return
+			}
+
+			// The session continues unrecorded.
+			n := len(sink.lines(t))
+			if _, err := lc.Write(fakes.DataFrame(1, []byte("more"))); err != nil {
+				t.Fatalf("writing data frame after idle timeout: %v", err)
+			}
+			if got := len(sink.lines(t)); got != n {
+				t.Errorf("got %d recording lines after idle timeout, want %d", got, n)
+			}
+		})
+	}
+}
+
+func Test_Hijacker_idleTimeoutSessionClosed(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &fakes.TestConn{}
+	sink := &testSink{}
+	h := &Hijacker{
+		sink: sink,
+		who:  &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+		log:  zl.Sugar(),
+		ts:   &tsnet.Server{},
+		req:  &http.Request{URL: &url.URL{}},
+	}
+	h.SetIdleTimeout(time.Hour, true)
+	lc, err := h.setUpRecording(context.Background(), tc)
+	if err != nil {
+		t.Fatalf("setUpRecording: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.endRecordingWhenIdle(context.Background(), lc.(srconn.Conn))
+		close(done)
+	}()
+	if err := lc.Close(); err != nil {
+		t.Fatalf("closing conn: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle timeout goroutine still running after the session was closed")
+	}
+	lines := sink.lines(t)
+	var ev []any
+	if err := json.Unmarshal(lines[len(lines)-1], &ev); err != nil {
+		t.Fatalf("unmarshalling end marker: %v", err)
+	}
+	if len(ev) != 3 || ev[1] != "m" || ev[2] != "session ended" {
+		t.Errorf("unexpected end marker: %s", lines[len(lines)-1])
+	}
+}
+
+func Test_Hijacker_CheckRecorders(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer recorder.Close()
+	// rejecter accepts the upload but fails it once it's done.
+	rejecter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Error(w, "recording not saved", http.StatusInternalServerError)
+	}))
+	defer rejecter.Close()
+
+	tests := []struct {
+		name    string
+		dial    func(context.Context, string, string) (net.Conn, error)
+		wantErr error
+	}{
+		{
+			name: "recorder_up",
+			dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, recorder.Listener.Addr().String())
+			},
+		},
+		{
+			name: "recorder_fails_upload",
+			dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, rejecter.Listener.Addr().String())
+			},
+			wantErr: ErrRecorderRejected,
+		},
+		{
+			name: "all_recorders_down",
+			dial: func(context.Context, string, string) (net.Conn, error) {
+				return nil, errors.New("dial failed")
+			},
+			wantErr: ErrNoRecorderReachable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Hijacker{
+				connectToRecorder: func(ctx context.Context, addrs []netip.AddrPort, _ func(context.Context, string, string) (net.Conn, error)) (io.WriteCloser, []*tailcfg.SSHRecordingAttempt, <-chan error, error) {
+					return sessionrecording.ConnectToRecorder(ctx, addrs, tt.dial)
+				},
+				addrs: []netip.AddrPort{netip.MustParseAddrPort("100.64.0.1:80"), netip.MustParseAddrPort("100.64.0.2:80")},
+				log:   zl.Sugar(),
+				ts:    &tsnet.Server{},
+				// No ResponseWriter: CheckRecorders must not hijack.
+			}
+			err := h.CheckRecorders(context.Background())
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("CheckRecorders() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CheckRecorders() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Hijacker_podInfo(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		podUID      string
+		containerID string
+		nodeIP      netip.Addr
+		want        map[string]any // want fields of the header's "kubernetes" object
+	}{
+		{
+			name:        "pod_info_set",
+			podUID:      "5f1e9a2c-7d1b-4c5e-9d2f-0a1b2c3d4e5f",
+			containerID: "containerd://4c8f0e2d",
+			nodeIP:      netip.MustParseAddr("10.0.0.5"),
+			want: map[string]any{
+				"PodName":     "pod",
+				"Namespace":   "ns",
+				"Container":   "",
+				"PodUID":      "5f1e9a2c-7d1b-4c5e-9d2f-0a1b2c3d4e5f",
+				"ContainerID": "containerd://4c8f0e2d",
+				"NodeIP":      "10.0.0.5",
+			},
+		},
+		{
+			name: "pod_info_unknown",
+			want: map[string]any{
+				"PodName":   "pod",
+				"Namespace": "ns",
+				"Container": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &testSink{}
+			h := &Hijacker{
+				sink: sink,
+				pod:  "pod",
+				ns:   "ns",
+				who:  &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{}},
+				log:  zl.Sugar(),
+				ts:   &tsnet.Server{},
+				req:  &http.Request{URL: &url.URL{}},
+			}
+			h.SetPodInfo(tt.podUID, tt.containerID, tt.nodeIP)
+			lc, err := h.setUpRecording(context.Background(), &fakes.TestConn{})
+			if err != nil {
+				t.Fatalf("setUpRecording: %v", err)
+			}
+			if err := lc.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var header struct {
+				Kubernetes map[string]any `json:"kubernetes"`
+			}
+			if err := json.Unmarshal(sink.lines(t)[0], &header); err != nil {
+				t.Fatalf("unmarshalling CastHeader: %v", err)
+			}
+			if !reflect.DeepEqual(header.Kubernetes, tt.want) {
+				t.Errorf("got kubernetes metadata %v, want %v", header.Kubernetes, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Hijacker_recorderTLS(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sawTLS atomic.Bool
+	recorder := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawTLS.Store(r.TLS != nil)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer recorder.Close()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(recorder.Certificate())
+
+	tests := []struct {
+		name    string
+		config  *tls.Config
+		wantErr error
+	}{
+		{
+			name:   "custom_ca",
+			config: &tls.Config{RootCAs: trusted, ServerName: "example.com"},
+		},
+		{
+			name:    "untrusted_ca",
+			config:  &tls.Config{ServerName: "example.com"},
+			wantErr: ErrNoRecorderReachable,
+		},
+		{
+			name:    "no_tls",
+			wantErr: ErrRecorderRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sawTLS.Store(false)
+			h := &Hijacker{
+				connectToRecorder: sessionrecording.ConnectToRecorder,
+				dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, recorder.Listener.Addr().String())
+				},
+				addrs: []netip.AddrPort{netip.MustParseAddrPort("100.64.0.1:443")},
+				log:   zl.Sugar(),
+				ts:    &tsnet.Server{},
+			}
+			h.SetRecorderTLSConfig(tt.config)
+			err := h.CheckRecorders(context.Background())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("CheckRecorders() = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckRecorders() = %v, want nil", err)
+			}
+			if !sawTLS.Load() {
+				t.Error("recorder wasn't connected to over TLS")
+			}
+		})
+	}
+}
+
+func Test_Hijacker_Protocol(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		proto  protocol // passed to New
+		want   protocol
+	}{
+		{
+			name:   "spdy",
+			method: "POST",
+			header: http.Header{"Upgrade": {"SPDY/3.1"}},
+			want:   SPDYProtocol,
+		},
+		{
+			name:   "spdy_lowercase",
+			method: "POST",
+			header: http.Header{"Upgrade": {"spdy/3.1"}},
+			want:   SPDYProtocol,
+		},
+		{
+			name:   "websocket",
+			method: "GET",
+			header: http.Header{"Upgrade": {"websocket"}, "Sec-Websocket-Protocol": {"v5.channel.k8s.io, v4.channel.k8s.io"}},
+			want:   WSProtocol,
+		},
+		{
+			name:   "websocket_not_remotecommand",
+			method: "GET",
+			header: http.Header{"Upgrade": {"websocket"}, "Sec-Websocket-Protocol": {"chat"}},
+			want:   "",
+		},
+		{
+			name:   "spdy_wrong_method",
+			method: "GET",
+			header: http.Header{"Upgrade": {"SPDY/3.1"}},
+			want:   "",
+		},
+		{
+			name:   "no_upgrade",
+			method: "POST",
+			want:   "",
+		},
+		{
+			name:   "explicit",
+			method: "POST",
+			proto:  SPDYProtocol,
+			want:   SPDYProtocol,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/namespaces/default/pods/foo/exec", nil)
+			for k, vs := range tt.header {
+				for _, v := range vs {
+					req.Header.Add(k, v)
+				}
+			}
+			h := New(nil, req, nil, nil, "foo", "default", tt.proto, nil, FailOpen(true), nil, nil, zap.NewNop().Sugar())
+			if got := h.Protocol(); got != tt.want {
+				t.Errorf("Protocol() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package spdy
+
+import "io"
+
+// ansiState is where an ansiStripper is in the terminal output it's been
+// written.
+type ansiState int
+
+const (
+	ansiText     ansiState = iota // not in an escape sequence
+	ansiEsc                       // after ESC
+	ansiEscInter                  // in an ESC sequence with intermediate bytes, like ESC ( B
+	ansiCSI                       // in a control sequence: ESC [ ... final byte
+	ansiOSC                       // in an operating system command: ESC ] ... BEL or ST
+	ansiOSCEsc                    // after ESC in an operating system command
+)
+
+// ansiStripper is an io.Writer that writes terminal output to w with ANSI
+// escape sequences, such as those setting colors or the window title,
+// removed. Sequences may be split across writes.
+type ansiStripper struct {
+	w     io.Writer
+	state ansiState
+	buf   []byte // reused for the stripped output of each write
+}
+
+func (s *ansiStripper) Write(b []byte) (int, error) {
+	const (
+		esc = 0x1b
+		bel = 0x07
+	)
+	out := s.buf[:0]
+	for _, c := range b {
+		switch s.state {
+		case ansiText:
+			if c == esc {
+				s.state = ansiEsc
+			} else {
+				out = append(out, c)
+			}
+		case ansiEsc:
+			switch {
+			case c == '[':
+				s.state = ansiCSI
+			case c == ']':
+				s.state = ansiOSC
+			case c >= 0x20 && c <= 0x2f:
+				s.state = ansiEscInter
+			default:
+				s.state = ansiText
+			}
+		case ansiEscInter:
+			if c < 0x20 || c > 0x2f {
+				s.state = ansiText
+			}
+		case ansiCSI:
+			if c >= 0x40 && c <= 0x7e {
+				s.state = ansiText
+			}
+		case ansiOSC:
+			switch c {
+			case bel:
+				s.state = ansiText
+			case esc:
+				s.state = ansiOSCEsc
+			}
+		case ansiOSCEsc:
+			// ESC \ is the string terminator; anything else ends the
+			// command too, as terminals do.
+			s.state = ansiText
+		}
+	}
+	s.buf = out
+	if len(out) == 0 {
+		return len(b), nil
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
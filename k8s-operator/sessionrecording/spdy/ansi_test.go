@@ -0,0 +1,60 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package spdy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_ansiStripper(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs []string
+		want   string
+	}{
+		{
+			name:   "plain",
+			inputs: []string{"hello\r\nworld"},
+			want:   "hello\r\nworld",
+		},
+		{
+			name:   "colors",
+			inputs: []string{"\x1b[1;31merror\x1b[0m: \x1b[32mok\x1b[m"},
+			want:   "error: ok",
+		},
+		{
+			name:   "cursor_and_charset",
+			inputs: []string{"\x1b[2J\x1b[H\x1b(Bprompt$ \x1b7x\x1b8"},
+			want:   "prompt$ x",
+		},
+		{
+			name:   "window_title",
+			inputs: []string{"\x1b]0;user@pod: ~\x07$ ls\n\x1b]2;title\x1b\\a.txt"},
+			want:   "$ ls\na.txt",
+		},
+		{
+			name:   "split_across_writes",
+			inputs: []string{"\x1b", "[01;3", "4mdir\x1b[", "0m/\x1b]0;t", "itle\x1b", "\\end"},
+			want:   "dir/end",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			s := &ansiStripper{w: &buf}
+			for _, in := range tt.inputs {
+				n, err := s.Write([]byte(in))
+				if err != nil || n != len(in) {
+					t.Fatalf("Write(%q) = %d, %v; want %d, nil", in, n, err, len(in))
+				}
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
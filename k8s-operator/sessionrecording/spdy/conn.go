@@ -12,25 +12,37 @@
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	srconn "tailscale.com/k8s-operator/sessionrecording/conn"
 	"tailscale.com/k8s-operator/sessionrecording/tsrecorder"
 	"tailscale.com/sessionrecording"
 )
 
-func New(nc net.Conn, rec *tsrecorder.Client, ch sessionrecording.CastHeader, log *zap.SugaredLogger) srconn.Conn {
-	return &conn{
+// New returns a conn that records the 'kubectl exec' session streamed over nc
+// with SPDY to rec. If transcript is non-nil, the session's stdout is also
+// written to it as plain text, with ANSI escape sequences removed.
+func New(nc net.Conn, rec *tsrecorder.Client, ch sessionrecording.CastHeader, transcript io.Writer, log *zap.SugaredLogger) srconn.Conn {
+	c := &conn{
 		Conn: nc,
 		rec:  rec,
 		ch:   ch,
 		log:  log,
 	}
+	if transcript != nil {
+		c.transcript = &ansiStripper{w: transcript}
+	}
+	c.lastActivity.Store(time.Now().UnixNano())
+	return c
 }
 
 // conn is a wrapper around net.Conn. It reads the bytestream for a 'kubectl
@@ -42,14 +54,32 @@ type conn struct {
 	// rec knows how to send data written to it to a tsrecorder instance.
 	rec *tsrecorder.Client
 	ch  sessionrecording.CastHeader
+	// transcript, if non-nil, is where stdout is written as plain text. It's
+	// set to nil if writing to it fails. Guarded by wmu.
+	transcript io.Writer
 
+	stdinStreamID  atomic.Uint32
 	stdoutStreamID atomic.Uint32
 	stderrStreamID atomic.Uint32
 	resizeStreamID atomic.Uint32
+	errorStreamID  atomic.Uint32
+
+	// lastActivity is the time, in Unix nanoseconds, that data was last sent
+	// on the stdin, stdout or stderr stream.
+	lastActivity atomic.Int64
 
 	wmu    sync.Mutex // sequences writes
 	closed bool
+	// done, if non-nil, is closed when closed is set. It's created by
+	// Done.
+	done   chan struct{}
 	failed bool
+	// recordingEnded is set once the recording has been finalized by
+	// EndRecording; session data is no longer recorded after that.
+	recordingEnded bool
+	// errStream is the data sent on the error stream, which reports the
+	// command's exit status.
+	errStream bytes.Buffer
 
 	rmu                 sync.Mutex // sequences reads
 	writeCastHeaderOnce sync.Once
@@ -66,8 +96,10 @@ type conn struct {
 
 // Read reads bytes from the original connection and parses them as SPDY frames.
 // If the frame is a data frame for resize stream, sends resize message to the
-// recorder. If the frame is a SYN_STREAM control frame that starts stdout,
-// stderr or resize stream, store the stream ID.
+// recorder. If the frame is a SYN_STREAM control frame that starts stdin,
+// stdout, stderr, resize or error stream, store the stream ID. Data frames on
+// the stdin stream count as session activity. All complete frames read are
+// processed, in order.
 func (c *conn) Read(b []byte) (int, error) {
 	c.rmu.Lock()
 	defer c.rmu.Unlock()
@@ -77,93 +109,115 @@ func (c *conn) Read(b []byte) (int, error) {
 	}
 	c.readBuf.Write(b[:n])
 
-	var sf spdyFrame
-	ok, err := sf.Parse(c.readBuf.Bytes(), c.log)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing data read from connection: %w", err)
-	}
-	if !ok {
-		// The parsed data in the buffer will be processed together with
-		// the new data on the next call to Read.
-		return n, nil
-	}
-	c.readBuf.Next(len(sf.Raw)) // advance buffer past the parsed frame
-
-	if !sf.Ctrl { // data frame
-		switch sf.StreamID {
-		case c.resizeStreamID.Load():
-			var err error
-			var msg spdyResizeMsg
-			if err = json.Unmarshal(sf.Payload, &msg); err != nil {
-				return 0, fmt.Errorf("error umarshalling resize msg: %w", err)
+	for {
+		var sf spdyFrame
+		ok, err := sf.Parse(c.readBuf.Bytes(), c.log)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing data read from connection: %w", err)
+		}
+		if !ok {
+			// The parsed data in the buffer will be processed together with
+			// the new data on the next call to Read.
+			return n, nil
+		}
+		c.readBuf.Next(len(sf.Raw)) // advance buffer past the parsed frame
+
+		if !sf.Ctrl { // data frame
+			switch sf.StreamID {
+			case c.stdinStreamID.Load():
+				c.lastActivity.Store(time.Now().UnixNano())
+			case c.resizeStreamID.Load():
+				var err error
+				var msg spdyResizeMsg
+				if err = json.Unmarshal(sf.Payload, &msg); err != nil {
+					return 0, fmt.Errorf("error umarshalling resize msg: %w", err)
+				}
+				c.ch.Width = msg.Width
+				c.ch.Height = msg.Height
 			}
-			c.ch.Width = msg.Width
-			c.ch.Height = msg.Height
+			continue
+		}
+		// We always want to parse the headers, even if we don't care about the
+		// frame, as we need to advance the zlib reader otherwise we will get
+		// garbage.
+		header, err := sf.parseHeaders(&c.zlibReqReader, c.log)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing frame headers: %w", err)
+		}
+		if sf.Type == SYN_STREAM {
+			c.storeStreamID(sf, header)
 		}
-		return n, nil
-	}
-	// We always want to parse the headers, even if we don't care about the
-	// frame, as we need to advance the zlib reader otherwise we will get
-	// garbage.
-	header, err := sf.parseHeaders(&c.zlibReqReader, c.log)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing frame headers: %w", err)
-	}
-	if sf.Type == SYN_STREAM {
-		c.storeStreamID(sf, header)
 	}
-	return n, nil
 }
 
-// Write forwards the raw data of the latest parsed SPDY frame to the original
-// destination. If the frame is an SPDY data frame, it also sends the payload to
-// the connected session recorder.
+// Write forwards the raw data of each parsed SPDY frame to the original
+// destination. If a frame is a stdout or stderr data frame, it also sends the
+// payload to the connected session recorder. Frames are processed in the order
+// they are written, so data from interleaved stdout and stderr frames is
+// recorded in the order it was sent, each with the time it was processed.
+// Data sent on the error stream is kept to record the command's exit code when
+// the connection is closed.
 func (c *conn) Write(b []byte) (int, error) {
 	c.wmu.Lock()
 	defer c.wmu.Unlock()
+	// Bytes buffered by earlier calls are forwarded first, and weren't part
+	// of b.
+	pending := c.writeBuf.Len()
 	c.writeBuf.Write(b)
+	var forwarded int // bytes of the buffer forwarded by this call
+	// written returns how many bytes of b have been forwarded, for returning
+	// on error.
+	written := func() int {
+		return min(max(forwarded-pending, 0), len(b))
+	}
 
-	var sf spdyFrame
-	ok, err := sf.Parse(c.writeBuf.Bytes(), c.log)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing data: %w", err)
-	}
-	if !ok {
-		// The parsed data in the buffer will be processed together with
-		// the new data on the next call to Write.
-		return len(b), nil
-	}
-	c.writeBuf.Next(len(sf.Raw)) // advance buffer past the parsed frame
-
-	// If this is a stdout or stderr data frame, send its payload to the
-	// session recorder.
-	if !sf.Ctrl {
-		switch sf.StreamID {
-		case c.stdoutStreamID.Load(), c.stderrStreamID.Load():
-			var err error
-			c.writeCastHeaderOnce.Do(func() {
-				var j []byte
-				j, err = json.Marshal(c.ch)
-				if err != nil {
-					return
+	for {
+		var sf spdyFrame
+		ok, err := sf.Parse(c.writeBuf.Bytes(), c.log)
+		if err != nil {
+			return written(), fmt.Errorf("error parsing data: %w", err)
+		}
+		if !ok {
+			// The parsed data in the buffer will be processed together with
+			// the new data on the next call to Write.
+			return len(b), nil
+		}
+		c.writeBuf.Next(len(sf.Raw)) // advance buffer past the parsed frame
+
+		// If this is a stdout or stderr data frame, send its payload to the
+		// session recorder.
+		if !sf.Ctrl {
+			switch sf.StreamID {
+			case c.stdoutStreamID.Load(), c.stderrStreamID.Load():
+				c.lastActivity.Store(time.Now().UnixNano())
+				if c.recordingEnded {
+					break
 				}
-				j = append(j, '\n')
-				err = c.rec.WriteCastLine(j)
-				if err != nil {
-					c.log.Errorf("received error from recorder: %v", err)
+				if err := c.writeCastHeader(); err != nil {
+					return written(), err
 				}
-			})
-			if err != nil {
-				return 0, fmt.Errorf("error writing CastHeader: %w", err)
-			}
-			if err := c.rec.Write(sf.Payload); err != nil {
-				return 0, fmt.Errorf("error sending payload to session recorder: %w", err)
+				if err := c.rec.Write(sf.Payload); err != nil {
+					return written(), fmt.Errorf("error sending payload to session recorder: %w", err)
+				}
+				if c.transcript != nil && sf.StreamID == c.stdoutStreamID.Load() {
+					if _, err := c.transcript.Write(sf.Payload); err != nil {
+						// The transcript is a convenience; don't fail the
+						// session over it.
+						c.log.Infof("error writing session transcript: %v; no longer writing it", err)
+						c.transcript = nil
+					}
+				}
+			case c.errorStreamID.Load():
+				c.errStream.Write(sf.Payload)
 			}
 		}
+		// Forward the whole frame to the original destination.
+		n, err := c.Conn.Write(sf.Raw) // send to net.Conn
+		forwarded += n
+		if err != nil {
+			return written(), err
+		}
 	}
-	// Forward the whole frame to the original destination.
-	_, err = c.Conn.Write(sf.Raw) // send to net.Conn
-	return len(b), err
 }
 
 func (c *conn) Close() error {
@@ -177,11 +231,130 @@ func (c *conn) Close() error {
 	}
 	c.writeBuf.Reset()
 	c.closed = true
+	if c.done != nil {
+		close(c.done)
+	}
+	if !c.failed && !c.recordingEnded {
+		if err := c.writeEndMarker(""); err != nil {
+			c.log.Infof("error recording end of session: %v", err)
+		}
+	}
 	err := c.Conn.Close()
 	c.rec.Close()
 	return err
 }
 
+// writeCastHeader sends the CastHeader to the session recorder, unless it has
+// already been sent. c.wmu must be held.
+func (c *conn) writeCastHeader() error {
+	var err error
+	c.writeCastHeaderOnce.Do(func() {
+		var j []byte
+		j, err = json.Marshal(c.ch)
+		if err != nil {
+			return
+		}
+		j = append(j, '\n')
+		err = c.rec.WriteCastLine(j)
+		if err != nil {
+			c.log.Errorf("received error from recorder: %v", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error writing CastHeader: %w", err)
+	}
+	return nil
+}
+
+// LastActivity returns the time that data was last sent on the session's
+// stdin, stdout or stderr stream, or the time the conn was created if none has
+// been.
+func (c *conn) LastActivity() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+// Done returns a channel that's closed once c is closed.
+func (c *conn) Done() <-chan struct{} {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+		if c.closed {
+			close(c.done)
+		}
+	}
+	return c.done
+}
+
+// EndRecording records the end of the session, giving reason, and closes the
+// recording. The connection stays open, but data sent on it is no longer
+// recorded.
+func (c *conn) EndRecording(reason string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed || c.recordingEnded {
+		return nil
+	}
+	c.recordingEnded = true
+	err := c.writeEndMarker(reason)
+	if cerr := c.rec.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeEndMarker records the end of the session as an asciicast marker event,
+// with the reason, if not empty, and the command's exit code if the error
+// stream reported one. c.wmu must be held.
+func (c *conn) writeEndMarker(reason string) error {
+	if err := c.writeCastHeader(); err != nil {
+		return err
+	}
+	label := "session ended"
+	if reason != "" {
+		label += " (" + reason + ")"
+	}
+	if code, ok := exitCode(c.errStream.Bytes()); ok {
+		label += fmt.Sprintf(", exit code %d", code)
+	}
+	return c.rec.WriteMarker(label)
+}
+
+// Reason and cause type of the metav1.Status sent on the error stream when a
+// command exits non-zero. See k8s.io/apimachinery/pkg/util/remotecommand.
+const (
+	nonZeroExitCodeReason = metav1.StatusReason("NonZeroExitCode")
+	exitCodeCauseType     = metav1.CauseType("ExitCode")
+)
+
+// exitCode returns the exit code of the exec'd command given the data sent on
+// the error stream, which for v4.channel.k8s.io and later is a JSON-encoded
+// metav1.Status. It reports false if the exit code is not known.
+func exitCode(b []byte) (int, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var st metav1.Status
+	if err := json.Unmarshal(b, &st); err != nil {
+		return 0, false
+	}
+	if st.Status == metav1.StatusSuccess {
+		return 0, true
+	}
+	if st.Reason != nonZeroExitCodeReason || st.Details == nil {
+		return 0, false
+	}
+	for _, cause := range st.Details.Causes {
+		if cause.Type != exitCodeCauseType {
+			continue
+		}
+		if code, err := strconv.Atoi(cause.Message); err == nil {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
 func (s *conn) Fail() {
 	s.wmu.Lock()
 	s.failed = true
@@ -200,12 +373,16 @@ func (c *conn) storeStreamID(sf spdyFrame, header http.Header) {
 	)
 	id := binary.BigEndian.Uint32(sf.Payload[0:4])
 	switch header.Get(streamTypeHeaderKey) {
+	case corev1.StreamTypeStdin:
+		c.stdinStreamID.Store(id)
 	case corev1.StreamTypeStdout:
 		c.stdoutStreamID.Store(id)
 	case corev1.StreamTypeStderr:
 		c.stderrStreamID.Store(id)
 	case corev1.StreamTypeResize:
 		c.resizeStreamID.Store(id)
+	case corev1.StreamTypeError:
+		c.errorStreamID.Store(id)
 	}
 }
 
@@ -6,9 +6,12 @@
 package spdy
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 	"tailscale.com/k8s-operator/sessionrecording/fakes"
@@ -127,6 +130,49 @@ func Test_Writes(t *testing.T) {
 	}
 }
 
+// failingRecorder is a session recorder connection whose writes fail.
+type failingRecorder struct{}
+
+func (failingRecorder) Write([]byte) (int, error) { return 0, errors.New("recorder gone") }
+func (failingRecorder) Close() error              { return nil }
+
+// Test_WriteRecorderError tests that a Write failing to record a frame reports
+// the bytes of earlier frames in the same buffer as written.
+func Test_WriteRecorderError(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := tstest.NewClock(tstest.ClockOpts{})
+	tc := &fakes.TestConn{}
+	c := &conn{
+		Conn: tc,
+		log:  zl.Sugar(),
+		rec:  tsrecorder.New(failingRecorder{}, cl, cl.Now(), false),
+	}
+	c.writeCastHeaderOnce.Do(func() {})
+	c.stdoutStreamID.Store(1)
+
+	// A control frame, forwarded without recording, then a partial control
+	// frame left over from an earlier Write, completed by a stdout data
+	// frame that fails to record.
+	ctrl := []byte{0x80, 0x3, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x5}
+	if n, err := c.Write(ctrl[:4]); err != nil || n != 4 {
+		t.Fatalf("Write of partial frame = %d, %v; want 4, nil", n, err)
+	}
+	input := append(bytes.Clone(ctrl[4:]), 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x1, 0x2)
+	n, err := c.Write(input)
+	if err == nil {
+		t.Fatal("Write succeeded; want recorder error")
+	}
+	if want := len(ctrl) - 4; n != want {
+		t.Errorf("Write = %d; want %d, the bytes of the forwarded frame", n, want)
+	}
+	if got := tc.WriteBufBytes(); !bytes.Equal(got, ctrl) {
+		t.Errorf("forwarded %v; want %v", got, ctrl)
+	}
+}
+
 // Test_Reads tests that 1 or more Read calls to spdyRemoteConnRecorder results
 // in the expected data being forwarded to the original destination and the
 // session recorder.
@@ -242,3 +288,239 @@ func resizeMsgBytes(t *testing.T, width, height int) []byte {
 	}
 	return bs
 }
+
+// Test_ExitCode tests that closing the connection records the end of the
+// session, with the exit code reported on the error stream.
+func Test_ExitCode(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := tstest.NewClock(tstest.ClockOpts{})
+	tests := []struct {
+		name       string
+		errStream  string
+		wantMarker string
+	}{
+		{
+			name:       "non_zero_exit",
+			errStream:  `{"metadata":{},"status":"Failure","message":"command terminated with non-zero exit code: error executing command [false], exit code 3","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"3"}]}}`,
+			wantMarker: "session ended, exit code 3",
+		},
+		{
+			name:       "success",
+			errStream:  `{"metadata":{},"status":"Success"}`,
+			wantMarker: "session ended, exit code 0",
+		},
+		{
+			name:       "no_exit_status",
+			wantMarker: "session ended",
+		},
+		{
+			name:       "not_a_status",
+			errStream:  "some error",
+			wantMarker: "session ended",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &fakes.TestConn{}
+			sr := &recording{}
+			c := &conn{
+				Conn: tc,
+				log:  zl.Sugar(),
+				rec:  tsrecorder.New(sr, cl, cl.Now(), false),
+			}
+
+			var f fakes.SPDYFramer
+			for i, typ := range []string{"stdout", "error"} {
+				tc.ResetReadBuf()
+				if err := tc.WriteReadBufBytes(f.SynStream(t, uint32(i+1), typ)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := c.Read(make([]byte, 1024)); err != nil {
+					t.Fatalf("reading SYN_STREAM for %s: %v", typ, err)
+				}
+			}
+			if _, err := c.Write(fakes.DataFrame(1, []byte("out"))); err != nil {
+				t.Fatal(err)
+			}
+			if tt.errStream != "" {
+				if _, err := c.Write(fakes.DataFrame(2, []byte(tt.errStream))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			lines := bytes.Split(bytes.TrimSuffix(sr.Bytes(), []byte("\n")), []byte("\n"))
+			var ev []any
+			if err := json.Unmarshal(lines[len(lines)-1], &ev); err != nil {
+				t.Fatalf("unmarshalling last event: %v", err)
+			}
+			if len(ev) != 3 || ev[1] != "m" || ev[2] != tt.wantMarker {
+				t.Errorf("got last event %v, want marker %q", ev, tt.wantMarker)
+			}
+			// The error stream is not part of the recorded output.
+			if len(lines) != 3 {
+				t.Errorf("got %d recording lines, want 3:\n%s", len(lines), sr.Bytes())
+			}
+		})
+	}
+}
+
+// recording is a session recorder that keeps what was written to it after
+// it is closed.
+type recording struct {
+	bytes.Buffer
+}
+
+func (r *recording) Close() error { return nil }
+
+// Test_InterleavedWrites tests that stdout and stderr data frames are recorded
+// in the order they are written, each with its own timestamp, however the
+// frames are split across Write calls.
+func Test_InterleavedWrites(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdoutStreamID, stderrStreamID uint32 = 1, 2
+	frames := [][]byte{
+		fakes.DataFrame(stdoutStreamID, []byte("out1")),
+		fakes.DataFrame(stderrStreamID, []byte("err1")),
+		fakes.DataFrame(stdoutStreamID, []byte("out2")),
+		fakes.DataFrame(stderrStreamID, []byte("err2")),
+		fakes.DataFrame(stderrStreamID, []byte("err3")),
+		fakes.DataFrame(stdoutStreamID, []byte("out3")),
+	}
+	all := bytes.Join(frames, nil)
+	wantPayloads := []string{"out1", "err1", "out2", "err2", "err3", "out3"}
+	tests := []struct {
+		name   string
+		inputs [][]byte
+	}{
+		{
+			name:   "one_frame_per_write",
+			inputs: frames,
+		},
+		{
+			name:   "all_frames_in_one_write",
+			inputs: [][]byte{all},
+		},
+		{
+			name:   "frames_split_across_writes",
+			inputs: [][]byte{all[:5], all[5:20], all[20:21], all[21:]},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &fakes.TestConn{}
+			sr := &recording{}
+			cl := tstest.NewClock(tstest.ClockOpts{Step: time.Millisecond})
+			c := &conn{
+				Conn: tc,
+				log:  zl.Sugar(),
+				rec:  tsrecorder.New(sr, cl, cl.Now(), false),
+			}
+			c.writeCastHeaderOnce.Do(func() {})
+			c.stdoutStreamID.Store(stdoutStreamID)
+			c.stderrStreamID.Store(stderrStreamID)
+			for i, input := range tt.inputs {
+				if _, err := c.Write(input); err != nil {
+					t.Fatalf("[%d] Write: %v", i, err)
+				}
+			}
+
+			if got := tc.WriteBufBytes(); !bytes.Equal(got, all) {
+				t.Errorf("forwarded bytes differ, wants\n%v\ngot\n%v", all, got)
+			}
+			lines := bytes.Split(bytes.TrimSuffix(sr.Bytes(), []byte("\n")), []byte("\n"))
+			if len(lines) != len(wantPayloads) {
+				t.Fatalf("got %d recorded events, want %d:\n%s", len(lines), len(wantPayloads), sr.Bytes())
+			}
+			var last float64
+			for i, line := range lines {
+				var ev []any
+				if err := json.Unmarshal(line, &ev); err != nil {
+					t.Fatalf("unmarshalling event %d: %v", i, err)
+				}
+				if len(ev) != 3 || ev[1] != "o" || ev[2] != wantPayloads[i] {
+					t.Errorf("event %d = %s, want output %q", i, line, wantPayloads[i])
+					continue
+				}
+				ts, _ := ev[0].(float64)
+				if i > 0 && ts <= last {
+					t.Errorf("event %d timestamp %v not after previous %v", i, ts, last)
+				}
+				last = ts
+			}
+		})
+	}
+}
+
+// Test_Pings tests that PING frames sent in either direction, such as those
+// keeping an idle session alive, are forwarded unchanged and don't affect the
+// parsing or recording of the frames around them.
+func Test_Pings(t *testing.T) {
+	zl, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdoutStreamID, stderrStreamID uint32 = 1, 3
+	tc := &fakes.TestConn{}
+	sr := &recording{}
+	cl := tstest.NewClock(tstest.ClockOpts{})
+	c := &conn{
+		Conn: tc,
+		log:  zl.Sugar(),
+		rec:  tsrecorder.New(sr, cl, cl.Now(), false),
+	}
+	c.writeCastHeaderOnce.Do(func() {})
+
+	// Client to server: the ping must not disturb the zlib stream shared by
+	// the SYN_STREAM frames on either side of it.
+	var f fakes.SPDYFramer
+	read := bytes.Join([][]byte{
+		f.SynStream(t, stdoutStreamID, "stdout"),
+		fakes.PingFrame(1),
+		f.SynStream(t, stderrStreamID, "stderr"),
+	}, nil)
+	if err := tc.WriteReadBufBytes(read); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(read))
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(b[:n], read) {
+		t.Errorf("read bytes differ, wants\n%v\ngot\n%v", read, b[:n])
+	}
+	if id := c.stdoutStreamID.Load(); id != stdoutStreamID {
+		t.Errorf("stdoutStreamID = %d, want %d", id, stdoutStreamID)
+	}
+	if id := c.stderrStreamID.Load(); id != stderrStreamID {
+		t.Errorf("stderrStreamID = %d, want %d", id, stderrStreamID)
+	}
+
+	// Server to client: the ping reply and a server-initiated ping are
+	// forwarded, but only the data frames are recorded.
+	written := bytes.Join([][]byte{
+		fakes.DataFrame(stdoutStreamID, []byte("foo")),
+		fakes.PingFrame(1),
+		fakes.PingFrame(2),
+		fakes.DataFrame(stderrStreamID, []byte("bar")),
+	}, nil)
+	if _, err := c.Write(written); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := tc.WriteBufBytes(); !bytes.Equal(got, written) {
+		t.Errorf("forwarded bytes differ, wants\n%v\ngot\n%v", written, got)
+	}
+	want := append(fakes.CastLine(t, []byte("foo"), cl), fakes.CastLine(t, []byte("bar"), cl)...)
+	if got := sr.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("recorded bytes differ, wants\n%s\ngot\n%s", want, got)
+	}
+}
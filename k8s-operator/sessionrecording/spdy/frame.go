@@ -17,9 +17,14 @@
 )
 
 const (
-	SYN_STREAM ControlFrameType = 1 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.1
-	SYN_REPLY  ControlFrameType = 2 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.2
-	SYN_PING   ControlFrameType = 6 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.5
+	SYN_STREAM    ControlFrameType = 1 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.1
+	SYN_REPLY     ControlFrameType = 2 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.2
+	RST_STREAM    ControlFrameType = 3 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.3
+	SETTINGS      ControlFrameType = 4 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.4
+	SYN_PING      ControlFrameType = 6 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.5
+	GOAWAY        ControlFrameType = 7 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.6
+	HEADERS       ControlFrameType = 8 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.7
+	WINDOW_UPDATE ControlFrameType = 9 // https://www.ietf.org/archive/id/draft-mbelshe-httpbis-spdy-00.txt section 2.6.8
 )
 
 // spdyFrame is a parsed SPDY frame as defined in
@@ -125,6 +130,11 @@ func (sf *spdyFrame) parseHeaders(z *zlibReader, log *zap.SugaredLogger) (http.H
 		//+------------------------------------+
 		synReplyPayloadLengthBeforeHeaders = 4
 
+		// +------------------------------------+
+		// |X|           Stream-ID (31bits)     |
+		// +------------------------------------+
+		headersPayloadLengthBeforeHeaders = 4
+
 		// +----------------------------------|
 		// |            32-bit ID             |
 		// +----------------------------------+
@@ -147,12 +157,27 @@ func (sf *spdyFrame) parseHeaders(z *zlibReader, log *zap.SugaredLogger) (http.H
 		}
 		z.Set(sf.Payload[synReplyPayloadLengthBeforeHeaders:])
 		return parseHeaders(z, log)
+	case HEADERS:
+		// A HEADERS frame's header block shares the zlib stream with those of
+		// SYN_STREAM and SYN_REPLY frames, so it must be read even though the
+		// headers are unused, or later header blocks can't be decompressed.
+		if len(sf.Payload) < headersPayloadLengthBeforeHeaders {
+			return nil, fmt.Errorf("HEADERS frame too short: %v", len(sf.Payload))
+		}
+		if len(sf.Payload) == headersPayloadLengthBeforeHeaders {
+			return nil, nil // no headers
+		}
+		z.Set(sf.Payload[headersPayloadLengthBeforeHeaders:])
+		return parseHeaders(z, log)
 	case SYN_PING:
+		// Pings, used by clients and servers to keep idle sessions alive, are
+		// forwarded as is.
 		if len(sf.Payload) != pingPayloadLength {
 			return nil, fmt.Errorf("PING frame with unexpected length %v", len(sf.Payload))
 		}
 		return nil, nil // ping frame has no headers
-
+	case RST_STREAM, SETTINGS, GOAWAY, WINDOW_UPDATE:
+		return nil, nil // no headers
 	default:
 		log.Infof("[unexpected] unknown control frame type %v", sf.Type)
 	}
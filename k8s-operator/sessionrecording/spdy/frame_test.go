@@ -153,6 +153,19 @@ func Test_spdyFrame_parseHeaders(t *testing.T) {
 			typ:     SYN_REPLY,
 			isCtrl:  true,
 		},
+		{
+			name:       "headers_with_header",
+			payload:    payload(t, map[string]string{"foo": "bar"}, HEADERS, 1),
+			typ:        HEADERS,
+			isCtrl:     true,
+			wantHeader: header(map[string]string{"foo": "bar"}),
+		},
+		{
+			name:    "window_update",
+			payload: []byte{0, 0, 0, 1, 0, 0, 0x10, 0},
+			typ:     WINDOW_UPDATE,
+			isCtrl:  true,
+		},
 		{
 			name:    "syn_stream_too_short_payload",
 			payload: []byte{0, 1, 2, 3, 4},
@@ -242,7 +255,7 @@ func writeControlFramePayloadBeforeHeaders(t *testing.T, w io.Writer, typ Contro
 		if err := binary.Write(w, binary.BigEndian, [6]byte{0}); err != nil {
 			t.Fatalf("writing payload: %v", err)
 		}
-	case SYN_REPLY:
+	case SYN_REPLY, HEADERS:
 		// needs 4 bytes in payload before any headers
 		if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
 			t.Fatalf("writing payload: %v", err)
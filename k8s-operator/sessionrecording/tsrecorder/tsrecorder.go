@@ -15,8 +15,13 @@
 
 	"github.com/pkg/errors"
 	"tailscale.com/tstime"
+	"tailscale.com/util/clientmetric"
 )
 
+// counterSessionRecordingBytes counts the number of bytes of asciicast
+// recordings, including headers and heartbeats, written to recorders.
+var counterSessionRecordingBytes = clientmetric.NewCounter("k8s_auth_proxy_session_recording_bytes")
+
 func New(conn io.WriteCloser, clock tstime.Clock, start time.Time, failOpen bool) *Client {
 	return &Client{
 		start:    start,
@@ -37,11 +42,75 @@ type Client struct {
 	failOpen bool
 
 	// backOff is set to true if  we've failed open and should stop
-	// attempting to write to tsrecorder.
+	// attempting to write to tsrecorder. It's guarded by cmu.
 	backOff bool
 
-	mu   sync.Mutex     // guards writes to conn
-	conn io.WriteCloser // connection to a tsrecorder instance
+	// cmu guards the following and is held while writing events, so that
+	// buffered output is written before any later event.
+	cmu        sync.Mutex
+	chunkSize  int                    // max buffered output bytes; 0 means no chunking
+	chunkDelay time.Duration          // max time output is buffered for
+	chunk      []byte                 // buffered output, not yet written
+	chunkTS    float64                // timestamp of the first write in chunk
+	chunkTimer tstime.TimerController // flushes chunk after chunkDelay, or nil
+	chunkErr   error                  // error from a timer flush, returned by the next write
+
+	mu    sync.Mutex     // guards writes to conn
+	conn  io.WriteCloser // connection to a tsrecorder instance
+	wrote bool           // whether any line has been written to conn
+
+	tmu       sync.Mutex    // guards the following
+	idleLimit time.Duration // max recorded gap between events; 0 means no limit
+	lastEvent time.Time     // when the last event was recorded
+	lastTS    time.Duration // recorded timestamp of the last event
+}
+
+// SetIdleTimeLimit caps the recorded gap between consecutive events at d, as
+// asciinema's idle_time_limit does, so that long pauses in a session take at
+// most d in the recording. Heartbeats don't count as events. A d of zero or
+// less, the default, means no limit. It must be called before any events are
+// written.
+func (rec *Client) SetIdleTimeLimit(d time.Duration) {
+	rec.tmu.Lock()
+	defer rec.tmu.Unlock()
+	rec.idleLimit = d
+}
+
+// SetChunking makes the Client coalesce the session's output into events of
+// up to size bytes, so that a session writing many small bursts of output
+// doesn't thrash the connection to the recorder. Output is buffered for at
+// most delay before being written. Each event is recorded at the time of its
+// first write, so the recording's timeline is off by at most delay. A single
+// write larger than size is recorded as one event. A size of zero or less,
+// the default, disables chunking. It must be called before any events are
+// written.
+func (rec *Client) SetChunking(size int, delay time.Duration) {
+	rec.cmu.Lock()
+	defer rec.cmu.Unlock()
+	rec.chunkSize = size
+	rec.chunkDelay = delay
+}
+
+// timestamp returns the timestamp, relative to the start of the recording, at
+// which an event occurring now should be recorded. If event is false, the
+// event is a heartbeat and doesn't reset the idle time.
+func (rec *Client) timestamp(event bool) float64 {
+	rec.tmu.Lock()
+	defer rec.tmu.Unlock()
+	now := rec.clock.Now()
+	if rec.idleLimit <= 0 {
+		return now.Sub(rec.start).Seconds()
+	}
+	last := rec.lastEvent
+	if last.IsZero() {
+		last = rec.start
+	}
+	ts := rec.lastTS + min(now.Sub(last), rec.idleLimit)
+	if event {
+		rec.lastEvent = now
+		rec.lastTS = ts
+	}
+	return ts.Seconds()
 }
 
 // Write appends timestamp to the provided bytes and sends them to the
@@ -50,11 +119,74 @@ func (rec *Client) Write(p []byte) (err error) {
 	if len(p) == 0 {
 		return nil
 	}
+	rec.cmu.Lock()
+	defer rec.cmu.Unlock()
+	if err := rec.takeChunkErrLocked(); err != nil {
+		return err
+	}
+	if rec.chunkSize <= 0 {
+		return rec.writeOutputLocked(p, rec.timestamp(true))
+	}
+	if len(rec.chunk) > 0 && len(rec.chunk)+len(p) > rec.chunkSize {
+		if err := rec.flushLocked(); err != nil {
+			return err
+		}
+	}
+	if len(rec.chunk) == 0 {
+		rec.chunkTS = rec.timestamp(true)
+		if rec.chunkDelay > 0 {
+			rec.chunkTimer = rec.clock.AfterFunc(rec.chunkDelay, rec.flushOnTimer)
+		}
+	}
+	rec.chunk = append(rec.chunk, p...)
+	if len(rec.chunk) >= rec.chunkSize || rec.chunkDelay <= 0 {
+		return rec.flushLocked()
+	}
+	return nil
+}
+
+// flushOnTimer writes the buffered output once it's been buffered for
+// rec.chunkDelay.
+func (rec *Client) flushOnTimer() {
+	rec.cmu.Lock()
+	defer rec.cmu.Unlock()
+	rec.chunkTimer = nil // it's fired
+	if err := rec.flushLocked(); err != nil && rec.chunkErr == nil {
+		rec.chunkErr = err
+	}
+}
+
+// flushLocked writes the buffered output, if any, as one event. rec.cmu
+// must be held.
+func (rec *Client) flushLocked() error {
+	if rec.chunkTimer != nil {
+		rec.chunkTimer.Stop()
+		rec.chunkTimer = nil
+	}
+	if len(rec.chunk) == 0 {
+		return nil
+	}
+	p := rec.chunk
+	rec.chunk = rec.chunk[:0]
+	return rec.writeOutputLocked(p, rec.chunkTS)
+}
+
+// takeChunkErrLocked returns and clears the error from the last flush by
+// flushOnTimer, if any. rec.cmu must be held.
+func (rec *Client) takeChunkErrLocked() error {
+	err := rec.chunkErr
+	rec.chunkErr = nil
+	return err
+}
+
+// writeOutputLocked sends p as an output event recorded at timestamp ts.
+// rec.cmu must be held.
+func (rec *Client) writeOutputLocked(p []byte, ts float64) error {
 	if rec.backOff {
 		return nil
 	}
 	j, err := json.Marshal([]any{
-		rec.clock.Now().Sub(rec.start).Seconds(),
+		ts,
 		"o",
 		string(p),
 	})
@@ -62,7 +194,7 @@ func (rec *Client) Write(p []byte) (err error) {
 		return fmt.Errorf("error marhalling payload: %w", err)
 	}
 	j = append(j, '\n')
-	if err := rec.WriteCastLine(j); err != nil {
+	if err := rec.writeCastLine(j); err != nil {
 		if !rec.failOpen {
 			return fmt.Errorf("error writing payload to recorder: %w", err)
 		}
@@ -71,7 +203,49 @@ func (rec *Client) Write(p []byte) (err error) {
 	return nil
 }
 
+// WriteMarker sends an asciicast marker event with the given label to the
+// configured tsrecorder.
+func (rec *Client) WriteMarker(label string) error {
+	rec.cmu.Lock()
+	defer rec.cmu.Unlock()
+	if err := rec.flushPendingLocked(); err != nil {
+		return err
+	}
+	if rec.backOff {
+		return nil
+	}
+	j, err := json.Marshal([]any{
+		rec.timestamp(true),
+		"m",
+		label,
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling marker: %w", err)
+	}
+	j = append(j, '\n')
+	if err := rec.writeCastLine(j); err != nil {
+		if !rec.failOpen {
+			return fmt.Errorf("error writing marker to recorder: %w", err)
+		}
+		rec.backOff = true
+	}
+	return nil
+}
+
+// flushPendingLocked returns the error from the last flush by flushOnTimer,
+// if any, and otherwise writes the buffered output, so that it's recorded
+// before the next event. rec.cmu must be held.
+func (rec *Client) flushPendingLocked() error {
+	if err := rec.takeChunkErrLocked(); err != nil {
+		return err
+	}
+	return rec.flushLocked()
+}
+
 func (rec *Client) Close() error {
+	rec.cmu.Lock()
+	defer rec.cmu.Unlock()
+	ferr := rec.flushPendingLocked()
 	rec.mu.Lock()
 	defer rec.mu.Unlock()
 	if rec.conn == nil {
@@ -79,18 +253,66 @@ func (rec *Client) Close() error {
 	}
 	err := rec.conn.Close()
 	rec.conn = nil
+	if ferr != nil {
+		return ferr
+	}
 	return err
 }
 
-// writeCastLine sends bytes to the tsrecorder. The bytes should be in
-// asciinema format.
+// WriteCastLine sends bytes to the tsrecorder, after any buffered output.
+// The bytes should be in asciinema format.
 func (c *Client) WriteCastLine(j []byte) error {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	if err := c.flushPendingLocked(); err != nil {
+		return err
+	}
+	return c.writeCastLine(j)
+}
+
+// writeCastLine is WriteCastLine without flushing buffered output.
+func (c *Client) writeCastLine(j []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.conn == nil {
 		return errors.New("recorder closed")
 	}
-	_, err := c.conn.Write(j)
+	n, err := c.conn.Write(j)
+	counterSessionRecordingBytes.Add(int64(n))
+	if err != nil {
+		return fmt.Errorf("recorder write error: %w", err)
+	}
+	c.wrote = true
+	return nil
+}
+
+// Heartbeat sends an empty output event to the tsrecorder, so that a
+// recorder that has gone away is noticed even while the session is idle. It
+// does nothing before the first line (the CastHeader) has been written, so
+// that the recording always starts with its header, or after the Client has
+// been closed.
+func (c *Client) Heartbeat() error {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	if err := c.flushPendingLocked(); err != nil {
+		return err
+	}
+	j, err := json.Marshal([]any{
+		c.timestamp(false),
+		"o",
+		"",
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling heartbeat: %w", err)
+	}
+	j = append(j, '\n')
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || !c.wrote {
+		return nil
+	}
+	n, err := c.conn.Write(j)
+	counterSessionRecordingBytes.Add(int64(n))
 	if err != nil {
 		return fmt.Errorf("recorder write error: %w", err)
 	}
@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package tsrecorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+)
+
+type bufCloser struct {
+	bytes.Buffer
+}
+
+func (*bufCloser) Close() error { return nil }
+
+func TestRecordingBytesCounter(t *testing.T) {
+	cl := tstest.NewClock(tstest.ClockOpts{})
+	buf := new(bufCloser)
+	rec := New(buf, cl, cl.Now(), false)
+
+	before := counterSessionRecordingBytes.Value()
+	if err := rec.WriteCastLine([]byte(`{"version":2}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.WriteMarker("exit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after Close aren't counted.
+	rec.WriteCastLine([]byte("{}\n"))
+
+	if got, want := counterSessionRecordingBytes.Value()-before, int64(buf.Len()); got != want {
+		t.Errorf("counterSessionRecordingBytes advanced by %d, want %d", got, want)
+	}
+	if buf.Len() == 0 {
+		t.Error("nothing recorded")
+	}
+}
+
+func TestIdleTimeLimit(t *testing.T) {
+	cl := tstest.NewClock(tstest.ClockOpts{})
+	buf := new(bufCloser)
+	rec := New(buf, cl, cl.Now(), false)
+	rec.SetIdleTimeLimit(2 * time.Second)
+
+	cl.Advance(time.Second)
+	if err := rec.Write([]byte("a")); err != nil { // at 1s
+		t.Fatal(err)
+	}
+	cl.Advance(time.Minute)
+	if err := rec.Heartbeat(); err != nil { // 1m into the pause, clamped to 3s
+		t.Fatal(err)
+	}
+	cl.Advance(time.Hour)
+	if err := rec.Write([]byte("b")); err != nil { // after the pause, clamped to 3s
+		t.Fatal(err)
+	}
+	cl.Advance(500 * time.Millisecond)
+	if err := rec.WriteMarker("end"); err != nil { // short gaps are kept
+		t.Fatal(err)
+	}
+
+	var got []float64
+	dec := json.NewDecoder(&buf.Buffer)
+	for dec.More() {
+		var ev []any
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ev[0].(float64))
+	}
+	want := []float64{1, 3, 3, 3.5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("event timestamps = %v, want %v", got, want)
+	}
+}
+
+// countingWriter is a bufCloser that counts its writes.
+type countingWriter struct {
+	bufCloser
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.bufCloser.Write(p)
+}
+
+func TestChunking(t *testing.T) {
+	const (
+		size  = 64
+		delay = 10 * time.Millisecond
+	)
+	record := func(chunked bool) (writes int, events [][]any) {
+		cl := tstest.NewClock(tstest.ClockOpts{})
+		w := new(countingWriter)
+		rec := New(w, cl, cl.Now(), false)
+		if chunked {
+			rec.SetChunking(size, delay)
+		}
+		// 100 writes of 4 bytes, one every millisecond.
+		for range 100 {
+			if err := rec.Write([]byte("abc\n")); err != nil {
+				t.Fatal(err)
+			}
+			cl.Advance(time.Millisecond)
+		}
+		// A trailing write is flushed after delay without further output.
+		if err := rec.Write([]byte("end")); err != nil {
+			t.Fatal(err)
+		}
+		cl.Advance(delay)
+		writes = w.writes
+		dec := json.NewDecoder(&w.Buffer)
+		for dec.More() {
+			var ev []any
+			if err := dec.Decode(&ev); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, ev)
+		}
+		return writes, events
+	}
+
+	plainWrites, plain := record(false)
+	chunkedWrites, chunked := record(true)
+	if chunkedWrites >= plainWrites/4 {
+		t.Errorf("chunked recording took %d writes; want well under the %d unchunked", chunkedWrites, plainWrites)
+	}
+
+	output := func(events [][]any) string {
+		var s strings.Builder
+		for _, ev := range events {
+			s.WriteString(ev[2].(string))
+		}
+		return s.String()
+	}
+	if got, want := output(chunked), output(plain); got != want {
+		t.Errorf("chunked output = %q, want %q", got, want)
+	}
+
+	// Each event is recorded when its first output was written, so output
+	// is recorded no more than delay early.
+	var offset int
+	for _, ev := range chunked {
+		data := ev[2].(string)
+		if len(data) > size {
+			t.Errorf("event of %d bytes, want at most %d", len(data), size)
+		}
+		// Find when the event's first byte was written in the unchunked
+		// recording, in which each event is one write.
+		var pos int
+		for _, pev := range plain {
+			if pos == offset {
+				if got, want := ev[0].(float64), pev[0].(float64); got > want || want-got > delay.Seconds() {
+					t.Errorf("event at byte %d recorded at %vs, want within %v before %vs", offset, got, delay, want)
+				}
+				break
+			}
+			pos += len(pev[2].(string))
+		}
+		offset += len(data)
+	}
+}
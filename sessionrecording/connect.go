@@ -20,6 +20,11 @@
 	"tailscale.com/util/multierr"
 )
 
+// ErrUnexpectedResponse is wrapped by errors from ConnectToRecorder when a
+// recorder was reached but did not accept the recording, for example because
+// it responded with a non-200 status.
+var ErrUnexpectedResponse = errors.New("recording: unexpected response from recorder")
+
 // ConnectToRecorder connects to the recorder at any of the provided addresses.
 // It returns the first successful response, or a multierr if all attempts fail.
 //
@@ -88,7 +93,7 @@ func ConnectToRecorder(ctx context.Context, recs []netip.AddrPort, dial func(con
 				return
 			}
 			if resp.StatusCode != 200 {
-				errChan <- fmt.Errorf("recording: unexpected status: %v", resp.Status)
+				errChan <- fmt.Errorf("%w: status %v", ErrUnexpectedResponse, resp.Status)
 				return
 			}
 			errChan <- nil
@@ -101,7 +106,7 @@ func ConnectToRecorder(ctx context.Context, recs []netip.AddrPort, dial func(con
 			if err == nil {
 				// If the error is nil, we got a 200 response, which
 				// is unexpected as we haven't sent any data yet.
-				err = errors.New("recording: unexpected EOF")
+				err = fmt.Errorf("%w: unexpected EOF", ErrUnexpectedResponse)
 			}
 			attempt.FailureMessage = err.Error()
 			errs = append(errs, err)
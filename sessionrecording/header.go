@@ -75,4 +75,12 @@ type Kubernetes struct {
 	Namespace string
 	// Container is the container being exec-ed.
 	Container string
+	// PodUID is the UID of the Pod being exec-ed, if known.
+	PodUID string `json:",omitempty"`
+	// ContainerID is the container runtime's ID of the container being
+	// exec-ed, such as "containerd://4c8f...", if known.
+	ContainerID string `json:",omitempty"`
+	// NodeIP is the IP address of the node that the Pod being exec-ed runs
+	// on, if known.
+	NodeIP string `json:",omitempty"`
 }
@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+)
+
+// NodeActivity is how many times a node has contacted each of the services
+// that Tailscale reaches at startup, as reported by [Server.NodeActivity].
+// It's for tests asserting on a node's netcheck and control behavior, such as
+// that it made exactly one control plane connection.
+type NodeActivity struct {
+	STUNRequests int64 // STUN binding requests answered by the fake STUN server
+	DERPConns    int64 // HTTP(S) connections to DERP servers
+	ControlConns int64 // HTTP(S) connections to the fake control plane
+}
+
+// nodeActivity is the counters behind a node's NodeActivity.
+type nodeActivity struct {
+	stunRequests atomic.Int64
+	derpConns    atomic.Int64
+	controlConns atomic.Int64
+}
+
+// NodeActivity returns the activity of the node with the given MAC since the
+// server started.
+func (s *Server) NodeActivity(mac MAC) (NodeActivity, error) {
+	n, ok := s.nodeForMAC(mac)
+	if !ok {
+		return NodeActivity{}, fmt.Errorf("unknown node %v", mac)
+	}
+	return NodeActivity{
+		STUNRequests: n.activity.stunRequests.Load(),
+		DERPConns:    n.activity.derpConns.Load(),
+		ControlConns: n.activity.controlConns.Load(),
+	}, nil
+}
+
+// noteTCPActivity counts an intercepted TCP connection from src, a node on n,
+// to dst if it's to DERP or the control plane.
+func (n *network) noteTCPActivity(src, dst netip.AddrPort) {
+	if dst.Port() != 80 && dst.Port() != 443 {
+		return
+	}
+	var node *node
+	var ok bool
+	if src.Addr().Is4() {
+		node, ok = n.nodeByIP(src.Addr())
+	} else if mac, ok6 := n.v6Neighbors.Load(src.Addr()); ok6 {
+		node, ok = n.nodeForMAC(mac)
+	}
+	if !ok {
+		return
+	}
+	switch {
+	case n.s.isDERPIP(dst.Addr()):
+		node.activity.derpConns.Add(1)
+	case dst.Addr() == n.s.fakeIPs.Controlplane:
+		node.activity.controlConns.Add(1)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// benchPayloadSize is the size of the UDP payloads that BenchUDP sends,
+// about that of a full-sized WireGuard packet.
+const benchPayloadSize = 1280
+
+// benchTokenLen is the length of the token identifying a BenchUDP stream
+// at the start of its payloads.
+const benchTokenLen = len("vnet-bench-0123456789abcdef")
+
+// benchSettleTime is how long BenchUDP waits after sending for packets
+// still in flight to arrive.
+const benchSettleTime = time.Second
+
+// BenchResult is the result of [Server.BenchUDP].
+type BenchResult struct {
+	Sent      int64         // packets sent
+	Delivered int64         // packets delivered to the destination node's client
+	Dropped   int64         // Sent - Delivered
+	Bytes     int64         // UDP payload bytes delivered
+	Elapsed   time.Duration // how long sending took
+}
+
+// PPS returns the rate at which packets were delivered, in packets per
+// second.
+func (r BenchResult) PPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Delivered) / r.Elapsed.Seconds()
+}
+
+// Throughput returns the rate at which UDP payload was delivered, in bytes
+// per second.
+func (r BenchResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+func (r BenchResult) String() string {
+	return fmt.Sprintf("sent %d, delivered %d, dropped %d in %v (%.0f pkts/s, %.1f MB/s)",
+		r.Sent, r.Delivered, r.Dropped, r.Elapsed, r.PPS(), r.Throughput()/1e6)
+}
+
+// BenchUDP sends a stream of UDP packets from node from to node to, which
+// must have a client connected, at pps packets per second (or as fast as
+// possible if pps is zero) for dur, and reports how many were delivered.
+// It's for measuring the performance of the virtual network itself.
+//
+// Packets are injected as with [Server.InjectUDP], NAT and all, along the
+// same path as [Server.AssertReachable] probes. Delivery is counted when a
+// packet is handed to to's client, so a client that's too slow to read them
+// doesn't affect the result. After sending, BenchUDP waits up to a second
+// for packets still in flight.
+//
+// Pacing is by wall time, regardless of Config.Clock.
+func (s *Server) BenchUDP(from, to *Node, pps int, dur time.Duration) (BenchResult, error) {
+	if pps < 0 || dur <= 0 {
+		return BenchResult{}, fmt.Errorf("invalid rate %d pkts/s for %v", pps, dur)
+	}
+	fromLAN, toLAN, fromWAN, toDst, err := s.probePath(from, to)
+	if err != nil {
+		return BenchResult{}, err
+	}
+	token := fmt.Sprintf("vnet-bench-%016x", s.rand.Uint64())
+	delivered := s.addBench(token)
+	defer s.removeBench(token)
+
+	if fromWAN.IsValid() {
+		if err := s.InjectUDP(to, toLAN.Port(), fromWAN, []byte("vnet-punch")); err != nil {
+			return BenchResult{}, fmt.Errorf("punching from %v: %w", toLAN, err)
+		}
+	}
+
+	payload := make([]byte, benchPayloadSize)
+	copy(payload, token)
+	var res BenchResult
+	start := time.Now()
+	for {
+		elapsed := time.Since(start)
+		if elapsed >= dur {
+			break
+		}
+		due := int64(pps) * int64(elapsed) / int64(time.Second)
+		if pps == 0 {
+			due = res.Sent + 1
+		}
+		if res.Sent >= due {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		for ; res.Sent < due; res.Sent++ {
+			if err := s.InjectUDP(from, fromLAN.Port(), toDst, payload); err != nil {
+				return res, fmt.Errorf("sending from %v: %w", fromLAN, err)
+			}
+		}
+	}
+	res.Elapsed = time.Since(start)
+
+	for deadline := time.Now().Add(benchSettleTime); delivered.Load() < res.Sent && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	res.Delivered = delivered.Load()
+	res.Dropped = res.Sent - res.Delivered
+	res.Bytes = res.Delivered * benchPayloadSize
+	return res, nil
+}
+
+func (s *Server) addBench(token string) *atomic.Int64 {
+	n := new(atomic.Int64)
+	s.probes.mu.Lock()
+	defer s.probes.mu.Unlock()
+	mak.Set(&s.probes.benches, token, n)
+	s.probes.updateActiveLocked()
+	return n
+}
+
+func (s *Server) removeBench(token string) {
+	s.probes.mu.Lock()
+	defer s.probes.mu.Unlock()
+	delete(s.probes.benches, token)
+	s.probes.updateActiveLocked()
+}
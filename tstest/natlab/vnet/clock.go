@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+// advancer is implemented by controllable clocks, such as *tstest.Clock.
+type advancer interface {
+	Advance(d time.Duration) time.Time
+}
+
+// afterFunc is like time.AfterFunc, but on the server's clock.
+//
+// If the clock is controllable, f instead runs in the goroutine that calls
+// AdvanceClock once it's due. A controllable clock may fire timers with its
+// own locks held, which f mustn't run under, as f may consult the clock.
+func (s *Server) afterFunc(d time.Duration, f func()) tstime.TimerController {
+	if _, ok := s.clock.(advancer); !ok {
+		return s.clock.AfterFunc(d, f)
+	}
+	return s.clock.AfterFunc(d, func() {
+		s.dueMu.Lock()
+		defer s.dueMu.Unlock()
+		s.due = append(s.due, f)
+	})
+}
+
+// sleep waits for d on the server's clock. It reports false if the server
+// was closed first.
+func (s *Server) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	done := make(chan struct{})
+	t := s.afterFunc(d, func() { close(done) })
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-s.shutdownCtx.Done():
+		return false
+	}
+}
+
+// AdvanceClock advances the server's clock by d and then synchronously runs
+// any of the server's timers that are due, such as those delivering packets
+// after a network's latency, in the order they fell due. Time-based state
+// without timers, such as NAT mapping timeouts, takes effect as of the new
+// time.
+//
+// Timers that fall due between now and d later see the clock's new time, not
+// their due time.
+//
+// It panics unless Config.Clock is a controllable clock with an Advance
+// method, such as a *tstest.Clock. Tests using one should advance it only
+// with AdvanceClock, or the server's timers won't run.
+func (s *Server) AdvanceClock(d time.Duration) {
+	c, ok := s.clock.(advancer)
+	if !ok {
+		panic("vnet: AdvanceClock requires a controllable Config.Clock")
+	}
+	c.Advance(d)
+	for {
+		s.dueMu.Lock()
+		due := s.due
+		s.due = nil
+		s.dueMu.Unlock()
+		if len(due) == 0 {
+			return
+		}
+		for _, f := range due {
+			f()
+		}
+	}
+}
@@ -5,10 +5,21 @@
 
 import (
 	"cmp"
+	"errors"
 	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
 	"net/netip"
 	"slices"
+	"strconv"
+	"time"
 
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/set"
 )
 
@@ -23,8 +34,144 @@
 // values to modify the config before calling NewServer.
 // Once the NewServer is called, Config is no longer used.
 type Config struct {
+	// TCPReceiveBufferSize, if non-zero, is the size in bytes of the
+	// receive buffer used by the gvisor TCP stack for intercepted TCP
+	// connections (DERP, control, etc). Zero means the gvisor default
+	// with auto-tuning.
+	TCPReceiveBufferSize int
+
+	// TCPSendBufferSize, if non-zero, is the size in bytes of the send
+	// buffer used by the gvisor TCP stack for intercepted TCP connections.
+	// Zero means the gvisor default.
+	TCPSendBufferSize int
+
+	// DisableTCPSACK disables TCP selective acknowledgements on the gvisor
+	// TCP stack. By default SACK is enabled.
+	DisableTCPSACK bool
+
+	// ConnStaleAfter is how long a connected node's client conn may go
+	// without sending a frame before [Server.ConnHealth] reports it as
+	// stale. Zero means 30 seconds.
+	ConnStaleAfter time.Duration
+
+	// TCPStack selects the implementation that terminates intercepted TCP
+	// connections (DERP, control, the test agent, etc). The zero value
+	// means TCPStackGVisor.
+	TCPStack TCPStack
+
+	// TCPConnectDelay is how long the router waits after intercepting a
+	// TCP connection's SYN before completing the handshake and dialing the
+	// upstream server, such as to model a slow DERP or control server.
+	// It's on the server's clock. Zero means no delay.
+	TCPConnectDelay time.Duration
+
+	// RandSeed, if non-zero, seeds the randomness of the server's network
+	// effects (latency jitter, duplication, reordering, DNS latency) and
+	// NAT port choices, so that runs with the same traffic make the same
+	// decisions. Zero means a random seed.
+	RandSeed int64
+
+	// DNSLatency is the distribution of the delay before the fake DNS
+	// server's responses are sent. The zero value means no delay.
+	DNSLatency DNSLatency
+
+	// FakeIPs are the IPs of the services the server fakes for all networks.
+	// Its zero fields mean the defaults.
+	FakeIPs FakeIPs
+
+	// Logf, if non-nil, is where the server logs. Nil means log.Printf.
+	Logf logger.Logf
+
+	// LogRingSize, if positive, is how many of the server's most recent
+	// log lines it keeps in memory for [Server.RecentLogs], such as for
+	// dumping when a test fails.
+	LogRingSize int
+
+	// Clock, if non-nil, is the clock that times the server's faults, such
+	// as the duration of a [DNSFault], its NAT mappings, and its timers,
+	// such as those for link latency. Nil means the real clock. If it's a
+	// controllable clock, advance it with [Server.AdvanceClock].
+	Clock tstime.Clock
+
+	// LogNAT, if true, makes each network's NAT log when it creates and
+	// closes a session, with its 5-tuple and time, like a home router's NAT
+	// log.
+	LogNAT bool
+
 	nodes    []*Node
 	networks []*Network
+	subnets  []*subnetBehind
+	derpMap  *tailcfg.DERPMap
+
+	controlUpstream string // host:port, or empty for the real control server
+}
+
+// SetDERPMap sets the DERP map whose servers' IPv4 addresses have their TCP
+// connections intercepted and proxied to the real DERP servers, as
+// [Server.PopulateDERPMapIPs] does with the map from the tailscale binary.
+// It lets hermetic tests choose their DERP IPs without exec or network
+// access.
+func (c *Config) SetDERPMap(dm *tailcfg.DERPMap) {
+	c.derpMap = dm
+}
+
+// SetControlUpstream makes the server proxy the intercepted TCP connections to
+// the fake control plane IP (see FakeIPs.Controlplane) to addr, a host:port,
+// whatever port they're to, instead of to controlplane.tailscale.com on the
+// same port, such as to test against a staging control server or Headscale.
+// An empty addr restores the default.
+func (c *Config) SetControlUpstream(addr string) {
+	c.controlUpstream = addr
+}
+
+// AddSubnetBehind adds a routed stub subnet, prefix, behind node, such as for
+// testing node as a Tailscale subnet router. The subnet isn't on any network's
+// LAN: the router of node's network routes packets for prefix to node, and
+// only node can reach the subnet's hosts, by sending packets for them to its
+// gateway as its next hop.
+//
+// The hosts are the IPs in prefix of the subnet's simulated hosts, which echo
+// the UDP packets and ICMP echo requests they receive back to their sender.
+func (c *Config) AddSubnetBehind(node *Node, prefix netip.Prefix, hosts ...netip.Addr) {
+	c.subnets = append(c.subnets, &subnetBehind{
+		via:    node,
+		prefix: prefix,
+		hosts:  hosts,
+	})
+}
+
+// subnetBehind is the configuration of a subnet added by
+// [Config.AddSubnetBehind].
+type subnetBehind struct {
+	via    *Node
+	prefix netip.Prefix
+	hosts  []netip.Addr
+}
+
+// FakeIPs are the IPs of the services a server fakes for its nodes. They
+// must be distinct IPv4 addresses, not on any network.
+type FakeIPs struct {
+	// DNS is the IP of the DNS server offered by DHCP, which answers A
+	// queries for the names of the other fake services. The default is
+	// 4.11.4.11.
+	DNS netip.Addr
+
+	// Controlplane is the IP of controlplane.tailscale.com, whose TCP
+	// connections are proxied to the real control server. The default is
+	// 52.52.0.1.
+	Controlplane netip.Addr
+
+	// TestAgent is the IP of test-driver.tailscale, to which nodes' test
+	// agents connect on TCP port 8008. The default is 52.52.0.2.
+	TestAgent netip.Addr
+}
+
+// DNSLatency is a distribution of DNS response delays: either uniform between
+// Min and Max, if Max is non-zero, or else normal with the given Mean and
+// StdDev, but never negative.
+type DNSLatency struct {
+	Min, Max     time.Duration
+	Mean, StdDev time.Duration
 }
 
 // AddNode creates a new node in the world.
@@ -62,7 +209,8 @@ func (c *Config) AddNode(opts ...any) *Node {
 // The opts may be of the following types:
 //   - string IP address, for the network's WAN IP (if any)
 //   - string netip.Prefix, for the network's LAN IP (defaults to 192.168.0.0/24)
-//   - NAT, the type of NAT to use
+//   - NAT, the type of NAT to use; with NoNAT, the LAN is routed from the
+//     internet, so its prefix should be public
 //   - NetworkService, a service to add to the network
 //
 // On an error or unknown opt type, AddNetwork returns a
@@ -106,8 +254,12 @@ type Node struct {
 	// TODO(bradfitz): this is halfway converted to supporting multiple NICs
 	// but not done. We need a MAC-per-Network.
 
-	mac  MAC
-	nets []*Network
+	mac        MAC
+	nets       []*Network
+	publicIP   netip.Addr
+	staticARP  bool
+	clockSkew  time.Duration
+	dhcpRoutes []dhcpRoute
 }
 
 // Network returns the first network this node is connected to,
@@ -119,8 +271,99 @@ func (n *Node) Network() *Network {
 	return n.nets[0]
 }
 
+// LANIP returns the node's LAN IP and whether it has one.
+//
+// After New, it's the address the server assigned the node, which on a
+// network with a DHCP pool it has only once its DHCP request is acked.
+// Before New, it's the address New will assign the node on its first
+// network, unless that network has a DHCP pool.
+func (n *Node) LANIP() (_ netip.Addr, ok bool) {
+	if n.n != nil {
+		netw := n.n.net
+		netw.mu.Lock()
+		defer netw.mu.Unlock()
+		return n.n.lanIP, n.n.lanIP.IsValid()
+	}
+	conf := n.Network()
+	if conf == nil || conf.dhcpPool.IsValid() {
+		return netip.Addr{}, false
+	}
+	return nodeLANIP(cmp.Or(conf.lanIP, defaultLANIP), n.mac), true
+}
+
+// LANIPv6 returns the IPv6 address the node was last seen using on its
+// network and whether there's one. The server doesn't assign nodes IPv6
+// addresses, but learns those they use, such as to connect to DERP over IPv6
+// or through NAT64. It's only known after New.
+func (n *Node) LANIPv6() (_ netip.Addr, ok bool) {
+	if n.n == nil {
+		return netip.Addr{}, false
+	}
+	_, ip6 := n.n.lanIPs()
+	return ip6, ip6.IsValid()
+}
+
+// nodeLANIP returns the fixed LAN IP of the node with MAC mac on the network
+// whose gateway has LAN IP lanIP: the network's address with final octet 101
+// for the first node, 102 for the second, and so on, per the last octet of
+// the MAC (0-based).
+func nodeLANIP(lanIP netip.Prefix, mac MAC) netip.Addr {
+	ip4 := lanIP.Addr().As4()
+	ip4[3] = 101 + mac[5]
+	return netip.AddrFrom4(ip4)
+}
+
+// SetMAC sets the node's MAC, which by default is unique to the node and
+// derived from the order in which it was added. As the last octet of the MAC
+// also picks the node's fixed LAN IP (see LANIP), New returns an error if two
+// nodes on a network share a last octet or if it picks the network's gateway,
+// network or broadcast address or one outside the network.
+func (n *Node) SetMAC(mac MAC) {
+	n.mac = mac
+}
+
+// SetPublicIP gives the node the public IPv4 address ip in addition to its
+// LAN IP, like a server with a static IP on a routed /32. Packets from the
+// internet to ip are delivered to the node as-is, and the node's packets
+// from ip leave its network without NAT. The node itself must be configured
+// to use ip.
+func (n *Node) SetPublicIP(ip netip.Addr) {
+	n.publicIP = ip
+}
+
+// AddDHCPRoute adds a route to dst via the router at via to the DHCP
+// responses the node is sent, in a classless static route option (RFC 3442,
+// option 121), as for a split tunnel or subnet router. An unspecified via
+// (0.0.0.0) makes dst on-link. Both must be IPv4, and via otherwise on the
+// node's network's LAN.
+//
+// Clients that support the option ignore the router option when it's
+// present, so add a route for 0.0.0.0/0 via the gateway too to keep the
+// node's default route.
+func (n *Node) AddDHCPRoute(dst netip.Prefix, via netip.Addr) {
+	n.dhcpRoutes = append(n.dhcpRoutes, dhcpRoute{dst.Masked(), via})
+}
+
+// SetStaticARP sets whether the router of the node's network has a static
+// ARP entry for the node, at its MAC and LAN IP, so it can still deliver
+// packets to the node when the network has ARP disabled. See
+// Network.SetDisableARP.
+func (n *Node) SetStaticARP(v bool) {
+	n.staticARP = v
+}
+
+// SetClockSkew models the node having a wrong clock, off by d from the
+// server's clock (see Config.Clock): the times that the server reports to
+// the node, such as in the fake NTP server's replies, are adjusted by d. A
+// positive d means the node's clock is ahead.
+func (n *Node) SetClockSkew(d time.Duration) {
+	n.clockSkew = d
+}
+
 // Network is the configuration of a network in the virtual network.
 type Network struct {
+	n *network // nil until NewServer called
+
 	mac     MAC // MAC address of the router/gateway
 	natType NAT
 
@@ -130,10 +373,58 @@ type Network struct {
 
 	svcs set.Set[NetworkService]
 
+	dnsOnGateway bool
+	hostnameDNS  bool
+	dns64        netip.Prefix
+	nat64        netip.Prefix
+	antiSpoof    bool
+	disableARP   bool
+	arpDelay     time.Duration
+	isolatedMACs bool
+	dhcpPool     netip.Prefix
+	latency      time.Duration
+	jitter       time.Duration
+	duplication  float64
+	reordering   float64
+	mtu          int
+	silentMTU    bool
+	bandwidth    int64 // bits per second
+	fairQueuing  bool
+	prioQueuing  bool
+	churnEvery   time.Duration
+	churnFrac    float64
+	portFlapping float64
+	natTimeout   time.Duration
+	extraWANs    []netip.Addr
+	wanPolicy    WANPolicy
+	portAlloc    PortAllocation
+	basePort     uint16
+	maxFlows     int
+	flowPolicy   FlowLimitPolicy
+
 	// ...
 	err error // carried error
 }
 
+// WANIP returns the network's WAN IP. It's invalid if the network has none.
+func (n *Network) WANIP() netip.Addr {
+	if n.n != nil {
+		return n.n.wanIP
+	}
+	return n.wanIP
+}
+
+// LANPrefix returns the network's LAN prefix, with the gateway's LAN IP as
+// its address (for example, 192.168.1.1/24). After New, it's the prefix in
+// effect, which is 192.168.0.0/24 if none was given. Before New, it's
+// invalid if none was given.
+func (n *Network) LANPrefix() netip.Prefix {
+	if n.n != nil {
+		return n.n.lanIP
+	}
+	return n.lanIP
+}
+
 // NetworkService is a service that can be added to a network.
 type NetworkService string
 
@@ -141,10 +432,18 @@ type Network struct {
 	NATPMP NetworkService = "NAT-PMP"
 	PCP    NetworkService = "PCP"
 	UPnP   NetworkService = "UPnP"
+
+	// RestrictiveGuestWiFi isn't a service but a firewall preset, like a
+	// captive guest network's: the router lets only DNS and DHCP (UDP ports
+	// 53, 67 and 68) and HTTP and HTTPS (TCP ports 80 and 443) out to the
+	// internet, and drops everything else, such as WireGuard and STUN, with
+	// DropFirewall. This forces Tailscale onto DERP.
+	RestrictiveGuestWiFi NetworkService = "RestrictiveGuestWiFi"
 )
 
 // AddService adds a network service (such as port mapping protocols) to a
-// network.
+// network. The router only answers the port mapping protocols added; UPnP
+// isn't implemented yet.
 func (n *Network) AddService(s NetworkService) {
 	if n.svcs == nil {
 		n.svcs = set.Of(s)
@@ -153,57 +452,541 @@ func (n *Network) AddService(s NetworkService) {
 	}
 }
 
+// SetDNSOnGateway sets whether the network's gateway LAN IP answers DNS
+// queries, like a typical home router, in addition to the fake DNS IP. When
+// set, DHCP also offers the gateway as the first DNS server.
+func (n *Network) SetDNSOnGateway(v bool) {
+	n.dnsOnGateway = v
+}
+
+// SetHostnameDNS sets whether the network's DNS answers A queries for the
+// hostnames its nodes send in their DHCP requests (option 12) with their LAN
+// IPs, like a home router registering its DHCP clients in local DNS, so that
+// nodes on the network can resolve each other by name. Only queries from the
+// network's own nodes are answered, and a node's later request with a new
+// hostname replaces its old one.
+func (n *Network) SetHostnameDNS(v bool) {
+	n.hostnameDNS = v
+}
+
+// SetIngressFiltering sets whether the network's ISP does ingress filtering
+// (BCP 38) against spoofed source addresses: packets from the internet with
+// a private or otherwise bogon source are dropped, as are packets to the
+// internet whose source, after NAT, isn't the network's WAN IP, a node's
+// public IP or, for a NoNAT network, on its LAN. Dropped packets are
+// reported with [DropSpoofed].
+func (n *Network) SetIngressFiltering(v bool) {
+	n.antiSpoof = v
+}
+
+// SetDisableARP sets whether the network has dynamic ARP disabled, as some
+// hardened networks do: the router doesn't answer ARP requests, neither for
+// itself nor for nodes, and only delivers packets to the nodes it has a
+// static ARP entry for (see Node.SetStaticARP). The nodes themselves must be
+// configured with static ARP entries for the router and any other nodes they
+// talk to.
+func (n *Network) SetDisableARP(v bool) {
+	n.disableARP = v
+}
+
+// SetIsolatedMACs sets whether the MACs of the network's nodes need only be
+// unique on the network rather than across the server, as when the same
+// guest image, and thus MAC, runs on separate isolated networks. See
+// Node.SetMAC. A client of a node whose MAC another node shares must be
+// served with [Server.ServeNetworkConn], and Server methods that look up a
+// node by MAC alone don't find such nodes.
+func (n *Network) SetIsolatedMACs(v bool) {
+	n.isolatedMACs = v
+}
+
+// SetARPDelay delays the router's replies to ARP requests by d, on the
+// server's clock (see Config.Clock), modeling a congested switch that's slow
+// to resolve addresses. Zero means no delay.
+func (n *Network) SetARPDelay(d time.Duration) {
+	n.arpDelay = d
+}
+
+// SetDNS64 makes the fake DNS server, when queried by the network's nodes,
+// answer AAAA queries for names it only has IPv4 addresses for with
+// addresses synthesized by DNS64 (RFC 6147): the IPv4 address embedded in
+// prefix, which must be an IPv6 /96 such as the well-known 64:ff9b::/96.
+// The zero prefix, the default, disables DNS64.
+func (n *Network) SetDNS64(prefix netip.Prefix) {
+	n.dns64 = prefix
+}
+
+// SetNAT64 makes the network's router a stateful NAT64 (RFC 6146) for
+// prefix, which must be an IPv6 /96 such as the well-known 64:ff9b::/96:
+// UDP packets that nodes send over IPv6 to an address in prefix are
+// translated to IPv4 packets to the IPv4 address embedded in it and NATed
+// as if sent from the router's own LAN IPv4 address, apart from the node's
+// IPv4 flows, and replies are translated back. Sessions expire like NAT
+// mappings (see SetNATTimeout). It's typically used with SetDNS64 and the
+// same prefix to model an IPv6-only network. The network's NAT mustn't be
+// One2OneNAT. The zero prefix, the default, disables NAT64.
+func (n *Network) SetNAT64(prefix netip.Prefix) {
+	n.nat64 = prefix
+}
+
+// SetDHCPPool makes the network's nodes get their LAN IPs from DHCP, with the
+// server leasing the next free address in pool rather than a fixed address
+// derived from the node's MAC. pool must be within the network's LAN prefix.
+// Until a node's DHCP request is acknowledged it has no LAN IP.
+func (n *Network) SetDHCPPool(pool netip.Prefix) {
+	n.dhcpPool = pool
+}
+
+// SetLatency delays each packet arriving at the network from the internet by
+// latency, plus or minus a uniformly random jitter of at most jitter. While
+// the network has a latency, the server records the latencies of the packets
+// it delivers; see [Server.LatencyStats].
+func (n *Network) SetLatency(latency, jitter time.Duration) {
+	n.latency = latency
+	n.jitter = jitter
+}
+
+// SetDuplication makes the network deliver a fraction frac, from 0 to 1, of
+// the packets arriving from the internet twice, the copy shortly after the
+// original.
+func (n *Network) SetDuplication(frac float64) {
+	n.duplication = frac
+}
+
+// SetReordering makes the network hold back each packet arriving from the
+// internet with probability prob, from 0 to 1, until the next packet has been
+// delivered ahead of it, so that packets are delivered out of order. A held
+// packet that isn't overtaken is delivered after a short wait.
+func (n *Network) SetReordering(prob float64) {
+	n.reordering = prob
+}
+
+// SetMTU sets the MTU of the network's link to the internet. The router
+// doesn't forward larger packets from the LAN that have the don't fragment
+// bit set, replying with an ICMP fragmentation needed message instead. Zero
+// means no limit.
+func (n *Network) SetMTU(mtu int) {
+	n.mtu = mtu
+}
+
+// SetSilentMTUBlackhole sets whether the router drops packets too large for
+// its MTU (see SetMTU) without sending the ICMP fragmentation needed message,
+// like a misconfigured middlebox that breaks path MTU discovery.
+func (n *Network) SetSilentMTUBlackhole(v bool) {
+	n.silentMTU = v
+}
+
+// SetBandwidth limits the rate of the network's link from the internet to
+// bitsPerSec, counting IP and UDP headers. Packets that arrive faster are
+// queued in a single drop-tail queue, of a size that causes bufferbloat at
+// typical rates; see SetFairQueuing for an alternative. Zero means no limit.
+func (n *Network) SetBandwidth(bitsPerSec int64) {
+	n.bandwidth = bitsPerSec
+}
+
+// SetFairQueuing sets whether the network's bandwidth limit (see
+// SetBandwidth) queues each UDP flow separately and serves the flows in turn,
+// dropping packets of flows that keep a standing queue per CoDel, like the
+// fq_codel queuing of modern routers. That keeps latency low for sparse flows
+// competing with bulk ones.
+func (n *Network) SetFairQueuing(v bool) {
+	n.fairQueuing = v
+}
+
+// SetPriorityQueuing sets whether the network's bandwidth limit (see
+// SetBandwidth) queues packets by the 802.1p priority of the frames they were
+// sent in, like a QoS-enabled switch, always sending queued packets of a
+// higher priority first. When the queue is full, a packet pushes out one of
+// a lower priority, if any, instead of being dropped. Priorities are ordered
+// per IEEE 802.1Q, in which background (1) is below best effort (0).
+//
+// It can't be combined with SetFairQueuing.
+func (n *Network) SetPriorityQueuing(v bool) {
+	n.prioQueuing = v
+}
+
+// SetNATChurn makes the network's NAT flush the mappings of each LAN host with
+// probability frac, from 0 to 1, once per interval every, as if its state
+// table churned mid-session. Unlike a router reboot, other hosts' mappings
+// survive. Zero every means no churn.
+//
+// Churn is driven by the times of the packets the NAT handles, and the hosts
+// flushed are chosen with the server's source of randomness (see
+// Config.RandSeed).
+func (n *Network) SetNATChurn(every time.Duration, frac float64) {
+	n.churnEvery = every
+	n.churnFrac = frac
+}
+
+// SetNATPortFlapping makes the network's NAT send a random fraction frac,
+// from 0 to 1, of outgoing packets from a random WAN source port rather than
+// their flow's mapped one, like carrier NATs that inconsistently rewrite
+// source ports mid-flow. Replies to a flapped port are still delivered, as
+// the NAT tracks it as a connection in its own right.
+//
+// Which packets flap, and to which ports, is chosen with the server's source
+// of randomness (see Config.RandSeed).
+func (n *Network) SetNATPortFlapping(frac float64) {
+	n.portFlapping = frac
+}
+
+// SetNATTimeout makes the network's NAT expire mappings that have been idle
+// for at least d, after which return traffic to them is dropped and new
+// traffic from the LAN gets a new mapping. Zero d means mappings never
+// expire.
+//
+// Mappings are timed by the server's clock (see Config.Clock).
+func (n *Network) SetNATTimeout(d time.Duration) {
+	n.natTimeout = d
+}
+
+// AddWANIP adds ip as another WAN IP of the network, in addition to the one
+// given to AddNetwork, like a router with multiple uplinks or a carrier NAT
+// with a pool of public addresses. The network's NAT keeps a separate table
+// per WAN IP, and which WAN IP outgoing traffic leaves from is picked by the
+// network's WAN policy; see SetWANPolicy.
+func (n *Network) AddWANIP(ip netip.Addr) {
+	n.extraWANs = append(n.extraWANs, ip)
+}
+
+// SetPortAllocation sets how the network's NAT picks the WAN ports of new
+// mappings. The default is [RandomPorts]. With [SequentialPorts], the first
+// mapping gets basePort, the next basePort+1, and so on, so a test can
+// predict exactly which port each new LAN socket gets; basePort is otherwise
+// unused.
+func (n *Network) SetPortAllocation(mode PortAllocation, basePort uint16) {
+	n.portAlloc = mode
+	n.basePort = basePort
+}
+
+// SetMaxFlows limits the network's NAT to max mappings, like a cheap router
+// with a small conntrack table, with policy deciding what happens to new
+// flows when it's full: [RejectNewFlows], the default if policy is empty,
+// or [EvictOldestFlow]. Expired mappings (see SetNATTimeout) are removed to
+// make room first. A network with multiple WAN IPs has max mappings per WAN
+// IP. Zero max means no limit. Only [EasyNAT] and [HardNAT] track flows.
+func (n *Network) SetMaxFlows(max int, policy FlowLimitPolicy) {
+	n.maxFlows = max
+	n.flowPolicy = policy
+}
+
+// SetWANPolicy sets how a network with multiple WAN IPs (see AddWANIP) picks
+// the WAN IP of outgoing traffic. The default is [SpreadPerFlow].
+func (n *Network) SetWANPolicy(p WANPolicy) {
+	n.wanPolicy = p
+}
+
+// defaultLANIP is the LAN IP of networks added without one.
+var defaultLANIP = netip.MustParsePrefix("192.168.0.0/24")
+
 // initFromConfig initializes the server from the previous calls
 // to NewNode and NewNetwork and returns an error if
 // there were any configuration issues.
 func (s *Server) initFromConfig(c *Config) error {
+	if c.TCPReceiveBufferSize < 0 || c.TCPSendBufferSize < 0 {
+		return errors.New("TCP buffer sizes must not be negative")
+	}
+	s.tcpReceiveBufferSize = c.TCPReceiveBufferSize
+	s.tcpSendBufferSize = c.TCPSendBufferSize
+	s.tcpSACK = !c.DisableTCPSACK
+	s.connStaleAfter = cmp.Or(c.ConnStaleAfter, 30*time.Second)
+	s.tcpStackType = cmp.Or(c.TCPStack, TCPStackGVisor)
+	if c.TCPConnectDelay < 0 {
+		return errors.New("TCPConnectDelay must not be negative")
+	}
+	s.tcpConnectDelay = c.TCPConnectDelay
+	if addr := c.controlUpstream; addr != "" {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid control upstream %q: %w", addr, err)
+		} else if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return fmt.Errorf("invalid control upstream %q: bad port %q", addr, port)
+		}
+	}
+	s.controlUpstream = c.controlUpstream
+	if l := c.DNSLatency; l.Min < 0 || l.Max < l.Min || l.Mean < 0 || l.StdDev < 0 {
+		return fmt.Errorf("invalid DNSLatency %+v", l)
+	}
+	s.dnsLatency = c.DNSLatency
+	s.fakeIPs = c.FakeIPs
+	for _, f := range []struct {
+		ip   *netip.Addr
+		def  netip.Addr
+		name string
+	}{
+		{&s.fakeIPs.DNS, defaultFakeIPs.DNS, "DNS"},
+		{&s.fakeIPs.Controlplane, defaultFakeIPs.Controlplane, "Controlplane"},
+		{&s.fakeIPs.TestAgent, defaultFakeIPs.TestAgent, "TestAgent"},
+	} {
+		if !f.ip.IsValid() {
+			*f.ip = f.def
+		} else if !f.ip.Is4() {
+			return fmt.Errorf("FakeIPs.%s %v is not an IPv4 address", f.name, *f.ip)
+		}
+	}
+	if fi := s.fakeIPs; fi.DNS == fi.Controlplane || fi.DNS == fi.TestAgent || fi.Controlplane == fi.TestAgent {
+		return fmt.Errorf("FakeIPs %+v are not distinct", fi)
+	}
+	s.baseLogf = c.Logf
+	if s.baseLogf == nil {
+		s.baseLogf = log.Printf
+	}
+	if c.LogRingSize > 0 {
+		s.logRing = newLogRing(c.LogRingSize)
+	}
+	s.clock = c.Clock
+	s.logNAT = c.LogNAT
+	if s.clock == nil {
+		s.clock = tstime.StdClock{}
+	}
+	seed := uint64(c.RandSeed)
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	s.rand = rand.New(&lockedSource{src: rand.NewPCG(seed, seed)})
+	if c.derpMap != nil {
+		if err := s.addDERPMapIPs(c.derpMap); err != nil {
+			return err
+		}
+	}
+
 	netOfConf := map[*Network]*network{}
 	for _, conf := range c.networks {
 		if conf.err != nil {
 			return conf.err
 		}
 		if !conf.lanIP.IsValid() {
-			conf.lanIP = netip.MustParsePrefix("192.168.0.0/24")
+			conf.lanIP = defaultLANIP
 		}
 		n := &network{
-			s:         s,
-			mac:       conf.mac,
-			portmap:   conf.svcs.Contains(NATPMP), // TODO: expand network.portmap
-			wanIP:     conf.wanIP,
-			lanIP:     conf.lanIP,
-			nodesByIP: map[netip.Addr]*node{},
+			s:            s,
+			mac:          conf.mac,
+			services:     set.SetOf(conf.svcs.Slice()),
+			dnsOnGateway: conf.dnsOnGateway,
+			hostnameDNS:  conf.hostnameDNS,
+			dns64:        conf.dns64.Masked(),
+			nat64:        conf.nat64.Masked(),
+			antiSpoof:    conf.antiSpoof,
+			disableARP:   conf.disableARP,
+			isolatedMACs: conf.isolatedMACs,
+			arpDelay:     conf.arpDelay,
+			dhcpPool:     conf.dhcpPool.Masked(),
+			latency:      conf.latency,
+			jitter:       conf.jitter,
+			duplication:  conf.duplication,
+			reordering:   conf.reordering,
+			mtu:          conf.mtu,
+			silentMTU:    conf.silentMTU,
+			churnEvery:   conf.churnEvery,
+			churnFrac:    conf.churnFrac,
+			portFlapping: conf.portFlapping,
+			natTimeout:   conf.natTimeout,
+			extraWANs:    slices.Clone(conf.extraWANs),
+			wanPolicy:    cmp.Or(conf.wanPolicy, SpreadPerFlow),
+			portAlloc:    cmp.Or(conf.portAlloc, RandomPorts),
+			basePort:     conf.basePort,
+			maxFlows:     conf.maxFlows,
+			flowPolicy:   cmp.Or(conf.flowPolicy, RejectNewFlows),
+			wanIP:        conf.wanIP,
+			lanIP:        conf.lanIP,
+			nodesByIP:    map[netip.Addr]*node{},
+		}
+		if n.services.Contains(RestrictiveGuestWiFi) {
+			n.firewall = restrictiveGuestWiFi
+		}
+		if n.latency < 0 || n.jitter < 0 || n.jitter > n.latency {
+			return fmt.Errorf("network %v: invalid latency %v with jitter %v", n.wanIP, n.latency, n.jitter)
+		}
+		if n.arpDelay < 0 {
+			return fmt.Errorf("network %v: negative ARP delay %v", n.wanIP, n.arpDelay)
+		}
+		if p := conf.dns64; p.IsValid() && !isNAT64Prefix(p) {
+			return fmt.Errorf("network %v: DNS64 prefix %v is not an IPv6 /96", n.wanIP, p)
+		}
+		if p := conf.nat64; p.IsValid() && !isNAT64Prefix(p) {
+			return fmt.Errorf("network %v: NAT64 prefix %v is not an IPv6 /96", n.wanIP, p)
+		}
+		if conf.nat64.IsValid() && conf.natType == One2OneNAT {
+			return fmt.Errorf("network %v: NAT64 is not supported with %v NAT", n.wanIP, One2OneNAT)
+		}
+		if n.duplication < 0 || n.duplication > 1 {
+			return fmt.Errorf("network %v: duplication fraction %v not in [0, 1]", n.wanIP, n.duplication)
+		}
+		if n.reordering < 0 || n.reordering > 1 {
+			return fmt.Errorf("network %v: reordering probability %v not in [0, 1]", n.wanIP, n.reordering)
+		}
+		if n.mtu != 0 && n.mtu < 68 {
+			return fmt.Errorf("network %v: MTU %d is below the IPv4 minimum of 68", n.wanIP, n.mtu)
+		}
+		for _, ip := range []netip.Addr{s.fakeIPs.DNS, s.fakeIPs.Controlplane, s.fakeIPs.TestAgent} {
+			if ip == n.wanIP || n.lanIP.Contains(ip) {
+				return fmt.Errorf("network %v: fake service IP %v is on the network", n.wanIP, ip)
+			}
+		}
+		if n.churnEvery < 0 || n.churnFrac < 0 || n.churnFrac > 1 {
+			return fmt.Errorf("network %v: invalid NAT churn every %v of fraction %v", n.wanIP, n.churnEvery, n.churnFrac)
+		}
+		if n.portFlapping < 0 || n.portFlapping > 1 {
+			return fmt.Errorf("network %v: NAT port flapping fraction %v not in [0, 1]", n.wanIP, n.portFlapping)
+		}
+		if n.natTimeout < 0 {
+			return fmt.Errorf("network %v: negative NAT timeout %v", n.wanIP, n.natTimeout)
+		}
+		for _, ip := range n.extraWANs {
+			if !ip.Is4() || ip == n.wanIP || !n.wanIP.IsValid() {
+				return fmt.Errorf("network %v: invalid extra WAN IP %v", n.wanIP, ip)
+			}
+		}
+		if n.wanPolicy != SpreadPerFlow && n.wanPolicy != StickyPerLANSocket {
+			return fmt.Errorf("network %v: unknown WAN policy %q", n.wanIP, n.wanPolicy)
+		}
+		switch n.portAlloc {
+		case RandomPorts:
+		case SequentialPorts:
+			if n.basePort == 0 {
+				return fmt.Errorf("network %v: sequential port allocation needs a base port", n.wanIP)
+			}
+		default:
+			return fmt.Errorf("network %v: unknown port allocation %q", n.wanIP, n.portAlloc)
+		}
+		if n.maxFlows < 0 {
+			return fmt.Errorf("network %v: negative max flows %d", n.wanIP, n.maxFlows)
+		}
+		if n.flowPolicy != RejectNewFlows && n.flowPolicy != EvictOldestFlow {
+			return fmt.Errorf("network %v: unknown flow limit policy %q", n.wanIP, n.flowPolicy)
+		}
+		if nt := cmp.Or(conf.natType, EasyNAT); n.maxFlows > 0 && nt != EasyNAT && nt != HardNAT {
+			return fmt.Errorf("network %v: %v NAT doesn't track flows to limit", n.wanIP, nt)
+		}
+		if len(n.extraWANs) > 0 && conf.natType == NoNAT {
+			return fmt.Errorf("network %v: %v networks can't have extra WAN IPs", n.wanIP, NoNAT)
+		}
+		if conf.bandwidth < 0 {
+			return fmt.Errorf("network %v: negative bandwidth %d", n.wanIP, conf.bandwidth)
+		}
+		if conf.fairQueuing && conf.bandwidth == 0 {
+			return fmt.Errorf("network %v: fair queuing requires a bandwidth limit", n.wanIP)
+		}
+		if conf.prioQueuing && conf.bandwidth == 0 {
+			return fmt.Errorf("network %v: priority queuing requires a bandwidth limit", n.wanIP)
+		}
+		if conf.prioQueuing && conf.fairQueuing {
+			return fmt.Errorf("network %v: priority queuing can't be combined with fair queuing", n.wanIP)
+		}
+		if conf.bandwidth > 0 {
+			n.throttle = &throttle{n: n, rate: conf.bandwidth, fair: conf.fairQueuing, prio: conf.prioQueuing}
+		}
+		if p := n.dhcpPool; p.IsValid() {
+			if p.Bits() < n.lanIP.Bits() || !n.lanIP.Contains(p.Addr()) {
+				return fmt.Errorf("DHCP pool %v is not within LAN %v", p, n.lanIP)
+			}
+			if conf.natType == One2OneNAT {
+				return fmt.Errorf("DHCP pool %v can't be used with %v", p, One2OneNAT)
+			}
 		}
 		netOfConf[conf] = n
+		conf.n = n
 		s.networks.Add(n)
-		if _, ok := s.networkByWAN[conf.wanIP]; ok {
-			return fmt.Errorf("two networks have the same WAN IP %v; Anycast not (yet?) supported", conf.wanIP)
+		for _, ip := range append([]netip.Addr{conf.wanIP}, n.extraWANs...) {
+			if err := s.inet.attach(ip, n); err != nil {
+				return fmt.Errorf("two networks have the same WAN IP %v; Anycast not (yet?) supported", ip)
+			}
+		}
+		if conf.natType == NoNAT {
+			s.inet.attachLAN(n)
+		}
+	}
+	for _, n := range s.inet.routedLANs {
+		for wanIP := range s.inet.byAddr {
+			if n.lanIP.Contains(wanIP) {
+				return fmt.Errorf("%v network %v: LAN %v contains the WAN IP %v", NoNAT, n.wanIP, n.lanIP, wanIP)
+			}
+		}
+		for _, o := range s.inet.routedLANs {
+			if o != n && o.lanIP.Overlaps(n.lanIP) {
+				return fmt.Errorf("%v networks %v and %v have overlapping LANs", NoNAT, n.wanIP, o.wanIP)
+			}
 		}
-		s.networkByWAN[conf.wanIP] = n
 	}
 	for _, conf := range c.nodes {
 		if conf.err != nil {
 			return conf.err
 		}
 		n := &node{
-			mac: conf.mac,
-			net: netOfConf[conf.Network()],
+			net:        netOfConf[conf.Network()],
+			publicIP:   conf.publicIP,
+			staticARP:  conf.staticARP,
+			clockSkew:  conf.clockSkew,
+			dhcpRoutes: slices.Clone(conf.dhcpRoutes),
 		}
+		n.mac.Store(conf.mac)
 		conf.n = n
-		if _, ok := s.nodeByMAC[n.mac]; ok {
-			return fmt.Errorf("two nodes have the same MAC %v", n.mac)
+		if conf.mac == (MAC{}) || conf.mac.IsBroadcast() {
+			return fmt.Errorf("node %v: invalid MAC", conf.mac)
+		}
+		key := n.net.macKey(conf.mac)
+		if _, ok := s.nodeByMAC[key]; ok {
+			return fmt.Errorf("two nodes have the same MAC %v", conf.mac)
+		}
+		var routesLen int
+		for _, r := range n.dhcpRoutes {
+			if !r.dst.IsValid() || !r.dst.Addr().Is4() || !r.via.Is4() {
+				return fmt.Errorf("node %v: DHCP route to %v via %v is not IPv4", conf.mac, r.dst, r.via)
+			}
+			if !r.via.IsUnspecified() && !n.net.lanIP.Contains(r.via) {
+				return fmt.Errorf("node %v: DHCP route via %v is not on LAN %v", conf.mac, r.via, n.net.lanIP)
+			}
+			routesLen += 1 + (r.dst.Bits()+7)/8 + 4
+		}
+		if routesLen > 255 {
+			return fmt.Errorf("node %v: DHCP routes don't fit in an option", conf.mac)
+		}
+		if ip := n.publicIP; ip.IsValid() {
+			if !ip.Is4() {
+				return fmt.Errorf("node %v: public IP %v is not IPv4", conf.mac, ip)
+			}
+			if _, ok := s.inet.route(ip); ok {
+				return fmt.Errorf("node %v: public IP %v is already routed", conf.mac, ip)
+			}
+			if n.net.lanIP.Contains(ip) || slices.Contains([]netip.Addr{s.fakeIPs.DNS, s.fakeIPs.Controlplane, s.fakeIPs.TestAgent}, ip) {
+				return fmt.Errorf("node %v: public IP %v is in use", conf.mac, ip)
+			}
+			if err := s.inet.attach(ip, n.net); err != nil {
+				return fmt.Errorf("node %v: %w", conf.mac, err)
+			}
+			mak.Set(&n.net.publicIPs, ip, n)
 		}
 		s.nodes = append(s.nodes, n)
-		s.nodeByMAC[n.mac] = n
-
-		// Allocate a lanIP for the node. Use the network's CIDR and use final
-		// octet 101 (for first node), 102, etc. The node number comes from the
-		// last octent of the MAC address (0-based)
-		ip4 := n.net.lanIP.Addr().As4()
-		ip4[3] = 101 + n.mac[5]
-		n.lanIP = netip.AddrFrom4(ip4)
+		s.nodeByMAC[key] = n
+
+		if n.net.dhcpPool.IsValid() {
+			// The node gets its lanIP when its DHCP request is acked.
+			continue
+		}
+
+		n.lanIP = nodeLANIP(n.net.lanIP, conf.mac)
+		lan := n.net.lanIP.Masked()
+		switch n.lanIP {
+		case n.net.lanIP.Addr():
+			return fmt.Errorf("node %v: LAN IP %v is the network's gateway", conf.mac, n.lanIP)
+		case lan.Addr():
+			return fmt.Errorf("node %v: LAN IP %v is the network's address", conf.mac, n.lanIP)
+		case netipx.PrefixLastIP(lan):
+			return fmt.Errorf("node %v: LAN IP %v is the network's broadcast address", conf.mac, n.lanIP)
+		}
+		if !lan.Contains(n.lanIP) {
+			return fmt.Errorf("node %v: LAN IP %v is outside the network %v", conf.mac, n.lanIP, lan)
+		}
+		if o, ok := n.net.nodesByIP[n.lanIP]; ok {
+			return fmt.Errorf("nodes %v and %v have the same LAN IP %v", o.mac.Load(), conf.mac, n.lanIP)
+		}
 		n.net.nodesByIP[n.lanIP] = n
 	}
 
+	for _, conf := range c.subnets {
+		if err := s.addSubnetBehind(conf); err != nil {
+			return err
+		}
+	}
+
 	// Now that nodes are populated, set up NAT:
 	for _, conf := range c.networks {
 		n := netOfConf[conf]
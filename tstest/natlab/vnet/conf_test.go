@@ -3,7 +3,13 @@
 
 package vnet
 
-import "testing"
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
 
 func TestConfig(t *testing.T) {
 	tests := []struct {
@@ -51,6 +57,66 @@ func TestConfig(t *testing.T) {
 			},
 			wantErr: "error creating NAT type \"one2one\" for network 2.1.1.1: can't use one2one NAT type on networks other than single-node networks",
 		},
+		{
+			name: "dup-lan-ip",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				c.AddNode(net1).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x05})
+				c.AddNode(net1).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xdd, 0x05})
+			},
+			wantErr: "nodes 52:cc:cc:cc:cc:05 and 52:cc:cc:cc:dd:05 have the same LAN IP 192.168.1.106",
+		},
+		{
+			name: "lan-ip-is-gateway",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x9c})
+			},
+			wantErr: "node 52:cc:cc:cc:cc:9c: LAN IP 192.168.1.1 is the network's gateway",
+		},
+		{
+			name: "lan-ip-is-broadcast",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x9a})
+			},
+			wantErr: "node 52:cc:cc:cc:cc:9a: LAN IP 192.168.1.255 is the network's broadcast address",
+		},
+		{
+			name: "lan-ip-is-network",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x9b})
+			},
+			wantErr: "node 52:cc:cc:cc:cc:9b: LAN IP 192.168.1.0 is the network's address",
+		},
+		{
+			name: "lan-ip-outside-network",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/26")).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x00})
+			},
+			wantErr: "node 52:cc:cc:cc:cc:00: LAN IP 192.168.1.101 is outside the network 192.168.1.0/26",
+		},
+		{
+			name: "subnet-behind",
+			setup: func(c *Config) {
+				n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+				c.AddSubnetBehind(n1, netip.MustParsePrefix("10.99.0.0/24"), netip.MustParseAddr("10.99.0.5"))
+			},
+		},
+		{
+			name: "subnet-behind-overlaps-lan",
+			setup: func(c *Config) {
+				n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+				c.AddSubnetBehind(n1, netip.MustParsePrefix("192.168.0.0/16"))
+			},
+			wantErr: "subnet 192.168.0.0/16 overlaps the LAN 192.168.1.1/24",
+		},
+		{
+			name: "subnet-behind-host-outside",
+			setup: func(c *Config) {
+				n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+				c.AddSubnetBehind(n1, netip.MustParsePrefix("10.99.0.0/24"), netip.MustParseAddr("10.98.0.5"))
+			},
+			wantErr: "host 10.98.0.5 is not in subnet 10.99.0.0/24",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -69,3 +135,78 @@ func TestConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestLint(t *testing.T) {
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "1a", IPv4: "9.9.9.9"}}},
+		},
+	}
+	tests := []struct {
+		name  string
+		setup func(*Config)
+		want  []WarningKind
+	}{
+		{
+			name: "ok",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", HardNAT))
+				c.AddNode(c.AddNetwork("2.2.2.2", "10.2.0.1/16", HardNAT, NATPMP))
+				c.SetDERPMap(derpMap)
+			},
+		},
+		{
+			name: "node-without-network",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+				c.AddNode()
+			},
+			want: []WarningKind{WarnNodeWithoutNetwork},
+		},
+		{
+			name: "network-without-nodes",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+				c.AddNetwork("2.2.2.2", "10.2.0.1/16")
+			},
+			want: []WarningKind{WarnNetworkWithoutNodes},
+		},
+		{
+			name: "hard-nats-without-derp",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", HardNAT))
+				c.AddNode(c.AddNetwork("2.2.2.2", "10.2.0.1/16", HardNAT))
+			},
+			want: []WarningKind{WarnNoPath},
+		},
+		{
+			name: "hard-nats-same-network",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", HardNAT)
+				c.AddNode(net1)
+				c.AddNode(net1)
+			},
+		},
+		{
+			name: "service-without-wan-ip",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("192.168.1.1/24", PCP))
+			},
+			want: []WarningKind{WarnServiceWithoutWANIP},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			tt.setup(&c)
+			ws := c.Lint()
+			var got []WarningKind
+			for _, w := range ws {
+				got = append(got, w.Kind)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Lint = %v; want kinds %v", ws, tt.want)
+			}
+		})
+	}
+}
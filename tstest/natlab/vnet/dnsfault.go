@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/util/mak"
+)
+
+// DNSFault is a fault of the fake DNS server, set by [Server.SetDNSFault].
+type DNSFault struct {
+	// RCode is the response code to answer queries with, without any
+	// answers, such as layers.DNSResponseCodeServFail. It must not be
+	// layers.DNSResponseCodeNoErr.
+	RCode layers.DNSResponseCode
+
+	// For is how long the fault lasts after it's set, per the server's
+	// clock (see Config.Clock), before the server recovers. Zero means
+	// until the fault is cleared.
+	For time.Duration
+}
+
+// SetDNSFault makes the fake DNS server answer all queries per f from now,
+// modeling a resolver outage, such as "SERVFAIL for the next 5 seconds". It
+// replaces any previous fault. The zero DNSFault clears it.
+func (s *Server) SetDNSFault(f DNSFault) {
+	s.dnsFaultMu.Lock()
+	defer s.dnsFaultMu.Unlock()
+	s.dnsFault = f
+	s.dnsFaultUntil = time.Time{}
+	if f.For > 0 {
+		s.dnsFaultUntil = s.clock.Now().Add(f.For)
+	}
+}
+
+// activeDNSFault returns the response code of the DNS fault in effect now, if
+// any.
+func (s *Server) activeDNSFault() (_ layers.DNSResponseCode, ok bool) {
+	s.dnsFaultMu.Lock()
+	defer s.dnsFaultMu.Unlock()
+	f := s.dnsFault
+	if f.RCode == layers.DNSResponseCodeNoErr {
+		return 0, false
+	}
+	if !s.dnsFaultUntil.IsZero() && !s.clock.Now().Before(s.dnsFaultUntil) {
+		s.dnsFault = DNSFault{} // recovered
+		return 0, false
+	}
+	return f.RCode, true
+}
+
+// dnsSpoofKey is a node's query for a name that the fake DNS server answers
+// with a forged response first; see Server.InjectDNSSpoof.
+type dnsSpoofKey struct {
+	mac   MAC
+	qname string // lowercase, without a trailing dot
+}
+
+// InjectDNSSpoof makes the fake DNS server race its next answer to an A query
+// for qname from the node with MAC mac with a forged response answering ip,
+// as an off-path attacker who guessed the query's ID and port would. The
+// forged response arrives first and the legitimate one right after it. It's
+// one-shot: later queries are answered normally.
+func (s *Server) InjectDNSSpoof(mac MAC, qname string, ip netip.Addr) error {
+	if _, ok := s.nodeForMAC(mac); !ok {
+		return fmt.Errorf("unknown node %v", mac)
+	}
+	if !ip.Is4() {
+		return fmt.Errorf("spoofed answer %v is not IPv4", ip)
+	}
+	s.dnsSpoofMu.Lock()
+	defer s.dnsSpoofMu.Unlock()
+	mak.Set(&s.dnsSpoofs, dnsSpoofKey{mac, dnsSpoofName(qname)}, ip)
+	return nil
+}
+
+func dnsSpoofName(qname string) string {
+	return strings.ToLower(strings.TrimSuffix(qname, "."))
+}
+
+// takeDNSSpoof returns a forged response to pkt, a DNS query from the node
+// with MAC mac, if InjectDNSSpoof armed one for it, and disarms it.
+func (s *Server) takeDNSSpoof(mac MAC, pkt gopacket.Packet) (_ []byte, ok bool) {
+	dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok || dns.QR || len(dns.Questions) != 1 {
+		return nil, false
+	}
+	q := dns.Questions[0]
+	if q.Type != layers.DNSTypeA || q.Class != layers.DNSClassIN {
+		return nil, false
+	}
+	k := dnsSpoofKey{mac, dnsSpoofName(string(q.Name))}
+	s.dnsSpoofMu.Lock()
+	ip, ok := s.dnsSpoofs[k]
+	delete(s.dnsSpoofs, k)
+	s.dnsSpoofMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	frame, err := dnsResponseFrame(pkt, &layers.DNS{
+		ID:           dns.ID,
+		QR:           true,
+		RD:           dns.RD,
+		RA:           true,
+		OpCode:       layers.DNSOpCodeQuery,
+		ResponseCode: layers.DNSResponseCodeNoErr,
+		QDCount:      1,
+		Questions:    dns.Questions,
+		ANCount:      1,
+		Answers: []layers.DNSResourceRecord{{
+			Name:  q.Name,
+			Type:  q.Type,
+			Class: q.Class,
+			IP:    ip.AsSlice(),
+			TTL:   60,
+		}},
+	})
+	if err != nil {
+		s.logf("forging DNS response: %v", err)
+		return nil, false
+	}
+	s.logf("DNS: forged answer %v for %q to %v", ip, q.Name, mac)
+	return frame, true
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/util/set"
+)
+
+// firewall is the rules by which a network's router filters packets from its
+// nodes to the internet, by destination port. A nil set of ports means the
+// protocol is unfiltered.
+type firewall struct {
+	udpPorts set.Set[uint16] // UDP destination ports allowed out
+	tcpPorts set.Set[uint16] // TCP destination ports allowed out
+}
+
+// restrictiveGuestWiFi is the firewall of the RestrictiveGuestWiFi service:
+// UDP only for DNS and DHCP, and TCP only for HTTP and HTTPS.
+var restrictiveGuestWiFi = &firewall{
+	udpPorts: set.Of[uint16](53, 67, 68),
+	tcpPorts: set.Of[uint16](80, 443),
+}
+
+// allows reports whether fw lets pkt, a packet from a node to the internet,
+// out.
+func (fw *firewall) allows(pkt gopacket.Packet) bool {
+	switch l := pkt.TransportLayer().(type) {
+	case *layers.UDP:
+		return fw.udpPorts == nil || fw.udpPorts.Contains(uint16(l.DstPort))
+	case *layers.TCP:
+		return fw.tcpPorts == nil || fw.tcpPorts.Contains(uint16(l.DstPort))
+	}
+	return true
+}
+
+// egressAllowed reports whether n's firewall, if any, lets pkt, a packet from
+// a node to dstIP on the internet, out. Packets to the fake test agent, which
+// is test infrastructure rather than part of the internet, are always allowed.
+func (n *network) egressAllowed(pkt gopacket.Packet, dstIP netip.Addr) bool {
+	if n.firewall == nil || dstIP == n.s.fakeIPs.TestAgent {
+		return true
+	}
+	return n.firewall.allows(pkt)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxHandshakes is how many intercepted TCP handshakes a network remembers.
+// Older ones are forgotten first.
+const maxHandshakes = 256
+
+// TCPOptions are the handshake parameters that one side of a TCP connection
+// offered in its SYN or SYN-ACK.
+type TCPOptions struct {
+	// MSS is the maximum segment size, or 0 if none was offered.
+	MSS int
+
+	// WindowScale is the window scale shift count, or -1 if window
+	// scaling wasn't offered.
+	WindowScale int
+
+	// SACKPermitted is whether selective acknowledgements were offered.
+	SACKPermitted bool
+}
+
+// TCPHandshake is the handshake of a TCP connection that a node made to an
+// intercepted destination, such as a DERP server, as reported by
+// [Server.TCPHandshakes].
+type TCPHandshake struct {
+	// Flow is the connection. Flow.Src is the node's LAN address and port,
+	// and Flow.Dst the address it connected to.
+	Flow FiveTuple
+
+	// SYN is what the node offered.
+	SYN TCPOptions
+
+	// SYNACK is what the server's TCP stack offered in reply. It's the zero
+	// value until the SYN-ACK is sent; see SYNACKSent.
+	SYNACK     TCPOptions
+	SYNACKSent bool
+}
+
+// TCPHandshakes returns the handshakes of the most recent TCP connections
+// intercepted on the network with WAN IP wanIP, oldest first. It's for tests
+// to check that settings such as MSS clamping and window scaling took effect.
+func (s *Server) TCPHandshakes(wanIP netip.Addr) ([]TCPHandshake, error) {
+	n, ok := s.inet.networkAt(wanIP)
+	if !ok {
+		return nil, fmt.Errorf("no network with WAN IP %v", wanIP)
+	}
+	n.handshakeMu.Lock()
+	defer n.handshakeMu.Unlock()
+	ret := make([]TCPHandshake, len(n.handshakes))
+	for i, h := range n.handshakes {
+		ret[i] = *h
+	}
+	return ret, nil
+}
+
+// tcpOptions returns the handshake parameters in tcp's options.
+func tcpOptions(tcp *layers.TCP) TCPOptions {
+	o := TCPOptions{WindowScale: -1}
+	for _, opt := range tcp.Options {
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) == 2 {
+				o.MSS = int(binary.BigEndian.Uint16(opt.OptionData))
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(opt.OptionData) == 1 {
+				o.WindowScale = int(opt.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			o.SACKPermitted = true
+		}
+	}
+	return o
+}
+
+// tcpFlowOf returns the flow of the TCP segment tcp in pkt.
+func tcpFlowOf(pkt gopacket.Packet, tcp *layers.TCP) (_ FiveTuple, ok bool) {
+	var src, dst netip.Addr
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, _ = netip.AddrFromSlice(ip.SrcIP)
+		dst, _ = netip.AddrFromSlice(ip.DstIP)
+	case *layers.IPv6:
+		src, _ = netip.AddrFromSlice(ip.SrcIP)
+		dst, _ = netip.AddrFromSlice(ip.DstIP)
+	default:
+		return FiveTuple{}, false
+	}
+	return FiveTuple{
+		Proto: layers.IPProtocolTCP,
+		Src:   netip.AddrPortFrom(src.Unmap(), uint16(tcp.SrcPort)),
+		Dst:   netip.AddrPortFrom(dst.Unmap(), uint16(tcp.DstPort)),
+	}, true
+}
+
+// noteSYN records the handshake of a connection if pkt, a TCP packet from a
+// node that's being intercepted, is its SYN.
+func (n *network) noteSYN(pkt gopacket.Packet) {
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || !tcp.SYN || tcp.ACK {
+		return
+	}
+	flow, ok := tcpFlowOf(pkt, tcp)
+	if !ok {
+		return
+	}
+	n.handshakeMu.Lock()
+	defer n.handshakeMu.Unlock()
+	if h := n.handshakeLocked(flow); h != nil {
+		h.SYN = tcpOptions(tcp) // a retransmitted SYN
+		return
+	}
+	if len(n.handshakes) >= maxHandshakes {
+		n.handshakes = n.handshakes[1:]
+	}
+	n.handshakes = append(n.handshakes, &TCPHandshake{Flow: flow, SYN: tcpOptions(tcp)})
+}
+
+// noteSYNACK records the SYN-ACK of a handshake noted by noteSYN if frame,
+// an Ethernet frame that the network's TCP stack sent to a node, is one.
+func (n *network) noteSYNACK(frame []byte) {
+	if !isTCPSYNFrame(frame) {
+		return
+	}
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || !tcp.SYN || !tcp.ACK {
+		return
+	}
+	flow, ok := tcpFlowOf(pkt, tcp)
+	if !ok {
+		return
+	}
+	flow.Src, flow.Dst = flow.Dst, flow.Src
+	n.handshakeMu.Lock()
+	defer n.handshakeMu.Unlock()
+	if h := n.handshakeLocked(flow); h != nil {
+		h.SYNACK = tcpOptions(tcp)
+		h.SYNACKSent = true
+	}
+}
+
+// handshakeLocked returns the most recent handshake of flow, or nil if none.
+// n.handshakeMu must be held.
+func (n *network) handshakeLocked(flow FiveTuple) *TCPHandshake {
+	for i := len(n.handshakes) - 1; i >= 0; i-- {
+		if h := n.handshakes[i]; h.Flow == flow {
+			return h
+		}
+	}
+	return nil
+}
+
+// isTCPSYNFrame reports whether frame is an Ethernet frame of an IP packet
+// carrying a TCP segment with the SYN flag set, without fully decoding it.
+func isTCPSYNFrame(frame []byte) bool {
+	const ethLen = 14
+	if len(frame) <= ethLen {
+		return false
+	}
+	ip := frame[ethLen:]
+	var tcp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		hdrLen := int(ip[0]&0x0f) * 4
+		if len(ip) < 20 || ip[9] != byte(layers.IPProtocolTCP) || len(ip) < hdrLen {
+			return false
+		}
+		tcp = ip[hdrLen:]
+	case 6:
+		if len(ip) < 40 || ip[6] != byte(layers.IPProtocolTCP) {
+			return false
+		}
+		tcp = ip[40:]
+	}
+	const synFlag = 0x02
+	return len(tcp) >= 14 && tcp[13]&synFlag != 0
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net/netip"
+	"slices"
+
+	"tailscale.com/net/tsaddr"
+)
+
+// isBogon reports whether ip is a source address that no packet from the
+// internet should have: a private, CGNAT, loopback, link-local, multicast
+// or otherwise non-global unicast address.
+func isBogon(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsGlobalUnicast() || ip.IsPrivate() || tsaddr.CGNATRange().Contains(ip)
+}
+
+// isOwnWANSource reports whether ip is a source address that packets n sends
+// to the internet may have: one of its WAN IPs, one of its nodes' public
+// IPs, or, if its LAN is routed, an IP on its LAN.
+func (n *network) isOwnWANSource(ip netip.Addr) bool {
+	if ip == n.wanIP || slices.Contains(n.extraWANs, ip) {
+		return true
+	}
+	if _, ok := n.publicIPs[ip]; ok {
+		return true
+	}
+	return n.natStyle.Load() == NoNAT && n.lanIP.Contains(ip)
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// internet is the virtual internet between the server's networks. Networks
+// are attached to it at their WAN IPs, at their nodes' public IPs and, for
+// NoNAT networks, at their LANs, and it routes packets to them by
+// destination. The server's in-process UDP services, such as STUN and NTP,
+// are on it too, answering at any address.
+//
+// It's set up by New and immutable after.
+type internet struct {
+	byAddr     map[netip.Addr]*network // by WAN IP or node public IP
+	routedLANs []*network              // NoNAT networks, whose LAN IPs are public
+	services   map[uint16]udpService   // by UDP port
+}
+
+// udpService is an in-process UDP service on the internet. It returns its
+// reply to req, if any.
+type udpService func(req UDPPacket) (res UDPPacket, ok bool)
+
+// attach attaches network n to the internet at ip, a WAN IP of n or a public
+// IP of one of its nodes.
+func (in *internet) attach(ip netip.Addr, n *network) error {
+	if _, ok := in.byAddr[ip]; ok {
+		return fmt.Errorf("%v is already attached to the internet", ip)
+	}
+	in.byAddr[ip] = n
+	return nil
+}
+
+// attachLAN attaches the LAN of n, a NoNAT network, to the internet.
+func (in *internet) attachLAN(n *network) {
+	in.routedLANs = append(in.routedLANs, n)
+}
+
+// addService adds f as the service for UDP packets to port at any address.
+func (in *internet) addService(port uint16, f udpService) {
+	in.services[port] = f
+}
+
+// networkAt returns the network attached at ip, one of its WAN IPs or a
+// public IP of one of its nodes.
+func (in *internet) networkAt(ip netip.Addr) (_ *network, ok bool) {
+	n, ok := in.byAddr[ip]
+	return n, ok
+}
+
+// route returns the network that packets to ip are routed to: the network
+// attached at ip, or else the NoNAT network whose LAN contains ip.
+func (in *internet) route(ip netip.Addr) (_ *network, ok bool) {
+	if n, ok := in.byAddr[ip]; ok {
+		return n, true
+	}
+	for _, n := range in.routedLANs {
+		if n.lanIP.Contains(ip) {
+			return n, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,266 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// duplicateDelay is how long after the original a duplicated packet is
+// delivered.
+const duplicateDelay = time.Millisecond
+
+// Bounds on the packets a network holds back for reordering.
+const (
+	maxHeldPackets = 16
+	maxHoldTime    = 10 * time.Millisecond
+)
+
+// deliverFromWAN delivers p, which arrived at the network's WAN IP from the
+// internet, through the network's bandwidth throttle, if any, and then over
+// its link.
+func (n *network) deliverFromWAN(p UDPPacket) {
+	if n.throttle != nil {
+		n.throttle.enqueue(p)
+		return
+	}
+	n.deliverOverLink(p)
+}
+
+// deliverOverLink delivers p after the network's configured latency, maybe
+// again shortly after per its configured duplication, and maybe out of order
+// per its configured reordering.
+func (n *network) deliverOverLink(p UDPPacket) {
+	if n.latency == 0 && n.duplication == 0 && n.reordering == 0 {
+		n.HandleUDPPacket(p)
+		return
+	}
+	p.Payload = bytes.Clone(p.Payload) // may alias a buffer the sender reuses
+	if n.latency > 0 {
+		p.sent = n.s.clock.Now()
+	}
+	n.deliverFromWANAfter(p, n.linkDelay())
+	if n.duplication > 0 && n.s.rand.Float64() < n.duplication {
+		n.deliverFromWANAfter(p, n.linkDelay()+duplicateDelay)
+	}
+}
+
+func (n *network) deliverFromWANAfter(p UDPPacket, d time.Duration) {
+	if d == 0 {
+		n.deliverMaybeReordered(p)
+		return
+	}
+	n.s.afterFunc(d, func() { n.deliverMaybeReordered(p) })
+}
+
+// deliverMaybeReordered either holds p back to be delivered after the next
+// packet, or delivers it followed by any packets held back before it.
+func (n *network) deliverMaybeReordered(p UDPPacket) {
+	if n.reordering == 0 {
+		n.HandleUDPPacket(p)
+		return
+	}
+	n.holdMu.Lock()
+	if len(n.held) < maxHeldPackets && n.s.rand.Float64() < n.reordering {
+		n.held = append(n.held, p)
+		if len(n.held) == 1 {
+			if n.holdTimer == nil {
+				n.holdTimer = n.s.afterFunc(maxHoldTime, n.releaseHeld)
+			} else {
+				n.holdTimer.Reset(maxHoldTime)
+			}
+		}
+		n.holdMu.Unlock()
+		return
+	}
+	held := n.takeHeldLocked()
+	n.holdMu.Unlock()
+
+	n.HandleUDPPacket(p)
+	for _, p := range held {
+		n.HandleUDPPacket(p)
+	}
+}
+
+// releaseHeld delivers the packets held back for reordering that no packet
+// has overtaken within maxHoldTime.
+func (n *network) releaseHeld() {
+	n.holdMu.Lock()
+	held := n.takeHeldLocked()
+	n.holdMu.Unlock()
+	for _, p := range held {
+		n.HandleUDPPacket(p)
+	}
+}
+
+// takeHeldLocked returns and clears the packets held back for reordering.
+// n.holdMu must be held.
+func (n *network) takeHeldLocked() []UDPPacket {
+	held := n.held
+	n.held = nil
+	if n.holdTimer != nil {
+		n.holdTimer.Stop()
+	}
+	return held
+}
+
+// linkDelay returns a random delay for a packet arriving from the internet,
+// per the network's configured latency and jitter.
+func (n *network) linkDelay() time.Duration {
+	d := n.latency
+	if n.jitter > 0 {
+		d += time.Duration(n.s.rand.Int64N(int64(2*n.jitter+1))) - n.jitter
+	}
+	return d
+}
+
+// dnsDelay returns a random delay for a DNS response, per the configured
+// DNSLatency.
+func (s *Server) dnsDelay() time.Duration {
+	l := s.dnsLatency
+	if l.Max > 0 {
+		return l.Min + time.Duration(s.rand.Int64N(int64(l.Max-l.Min)+1))
+	}
+	if l.StdDev == 0 {
+		return l.Mean
+	}
+	return max(0, l.Mean+time.Duration(s.rand.NormFloat64()*float64(l.StdDev)))
+}
+
+// lockedSource is a [rand.Source] that's safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+// NodePair is a source and destination node, by MAC.
+type NodePair struct {
+	Src, Dst MAC
+}
+
+// latencyBucketBounds are the upper bounds of the buckets of a
+// LatencyHistogram, other than its last.
+var latencyBucketBounds = func() []time.Duration {
+	var ret []time.Duration
+	for d := 5 * time.Millisecond; d <= 100*time.Millisecond; d += 5 * time.Millisecond {
+		ret = append(ret, d)
+	}
+	for _, ms := range []int{150, 200, 300, 500, 1000, 2000} {
+		ret = append(ret, time.Duration(ms)*time.Millisecond)
+	}
+	return ret
+}()
+
+// LatencyHistogram is a histogram of the latencies of delivered packets.
+type LatencyHistogram struct {
+	// Buckets are the histogram's buckets, in increasing order of Le.
+	Buckets []LatencyBucket
+
+	Count int
+	Sum   time.Duration
+	Min   time.Duration
+	Max   time.Duration
+
+	sumSquares float64 // of latencies in seconds, for StdDev
+}
+
+// LatencyBucket is a bucket of a LatencyHistogram.
+type LatencyBucket struct {
+	// Le is the bucket's inclusive upper bound, above the previous
+	// bucket's. The last bucket's Le is the maximum Duration.
+	Le time.Duration
+
+	// Count is the number of latencies in the bucket.
+	Count int
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	h := &LatencyHistogram{}
+	for _, le := range latencyBucketBounds {
+		h.Buckets = append(h.Buckets, LatencyBucket{Le: le})
+	}
+	h.Buckets = append(h.Buckets, LatencyBucket{Le: math.MaxInt64})
+	return h
+}
+
+func (h *LatencyHistogram) add(d time.Duration) {
+	for i := range h.Buckets {
+		if d <= h.Buckets[i].Le {
+			h.Buckets[i].Count++
+			break
+		}
+	}
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Sum += d
+	h.sumSquares += d.Seconds() * d.Seconds()
+}
+
+// Mean returns the mean latency, or zero if h is empty.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// StdDev returns the standard deviation of the latencies, or zero if h is
+// empty.
+func (h *LatencyHistogram) StdDev() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	mean := h.Mean().Seconds()
+	v := h.sumSquares/float64(h.Count) - mean*mean
+	return time.Duration(math.Sqrt(max(v, 0)) * float64(time.Second))
+}
+
+func (h *LatencyHistogram) clone() *LatencyHistogram {
+	h2 := *h
+	h2.Buckets = append([]LatencyBucket(nil), h.Buckets...)
+	return &h2
+}
+
+// recordLatency records the latency d of a packet delivered between pair.
+func (s *Server) recordLatency(pair NodePair, d time.Duration) {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	h, ok := s.latencyStats[pair]
+	if !ok {
+		h = newLatencyHistogram()
+		mak.Set(&s.latencyStats, pair, h)
+	}
+	h.add(d)
+}
+
+// LatencyStats returns histograms of the latencies of packets delivered
+// between each pair of nodes, from when the packet left the source node's
+// network to when it was delivered to the destination node. Only packets to
+// networks with a latency set by [Network.SetLatency] are measured.
+func (s *Server) LatencyStats() map[NodePair]*LatencyHistogram {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	ret := make(map[NodePair]*LatencyHistogram, len(s.latencyStats))
+	for pair, h := range s.latencyStats {
+		ret[pair] = h.clone()
+	}
+	return ret
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"slices"
+)
+
+// WarningKind is the kind of likely mistake that a [Warning] is about.
+type WarningKind string
+
+const (
+	// WarnNodeWithoutNetwork is a node that isn't attached to any network,
+	// so it can't reach anything.
+	WarnNodeWithoutNetwork WarningKind = "node without network"
+
+	// WarnNetworkWithoutNodes is a network that no node is attached to.
+	WarnNetworkWithoutNodes WarningKind = "network without nodes"
+
+	// WarnNoPath is a pair of nodes behind hard (symmetric) NATs with no
+	// DERP region configured, so they can't reach each other directly or
+	// via DERP.
+	WarnNoPath WarningKind = "no path between nodes"
+
+	// WarnServiceWithoutWANIP is a network with a service, such as a port
+	// mapping protocol, but no WAN IP for the service to use.
+	WarnServiceWithoutWANIP WarningKind = "service without WAN IP"
+)
+
+// Warning is a likely mistake in a Config, as found by [Config.Lint].
+type Warning struct {
+	Kind WarningKind
+	Msg  string // describes the mistake, naming the nodes or networks involved
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Kind, w.Msg)
+}
+
+// Lint returns warnings about likely mistakes in c that aren't errors, such
+// as a node that can't reach any other, to catch test setup mistakes early.
+// It only knows about DERP maps set with [Config.SetDERPMap], not ones added
+// later with [Server.PopulateDERPMapIPs].
+func (c *Config) Lint() []Warning {
+	var ws []Warning
+	warn := func(kind WarningKind, format string, args ...any) {
+		ws = append(ws, Warning{Kind: kind, Msg: fmt.Sprintf(format, args...)})
+	}
+	for _, n := range c.nodes {
+		if len(n.nets) == 0 {
+			warn(WarnNodeWithoutNetwork, "node %v is on no network", n.mac)
+		}
+	}
+	for _, n := range c.networks {
+		if len(n.nodes) == 0 {
+			warn(WarnNetworkWithoutNodes, "network %v has no nodes", c.networkName(n))
+		}
+		if len(n.svcs) > 0 && !n.wanIP.IsValid() {
+			svcs := n.svcs.Slice()
+			slices.Sort(svcs)
+			warn(WarnServiceWithoutWANIP, "network %v has services %v but no WAN IP", c.networkName(n), svcs)
+		}
+	}
+	if !c.hasDERPRegion() {
+		var hard []*Node // nodes behind hard NATs
+		for _, n := range c.nodes {
+			if nw := n.Network(); nw != nil && nw.natType == HardNAT {
+				hard = append(hard, n)
+			}
+		}
+		for i, a := range hard {
+			for _, b := range hard[i+1:] {
+				if a.Network() != b.Network() {
+					warn(WarnNoPath, "nodes %v and %v are both behind hard NATs and no DERP region is configured", a.mac, b.mac)
+				}
+			}
+		}
+	}
+	return ws
+}
+
+// networkName returns a name for n in Lint warnings: its WAN IP or, if it
+// has none, its LAN prefix or index.
+func (c *Config) networkName(n *Network) string {
+	switch {
+	case n.wanIP.IsValid():
+		return n.wanIP.String()
+	case n.lanIP.IsValid():
+		return n.lanIP.String()
+	}
+	return fmt.Sprintf("#%d", slices.Index(c.networks, n))
+}
+
+// hasDERPRegion reports whether c's DERP map has a region with a node.
+func (c *Config) hasDERPRegion() bool {
+	if c.derpMap == nil {
+		return false
+	}
+	for _, r := range c.derpMap.Regions {
+		if r != nil && len(r.Nodes) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// logRing is a fixed-size ring buffer of the most recent log lines.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string // len is the capacity
+	next  int      // index in lines of the next line to write
+	n     int      // number of lines written, up to len(lines)
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size)}
+}
+
+func (r *logRing) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	r.n = min(r.n+1, len(r.lines))
+}
+
+// last returns the last n lines, oldest first.
+func (r *logRing) last(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n = min(n, r.n)
+	ret := make([]string, 0, n)
+	for i := range n {
+		ret = append(ret, r.lines[(r.next-n+i+len(r.lines))%len(r.lines)])
+	}
+	return ret
+}
+
+// logf logs a line with the server's logger, and keeps it for RecentLogs if
+// the server has a log ring (see Config.LogRingSize).
+func (s *Server) logf(format string, args ...any) {
+	s.baseLogf(format, args...)
+	if s.logRing != nil {
+		s.logRing.add(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+	}
+}
+
+// RecentLogs returns up to the last n lines the server logged, oldest first.
+// It returns nil unless Config.LogRingSize is set, and only the last
+// LogRingSize lines are kept.
+func (s *Server) RecentLogs(n int) []string {
+	if s.logRing == nil || n <= 0 {
+		return nil
+	}
+	return s.logRing.last(n)
+}
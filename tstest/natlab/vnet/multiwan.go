@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"hash/fnv"
+	"net/netip"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// WANPolicy is how a network with multiple WAN IPs picks the WAN IP of
+// outgoing traffic. See Network.SetWANPolicy.
+type WANPolicy string
+
+const (
+	// SpreadPerFlow spreads traffic across the WAN IPs by flow: each LAN
+	// source and WAN destination pair gets a WAN IP by hash, so one LAN
+	// socket's flows to different destinations may leave from different
+	// WAN IPs, like a load balancer hashing the 5-tuple. It's the default.
+	SpreadPerFlow WANPolicy = "flow"
+
+	// StickyPerLANSocket keeps all of a LAN socket's flows on one WAN IP:
+	// the first flow from a LAN ip:port is assigned the next WAN IP in turn,
+	// and all its later flows, to any destination, use the same one. This
+	// is what protocols that key peers on the UDP 4-tuple, like WireGuard,
+	// need of a multi-WAN router.
+	StickyPerLANSocket WANPolicy = "socket"
+)
+
+// wanPool is an IPPool for one of the WAN IPs of a network with multiple
+// WAN IPs, so that each WAN IP's NAT table allocates its mappings on it.
+type wanPool struct {
+	IPPool
+	wan netip.Addr
+}
+
+// WANIP implements [IPPool].
+func (p wanPool) WANIP() netip.Addr { return p.wan }
+
+// multiWANNAT is the NAT of a network with multiple WAN IPs: a NAT table per
+// WAN IP, with outgoing traffic assigned to one of them by a WANPolicy and
+// incoming traffic handled by the table of the WAN IP it's addressed to.
+type multiWANNAT struct {
+	wans   []netip.Addr // in order, the primary WAN IP first
+	tables map[netip.Addr]NATTable
+	policy WANPolicy
+
+	sticky map[netip.AddrPort]netip.Addr // LAN socket to WAN IP, for StickyPerLANSocket
+	next   int                           // index into wans of the next socket's WAN IP
+}
+
+// newMultiWANNAT returns a NAT for the WAN IPs wans, using newTable to make
+// each WAN IP's table from pool.
+func newMultiWANNAT(pool IPPool, wans []netip.Addr, policy WANPolicy, newTable newTableFunc) (*multiWANNAT, error) {
+	n := &multiWANNAT{
+		wans:   wans,
+		tables: make(map[netip.Addr]NATTable, len(wans)),
+		policy: policy,
+	}
+	for _, wan := range wans {
+		t, err := newTable(wanPool{pool, wan})
+		if err != nil {
+			return nil, err
+		}
+		n.tables[wan] = t
+	}
+	return n, nil
+}
+
+// pickWAN returns the WAN IP for a packet from the LAN address src to dst.
+func (n *multiWANNAT) pickWAN(src, dst netip.AddrPort) netip.Addr {
+	if n.policy == StickyPerLANSocket {
+		if wan, ok := n.sticky[src]; ok {
+			return wan
+		}
+		wan := n.wans[n.next%len(n.wans)]
+		n.next++
+		mak.Set(&n.sticky, src, wan)
+		return wan
+	}
+	// Hash rather than use the seeded rand, so a flow keeps its WAN IP.
+	h := fnv.New32a()
+	b, _ := src.MarshalBinary()
+	h.Write(b)
+	b, _ = dst.MarshalBinary()
+	h.Write(b)
+	return n.wans[h.Sum32()%uint32(len(n.wans))]
+}
+
+func (n *multiWANNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
+	return n.tables[n.pickWAN(src, dst)].PickOutgoingSrc(src, dst, at)
+}
+
+func (n *multiWANNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	t, ok := n.tables[dst.Addr()]
+	if !ok {
+		return netip.AddrPort{} // drop; not for us
+	}
+	return t.PickIncomingDst(src, dst, at)
+}
+
+func (n *multiWANNAT) PeekIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	t, ok := n.tables[dst.Addr()]
+	if !ok {
+		return netip.AddrPort{} // drop; not for us
+	}
+	return t.PeekIncomingDst(src, dst, at)
+}
+
+func (n *multiWANNAT) RemoveLANHost(lanIP netip.Addr) {
+	for _, t := range n.tables {
+		t.RemoveLANHost(lanIP)
+	}
+	for src := range n.sticky {
+		if src.Addr() == lanIP {
+			delete(n.sticky, src)
+		}
+	}
+}
+
+func (n *multiWANNAT) RenameLANHost(old, new netip.Addr) {
+	for _, t := range n.tables {
+		t.RenameLANHost(old, new)
+	}
+	for src, wan := range n.sticky {
+		if src.Addr() == old {
+			delete(n.sticky, src)
+			n.sticky[netip.AddrPortFrom(new, src.Port())] = wan
+		}
+	}
+}
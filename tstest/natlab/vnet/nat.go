@@ -7,15 +7,19 @@
 	"errors"
 	"math/rand/v2"
 	"net/netip"
+	"slices"
 	"time"
 
+	"tailscale.com/types/logger"
 	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
 )
 
 const (
 	One2OneNAT NAT = "one2one"
 	EasyNAT    NAT = "easy"
 	HardNAT    NAT = "hard"
+	NoNAT      NAT = "none"
 )
 
 // IPPool is the interface that a NAT implementation uses to get information
@@ -25,16 +29,133 @@
 type IPPool interface {
 	// WANIP returns the primary WAN IP address.
 	//
-	// TODO: add another method for networks with multiple WAN IP addresses.
+	// On a network with multiple WAN IP addresses, each WAN IP address gets
+	// its own NAT table, whose IPPool returns that address.
 	WANIP() netip.Addr
 
 	// SoleLanIP reports whether this network has a sole LAN client
 	// and if so, its IP address.
 	SoleLANIP() (_ netip.Addr, ok bool)
 
+	// Rand returns the source of randomness to use, such as for picking
+	// ports. It's safe for concurrent use.
+	Rand() *rand.Rand
+
+	// MappingTimeout returns how long a mapping may be idle before it
+	// expires, or zero if mappings never expire.
+	MappingTimeout() time.Duration
+
+	// PortAllocation returns how new mappings' WAN ports are picked and,
+	// for SequentialPorts, the first port.
+	PortAllocation() (_ PortAllocation, basePort uint16)
+
+	// MaxFlows returns the most mappings the NAT table may hold, or zero
+	// for no limit, and what it does with new flows when full.
+	MaxFlows() (max int, policy FlowLimitPolicy)
+
 	// TODO: port availability stuff for interacting with portmapping
 }
 
+// PortAllocation is how a NAT picks the WAN ports of new mappings. See
+// Network.SetPortAllocation.
+type PortAllocation string
+
+const (
+	// RandomPorts picks ports at random, from the server's source of
+	// randomness, among the high ports 32768 to 65535. It's the default.
+	RandomPorts PortAllocation = "random"
+
+	// SequentialPorts picks ports in order, from a base port up, skipping
+	// those in use and wrapping around after 65535 to the base port, so
+	// tests can predict which port each new mapping gets.
+	SequentialPorts PortAllocation = "sequential"
+)
+
+// FlowLimitPolicy is what a NAT whose table holds a limited number of flows
+// does with a new flow when the table is full, like a cheap router with a
+// small conntrack table. See Network.SetMaxFlows.
+type FlowLimitPolicy string
+
+const (
+	// RejectNewFlows drops the packets of new flows, reported with
+	// [DropNATTableFull], until a mapping expires or is removed. It's the
+	// default.
+	RejectNewFlows FlowLimitPolicy = "reject"
+
+	// EvictOldestFlow removes the least recently used mapping to make room
+	// for the new flow, breaking the flow that used it.
+	EvictOldestFlow FlowLimitPolicy = "evict-oldest"
+)
+
+// flowLimit is the limit on the flows of a NAT table, from its IPPool's
+// MaxFlows.
+type flowLimit struct {
+	max    int // or 0 for no limit
+	policy FlowLimitPolicy
+}
+
+func newFlowLimit(p IPPool) flowLimit {
+	max, policy := p.MaxFlows()
+	return flowLimit{max: max, policy: policy}
+}
+
+// makeRoom reports whether a table with the given number of flows may add
+// another, after calling purgeExpired and, if the table is still full and
+// the policy allows it, evictOldest. Both must remove mappings from the
+// table so that flows reports fewer.
+func (l flowLimit) makeRoom(flows func() int, purgeExpired, evictOldest func()) bool {
+	if l.max <= 0 || flows() < l.max {
+		return true
+	}
+	purgeExpired()
+	if flows() < l.max {
+		return true
+	}
+	if l.policy != EvictOldestFlow {
+		return false
+	}
+	evictOldest()
+	return flows() < l.max
+}
+
+// portAllocator picks the WAN ports of a NAT table's new mappings, as set by
+// its IPPool's PortAllocation. Ports are identified by their offset from lo,
+// wrapping around after size.
+type portAllocator struct {
+	rand       *rand.Rand
+	sequential bool
+	lo, size   int
+	next       int // for sequential, the offset of the next port to try
+}
+
+func newPortAllocator(p IPPool) *portAllocator {
+	a := &portAllocator{rand: p.Rand(), lo: 32 << 10, size: 32 << 10}
+	if mode, base := p.PortAllocation(); mode == SequentialPorts {
+		a.sequential = true
+		a.lo = int(base)
+		a.size = 1<<16 - a.lo
+	}
+	return a
+}
+
+// start returns the offset of the first port to try for a new mapping.
+func (a *portAllocator) start() int {
+	if a.sequential {
+		return a.next
+	}
+	return a.rand.IntN(a.size)
+}
+
+// port returns the port at offset off.
+func (a *portAllocator) port(off int) uint16 {
+	return uint16(a.lo + off%a.size)
+}
+
+// used records that the port at offset off was allocated.
+func (a *portAllocator) used(off int) {
+	a.next = (off + 1) % a.size
+}
+
 // newTableFunc is a constructor for a NAT table.
 // The provided IPPool is typically (outside of tests) a *network.
 type newTableFunc func(IPPool) (NATTable, error)
@@ -85,6 +206,19 @@ type NATTable interface {
 	// address of a machine on the local network address, usually a private
 	// LAN IP.
 	PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort)
+
+	// PeekIncomingDst is like PickIncomingDst but only reports what it would
+	// return, without side effects such as creating or refreshing mappings.
+	PeekIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort)
+
+	// RemoveLANHost removes any mappings for the given LAN IP, such as
+	// when that host leaves the network.
+	RemoveLANHost(lanIP netip.Addr)
+
+	// RenameLANHost moves any mappings for the LAN IP old to the LAN IP new,
+	// such as when that host is given a new address by DHCP, so their return
+	// traffic goes to the host at its new address.
+	RenameLANHost(old, new netip.Addr)
 }
 
 // oneToOneNAT is a 1:1 NAT, like a typical EC2 VM.
@@ -108,14 +242,59 @@ func (n *oneToOneNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wa
 }
 
 func (n *oneToOneNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	return n.PeekIncomingDst(src, dst, at)
+}
+
+func (n *oneToOneNAT) PeekIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
 	return netip.AddrPortFrom(n.lanIP, dst.Port())
 }
 
+func (n *oneToOneNAT) RemoveLANHost(lanIP netip.Addr) {
+	// No state to remove. The NAT is bound to its sole LAN IP for life.
+}
+
+func (n *oneToOneNAT) RenameLANHost(old, new netip.Addr) {
+	if n.lanIP == old {
+		n.lanIP = new
+	}
+}
+
+// noNAT doesn't translate addresses at all: the network's LAN addresses are
+// public and routed to it from the internet, like a server in a data center.
+type noNAT struct{}
+
+func init() {
+	registerNATType(NoNAT, func(IPPool) (NATTable, error) {
+		return noNAT{}, nil
+	})
+}
+
+func (noNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
+	return src
+}
+
+func (noNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	return dst
+}
+
+func (noNAT) PeekIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	return dst
+}
+
+func (noNAT) RemoveLANHost(lanIP netip.Addr)    {}
+func (noNAT) RenameLANHost(old, new netip.Addr) {}
+
 type hardKeyOut struct {
 	lanIP netip.Addr
 	dst   netip.AddrPort
 }
 
+// expired reports whether a mapping last used at last has expired at time at,
+// given the NAT's mapping timeout, which is zero for never.
+func expired(last, at time.Time, timeout time.Duration) bool {
+	return timeout > 0 && at.Sub(last) >= timeout
+}
+
 type hardKeyIn struct {
 	wanPort uint16
 	src     netip.AddrPort
@@ -135,7 +314,10 @@ type lanAddrAndTime struct {
 // This is shown as "MappingVariesByDestIP: true" by netcheck, and what
 // Tailscale calls "Hard NAT".
 type hardNAT struct {
-	wanIP netip.Addr
+	wanIP   netip.Addr
+	ports   *portAllocator
+	timeout time.Duration // or 0 for mappings that never expire
+	limit   flowLimit
 
 	out map[hardKeyOut]portMappingAndTime
 	in  map[hardKeyIn]lanAddrAndTime
@@ -143,50 +325,127 @@ type hardNAT struct {
 
 func init() {
 	registerNATType(HardNAT, func(p IPPool) (NATTable, error) {
-		return &hardNAT{wanIP: p.WANIP()}, nil
+		return &hardNAT{wanIP: p.WANIP(), ports: newPortAllocator(p), timeout: p.MappingTimeout(), limit: newFlowLimit(p)}, nil
 	})
 }
 
 func (n *hardNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
 	ko := hardKeyOut{src.Addr(), dst}
 	if pm, ok := n.out[ko]; ok {
-		// Existing flow.
-		// TODO: bump timestamp
-		return netip.AddrPortFrom(n.wanIP, pm.port)
+		ki := hardKeyIn{wanPort: pm.port, src: dst}
+		if !expired(pm.at, at, n.timeout) {
+			// Existing flow.
+			n.out[ko] = portMappingAndTime{port: pm.port, at: at}
+			n.in[ki] = lanAddrAndTime{lanAddr: n.in[ki].lanAddr, at: at}
+			return netip.AddrPortFrom(n.wanIP, pm.port)
+		}
+		delete(n.out, ko)
+		delete(n.in, ki)
 	}
 
 	// No existing mapping exists. Create one.
-
-	// TODO: clean up old expired mappings
+	if !n.limit.makeRoom(func() int { return len(n.out) }, func() { n.purgeExpired(at) }, n.evictOldest) {
+		return netip.AddrPort{} // table full
+	}
 
 	// Instead of proper data structures that would be efficient, we instead
 	// just loop a bunch and look for a free port. This project is only used
 	// by tests and doesn't care about performance, this is good enough.
-	for {
-		port := rand.N(uint16(32<<10)) + 32<<10 // pick some "ephemeral" port
+	start := n.ports.start()
+	for i := 0; ; i++ {
+		off := start + i
+		if !n.ports.sequential && i > 0 {
+			off = n.ports.start() // try another random port
+		}
+		port := n.ports.port(off)
 		ki := hardKeyIn{wanPort: port, src: dst}
-		if _, ok := n.in[ki]; ok {
-			// Port already in use.
-			continue
+		if la, ok := n.in[ki]; ok {
+			if !expired(la.at, at, n.timeout) {
+				// Port already in use.
+				continue
+			}
+			delete(n.out, hardKeyOut{la.lanAddr.Addr(), dst})
 		}
 		mak.Set(&n.in, ki, lanAddrAndTime{lanAddr: src, at: at})
 		mak.Set(&n.out, ko, portMappingAndTime{port: port, at: at})
+		n.ports.used(off)
 		return netip.AddrPortFrom(n.wanIP, port)
 	}
 }
 
+// purgeExpired removes the mappings that have expired at time at.
+func (n *hardNAT) purgeExpired(at time.Time) {
+	for ko, pm := range n.out {
+		if expired(pm.at, at, n.timeout) {
+			delete(n.out, ko)
+			delete(n.in, hardKeyIn{wanPort: pm.port, src: ko.dst})
+		}
+	}
+}
+
+// evictOldest removes the least recently used mapping.
+func (n *hardNAT) evictOldest() {
+	var oldest hardKeyOut
+	var oldestPM portMappingAndTime
+	found := false
+	for ko, pm := range n.out {
+		if !found || pm.at.Before(oldestPM.at) || (pm.at.Equal(oldestPM.at) && pm.port < oldestPM.port) {
+			oldest, oldestPM, found = ko, pm, true
+		}
+	}
+	if found {
+		delete(n.out, oldest)
+		delete(n.in, hardKeyIn{wanPort: oldestPM.port, src: oldest.dst})
+	}
+}
+
 func (n *hardNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	lanDst = n.PeekIncomingDst(src, dst, at)
+	if lanDst.IsValid() {
+		// Return traffic keeps the mapping alive.
+		ki := hardKeyIn{wanPort: dst.Port(), src: src}
+		n.in[ki] = lanAddrAndTime{lanAddr: lanDst, at: at}
+		n.out[hardKeyOut{lanDst.Addr(), src}] = portMappingAndTime{port: dst.Port(), at: at}
+	}
+	return lanDst
+}
+
+func (n *hardNAT) PeekIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
 	if dst.Addr() != n.wanIP {
 		return netip.AddrPort{} // drop; not for us. shouldn't happen if natlabd routing isn't broken.
 	}
 	ki := hardKeyIn{wanPort: dst.Port(), src: src}
-	if pm, ok := n.in[ki]; ok {
+	if pm, ok := n.in[ki]; ok && !expired(pm.at, at, n.timeout) {
 		// Existing flow.
 		return pm.lanAddr
 	}
 	return netip.AddrPort{} // drop; no mapping
 }
 
+func (n *hardNAT) RemoveLANHost(lanIP netip.Addr) {
+	for ko, pm := range n.out {
+		if ko.lanIP == lanIP {
+			delete(n.out, ko)
+			delete(n.in, hardKeyIn{wanPort: pm.port, src: ko.dst})
+		}
+	}
+}
+
+func (n *hardNAT) RenameLANHost(old, new netip.Addr) {
+	for ko, pm := range n.out {
+		if ko.lanIP != old {
+			continue
+		}
+		delete(n.out, ko)
+		n.out[hardKeyOut{lanIP: new, dst: ko.dst}] = pm
+		ki := hardKeyIn{wanPort: pm.port, src: ko.dst}
+		if la, ok := n.in[ki]; ok {
+			la.lanAddr = netip.AddrPortFrom(new, la.lanAddr.Port())
+			n.in[ki] = la
+		}
+	}
+}
+
 // easyNAT is an "Endpoint Independent" NAT, like Linux and most home routers
 // (many of which are Linux).
 //
@@ -196,44 +455,350 @@ func (n *hardNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst
 // Unlike Linux, this implementation is capped at 32k entries and doesn't resort
 // to other allocation strategies when all 32k WAN ports are taken.
 type easyNAT struct {
-	wanIP netip.Addr
-	out   map[netip.AddrPort]portMappingAndTime
-	in    map[uint16]lanAddrAndTime
+	wanIP   netip.Addr
+	ports   *portAllocator
+	timeout time.Duration // or 0 for mappings that never expire
+	limit   flowLimit
+	out     map[netip.AddrPort]portMappingAndTime
+	in      map[uint16]lanAddrAndTime
 }
 
 func init() {
 	registerNATType(EasyNAT, func(p IPPool) (NATTable, error) {
-		return &easyNAT{wanIP: p.WANIP()}, nil
+		return &easyNAT{wanIP: p.WANIP(), ports: newPortAllocator(p), timeout: p.MappingTimeout(), limit: newFlowLimit(p)}, nil
 	})
 }
 
 func (n *easyNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
 	if pm, ok := n.out[src]; ok {
-		// Existing flow.
-		// TODO: bump timestamp
-		return netip.AddrPortFrom(n.wanIP, pm.port)
+		if !expired(pm.at, at, n.timeout) {
+			// Existing flow.
+			n.out[src] = portMappingAndTime{port: pm.port, at: at}
+			n.in[pm.port] = lanAddrAndTime{lanAddr: src, at: at}
+			return netip.AddrPortFrom(n.wanIP, pm.port)
+		}
+		delete(n.out, src)
+		delete(n.in, pm.port)
+	}
+	if !n.limit.makeRoom(func() int { return len(n.out) }, func() { n.purgeExpired(at) }, n.evictOldest) {
+		return netip.AddrPort{} // table full
 	}
 
-	// Loop through all 32k high (ephemeral) ports, starting at a random
-	// position and looping back around to the start.
-	start := rand.N(uint16(32 << 10))
-	for off := range uint16(32 << 10) {
-		port := 32<<10 + (start+off)%(32<<10)
-		if _, ok := n.in[port]; !ok {
+	// Loop through all the allocatable ports, starting at a random (or
+	// the next sequential) position and looping back around to the start.
+	start := n.ports.start()
+	for i := range n.ports.size {
+		off := start + i
+		port := n.ports.port(off)
+		la, ok := n.in[port]
+		if ok && expired(la.at, at, n.timeout) {
+			delete(n.out, la.lanAddr)
+			ok = false
+		}
+		if !ok {
 			wanAddr := netip.AddrPortFrom(n.wanIP, port)
 
 			// Found a free port.
 			mak.Set(&n.out, src, portMappingAndTime{port: port, at: at})
 			mak.Set(&n.in, port, lanAddrAndTime{lanAddr: src, at: at})
+			n.ports.used(off)
 			return wanAddr
 		}
 	}
 	return netip.AddrPort{} // failed to allocate a mapping; TODO: fire an alert?
 }
 
+// purgeExpired removes the mappings that have expired at time at.
+func (n *easyNAT) purgeExpired(at time.Time) {
+	for src, pm := range n.out {
+		if expired(pm.at, at, n.timeout) {
+			delete(n.out, src)
+			delete(n.in, pm.port)
+		}
+	}
+}
+
+// evictOldest removes the least recently used mapping.
+func (n *easyNAT) evictOldest() {
+	var oldest netip.AddrPort
+	var oldestPM portMappingAndTime
+	for src, pm := range n.out {
+		if !oldest.IsValid() || pm.at.Before(oldestPM.at) || (pm.at.Equal(oldestPM.at) && pm.port < oldestPM.port) {
+			oldest, oldestPM = src, pm
+		}
+	}
+	if oldest.IsValid() {
+		delete(n.out, oldest)
+		delete(n.in, oldestPM.port)
+	}
+}
+
 func (n *easyNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	lanDst = n.PeekIncomingDst(src, dst, at)
+	if lanDst.IsValid() {
+		// Return traffic keeps the mapping alive.
+		n.in[dst.Port()] = lanAddrAndTime{lanAddr: lanDst, at: at}
+		n.out[lanDst] = portMappingAndTime{port: dst.Port(), at: at}
+	}
+	return lanDst
+}
+
+func (n *easyNAT) PeekIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
 	if dst.Addr() != n.wanIP {
 		return netip.AddrPort{} // drop; not for us. shouldn't happen if natlabd routing isn't broken.
 	}
-	return n.in[dst.Port()].lanAddr
+	la, ok := n.in[dst.Port()]
+	if !ok || expired(la.at, at, n.timeout) {
+		return netip.AddrPort{} // drop; no mapping
+	}
+	return la.lanAddr
+}
+
+func (n *easyNAT) RemoveLANHost(lanIP netip.Addr) {
+	for src, pm := range n.out {
+		if src.Addr() == lanIP {
+			delete(n.out, src)
+			delete(n.in, pm.port)
+		}
+	}
+}
+
+func (n *easyNAT) RenameLANHost(old, new netip.Addr) {
+	for src, pm := range n.out {
+		if src.Addr() != old {
+			continue
+		}
+		newSrc := netip.AddrPortFrom(new, src.Port())
+		delete(n.out, src)
+		n.out[newSrc] = pm
+		if la, ok := n.in[pm.port]; ok {
+			la.lanAddr = newSrc
+			n.in[pm.port] = la
+		}
+	}
+}
+
+// churningNAT wraps a NATTable, flushing the mappings of a random subset of
+// its LAN hosts periodically, as if its state table churned. See
+// Network.SetNATChurn.
+type churningNAT struct {
+	NATTable
+	every time.Duration
+	frac  float64
+	rand  *rand.Rand
+
+	hosts set.Set[netip.Addr] // that may have mappings
+	next  time.Time           // of the next churn; zero until first used
+}
+
+// maybeChurn flushes the mappings of a random subset of the LAN hosts if a
+// churn is due at time at.
+func (n *churningNAT) maybeChurn(at time.Time) {
+	if n.next.IsZero() {
+		n.next = at.Add(n.every)
+		return
+	}
+	if at.Before(n.next) {
+		return
+	}
+	// However many intervals have passed, churn once.
+	for !at.Before(n.next) {
+		n.next = n.next.Add(n.every)
+	}
+
+	// Visit hosts in order so a seeded rand picks the same ones each run.
+	hosts := n.hosts.Slice()
+	slices.SortFunc(hosts, netip.Addr.Compare)
+	for _, h := range hosts {
+		if n.rand.Float64() < n.frac {
+			n.NATTable.RemoveLANHost(h)
+			n.hosts.Delete(h)
+		}
+	}
+}
+
+func (n *churningNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
+	n.maybeChurn(at)
+	wanSrc = n.NATTable.PickOutgoingSrc(src, dst, at)
+	if wanSrc.IsValid() {
+		n.hosts.Make()
+		n.hosts.Add(src.Addr())
+	}
+	return wanSrc
+}
+
+func (n *churningNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	n.maybeChurn(at)
+	return n.NATTable.PickIncomingDst(src, dst, at)
+}
+
+func (n *churningNAT) RemoveLANHost(lanIP netip.Addr) {
+	n.NATTable.RemoveLANHost(lanIP)
+	n.hosts.Delete(lanIP)
+}
+
+func (n *churningNAT) RenameLANHost(old, new netip.Addr) {
+	n.NATTable.RenameLANHost(old, new)
+	if n.hosts.Contains(old) {
+		n.hosts.Delete(old)
+		n.hosts.Add(new)
+	}
+}
+
+// portFlappingNAT wraps a NATTable, giving a random fraction of outgoing
+// packets a random WAN source port instead of their flow's mapped one, like a
+// misbehaving carrier NAT. See Network.SetNATPortFlapping.
+//
+// Return traffic to a flapped port is still let in: the port is remembered,
+// like a conntrack entry, for the remote address the packet went to.
+type portFlappingNAT struct {
+	NATTable
+	frac    float64
+	rand    *rand.Rand
+	timeout time.Duration // or 0 for flapped ports that never expire
+
+	flaps map[flapKey]lanAddrAndTime
+}
+
+type flapKey struct {
+	wanSrc netip.AddrPort // the flapped WAN address
+	dst    netip.AddrPort // on the WAN
+}
+
+func (n *portFlappingNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
+	wanSrc = n.NATTable.PickOutgoingSrc(src, dst, at)
+	if !wanSrc.IsValid() || n.rand.Float64() >= n.frac {
+		return wanSrc
+	}
+	port := uint16(n.rand.IntN(32<<10)) + 32<<10
+	wanSrc = netip.AddrPortFrom(wanSrc.Addr(), port)
+	mak.Set(&n.flaps, flapKey{wanSrc, dst}, lanAddrAndTime{lanAddr: src, at: at})
+	return wanSrc
+}
+
+func (n *portFlappingNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	if lanDst = n.NATTable.PickIncomingDst(src, dst, at); lanDst.IsValid() {
+		return lanDst
+	}
+	k := flapKey{dst, src}
+	la, ok := n.flaps[k]
+	if !ok {
+		return netip.AddrPort{}
+	}
+	if expired(la.at, at, n.timeout) {
+		delete(n.flaps, k)
+		return netip.AddrPort{}
+	}
+	n.flaps[k] = lanAddrAndTime{lanAddr: la.lanAddr, at: at}
+	return la.lanAddr
+}
+
+func (n *portFlappingNAT) PeekIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	if lanDst = n.NATTable.PeekIncomingDst(src, dst, at); lanDst.IsValid() {
+		return lanDst
+	}
+	if la, ok := n.flaps[flapKey{dst, src}]; ok && !expired(la.at, at, n.timeout) {
+		return la.lanAddr
+	}
+	return netip.AddrPort{}
+}
+
+func (n *portFlappingNAT) RemoveLANHost(lanIP netip.Addr) {
+	n.NATTable.RemoveLANHost(lanIP)
+	for k, la := range n.flaps {
+		if la.lanAddr.Addr() == lanIP {
+			delete(n.flaps, k)
+		}
+	}
+}
+
+func (n *portFlappingNAT) RenameLANHost(old, new netip.Addr) {
+	n.NATTable.RenameLANHost(old, new)
+	for k, la := range n.flaps {
+		if la.lanAddr.Addr() == old {
+			la.lanAddr = netip.AddrPortFrom(new, la.lanAddr.Port())
+			n.flaps[k] = la
+		}
+	}
+}
+
+// loggingNAT wraps a NATTable, logging each session it creates and closes
+// like a home router's NAT log. See Config.LogNAT.
+//
+// A session is a LAN source's flow to one WAN destination. It's closed when
+// its mapping no longer lets return traffic in, such as when the mapping
+// expires or is flushed, which is noticed the next time the NAT handles a
+// packet.
+type loggingNAT struct {
+	NATTable
+	wanIP netip.Addr
+	logf  logger.Logf
+
+	sessions map[natSessionKey]natSession
+	last     time.Time // of the most recent packet handled
+}
+
+type natSessionKey struct {
+	src netip.AddrPort // on the LAN
+	dst netip.AddrPort // on the WAN
+}
+
+type natSession struct {
+	wanSrc  netip.AddrPort
+	created time.Time
+}
+
+func (n *loggingNAT) logSession(event string, k natSessionKey, s natSession, at time.Time) {
+	n.logf("nat[%v]: session %s UDP %v -> %v via %v at %v", n.wanIP, event, k.src, k.dst, s.wanSrc, at.UTC().Format(time.RFC3339Nano))
+}
+
+// closeSessions logs and forgets the sessions whose mappings no longer
+// exist at time at.
+func (n *loggingNAT) closeSessions(at time.Time) {
+	for k, s := range n.sessions {
+		if n.NATTable.PeekIncomingDst(k.dst, s.wanSrc, at) != k.src {
+			n.logSession("closed", k, s, at)
+			delete(n.sessions, k)
+		}
+	}
+}
+
+func (n *loggingNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
+	n.last = at
+	wanSrc = n.NATTable.PickOutgoingSrc(src, dst, at)
+	n.closeSessions(at)
+	k := natSessionKey{src, dst}
+	if _, ok := n.sessions[k]; !ok && wanSrc.IsValid() {
+		s := natSession{wanSrc: wanSrc, created: at}
+		mak.Set(&n.sessions, k, s)
+		n.logSession("created", k, s, at)
+	}
+	return wanSrc
+}
+
+func (n *loggingNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	n.last = at
+	lanDst = n.NATTable.PickIncomingDst(src, dst, at)
+	n.closeSessions(at)
+	return lanDst
+}
+
+func (n *loggingNAT) RemoveLANHost(lanIP netip.Addr) {
+	n.NATTable.RemoveLANHost(lanIP)
+	for k, s := range n.sessions {
+		if k.src.Addr() == lanIP {
+			n.logSession("closed", k, s, n.last)
+			delete(n.sessions, k)
+		}
+	}
+}
+
+func (n *loggingNAT) RenameLANHost(old, new netip.Addr) {
+	n.NATTable.RenameLANHost(old, new)
+	for k, s := range n.sessions {
+		if k.src.Addr() == old {
+			delete(n.sessions, k)
+			n.sessions[natSessionKey{netip.AddrPortFrom(new, k.src.Port()), k.dst}] = s
+		}
+	}
 }
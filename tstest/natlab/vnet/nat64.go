@@ -0,0 +1,196 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/util/mak"
+)
+
+// nat64Key identifies a NAT64 session by its IPv4 flow: the router's LAN
+// IPv4 address and the port it translated the session to, and the IPv4
+// destination.
+type nat64Key struct {
+	lan, remote netip.AddrPort
+}
+
+// nat64Key6 identifies a NAT64 session by its IPv6 side: the node's IPv6
+// address and port, and the IPv4 destination.
+type nat64Key6 struct {
+	src6, remote netip.AddrPort
+}
+
+// nat64Session is a NAT64 session: a UDP flow from a node's IPv6 address to
+// an IPv4 destination. The router translates it to a flow from its own LAN
+// IPv4 address, so that it's NATed apart from the node's IPv4 flows, even
+// from the same port.
+type nat64Session struct {
+	key  nat64Key
+	src6 netip.AddrPort
+	at   time.Time // when last used, for the network's NAT timeout
+}
+
+// isNAT64Prefix reports whether p is usable as a DNS64 or NAT64 prefix: an
+// IPv6 /96, in whose last 32 bits IPv4 addresses are embedded.
+func isNAT64Prefix(p netip.Prefix) bool {
+	return p.Addr().Is6() && !p.Addr().Is4In6() && p.Bits() == 96
+}
+
+// nat64Addr returns the IPv4 address embedded in ip, an address in a NAT64
+// prefix.
+func nat64Addr(ip netip.Addr) netip.Addr {
+	a := ip.As16()
+	return netip.AddrFrom4([4]byte(a[12:]))
+}
+
+// handleNAT64Out handles an IPv6 packet that a node sent to the router. If
+// it's a UDP packet to the network's NAT64 prefix, it's translated to IPv4
+// from the router's LAN IPv4 address and forwarded, so it's NATed as usual,
+// and the session is recorded so that replies are translated back. Other
+// IPv6 packets are dropped.
+func (n *network) handleNAT64Out(ep EthernetPacket) {
+	ip6, ok := ep.gp.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		return
+	}
+	udp, ok := ep.gp.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		// Like IPv4, TCP is only intercepted, not forwarded.
+		return
+	}
+	src6, _ := netip.AddrFromSlice(ip6.SrcIP)
+	dst6, _ := netip.AddrFromSlice(ip6.DstIP)
+	if !n.nat64.Contains(dst6) {
+		n.s.noteDrop(DropNoRoute, netip.AddrPortFrom(src6, uint16(udp.SrcPort)), netip.AddrPortFrom(dst6, uint16(udp.DstPort)))
+		return
+	}
+	if _, ok := n.nodeForMAC(ep.SrcMAC()); !ok {
+		return
+	}
+	n.noteV6Neighbor(src6, ep.SrcMAC())
+
+	dst := netip.AddrPortFrom(nat64Addr(dst6), uint16(udp.DstPort))
+	lan, ok := n.nat64SessionOut(netip.AddrPortFrom(src6, uint16(udp.SrcPort)), dst)
+	if !ok {
+		n.s.noteDrop(DropNATTableFull, netip.AddrPortFrom(src6, uint16(udp.SrcPort)), dst)
+		return
+	}
+
+	wanSrc := n.doNATOut(lan, dst)
+	if !wanSrc.IsValid() {
+		n.s.noteDrop(DropNATTableFull, lan, dst)
+		return
+	}
+	n.s.routeUDPPacket(UDPPacket{
+		Src:      wanSrc,
+		Dst:      dst,
+		Payload:  udp.Payload,
+		priority: ep.priority(),
+		srcMAC:   ep.SrcMAC(),
+		srcNet:   n,
+	})
+}
+
+// nat64SessionOut returns the router's LAN IPv4 address and port that the
+// NAT64 session from the node address src6 to remote is translated from,
+// starting the session or keeping it alive. It prefers the port of src6. It
+// reports false if all ports to remote are in use.
+func (n *network) nat64SessionOut(src6, remote netip.AddrPort) (lan netip.AddrPort, ok bool) {
+	now := n.s.clock.Now()
+	n.nat64Mu.Lock()
+	defer n.nat64Mu.Unlock()
+	k6 := nat64Key6{src6, remote}
+	if se, ok := n.nat64By6[k6]; ok && !expired(se.at, now, n.natTimeout) {
+		se.at = now
+		return se.key.lan, true
+	}
+	n.purgeNAT64Locked(now)
+	port := src6.Port()
+	for range 1 << 16 {
+		k := nat64Key{netip.AddrPortFrom(n.lanIP.Addr(), port), remote}
+		if _, ok := n.nat64By4[k]; !ok && port != 0 {
+			se := &nat64Session{key: k, src6: src6, at: now}
+			mak.Set(&n.nat64By4, k, se)
+			mak.Set(&n.nat64By6, k6, se)
+			return k.lan, true
+		}
+		port++
+	}
+	return netip.AddrPort{}, false
+}
+
+// nat64Session returns the IPv6 address and port of the node whose NAT64
+// session was translated to the router's LAN address lan to remote, if any,
+// keeping the session alive.
+func (n *network) nat64Session(lan, remote netip.AddrPort) (_ netip.AddrPort, ok bool) {
+	now := n.s.clock.Now()
+	n.nat64Mu.Lock()
+	defer n.nat64Mu.Unlock()
+	se, ok := n.nat64By4[nat64Key{lan, remote}]
+	if !ok || expired(se.at, now, n.natTimeout) {
+		return netip.AddrPort{}, false
+	}
+	se.at = now
+	return se.src6, true
+}
+
+// purgeNAT64Locked removes the NAT64 sessions that have expired at time at.
+// n.nat64Mu must be held.
+func (n *network) purgeNAT64Locked(at time.Time) {
+	for k, se := range n.nat64By4 {
+		if expired(se.at, at, n.natTimeout) {
+			delete(n.nat64By4, k)
+			delete(n.nat64By6, nat64Key6{se.src6, se.key.remote})
+		}
+	}
+}
+
+// writeNAT64In writes p, a UDP packet from the internet already NATed to a
+// NAT64 session's LAN address, to the node at dst6, translated to IPv6 from
+// the remote's address in the NAT64 prefix.
+func (n *network) writeNAT64In(p UDPPacket, dst6 netip.AddrPort) {
+	mac, ok := n.nodeMACOfIP(dst6.Addr())
+	if !ok {
+		n.s.noteDrop(DropNoHost, p.Src, p.Dst)
+		return
+	}
+	src6 := netip.AddrPortFrom(dns64Addr(n.nat64, p.Src.Addr()), p.Src.Port())
+	frame, err := udp6Frame(n.mac, mac, src6, dst6, p.Payload)
+	if err != nil {
+		n.s.logf("serializing NAT64 UDP: %v", err)
+		return
+	}
+	n.writeEth(frame)
+	if !p.sent.IsZero() && p.srcMAC != (MAC{}) {
+		n.s.recordLatency(NodePair{p.srcMAC, mac}, n.s.clock.Since(p.sent))
+	}
+	n.s.noteWireGuardDelivered(p, mac)
+}
+
+// udp6Frame returns a raw Ethernet frame of a UDP packet over IPv6.
+func udp6Frame(srcMAC, dstMAC MAC, src, dst netip.AddrPort, payload []byte) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      src.Addr().AsSlice(),
+		DstIP:      dst.Addr().AsSlice(),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port()),
+		DstPort: layers.UDPPort(dst.Port()),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	return serializeFrame(eth, ip, udp, gopacket.Payload(payload))
+}
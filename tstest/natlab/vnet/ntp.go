@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ntpPort is the UDP port of NTP. Like STUN, NTP requests to any internet IP
+// are answered in-process.
+const ntpPort = 123
+
+// ntpPacketLen is the length of an NTP packet without extensions or a MAC.
+const ntpPacketLen = 48
+
+// ntpEpochOffset is the number of seconds from the NTP epoch (1900) to the
+// Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// ntpTime returns t as a 64-bit NTP timestamp.
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+// makeNTPReply returns the reply of the fake NTP server to req, an NTP client
+// request. The time it reports is the server's clock (see Config.Clock)
+// adjusted by the clock skew of the node that sent req, if any, so a skewed
+// node that syncs its clock by NTP keeps the wrong time.
+func (s *Server) makeNTPReply(req UDPPacket) (res UDPPacket, ok bool) {
+	p := req.Payload
+	const modeClient, modeServer = 3, 4
+	if len(p) < ntpPacketLen || p[0]&0x7 != modeClient {
+		s.logf("invalid NTP request from %v", req.Src)
+		return res, false
+	}
+	now := s.clock.Now().Add(clockSkewOf(req))
+
+	reply := make([]byte, ntpPacketLen)
+	version := p[0] >> 3 & 0x7
+	reply[0] = version<<3 | modeServer                   // leap indicator 0: no warning
+	reply[1] = 1                                         // stratum: primary server
+	reply[2] = p[2]                                      // poll interval, as the client asked
+	reply[3] = 0xec                                      // precision: 2^-20 seconds
+	copy(reply[12:16], "VNET")                           // reference ID
+	binary.BigEndian.PutUint64(reply[16:], ntpTime(now)) // reference time
+	copy(reply[24:32], p[40:48])                         // origin: the client's transmit time
+	binary.BigEndian.PutUint64(reply[32:], ntpTime(now)) // receive time
+	binary.BigEndian.PutUint64(reply[40:], ntpTime(now)) // transmit time
+	return UDPPacket{
+		Src:     req.Dst,
+		Dst:     req.Src,
+		Payload: reply,
+	}, true
+}
+
+// clockSkewOf returns the clock skew of the node that sent p, or zero if
+// there's no such node.
+func clockSkewOf(p UDPPacket) time.Duration {
+	if node, ok := p.sender(); ok {
+		return node.clockSkew
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// partitionSide is the side of an internet partition a network is on.
+type partitionSide int
+
+const (
+	partitionA partitionSide = iota + 1
+	partitionB
+)
+
+// Partition partitions the internet between the networks in groupA and those
+// in groupB until [Server.Heal] is called, like a partition between regions:
+// UDP packets between a network in one group and a network in the other are
+// dropped in both directions, reported with [DropPartition]. Networks in
+// neither group can still reach both. It replaces any previous partition.
+//
+// As with [Server.SetPathPolicy], packets to the in-process STUN server and
+// intercepted connections to DERP and the control plane aren't affected, so
+// nodes can still fall back to DERP.
+func (s *Server) Partition(groupA, groupB []*Network) error {
+	sides := make(map[*network]partitionSide, len(groupA)+len(groupB))
+	for _, g := range []struct {
+		nets []*Network
+		side partitionSide
+	}{{groupA, partitionA}, {groupB, partitionB}} {
+		for _, n := range g.nets {
+			if n == nil || n.n == nil || n.n.s != s {
+				return errors.New("partitioned network isn't on this server")
+			}
+			if side, ok := sides[n.n]; ok && side != g.side {
+				return fmt.Errorf("network %v is in both groups of the partition", n.wanIP)
+			}
+			sides[n.n] = g.side
+		}
+	}
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	s.partition = sides
+	return nil
+}
+
+// Heal ends the partition set by [Server.Partition], if any.
+func (s *Server) Heal() {
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	s.partition = nil
+}
+
+// partitioned reports whether the internet is partitioned between the
+// networks with internet IPs src and dst.
+func (s *Server) partitioned(src, dst netip.Addr) bool {
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	if len(s.partition) == 0 {
+		return false
+	}
+	from, ok := s.inet.route(src)
+	if !ok {
+		return false
+	}
+	to, ok := s.inet.route(dst)
+	if !ok {
+		return false
+	}
+	a, b := s.partition[from], s.partition[to]
+	return a != 0 && b != 0 && a != b
+}
@@ -0,0 +1,57 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// PathPolicy is what happens to UDP packets on a directed path across the
+// internet, set by [Server.SetPathPolicy].
+type PathPolicy struct {
+	// Drop is whether the path drops all packets, reported with
+	// [DropPathPolicy].
+	Drop bool
+
+	// Delay is how long packets are delayed on the path, in addition to any
+	// latency of the destination network's link. It's ignored if Drop is
+	// set.
+	Delay time.Duration
+}
+
+// pathKey is a directed path across the internet.
+type pathKey struct {
+	from, to netip.Addr
+}
+
+// SetPathPolicy sets the policy for UDP packets crossing the internet from
+// the IP from to the IP to, typically the WAN IPs of two networks, replacing
+// any previous policy for that path. It's directed: the reverse path is
+// unaffected, so dropping packets one way models a half-open path, such as
+// when only one side's firewall lets the other's packets through. The zero
+// PathPolicy clears it.
+//
+// Packets to the fake STUN server, which answers them in-process, aren't
+// affected.
+func (s *Server) SetPathPolicy(from, to netip.Addr, p PathPolicy) {
+	s.pathMu.Lock()
+	defer s.pathMu.Unlock()
+	k := pathKey{from.Unmap(), to.Unmap()}
+	if p == (PathPolicy{}) {
+		delete(s.paths, k)
+		return
+	}
+	mak.Set(&s.paths, k, p)
+}
+
+// pathPolicy returns the policy of the path from from to to, if any.
+func (s *Server) pathPolicy(from, to netip.Addr) (_ PathPolicy, ok bool) {
+	s.pathMu.Lock()
+	defer s.pathMu.Unlock()
+	p, ok := s.paths[pathKey{from.Unmap(), to.Unmap()}]
+	return p, ok
+}
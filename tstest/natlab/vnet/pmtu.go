@@ -0,0 +1,183 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/util/mak"
+)
+
+// minIPv4MTU is the smallest MTU an IPv4 link may have. See RFC 791.
+const minIPv4MTU = 68
+
+// HandleICMPFromWAN handles pkt, a raw IPv4 packet (without an Ethernet
+// header) carrying an ICMP message from the internet to the WAN IP of one of
+// the server's networks.
+//
+// If it's a fragmentation needed message quoting a packet the network's
+// router forwarded, the router learns the next-hop MTU it gives as the path
+// MTU to the quoted packet's destination. From then on, the router answers
+// packets from the LAN to that destination that are larger than the path MTU
+// and have the don't fragment bit set with a fragmentation needed message of
+// its own, and fragments those without it. Path MTUs are only ever lowered.
+//
+// Other ICMP messages are ignored. It returns an error if pkt is malformed or
+// isn't to a known network.
+func (s *Server) HandleICMPFromWAN(pkt []byte) error {
+	p := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.Default)
+	v4, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return errors.New("not an IPv4 packet")
+	}
+	icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok {
+		return errors.New("not an ICMP packet")
+	}
+	dstIP, _ := netip.AddrFromSlice(v4.DstIP)
+	n, ok := s.inet.networkAt(dstIP)
+	if !ok {
+		return fmt.Errorf("no network with WAN IP %v", dstIP)
+	}
+	fragNeeded := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded)
+	if icmp.TypeCode != fragNeeded {
+		return nil
+	}
+
+	// The quoted packet starts with its IPv4 header, which may be followed by
+	// only part of its payload, so it's parsed by hand.
+	q := icmp.Payload
+	if len(q) < 20 || q[0]>>4 != 4 {
+		return errors.New("malformed quoted packet")
+	}
+	origSrc := netip.AddrFrom4([4]byte(q[12:16]))
+	origDst := netip.AddrFrom4([4]byte(q[16:20]))
+	if origSrc != n.wanIP {
+		return fmt.Errorf("quoted packet from %v wasn't forwarded by %v", origSrc, n.wanIP)
+	}
+	mtu := int(icmp.Seq) // the next-hop MTU field
+	if mtu < minIPv4MTU {
+		// Routers predating RFC 1191 don't give the next-hop MTU. Rather than
+		// guess, ignore them.
+		return nil
+	}
+	n.learnPathMTU(origDst, mtu)
+	return nil
+}
+
+// learnPathMTU lowers the path MTU of n's WAN link to dst to mtu, if it's
+// not already lower.
+func (n *network) learnPathMTU(dst netip.Addr, mtu int) {
+	n.pmtuMu.Lock()
+	defer n.pmtuMu.Unlock()
+	if old, ok := n.pathMTU[dst]; ok && old <= mtu {
+		return
+	}
+	mak.Set(&n.pathMTU, dst, mtu)
+}
+
+// SetMTU changes the MTU of the WAN link of the network with WAN IP wanIP, as
+// set by [Network.SetMTU], at runtime, as when a PPPoE or VPN link comes up
+// mid-session. It applies to the packets forwarded from then on. Path MTUs
+// that the router has learned are kept. Zero means no limit.
+func (s *Server) SetMTU(wanIP netip.Addr, mtu int) error {
+	n, ok := s.inet.networkAt(wanIP)
+	if !ok {
+		return fmt.Errorf("no network with WAN IP %v", wanIP)
+	}
+	if mtu != 0 && mtu < minIPv4MTU {
+		return fmt.Errorf("MTU %d is below the IPv4 minimum of %d", mtu, minIPv4MTU)
+	}
+	n.pmtuMu.Lock()
+	defer n.pmtuMu.Unlock()
+	n.mtu = mtu
+	return nil
+}
+
+// linkMTU returns the MTU of n's WAN link, or 0 for no limit.
+func (n *network) linkMTU() int {
+	n.pmtuMu.Lock()
+	defer n.pmtuMu.Unlock()
+	return n.mtu
+}
+
+// pathMTUTo returns the path MTU learned with HandleICMPFromWAN from n to
+// the WAN IP dst, or 0 if none is known.
+func (n *network) pathMTUTo(dst netip.Addr) int {
+	n.pmtuMu.Lock()
+	defer n.pmtuMu.Unlock()
+	return n.pathMTU[dst]
+}
+
+// udpFragmentFrames is like udpFrame, but if the IPv4 packet is larger than
+// mtu it returns the frames of its IPv4 fragments, each at most mtu bytes of
+// IP with the given IP ID. Header options are only in the first fragment.
+func udpFragmentFrames(srcMAC, dstMAC MAC, src, dst netip.AddrPort, options []layers.IPv4Option, payload []byte, mtu int, id uint16) ([][]byte, error) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    src.Addr().AsSlice(),
+		DstIP:    dst.Addr().AsSlice(),
+		Options:  options,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port()),
+		DstPort: layers.UDPPort(dst.Port()),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	pkt, err := serializeFrame(ip, udp, gopacket.Payload(payload))
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) <= mtu {
+		frame, err := udpFrame(srcMAC, dstMAC, src, dst, options, payload)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{frame}, nil
+	}
+
+	hdrLen := int(pkt[0]&0x0f) * 4
+	data := pkt[hdrLen:] // the UDP header and payload
+	chunk := (mtu - hdrLen) &^ 7
+	if chunk <= 0 {
+		return nil, fmt.Errorf("MTU %d too small for a %d byte IPv4 header", mtu, hdrLen)
+	}
+	var frames [][]byte
+	for off := 0; off < len(data); off += chunk {
+		end := min(off+chunk, len(data))
+		eth := &layers.Ethernet{
+			SrcMAC:       srcMAC.HWAddr(),
+			DstMAC:       dstMAC.HWAddr(),
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		frag := &layers.IPv4{
+			Version:    4,
+			TTL:        64,
+			Id:         id,
+			FragOffset: uint16(off / 8),
+			Protocol:   layers.IPProtocolUDP,
+			SrcIP:      ip.SrcIP,
+			DstIP:      ip.DstIP,
+		}
+		if off == 0 {
+			frag.Options = options
+		}
+		if end < len(data) {
+			frag.Flags = layers.IPv4MoreFragments
+		}
+		frame, err := serializeFrame(eth, frag, gopacket.Payload(data[off:end]))
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
@@ -0,0 +1,409 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/metrics"
+	"tailscale.com/util/mak"
+)
+
+// DropReason is why the virtual network dropped a packet.
+type DropReason string
+
+const (
+	// DropNoRoute is a packet to an internet IP that no network has as its
+	// WAN IP.
+	DropNoRoute DropReason = "no route to destination"
+
+	// DropNoNATMapping is a packet arriving at a network's WAN IP that its
+	// NAT has no mapping for, such as an unsolicited packet through a NAT
+	// that filters by source.
+	DropNoNATMapping DropReason = "no NAT mapping"
+
+	// DropNATTableFull is a packet from a node starting a new flow through
+	// a NAT whose table is full; see [Network.SetMaxFlows].
+	DropNATTableFull DropReason = "NAT table full"
+
+	// DropNoHost is a packet to a LAN IP that no node on the network has,
+	// or whose node the router has no static ARP entry for on a network
+	// with ARP disabled.
+	DropNoHost DropReason = "no host with destination IP"
+
+	// DropSelfSend is a unicast frame addressed to the MAC that sent it.
+	DropSelfSend DropReason = "frame addressed to its sender"
+
+	// DropNotConnected is a frame for a node that has no client connected.
+	DropNotConnected DropReason = "destination node not connected"
+
+	// DropTooBig is a packet with the don't fragment bit set that's too
+	// large for the MTU of the network's link to the internet.
+	DropTooBig DropReason = "packet too big for MTU"
+
+	// DropQueueFull is a packet arriving from the internet at a network with
+	// a bandwidth limit whose queue is full.
+	DropQueueFull DropReason = "throttle queue full"
+
+	// DropAQM is a packet dropped by a network's fair queuing because its
+	// flow had packets queued for too long.
+	DropAQM DropReason = "dropped by AQM"
+
+	// DropSpoofed is a packet dropped by a network's ingress filtering
+	// because its source address is one it shouldn't have: a bogon from
+	// the internet, or one not the network's own to the internet.
+	DropSpoofed DropReason = "spoofed source address"
+
+	// DropFirewall is a packet from a node to the internet dropped by its
+	// network's firewall, such as that of [RestrictiveGuestWiFi].
+	DropFirewall DropReason = "blocked by firewall"
+
+	// DropPathPolicy is a packet dropped by the policy of its path across
+	// the internet; see [Server.SetPathPolicy].
+	DropPathPolicy DropReason = "dropped by path policy"
+
+	// DropPartition is a packet between networks on opposite sides of an
+	// internet partition; see [Server.Partition].
+	DropPartition DropReason = "dropped by internet partition"
+)
+
+// PacketDrop describes a packet dropped by the virtual network, as passed to
+// the hooks registered with [Server.AddDropHook].
+type PacketDrop struct {
+	Reason DropReason
+
+	// Src and Dst are the packet's addresses at the point it was dropped,
+	// after any NAT. They're zero if the packet wasn't TCP or UDP over IPv4.
+	Src, Dst netip.AddrPort
+}
+
+// AddDropHook registers f to be called for each packet the virtual network
+// drops, from whichever goroutine is handling the packet. It returns a func
+// that unregisters f.
+func (s *Server) AddDropHook(f func(PacketDrop)) (remove func()) {
+	s.dropMu.Lock()
+	defer s.dropMu.Unlock()
+	h := s.dropHooks.Add(f)
+	return func() {
+		s.dropMu.Lock()
+		defer s.dropMu.Unlock()
+		delete(s.dropHooks, h)
+	}
+}
+
+func (s *Server) hasDropHooks() bool {
+	s.dropMu.Lock()
+	defer s.dropMu.Unlock()
+	return len(s.dropHooks) > 0
+}
+
+// DropStats returns how many packets the virtual network has dropped for
+// each reason since it started. Reasons with no drops are omitted.
+func (s *Server) DropStats() map[DropReason]uint64 {
+	ret := map[DropReason]uint64{}
+	s.drops.Do(func(kv expvar.KeyValue) {
+		ret[DropReason(kv.Key)] = uint64(kv.Value.(*expvar.Int).Value())
+	})
+	return ret
+}
+
+// ExpVar returns the server's metrics, for publishing with [expvar.Publish]
+// and serving in Prometheus format with tsweb/varz. Dropped packets are
+// counted by the "reason" label.
+func (s *Server) ExpVar() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("counter_packets_dropped_reason", &s.drops)
+	return m
+}
+
+// noteDrop counts a packet from src to dst dropped for reason and calls the
+// registered drop hooks for it.
+func (s *Server) noteDrop(reason DropReason, src, dst netip.AddrPort) {
+	s.drops.Add(string(reason), 1)
+
+	s.dropMu.Lock()
+	hooks := make([]func(PacketDrop), 0, len(s.dropHooks))
+	for _, f := range s.dropHooks {
+		hooks = append(hooks, f)
+	}
+	s.dropMu.Unlock()
+
+	d := PacketDrop{Reason: reason, Src: src, Dst: dst}
+	for _, f := range hooks {
+		f(d)
+	}
+}
+
+// noteDropFrame is like noteDrop, but for a dropped raw Ethernet frame.
+func (s *Server) noteDropFrame(reason DropReason, frame []byte) {
+	if !s.hasDropHooks() {
+		// Don't bother parsing the frame.
+		s.drops.Add(string(reason), 1)
+		return
+	}
+	src, dst := frameAddrs(frame)
+	s.noteDrop(reason, src, dst)
+}
+
+// frameAddrs returns the source and destination addresses of the TCP or UDP
+// over IPv4 packet in the raw Ethernet frame, or zero values if it's not one.
+func frameAddrs(frame []byte) (src, dst netip.AddrPort) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+	ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return
+	}
+	srcIP, _ := netip.AddrFromSlice(ip.SrcIP)
+	dstIP, _ := netip.AddrFromSlice(ip.DstIP)
+	switch l := packet.TransportLayer().(type) {
+	case *layers.UDP:
+		return netip.AddrPortFrom(srcIP, uint16(l.SrcPort)), netip.AddrPortFrom(dstIP, uint16(l.DstPort))
+	case *layers.TCP:
+		return netip.AddrPortFrom(srcIP, uint16(l.SrcPort)), netip.AddrPortFrom(dstIP, uint16(l.DstPort))
+	}
+	return
+}
+
+// InjectUDP injects a UDP packet into the virtual network as if node from had
+// sent it from srcPort on its LAN IP to dst. The packet is handled exactly as
+// if it came from the node's client, NAT and all, but the node doesn't need to
+// have a client connected.
+func (s *Server) InjectUDP(from *Node, srcPort uint16, dst netip.AddrPort, payload []byte) error {
+	n, lanIP, dstMAC, err := s.injectFrom(from, dst.Addr())
+	if err != nil {
+		return err
+	}
+	frame, err := udpFrame(n.mac.Load(), dstMAC, netip.AddrPortFrom(lanIP, srcPort), dst, nil, payload)
+	if err != nil {
+		return err
+	}
+	n.inject(frame)
+	return nil
+}
+
+// InjectTCP is like InjectUDP, but injects a TCP segment. The segment's
+// flags, sequence and acknowledgement numbers, window and options are taken
+// from tcp; its ports are those of srcPort and dst.
+func (s *Server) InjectTCP(from *Node, srcPort uint16, dst netip.AddrPort, tcp layers.TCP, payload []byte) error {
+	n, lanIP, dstMAC, err := s.injectFrom(from, dst.Addr())
+	if err != nil {
+		return err
+	}
+	tcp.SrcPort = layers.TCPPort(srcPort)
+	tcp.DstPort = layers.TCPPort(dst.Port())
+	frame, err := ipv4Frame(n.mac.Load(), dstMAC, lanIP, dst.Addr(), layers.IPProtocolTCP, &tcp, gopacket.Payload(payload))
+	if err != nil {
+		return err
+	}
+	n.inject(frame)
+	return nil
+}
+
+// InjectICMP is like InjectUDP, but injects an ICMP message with the type,
+// code, ID and sequence number of icmp, followed by payload.
+func (s *Server) InjectICMP(from *Node, dst netip.Addr, icmp layers.ICMPv4, payload []byte) error {
+	n, lanIP, dstMAC, err := s.injectFrom(from, dst)
+	if err != nil {
+		return err
+	}
+	frame, err := ipv4Frame(n.mac.Load(), dstMAC, lanIP, dst, layers.IPProtocolICMPv4, &icmp, gopacket.Payload(payload))
+	if err != nil {
+		return err
+	}
+	n.inject(frame)
+	return nil
+}
+
+// injectFrom returns the node that packets injected as if from node from to
+// dst are sent by, its LAN IP, and the MAC they're sent to: that of the host
+// with IP dst if it's on the node's LAN, else that of the gateway.
+func (s *Server) injectFrom(from *Node, dst netip.Addr) (_ *node, lanIP netip.Addr, dstMAC MAC, _ error) {
+	n := from.n
+	if n == nil {
+		return nil, lanIP, dstMAC, fmt.Errorf("node %v not in server", from.mac)
+	}
+	s.mu.Lock()
+	mac := n.mac.Load()
+	attached := s.nodeByMAC[n.net.macKey(mac)] == n
+	lanIP = n.lanIP
+	s.mu.Unlock()
+	if !attached {
+		return nil, lanIP, dstMAC, fmt.Errorf("node %v not attached", mac)
+	}
+	if !lanIP.IsValid() {
+		return nil, lanIP, dstMAC, fmt.Errorf("node %v has no LAN IP", mac)
+	}
+
+	dstMAC = n.net.mac // of gateway, for non-LAN destinations
+	if n.net.lanIP.Contains(dst) {
+		var ok bool
+		dstMAC, ok = n.net.MACOfIP(dst)
+		if !ok {
+			return nil, lanIP, dstMAC, fmt.Errorf("no host with IP %v on the LAN of node %v", dst, mac)
+		}
+	}
+	return n, lanIP, dstMAC, nil
+}
+
+// inject handles the raw Ethernet frame as if n's client had sent it.
+func (n *node) inject(frame []byte) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+	le := packet.LinkLayer().(*layers.Ethernet)
+	n.net.HandleEthernetPacket(EthernetPacket{le, packet})
+}
+
+// probeSTUNAddr is the STUN server that AssertReachable has nodes discover
+// their public endpoints against.
+var probeSTUNAddr = netip.AddrPortFrom(netip.AddrFrom4([4]byte{52, 52, 0, 3}), stunPort)
+
+// AssertReachable checks that a UDP packet sent by node from arrives at node
+// to, which must have a client connected, and returns a descriptive error
+// naming why it was dropped if not.
+//
+// Nodes on the same network are probed directly over their LAN. Otherwise,
+// the probe emulates a direct NAT traversal: from learns its public endpoint
+// from a STUN server, to sends a packet to that endpoint to open its own NAT,
+// and then from sends the probe back to the address that packet came from.
+// DERP isn't used, so nodes that can only talk via DERP are unreachable.
+//
+// It waits for the probe until ctx is done.
+func (s *Server) AssertReachable(ctx context.Context, from, to *Node) error {
+	fromLAN, toLAN, fromWAN, toDst, err := s.probePath(from, to)
+	if err != nil {
+		return err
+	}
+
+	token := fmt.Sprintf("vnet-probe-%016x", s.rand.Uint64())
+	arrived := s.addProbe(token)
+	defer s.removeProbe(token)
+
+	dropped := make(chan PacketDrop, 1)
+	defer s.AddDropHook(func(d PacketDrop) {
+		if d.Dst != toDst && d.Dst != toLAN {
+			// Not the probe; maybe the hole punch.
+			return
+		}
+		select {
+		case dropped <- d:
+		default:
+		}
+	})()
+
+	if fromWAN.IsValid() {
+		if err := s.InjectUDP(to, toLAN.Port(), fromWAN, []byte("vnet-punch")); err != nil {
+			return fmt.Errorf("punching from %v: %w", toLAN, err)
+		}
+	}
+	if err := s.InjectUDP(from, fromLAN.Port(), toDst, []byte(token)); err != nil {
+		return fmt.Errorf("probing from %v: %w", fromLAN, err)
+	}
+	select {
+	case <-arrived:
+		return nil
+	case d := <-dropped:
+		return fmt.Errorf("probe from %v to %v (via %v) dropped at %v: %s", fromLAN, toLAN, toDst, d.Dst, d.Reason)
+	case <-ctx.Done():
+		return fmt.Errorf("probe from %v to %v (via %v) didn't arrive: %w", fromLAN, toLAN, toDst, ctx.Err())
+	}
+}
+
+// probePath returns the addresses of a UDP flow from node from to node to
+// that AssertReachable and BenchUDP emulate: their LAN ip:ports, and the
+// address that from sends to. If the nodes are on different networks, to
+// must first punch a hole in its NAT by sending to fromWAN, the public
+// endpoint that from learned by STUN; otherwise fromWAN is invalid.
+func (s *Server) probePath(from, to *Node) (fromLAN, toLAN, fromWAN, toDst netip.AddrPort, err error) {
+	fromLAN, err = s.probeAddr(from)
+	if err != nil {
+		return
+	}
+	toLAN, err = s.probeAddr(to)
+	if err != nil {
+		return
+	}
+	toDst = toLAN
+	if from.n.net != to.n.net {
+		fromWAN = from.n.net.doNATOut(fromLAN, probeSTUNAddr)
+		// The NAT mapping that to's packet to fromWAN will use.
+		toDst = to.n.net.doNATOut(toLAN, fromWAN)
+	}
+	return
+}
+
+// probeAddr returns a LAN ip:port of n for AssertReachable to probe from or
+// to, with a random port so concurrent probes don't share NAT mappings.
+func (s *Server) probeAddr(n *Node) (netip.AddrPort, error) {
+	if n.n == nil {
+		return netip.AddrPort{}, fmt.Errorf("node %v not in server", n.mac)
+	}
+	s.mu.Lock()
+	lanIP := n.n.lanIP
+	s.mu.Unlock()
+	if !lanIP.IsValid() {
+		return netip.AddrPort{}, fmt.Errorf("node %v has no LAN IP", n.mac)
+	}
+	return netip.AddrPortFrom(lanIP, 1024+uint16(s.rand.IntN(31<<10))), nil
+}
+
+// probes tracks the probes that AssertReachable is waiting on and the
+// streams that BenchUDP is counting.
+type probes struct {
+	active atomic.Int32 // len(m) + len(benches), to skip frame parsing when zero
+
+	mu      sync.Mutex
+	m       map[string]chan struct{} // by payload; closed on arrival
+	benches map[string]*atomic.Int64 // delivered count by payload token prefix
+}
+
+func (s *Server) addProbe(token string) <-chan struct{} {
+	ch := make(chan struct{})
+	s.probes.mu.Lock()
+	defer s.probes.mu.Unlock()
+	mak.Set(&s.probes.m, token, ch)
+	s.probes.updateActiveLocked()
+	return ch
+}
+
+func (s *Server) removeProbe(token string) {
+	s.probes.mu.Lock()
+	defer s.probes.mu.Unlock()
+	delete(s.probes.m, token)
+	s.probes.updateActiveLocked()
+}
+
+func (p *probes) updateActiveLocked() {
+	p.active.Store(int32(len(p.m) + len(p.benches)))
+}
+
+// noteDelivered notes that the raw Ethernet frame was delivered to a node's
+// client, for any probe it carries.
+func (s *Server) noteDelivered(frame []byte) {
+	if s.probes.active.Load() == 0 {
+		return
+	}
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return
+	}
+	s.probes.mu.Lock()
+	defer s.probes.mu.Unlock()
+	if ch, ok := s.probes.m[string(udp.Payload)]; ok {
+		close(ch)
+		delete(s.probes.m, string(udp.Payload))
+		s.probes.updateActiveLocked()
+	}
+	if len(udp.Payload) >= benchTokenLen {
+		if n, ok := s.probes.benches[string(udp.Payload[:benchTokenLen])]; ok {
+			n.Add(1)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"sync"
+
+	"tailscale.com/util/mak"
+)
+
+// registry is the process-wide set of Servers registered by name.
+var registry struct {
+	mu sync.Mutex
+	m  map[string]*Server
+}
+
+// RegisterServer registers s under name so that test helpers without access
+// to s can find it with [LookupServer]. It stays registered until s is
+// closed. Tests that run in parallel should use distinct names, such as
+// their t.Name().
+//
+// It panics if name is registered to another server. Registering a closed
+// server does nothing.
+func RegisterServer(name string, s *Server) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if s.shutdownCtx.Err() != nil {
+		return
+	}
+	if old, ok := registry.m[name]; ok && old != s {
+		panic(fmt.Sprintf("vnet: server name %q already registered", name))
+	}
+	mak.Set(&registry.m, name, s)
+}
+
+// LookupServer returns the Server registered under name with
+// [RegisterServer], if it's still open.
+func LookupServer(name string) (_ *Server, ok bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	s, ok := registry.m[name]
+	return s, ok
+}
+
+// unregisterServer removes s from the registry under all its names.
+func unregisterServer(s *Server) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for name, rs := range registry.m {
+		if rs == s {
+			delete(registry.m, name)
+		}
+	}
+}
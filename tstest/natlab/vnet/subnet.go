@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/util/set"
+)
+
+// subnet is a routed stub subnet behind a node, added by
+// [Config.AddSubnetBehind].
+type subnet struct {
+	via    *node
+	prefix netip.Prefix
+	hosts  set.Set[netip.Addr]
+}
+
+// addSubnetBehind adds the subnet configured by conf to the network of the
+// node it's behind.
+func (s *Server) addSubnetBehind(conf *subnetBehind) error {
+	via := conf.via.n
+	if via == nil || via.net == nil {
+		return fmt.Errorf("subnet %v: node %v is not on a network", conf.prefix, conf.via.mac)
+	}
+	if !conf.prefix.IsValid() || !conf.prefix.Addr().Is4() {
+		return fmt.Errorf("subnet %v behind node %v: not an IPv4 prefix", conf.prefix, conf.via.mac)
+	}
+	sn := &subnet{
+		via:    via,
+		prefix: conf.prefix.Masked(),
+		hosts:  set.Of(conf.hosts...),
+	}
+	for n := range s.networks {
+		if n.lanIP.Overlaps(sn.prefix) {
+			return fmt.Errorf("subnet %v overlaps the LAN %v", sn.prefix, n.lanIP)
+		}
+		for _, other := range n.subnets {
+			if other.prefix.Overlaps(sn.prefix) {
+				return fmt.Errorf("subnet %v overlaps subnet %v", sn.prefix, other.prefix)
+			}
+		}
+	}
+	for h := range sn.hosts {
+		if !sn.prefix.Contains(h) {
+			return fmt.Errorf("host %v is not in subnet %v", h, sn.prefix)
+		}
+	}
+	via.net.subnets = append(via.net.subnets, sn)
+	return nil
+}
+
+// subnetFor returns the subnet behind one of the network's nodes that
+// contains ip, if any.
+func (n *network) subnetFor(ip netip.Addr) (_ *subnet, ok bool) {
+	for _, sn := range n.subnets {
+		if sn.prefix.Contains(ip) {
+			return sn, true
+		}
+	}
+	return nil, false
+}
+
+// handleSubnetPacket handles an IPv4 packet sent to the router for an IP in
+// sn. The router routes packets from other nodes to the subnet's router node,
+// and delivers those from the subnet's router node to the subnet's hosts.
+func (n *network) handleSubnetPacket(ep EthernetPacket, sn *subnet) {
+	viaMAC := sn.via.mac.Load()
+	if ep.SrcMAC() != viaMAC {
+		frame := bytes.Clone(ep.gp.Data())
+		copy(frame[0:6], viaMAC[:])
+		copy(frame[6:12], n.mac[:])
+		n.writeEth(frame)
+		return
+	}
+
+	v4 := ep.gp.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	srcIP, _ := netip.AddrFromSlice(v4.SrcIP)
+	dstIP, _ := netip.AddrFromSlice(v4.DstIP)
+	if !sn.hosts.Contains(dstIP) {
+		n.s.noteDropFrame(DropNoHost, ep.gp.Data())
+		return
+	}
+	var res []byte
+	var err error
+	switch l := ep.gp.TransportLayer().(type) {
+	case *layers.UDP:
+		res, err = udpFrame(n.mac, viaMAC,
+			netip.AddrPortFrom(dstIP, uint16(l.DstPort)),
+			netip.AddrPortFrom(srcIP, uint16(l.SrcPort)),
+			nil, l.Payload)
+	default:
+		icmp, ok := ep.gp.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if !ok || icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+			return
+		}
+		res, err = icmpEchoReplyFrame(n.mac, viaMAC, dstIP, srcIP, icmp)
+	}
+	if err != nil {
+		n.s.logf("subnet %v host %v reply: %v", sn.prefix, dstIP, err)
+		return
+	}
+	n.writeEth(res)
+}
+
+// icmpEchoReplyFrame returns a raw Ethernet frame of an ICMP echo reply from
+// src to dst for the echo request req.
+func icmpEchoReplyFrame(srcMAC, dstMAC MAC, src, dst netip.Addr, req *layers.ICMPv4) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    src.AsSlice(),
+		DstIP:    dst.AsSlice(),
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       req.Id,
+		Seq:      req.Seq,
+	}
+	return serializeFrame(eth, ip, icmp, gopacket.Payload(req.Payload))
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+// tapQueueLen is how many frames a tap (see Server.TapNode) buffers for a
+// reader that's behind before dropping them.
+const tapQueueLen = 64
+
+// TapNode returns a channel of copies of the raw Ethernet frames delivered to
+// the connected client of the node with the given MAC, including broadcast
+// frames, and a func to stop the tap and close the channel. It's lighter
+// than a pcap file and doesn't affect delivery to the client: frames that
+// arrive while the channel's buffer is full are dropped from the tap only.
+//
+// Frames sent while the node has no client aren't tapped.
+func (s *Server) TapNode(mac MAC) (_ <-chan []byte, stop func()) {
+	ch := make(chan []byte, tapQueueLen)
+	s.tapMu.Lock()
+	defer s.tapMu.Unlock()
+	hs, ok := s.taps[mac]
+	if !ok {
+		hs = set.HandleSet[chan []byte]{}
+		mak.Set(&s.taps, mac, hs)
+	}
+	h := hs.Add(ch)
+	return ch, func() {
+		s.tapMu.Lock()
+		defer s.tapMu.Unlock()
+		if _, ok := hs[h]; !ok {
+			return // already stopped
+		}
+		delete(hs, h)
+		if len(hs) == 0 {
+			delete(s.taps, mac)
+		}
+		close(ch)
+	}
+}
+
+// noteTapped sends a copy of frame, delivered to the node with MAC mac, to
+// the node's taps, if any.
+func (s *Server) noteTapped(mac MAC, frame []byte) {
+	s.tapMu.Lock()
+	defer s.tapMu.Unlock()
+	for _, ch := range s.taps[mac] {
+		select {
+		case ch <- bytes.Clone(frame):
+		default:
+		}
+	}
+}
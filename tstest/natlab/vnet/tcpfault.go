@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"errors"
+	"net"
+)
+
+// TCPFault is a fault that a TCPFaultPolicy injects into an intercepted
+// connection to DERP or the control plane.
+type TCPFault int
+
+const (
+	// TCPNoFault proxies the connection as usual.
+	TCPNoFault TCPFault = iota
+
+	// TCPFaultCloseUpstream abruptly closes the connection to the upstream
+	// server, dropping the data read from it. The node's connection is then
+	// closed with a FIN.
+	TCPFaultCloseUpstream
+
+	// TCPFaultReset resets the node's connection, sending it a RST, and
+	// closes the one to the upstream server, as [Server.ResetTCP] does.
+	TCPFaultReset
+
+	// TCPFaultTruncate delivers only the first half of the data read from
+	// the upstream server and then closes both connections, cutting a
+	// response short.
+	TCPFaultTruncate
+)
+
+// TCPFaultPolicy decides which fault, if any, to inject into the intercepted
+// TCP connection flow, from a node to DERP or the control plane, before
+// delivering the next data read from the upstream server to the node.
+// delivered is how many bytes the node has been sent so far.
+type TCPFaultPolicy func(flow FiveTuple, delivered int64) TCPFault
+
+// SetTCPFaultPolicy makes the server consult p while proxying intercepted
+// connections to DERP and the control plane, modeling flaky connectivity to
+// them. It replaces any previous policy. A nil p removes it.
+func (s *Server) SetTCPFaultPolicy(p TCPFaultPolicy) {
+	s.tcpFault.Store(p)
+}
+
+// errTCPFault is returned by proxyToNode when it injected a fault.
+var errTCPFault = errors.New("injected TCP fault")
+
+// proxyToNode copies the upstream server's data from up to the node's
+// intercepted connection tc, for flow, injecting the faults of the server's
+// TCP fault policy.
+func (n *network) proxyToNode(tc, up net.Conn, flow FiveTuple) error {
+	buf := make([]byte, 32<<10)
+	var delivered int64
+	for {
+		nr, err := up.Read(buf)
+		if nr > 0 {
+			data := buf[:nr]
+			var fault TCPFault
+			if p := n.s.tcpFault.Load(); p != nil {
+				fault = p(flow, delivered)
+			}
+			switch fault {
+			case TCPFaultCloseUpstream:
+				n.s.logf("closing upstream of %v to %v", flow.Src, flow.Dst)
+				up.Close()
+				return errTCPFault
+			case TCPFaultReset:
+				n.s.logf("resetting %v to %v", flow.Src, flow.Dst)
+				n.tcpStack.resetTCP(flow.Src, flow.Dst)
+				return errTCPFault
+			case TCPFaultTruncate:
+				data = data[:len(data)/2]
+			}
+			if _, err := tc.Write(data); err != nil {
+				return err
+			}
+			delivered += int64(len(data))
+			if fault == TCPFaultTruncate {
+				n.s.logf("truncated %v to %v after %d bytes", flow.Src, flow.Dst, delivered)
+				return errTCPFault
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
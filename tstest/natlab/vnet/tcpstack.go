@@ -0,0 +1,615 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TCPStack is a TCP implementation that natlab can use to terminate
+// intercepted TCP connections.
+type TCPStack string
+
+const (
+	// TCPStackGVisor terminates intercepted TCP connections with a full
+	// gvisor netstack per network.
+	TCPStackGVisor TCPStack = "gvisor"
+
+	// TCPStackGo terminates intercepted TCP connections with a minimal
+	// TCP implementation in this package, skipping gvisor entirely.
+	//
+	// It does in-order delivery with flow control but no retransmission,
+	// congestion control, or TCP options other than MSS, so it assumes a
+	// lossless LAN. It's meant for benchmarking natlab itself.
+	TCPStackGo TCPStack = "go"
+)
+
+// tcpInterceptor terminates TCP connections that the router intercepts
+// (see Server.shouldInterceptTCP) and hands them to network.tcpTarget.
+type tcpInterceptor interface {
+	// handleTCP handles an intercepted TCP packet from a node. The packet
+	// starts at its Ethernet layer and has IPv4 or IPv6 and TCP layers.
+	handleTCP(gopacket.Packet)
+
+	// resetTCP abruptly closes the intercepted connection from the node
+	// address src to dst, sending the node a RST. It reports whether there
+	// was such a connection.
+	resetTCP(src, dst netip.AddrPort) bool
+
+	// resetHost abruptly closes all the intercepted connections from the
+	// node address ip, as resetTCP does.
+	resetHost(ip netip.Addr)
+
+	// close closes all intercepted connections, without notifying the
+	// nodes, and releases the interceptor's resources. It's called once,
+	// when the server is closed.
+	close()
+}
+
+// FiveTuple identifies a flow by its protocol and its endpoints.
+type FiveTuple struct {
+	Proto    layers.IPProtocol
+	Src, Dst netip.AddrPort
+}
+
+// ResetTCP tears down the intercepted TCP connection flow on the network with
+// WAN IP wanIP, such as a DERP connection, as a middlebox killing it would: the
+// node is sent a RST, and the connection to the upstream server is closed.
+// flow.Src is the node's LAN address and port, and flow.Dst the address it
+// connected to. It returns an error if there's no such connection.
+func (s *Server) ResetTCP(wanIP netip.Addr, flow FiveTuple) error {
+	if flow.Proto != layers.IPProtocolTCP {
+		return fmt.Errorf("flow protocol %v is not TCP", flow.Proto)
+	}
+	n, ok := s.inet.networkAt(wanIP)
+	if !ok {
+		return fmt.Errorf("no network with WAN IP %v", wanIP)
+	}
+	if !n.tcpStack.resetTCP(flow.Src, flow.Dst) {
+		return fmt.Errorf("no intercepted TCP connection from %v to %v on network %v", flow.Src, flow.Dst, wanIP)
+	}
+	s.logf("ResetTCP: %v -> %v", flow.Src, flow.Dst)
+	return nil
+}
+
+// goTCPRcvBufSize is the receive buffer size of a goTCPConn. It's the
+// largest window we can advertise without window scaling.
+const goTCPRcvBufSize = 1<<16 - 1
+
+// goTCPMSS is the MSS that a goTCPStack advertises over IPv4. Over IPv6,
+// whose header is 20 bytes longer, it's 20 bytes less.
+const goTCPMSS = 1460
+
+// goTCPStack is the TCPStackGo implementation of tcpInterceptor.
+type goTCPStack struct {
+	n *network
+
+	mu    sync.Mutex
+	conns map[goTCPFlow]*goTCPConn
+}
+
+// goTCPFlow identifies a connection terminated by a goTCPStack.
+type goTCPFlow struct {
+	node   netip.AddrPort // the node's side
+	remote netip.AddrPort // the intercepted destination
+}
+
+// mss returns the MSS that a goTCPStack advertises for f.
+func (f goTCPFlow) mss() int {
+	if f.node.Addr().Is6() {
+		return goTCPMSS - 20
+	}
+	return goTCPMSS
+}
+
+func newGoTCPStack(n *network) *goTCPStack {
+	return &goTCPStack{
+		n:     n,
+		conns: map[goTCPFlow]*goTCPConn{},
+	}
+}
+
+func (st *goTCPStack) handleTCP(packet gopacket.Packet) {
+	if st.n.s.shutdownCtx.Err() != nil {
+		return // closed
+	}
+	var srcIP, dstIP netip.Addr
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, _ = netip.AddrFromSlice(ip.SrcIP.To4())
+		dstIP, _ = netip.AddrFromSlice(ip.DstIP.To4())
+	case *layers.IPv6:
+		srcIP, _ = netip.AddrFromSlice(ip.SrcIP)
+		dstIP, _ = netip.AddrFromSlice(ip.DstIP)
+	default:
+		return
+	}
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return
+	}
+	flow := goTCPFlow{
+		node:   netip.AddrPortFrom(srcIP, uint16(tcp.SrcPort)),
+		remote: netip.AddrPortFrom(dstIP, uint16(tcp.DstPort)),
+	}
+
+	st.mu.Lock()
+	c, ok := st.conns[flow]
+	if ok {
+		st.mu.Unlock()
+		c.handleSegment(tcp)
+		return
+	}
+	if !tcp.SYN || tcp.ACK {
+		st.mu.Unlock()
+		if !tcp.RST {
+			st.sendRST(flow, tcp)
+		}
+		return
+	}
+	h, ok := st.n.tcpTarget(flow.node, flow.remote)
+	if !ok {
+		st.mu.Unlock()
+		st.sendRST(flow, tcp)
+		return
+	}
+	c = newGoTCPConn(st, flow, tcp)
+	delay := st.n.s.tcpConnectDelay
+	c.accepting = delay > 0 || h.dial != nil
+	st.conns[flow] = c
+	st.mu.Unlock()
+
+	st.n.s.logf("AcceptTCP (go): %v -> %v", flow.node, flow.remote)
+	if !c.accepting {
+		c.sendSYNACK()
+		st.n.s.goTracked(func() { h.serve(c, nil) })
+		return
+	}
+	st.n.s.goTracked(func() {
+		if !st.n.s.sleep(delay) {
+			return
+		}
+		up, ok := h.dialUpstream()
+		if !ok {
+			c.refuse()
+			return
+		}
+		c.mu.Lock()
+		c.accepting = false
+		c.mu.Unlock()
+		c.sendSYNACK()
+		h.serve(c, up)
+	})
+}
+
+func (st *goTCPStack) resetTCP(src, dst netip.AddrPort) bool {
+	st.mu.Lock()
+	c, ok := st.conns[goTCPFlow{node: src, remote: dst}]
+	st.mu.Unlock()
+	if ok {
+		c.abort()
+	}
+	return ok
+}
+
+func (st *goTCPStack) resetHost(ip netip.Addr) {
+	var cs []*goTCPConn
+	st.mu.Lock()
+	for f, c := range st.conns {
+		if f.node.Addr() == ip {
+			cs = append(cs, c)
+		}
+	}
+	st.mu.Unlock()
+	for _, c := range cs {
+		c.abort()
+	}
+}
+
+func (st *goTCPStack) close() {
+	st.mu.Lock()
+	conns := st.conns
+	st.conns = map[goTCPFlow]*goTCPConn{}
+	st.mu.Unlock()
+	for _, c := range conns {
+		c.mu.Lock()
+		c.reset = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+func (st *goTCPStack) remove(c *goTCPConn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.conns[c.flow] == c {
+		delete(st.conns, c.flow)
+	}
+}
+
+// sendRST sends a RST in response to the segment in, per RFC 793 section 3.4.
+func (st *goTCPStack) sendRST(flow goTCPFlow, in *layers.TCP) {
+	rst := &layers.TCP{RST: true}
+	if in.ACK {
+		rst.Seq = in.Ack
+	} else {
+		rst.ACK = true
+		rst.Ack = in.Seq + uint32(len(in.Payload))
+		if in.SYN {
+			rst.Ack++
+		}
+		if in.FIN {
+			rst.Ack++
+		}
+	}
+	st.send(st.segment(flow, rst, nil))
+}
+
+// segment returns an Ethernet frame from the router to the node of flow,
+// carrying tcp (with its ports filled in) and payload. It returns nil if the
+// node is no longer on the network.
+func (st *goTCPStack) segment(flow goTCPFlow, tcp *layers.TCP, payload []byte) []byte {
+	dstMAC, ok := st.n.nodeMACOfIP(flow.node.Addr())
+	if !ok {
+		return nil
+	}
+	tcp.SrcPort = layers.TCPPort(flow.remote.Port())
+	tcp.DstPort = layers.TCPPort(flow.node.Port())
+	eth := &layers.Ethernet{
+		SrcMAC:       st.n.mac.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var ip gopacket.SerializableLayer
+	if flow.node.Addr().Is6() {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolTCP,
+			SrcIP:      flow.remote.Addr().AsSlice(),
+			DstIP:      flow.node.Addr().AsSlice(),
+		}
+		tcp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	} else {
+		ip4 := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    flow.remote.Addr().AsSlice(),
+			DstIP:    flow.node.Addr().AsSlice(),
+		}
+		tcp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	}
+	frame, err := serializeFrame(eth, ip, tcp, gopacket.Payload(payload))
+	if err != nil {
+		st.n.s.logf("serializing TCP: %v", err)
+		return nil
+	}
+	return frame
+}
+
+func (st *goTCPStack) send(frame []byte) {
+	if frame != nil {
+		st.n.noteSYNACK(frame)
+		st.n.writeEth(frame)
+	}
+}
+
+// goTCPConn is a TCP connection terminated by a goTCPStack.
+// It implements net.Conn for the intercepted connection's handler.
+type goTCPConn struct {
+	st   *goTCPStack
+	flow goTCPFlow
+	mss  int // max payload per segment we send
+
+	writeMu sync.Mutex // serializes data segments and our FIN
+
+	mu          sync.Mutex
+	cond        *sync.Cond // on mu; broadcast on any state change
+	accepting   bool       // waiting out Config.TCPConnectDelay or the upstream dial; no SYN-ACK sent yet
+	established bool       // peer ACKed our SYN
+	iss         uint32     // our initial sequence number
+	sndUna      uint32     // oldest unacknowledged sequence number
+	sndNxt      uint32     // next sequence number to send
+	sndWnd      uint32     // peer's advertised receive window
+	rcvNxt      uint32     // next sequence number expected from peer
+	rcvBuf      bytes.Buffer
+	rcvEOF      bool // peer sent FIN
+	closed      bool // Close was called and our FIN sent
+	reset       bool // RST sent or received
+	rDeadline   time.Time
+	wDeadline   time.Time
+}
+
+func newGoTCPConn(st *goTCPStack, flow goTCPFlow, syn *layers.TCP) *goTCPConn {
+	c := &goTCPConn{
+		st:     st,
+		flow:   flow,
+		mss:    flow.mss(),
+		iss:    rand.Uint32(),
+		sndWnd: uint32(syn.Window),
+		rcvNxt: syn.Seq + 1,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	for _, o := range syn.Options {
+		if o.OptionType == layers.TCPOptionKindMSS && len(o.OptionData) == 2 {
+			c.mss = min(c.mss, int(binary.BigEndian.Uint16(o.OptionData)))
+		}
+	}
+	return c
+}
+
+// seqGT reports whether sequence number a is after b, modulo wraparound.
+func seqGT(a, b uint32) bool { return int32(a-b) > 0 }
+
+// rcvWndLocked returns the receive window to advertise.
+// c.mu must be held.
+func (c *goTCPConn) rcvWndLocked() uint16 {
+	return uint16(goTCPRcvBufSize - c.rcvBuf.Len())
+}
+
+// segmentLocked returns a frame carrying an ACK segment with the given extra
+// flags and payload at c.sndNxt. It doesn't advance c.sndNxt.
+// c.mu must be held.
+func (c *goTCPConn) segmentLocked(tcp *layers.TCP, payload []byte) []byte {
+	tcp.Seq = c.sndNxt
+	tcp.ACK = true
+	tcp.Ack = c.rcvNxt
+	tcp.Window = c.rcvWndLocked()
+	return c.st.segment(c.flow, tcp, payload)
+}
+
+func (c *goTCPConn) sendSYNACK() {
+	c.mu.Lock()
+	tcp := &layers.TCP{
+		SYN: true,
+		Options: []layers.TCPOption{{
+			OptionType:   layers.TCPOptionKindMSS,
+			OptionLength: 4,
+			OptionData:   binary.BigEndian.AppendUint16(nil, uint16(c.flow.mss())),
+		}},
+	}
+	c.sndNxt = c.iss
+	frame := c.segmentLocked(tcp, nil)
+	c.sndNxt = c.iss + 1
+	c.mu.Unlock()
+	c.st.send(frame)
+}
+
+func (c *goTCPConn) handleSegment(tcp *layers.TCP) {
+	c.mu.Lock()
+	if tcp.RST {
+		c.reset = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		c.st.remove(c)
+		return
+	}
+	if tcp.SYN {
+		resend := !c.established && !c.accepting
+		c.mu.Unlock()
+		if resend {
+			c.sendSYNACK() // our SYN-ACK was presumably lost
+		}
+		return
+	}
+	if tcp.ACK {
+		if seqGT(tcp.Ack, c.sndUna) && !seqGT(tcp.Ack, c.sndNxt) {
+			c.sndUna = tcp.Ack
+			c.established = true
+		}
+		c.sndWnd = uint32(tcp.Window)
+		c.cond.Broadcast()
+	}
+
+	var ack bool
+	if len(tcp.Payload) > 0 || tcp.FIN {
+		ack = true
+		if tcp.Seq == c.rcvNxt && !c.rcvEOF {
+			p := tcp.Payload
+			if free := goTCPRcvBufSize - c.rcvBuf.Len(); len(p) > free {
+				p = p[:free] // peer overran our window; drop the rest
+			}
+			if !c.closed {
+				c.rcvBuf.Write(p)
+			}
+			c.rcvNxt += uint32(len(p))
+			if tcp.FIN && len(p) == len(tcp.Payload) {
+				c.rcvNxt++
+				c.rcvEOF = true
+			}
+			c.cond.Broadcast()
+		}
+		// Otherwise it's out of order or a retransmit; just re-ACK.
+	}
+	var frame []byte
+	if ack {
+		frame = c.segmentLocked(&layers.TCP{}, nil)
+	}
+	done := c.rcvEOF && c.closed && c.sndUna == c.sndNxt
+	c.mu.Unlock()
+
+	c.st.send(frame)
+	if done {
+		c.st.remove(c)
+	}
+}
+
+var errConnReset = errors.New("connection reset by peer")
+
+// abort resets the connection, sending the peer a RST.
+func (c *goTCPConn) abort() {
+	c.mu.Lock()
+	if c.reset {
+		c.mu.Unlock()
+		return
+	}
+	c.reset = true
+	frame := c.segmentLocked(&layers.TCP{RST: true}, nil)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.st.send(frame)
+	c.st.remove(c)
+}
+
+// refuse resets the connection before its SYN-ACK was sent, as a closed
+// port would, sending the peer a RST that acknowledges its SYN.
+func (c *goTCPConn) refuse() {
+	c.mu.Lock()
+	if c.reset {
+		c.mu.Unlock()
+		return
+	}
+	c.reset = true
+	frame := c.st.segment(c.flow, &layers.TCP{RST: true, ACK: true, Ack: c.rcvNxt}, nil)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.st.send(frame)
+	c.st.remove(c)
+}
+
+// deadlinePassed reports whether t is set and in the past on the server's
+// clock.
+func (c *goTCPConn) deadlinePassed(t time.Time) bool {
+	return !t.IsZero() && !c.st.n.s.clock.Now().Before(t)
+}
+
+func (c *goTCPConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	for c.rcvBuf.Len() == 0 && !c.rcvEOF && !c.reset && !c.closed && !c.deadlinePassed(c.rDeadline) {
+		c.cond.Wait()
+	}
+	switch {
+	case c.rcvBuf.Len() > 0:
+		freeBefore := goTCPRcvBufSize - c.rcvBuf.Len()
+		n, _ := c.rcvBuf.Read(p)
+		var frame []byte
+		if freeBefore < goTCPRcvBufSize/2 && goTCPRcvBufSize-c.rcvBuf.Len() >= goTCPRcvBufSize/2 {
+			// Our window had mostly closed and has now reopened;
+			// tell the peer so it doesn't stall.
+			frame = c.segmentLocked(&layers.TCP{}, nil)
+		}
+		c.mu.Unlock()
+		c.st.send(frame)
+		return n, nil
+	case c.reset:
+		c.mu.Unlock()
+		return 0, errConnReset
+	case c.rcvEOF:
+		c.mu.Unlock()
+		return 0, io.EOF
+	case c.closed:
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.mu.Unlock()
+	return 0, os.ErrDeadlineExceeded
+}
+
+func (c *goTCPConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var written int
+	for len(b) > 0 {
+		c.mu.Lock()
+		for !c.reset && !c.closed && !c.deadlinePassed(c.wDeadline) &&
+			(!c.established || c.sndNxt-c.sndUna >= c.sndWnd) {
+			c.cond.Wait()
+		}
+		switch {
+		case c.reset:
+			c.mu.Unlock()
+			return written, errConnReset
+		case c.closed:
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		case c.deadlinePassed(c.wDeadline):
+			c.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := min(len(b), c.mss, int(c.sndWnd-(c.sndNxt-c.sndUna)))
+		frame := c.segmentLocked(&layers.TCP{PSH: true}, b[:n])
+		c.sndNxt += uint32(n)
+		c.mu.Unlock()
+
+		c.st.send(frame)
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (c *goTCPConn) Close() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	if c.closed || c.reset {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.rcvBuf.Reset()
+	frame := c.segmentLocked(&layers.TCP{FIN: true}, nil)
+	c.sndNxt++
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.st.send(frame)
+	return nil
+}
+
+func (c *goTCPConn) LocalAddr() net.Addr  { return net.TCPAddrFromAddrPort(c.flow.remote) }
+func (c *goTCPConn) RemoteAddr() net.Addr { return net.TCPAddrFromAddrPort(c.flow.node) }
+
+func (c *goTCPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *goTCPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rDeadline = t
+	c.wakeAtLocked(t)
+	return nil
+}
+
+func (c *goTCPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wDeadline = t
+	c.wakeAtLocked(t)
+	return nil
+}
+
+// wakeAtLocked arranges for blocked readers and writers to wake up at t to
+// notice their deadline passing.
+func (c *goTCPConn) wakeAtLocked(t time.Time) {
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return
+	}
+	c.st.n.s.afterFunc(t.Sub(c.st.n.s.clock.Now()), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.cond.Broadcast()
+	})
+}
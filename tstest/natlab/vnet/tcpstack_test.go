@@ -0,0 +1,1099 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"tailscale.com/tailcfg"
+)
+
+// testStack is a gvisor netstack acting as a node's OS, attached to a Server
+// with NodeEndpoint. It's used by tests that need a real client TCP stack.
+type testStack struct {
+	t     testing.TB
+	ns    *stack.Stack
+	gwMAC MAC
+}
+
+func newTestStack(t testing.TB, s *Server, n *Node) *testStack {
+	t.Helper()
+	ep, err := s.NodeEndpoint(n.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	linkEP := channel.New(4096, 1500, tcpip.LinkAddress(n.mac.HWAddr()))
+	if err := ns.CreateNIC(nicID, ethernet.New(linkEP)); err != nil {
+		t.Fatalf("CreateNIC: %v", err)
+	}
+	lanIP := n.n.lanIP
+	if err := ns.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFrom4(lanIP.As4()),
+			PrefixLen: n.n.net.lanIP.Bits(),
+		},
+	}, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress: %v", err)
+	}
+	ns.SetRouteTable([]tcpip.Route{{
+		Destination: header.IPv4EmptySubnet,
+		Gateway:     tcpip.AddrFrom4(n.n.net.lanIP.Addr().As4()),
+		NIC:         nicID,
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		ep.Close()
+		ns.Close()
+	})
+	go func() {
+		for {
+			pkt := linkEP.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+			frame := pkt.ToView().AsSlice()
+			pkt.DecRef()
+			ep.Write(frame)
+		}
+	}()
+	go func() {
+		buf := make([]byte, 16<<10)
+		for {
+			n, err := ep.Read(buf)
+			if err != nil {
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Payload: buffer.MakeWithData(bytes.Clone(buf[:n])),
+			})
+			linkEP.InjectInbound(0, pkt)
+			pkt.DecRef()
+		}
+	}()
+	return &testStack{t: t, ns: ns, gwMAC: n.n.net.mac}
+}
+
+// addIPv6 gives the stack the IPv6 address ip and a default IPv6 route via
+// the network's gateway. The gateway doesn't do neighbor discovery, so its
+// MAC is added as a static neighbor.
+func (ts *testStack) addIPv6(ip netip.Addr) {
+	ts.t.Helper()
+	if err := ts.ns.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom16(ip.As16()).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		ts.t.Fatalf("AddProtocolAddress: %v", err)
+	}
+	gw := tcpip.AddrFrom16(netip.MustParseAddr("fe80::1").As16())
+	if err := ts.ns.AddStaticNeighbor(nicID, ipv6.ProtocolNumber, gw, tcpip.LinkAddress(ts.gwMAC.HWAddr())); err != nil {
+		ts.t.Fatalf("AddStaticNeighbor: %v", err)
+	}
+	ts.ns.AddRoute(tcpip.Route{
+		Destination: header.IPv6EmptySubnet,
+		Gateway:     gw,
+		NIC:         nicID,
+	})
+}
+
+func (ts *testStack) dialTCP(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+	if dst.Addr().Is6() {
+		return gonet.DialContextTCP(ctx, ts.ns, tcpip.FullAddress{
+			NIC:  nicID,
+			Addr: tcpip.AddrFrom16(dst.Addr().As16()),
+			Port: dst.Port(),
+		}, ipv6.ProtocolNumber)
+	}
+	return gonet.DialContextTCP(ctx, ts.ns, tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFrom4(dst.Addr().As4()),
+		Port: dst.Port(),
+	}, ipv4.ProtocolNumber)
+}
+
+var (
+	testDERPIP  = netip.MustParseAddr("9.9.9.9")
+	testDERPIP6 = netip.MustParseAddr("2001:db8:9::9")
+)
+
+// newTCPTestServer returns a single-node Server using the given TCP stack,
+// with testDERPIP and testDERPIP6 as DERP IPs whose intercepted connections
+// are handed to upstream.
+func newTCPTestServer(t testing.TB, stack TCPStack, upstream func(net.Conn)) (*Server, *Node) {
+	t.Helper()
+	return newTCPTestServerConfig(t, Config{TCPStack: stack}, upstream)
+}
+
+// newTCPTestServerConfig is like newTCPTestServer, but takes the Config,
+// which must have no nodes or networks yet.
+func newTCPTestServerConfig(t testing.TB, c Config, upstream func(net.Conn)) (*Server, *Node) {
+	t.Helper()
+	n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+	return newUpstreamTestServer(t, &c, upstream), n1
+}
+
+// newUpstreamTestServer returns a Server for c, which must have no DERP map,
+// with testDERPIP and testDERPIP6 as DERP IPs. The intercepted connections to
+// them and to the control plane are handed to upstream.
+func newUpstreamTestServer(t testing.TB, c *Config, upstream func(net.Conn)) *Server {
+	t.Helper()
+	c.SetDERPMap(&tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "1a", IPv4: testDERPIP.String(), IPv6: testDERPIP6.String()}}},
+		},
+	})
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dialUpstream = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go upstream(c2)
+		return c1, nil
+	}
+	return s
+}
+
+// checkDERPEcho dials DERP at testDERPIP from ts and checks that what it
+// writes is echoed, as by an echoing upstream of newUpstreamTestServer.
+func checkDERPEcho(ctx context.Context, t *testing.T, ts *testStack) {
+	t.Helper()
+	conn, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+	if err != nil {
+		t.Fatalf("dialing DERP: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Errorf("DERP echo = %q, %v; want %q", got, err, "hello")
+	}
+}
+
+var tcpStacks = []TCPStack{TCPStackGVisor, TCPStackGo}
+
+func TestTCPStacks(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			// Echo upstream.
+			s, n1 := newTCPTestServer(t, st, func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			})
+			ts := newTestStack(t, s, n1)
+
+			// The built-in port 123 greeter.
+			c, err := ts.dialTCP(ctx, netip.MustParseAddrPort("1.2.3.4:123"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(c)
+			c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "Hello from Go\nGoodbye.\n"; string(got) != want {
+				t.Errorf("port 123 got %q; want %q", got, want)
+			}
+
+			// A bulk round trip through the DERP proxy.
+			c, err = ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			want := bytes.Repeat([]byte("0123456789abcdef"), 64<<10) // 1MB
+			go c.Write(want)
+			got = make([]byte, len(want))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("echoed data differs")
+			}
+		})
+	}
+}
+
+func BenchmarkTCPStack(b *testing.B) {
+	const chunk = 1 << 20
+	for _, st := range tcpStacks {
+		b.Run(string(st), func(b *testing.B) {
+			// The upstream reads each chunk and acknowledges it with one byte.
+			s, n1 := newTCPTestServer(b, st, func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, chunk)
+				for {
+					if _, err := io.ReadFull(c, buf); err != nil {
+						return
+					}
+					if _, err := c.Write([]byte{1}); err != nil {
+						return
+					}
+				}
+			})
+			ts := newTestStack(b, s, n1)
+			c, err := ts.dialTCP(context.Background(), netip.AddrPortFrom(testDERPIP, 443))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			data := make([]byte, chunk)
+			ack := make([]byte, 1)
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := c.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(c, ack); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPStackBufferSizes(t *testing.T) {
+	const bufSize = 4096
+
+	// A large transfer to the gvisor stack is never offered more than its
+	// receive buffer.
+	t.Run("receive", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		s, n1 := newTCPTestServerConfig(t, Config{TCPReceiveBufferSize: bufSize}, func(c net.Conn) {
+			defer c.Close()
+			io.Copy(c, c)
+		})
+		defer s.Close()
+		frames, stop := s.TapNode(n1.mac)
+		defer stop()
+		maxWindow := make(chan int, 1)
+		go func() {
+			var shift, largest int
+			for f := range frames {
+				pkt := gopacket.NewPacket(f, layers.LayerTypeEthernet, gopacket.Default)
+				th, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+				if !ok || th.SrcPort != 443 {
+					continue
+				}
+				win := int(th.Window)
+				if th.SYN {
+					for _, o := range th.Options {
+						if o.OptionType == layers.TCPOptionKindWindowScale && len(o.OptionData) == 1 {
+							shift = int(o.OptionData[0])
+						}
+					}
+				} else {
+					win <<= shift
+				}
+				largest = max(largest, win)
+			}
+			maxWindow <- largest
+		}()
+
+		ts := newTestStack(t, s, n1)
+		c, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bytes.Repeat([]byte("0123456789abcdef"), 16<<10) // 256KB
+		go c.Write(want)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatalf("after %d bytes: %v", len(got), err)
+		}
+		c.Close()
+		if !bytes.Equal(got, want) {
+			t.Error("echoed data differs")
+		}
+		stop()
+		if m := <-maxWindow; m == 0 || m > bufSize {
+			t.Errorf("largest window advertised = %d; want 1 to %d", m, bufSize)
+		}
+	})
+
+	// Data from upstream to a node that isn't reading stalls once the
+	// node's window and the gvisor stack's send buffer are full.
+	t.Run("send", func(t *testing.T) {
+		buffered := func(c Config) int64 {
+			t.Helper()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			var written atomic.Int64
+			s, n1 := newTCPTestServerConfig(t, c, func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Write(buf)
+					written.Add(int64(n))
+					if err != nil {
+						return
+					}
+				}
+			})
+			defer s.Close()
+			ts := newTestStack(t, s, n1)
+			opt := tcpip.TCPReceiveBufferSizeRangeOption{Min: bufSize, Default: bufSize, Max: bufSize}
+			if err := ts.ns.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+				t.Fatalf("setting the node's receive buffer: %v", err)
+			}
+			conn, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for last := int64(-1); ; {
+				select {
+				case <-ctx.Done():
+					t.Fatal("upstream writes didn't stall")
+				case <-time.After(200 * time.Millisecond):
+				}
+				n := written.Load()
+				if n == last {
+					return n
+				}
+				last = n
+			}
+		}
+		def := buffered(Config{})
+		small := buffered(Config{TCPSendBufferSize: bufSize})
+		t.Logf("bytes written before stalling: default=%d, with %d byte send buffer=%d", def, bufSize, small)
+		// The proxy also holds up to 32KB read from upstream.
+		if small > 64<<10 {
+			t.Errorf("with %d byte send buffer, %d bytes written before stalling; want at most %d", bufSize, small, 64<<10)
+		}
+		if small >= def {
+			t.Errorf("with small send buffer, %d bytes written before stalling; want fewer than default (%d)", small, def)
+		}
+	})
+}
+
+func TestDetachNodeResetsTCP(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			upstreamStarted := make(chan struct{})
+			upstreamDone := make(chan struct{})
+			s, n1 := newTCPTestServer(t, st, func(c net.Conn) {
+				defer close(upstreamDone)
+				defer c.Close()
+				if _, err := c.Read(make([]byte, 1)); err != nil {
+					return
+				}
+				close(upstreamStarted)
+				io.Copy(io.Discard, c)
+			})
+			ts := newTestStack(t, s, n1)
+			c, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			// Wait for the connection to be proxied, not just accepted.
+			if _, err := c.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-upstreamStarted:
+			case <-ctx.Done():
+				t.Fatal("upstream got no data")
+			}
+
+			if err := s.DetachNode(n1.mac); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-upstreamDone:
+			case <-ctx.Done():
+				t.Fatal("intercepted connection from detached node still open")
+			}
+		})
+	}
+}
+
+func TestTCPStacksIPv6DERP(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			dialed := make(chan string, 1)
+			s, n1 := newTCPTestServer(t, st, func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			})
+			dialUpstream := s.dialUpstream
+			s.dialUpstream = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed <- addr
+				return dialUpstream(ctx, network, addr)
+			}
+			ts := newTestStack(t, s, n1)
+			ts.addIPv6(netip.MustParseAddr("fd00::2"))
+
+			c, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP6, 443))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if got, want := <-dialed, "[2001:db8:9::9]:443"; got != want {
+				t.Errorf("dialed upstream %q; want %q", got, want)
+			}
+			want := bytes.Repeat([]byte("0123456789abcdef"), 4<<10) // 64KB
+			go c.Write(want)
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("echoed data differs")
+			}
+		})
+	}
+}
+
+func TestTCPUpstreamDialFailure(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			s, n1 := newTCPTestServer(t, st, func(c net.Conn) { c.Close() })
+			s.dialUpstream = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, errors.New("upstream unreachable")
+			}
+			ts := newTestStack(t, s, n1)
+			c, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+			if err == nil {
+				c.Close()
+				t.Fatal("dial succeeded; want the connection reset")
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("dial timed out (%v); want the connection reset", err)
+			}
+		})
+	}
+}
+
+func TestControlUpstream(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		upstream string
+		port     uint16
+		want     string
+	}{
+		{"default", "", 443, "controlplane.tailscale.com:443"},
+		{"default-http", "", 80, "controlplane.tailscale.com:80"},
+		{"configured", "headscale.example:8080", 443, "headscale.example:8080"},
+		{"configured-http", "headscale.example:8080", 80, "headscale.example:8080"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			var c Config
+			c.SetControlUpstream(tt.upstream)
+			s, n1 := newTCPTestServerConfig(t, c, func(c net.Conn) { c.Close() })
+			dialed := make(chan string, 1)
+			dialUpstream := s.dialUpstream
+			s.dialUpstream = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed <- addr
+				return dialUpstream(ctx, network, addr)
+			}
+			ts := newTestStack(t, s, n1)
+			conn, err := ts.dialTCP(ctx, netip.AddrPortFrom(s.fakeIPs.Controlplane, tt.port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			select {
+			case got := <-dialed:
+				if got != tt.want {
+					t.Errorf("dialed upstream %q; want %q", got, tt.want)
+				}
+			case <-ctx.Done():
+				t.Fatal("no upstream dialed")
+			}
+		})
+	}
+
+	var c Config
+	c.SetControlUpstream("headscale.example")
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+	if _, err := New(&c); err == nil {
+		t.Error("New with a control upstream without a port succeeded")
+	}
+}
+
+func TestLANIPv6(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	s, n1 := newTCPTestServer(t, TCPStackGVisor, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	if ip, ok := n1.LANIPv6(); ok {
+		t.Fatalf("LANIPv6 before any IPv6 traffic = %v; want none", ip)
+	}
+	ts := newTestStack(t, s, n1)
+	ip6 := netip.MustParseAddr("fd00::2")
+	ts.addIPv6(ip6)
+
+	c, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP6, 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if got, ok := n1.LANIPv6(); !ok || got != ip6 {
+		t.Errorf("LANIPv6 = %v, %v; want %v, true", got, ok, ip6)
+	}
+	lanIP, _ := n1.LANIP()
+	if hs := s.ConnHealth(); len(hs) != 1 || hs[0].LANIP != lanIP || hs[0].LANIPv6 != ip6 {
+		t.Errorf("ConnHealth = %+v; want LANIP %v, LANIPv6 %v", hs, lanIP, ip6)
+	}
+	if es := s.StartingInfo(); len(es) != 1 || es[0].LANIP != lanIP || es[0].LANIPv6 != ip6 {
+		t.Errorf("StartingInfo = %+v; want LANIP %v, LANIPv6 %v", es, lanIP, ip6)
+	}
+	agentEnd, sc := net.Pipe()
+	defer agentEnd.Close()
+	s.addIdleAgentConn(&agentConn{node: n1.n, tc: sc, added: time.Now()})
+	if acs := s.AgentConns(); len(acs) != 1 || acs[0].LANIP != lanIP || acs[0].LANIPv6 != ip6 {
+		t.Errorf("AgentConns = %+v; want LANIP %v, LANIPv6 %v", acs, lanIP, ip6)
+	}
+
+	// The node's address is the one it used last, even if it's gone back
+	// to one it used before.
+	other := netip.MustParseAddr("fd00::3")
+	for _, ip := range []netip.Addr{other, ip6} {
+		n1.n.net.noteV6Neighbor(ip, n1.mac)
+		if got, _ := n1.LANIPv6(); got != ip {
+			t.Errorf("after packet from %v, LANIPv6 = %v", ip, got)
+		}
+	}
+}
+
+func TestTCPHandshakes(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			s, n1 := newTCPTestServer(t, st, func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			})
+			defer s.Close()
+			ts := newTestStack(t, s, n1)
+			sack := tcpip.TCPSACKEnabled(true)
+			if err := ts.ns.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+				t.Fatalf("SetTransportProtocolOption SACK: %v", err)
+			}
+
+			dst := netip.AddrPortFrom(testDERPIP, 443)
+			c, err := ts.dialTCP(ctx, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			hs, err := s.TCPHandshakes(n1.Network().WANIP())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hs) != 1 {
+				t.Fatalf("got %d handshakes; want 1: %+v", len(hs), hs)
+			}
+			h := hs[0]
+			t.Logf("handshake: %+v", h)
+			if h.Flow.Src.Addr() != n1.n.lanIP || h.Flow.Dst != dst {
+				t.Errorf("flow = %v -> %v; want %v -> %v", h.Flow.Src, h.Flow.Dst, n1.n.lanIP, dst)
+			}
+			// The node's stack has a 1500 byte MTU, and offers window
+			// scaling and SACK.
+			if h.SYN.MSS == 0 || h.SYN.MSS > 1460 || h.SYN.WindowScale < 0 || !h.SYN.SACKPermitted {
+				t.Errorf("SYN options = %+v; want MSS up to 1460 with window scaling and SACK", h.SYN)
+			}
+			if !h.SYNACKSent {
+				t.Fatal("no SYN-ACK recorded")
+			}
+			want := TCPOptions{MSS: goTCPMSS, WindowScale: -1} // only MSS
+			if st == TCPStackGVisor {
+				want = TCPOptions{MSS: 1460, WindowScale: h.SYNACK.WindowScale, SACKPermitted: true}
+				if h.SYNACK.WindowScale < 0 {
+					t.Errorf("gvisor SYN-ACK didn't offer window scaling")
+				}
+			}
+			if h.SYNACK != want {
+				t.Errorf("SYN-ACK options = %+v; want %+v", h.SYNACK, want)
+			}
+
+			if _, err := s.TCPHandshakes(netip.MustParseAddr("2.9.9.9")); err == nil {
+				t.Error("TCPHandshakes for unknown network succeeded")
+			}
+		})
+	}
+}
+
+// TestDERPIPsConcurrent tests that the DERP IPs can be changed while
+// connections to them are being intercepted. Run it with -race.
+func TestDERPIPsConcurrent(t *testing.T) {
+	s, n1 := newTCPTestServer(t, TCPStackGo, func(c net.Conn) { c.Close() })
+	defer s.Close()
+	extra := netip.MustParseAddr("9.9.9.10")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 1000 {
+			if i%2 == 0 {
+				s.AddDERPIP(extra)
+			} else {
+				s.RemoveDERPIP(extra)
+			}
+		}
+	}()
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			if s.isDERPIP(extra) {
+				t.Errorf("%v is a DERP IP after being removed", extra)
+			}
+			if !s.isDERPIP(testDERPIP) {
+				t.Errorf("%v is no longer a DERP IP", testDERPIP)
+			}
+			return
+		default:
+		}
+		for _, ip := range []netip.Addr{testDERPIP, extra} {
+			if err := s.InjectTCP(n1, uint16(10000+i%50000), netip.AddrPortFrom(ip, 443), layers.TCP{SYN: true, Seq: 1, Window: 1000}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestResetTCP(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			upstreamDone := make(chan struct{})
+			s, n1 := newTCPTestServer(t, st, func(c net.Conn) {
+				defer close(upstreamDone)
+				defer c.Close()
+				io.Copy(c, c)
+			})
+			ts := newTestStack(t, s, n1)
+			dst := netip.AddrPortFrom(testDERPIP, 443)
+			c, err := ts.dialTCP(ctx, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := io.WriteString(c, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+				t.Fatal(err)
+			}
+
+			wanIP := netip.MustParseAddr("2.1.1.1")
+			src := netip.MustParseAddrPort(c.LocalAddr().String())
+			if err := s.ResetTCP(wanIP, FiveTuple{Proto: layers.IPProtocolUDP, Src: src, Dst: dst}); err == nil {
+				t.Error("ResetTCP of a UDP flow succeeded")
+			}
+			if err := s.ResetTCP(wanIP, FiveTuple{Proto: layers.IPProtocolTCP, Src: src, Dst: netip.AddrPortFrom(testDERPIP, 80)}); err == nil {
+				t.Error("ResetTCP of a nonexistent connection succeeded")
+			}
+			if err := s.ResetTCP(wanIP, FiveTuple{Proto: layers.IPProtocolTCP, Src: src, Dst: dst}); err != nil {
+				t.Fatal(err)
+			}
+
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = c.Read(make([]byte, 1))
+			if err == nil || !strings.Contains(err.Error(), "reset") {
+				t.Errorf("Read after ResetTCP = %v; want connection reset", err)
+			}
+			select {
+			case <-upstreamDone:
+			case <-ctx.Done():
+				t.Error("upstream connection not closed")
+			}
+			if err := s.ResetTCP(wanIP, FiveTuple{Proto: layers.IPProtocolTCP, Src: src, Dst: dst}); err == nil {
+				t.Error("second ResetTCP succeeded")
+			}
+		})
+	}
+}
+
+func TestTCPFaultPolicy(t *testing.T) {
+	const msg = "0123456789"
+	for _, st := range tcpStacks {
+		for _, tt := range []struct {
+			name  string
+			fault TCPFault
+			want  string // what the node reads before the conn ends
+			reset bool   // whether the conn ends with a RST
+		}{
+			{"truncate", TCPFaultTruncate, msg[:len(msg)/2], false},
+			{"reset", TCPFaultReset, "", true},
+			{"close_upstream", TCPFaultCloseUpstream, "", false},
+		} {
+			t.Run(string(st)+"/"+tt.name, func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+
+				s, n1 := newTCPTestServer(t, st, func(c net.Conn) {
+					defer c.Close()
+					io.Copy(c, c)
+				})
+				ts := newTestStack(t, s, n1)
+				dst := netip.AddrPortFrom(testDERPIP, 443)
+
+				// Only the first connection is faulted.
+				var faulted atomic.Bool
+				faultedFlow := make(chan FiveTuple, 1)
+				s.SetTCPFaultPolicy(func(flow FiveTuple, delivered int64) TCPFault {
+					if delivered != 0 || faulted.Swap(true) {
+						return TCPNoFault
+					}
+					faultedFlow <- flow
+					return tt.fault
+				})
+
+				c, err := ts.dialTCP(ctx, dst)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				if _, err := io.WriteString(c, msg); err != nil {
+					t.Fatal(err)
+				}
+				c.SetReadDeadline(time.Now().Add(5 * time.Second))
+				got, err := io.ReadAll(c)
+				if tt.reset {
+					if err == nil || !strings.Contains(err.Error(), "reset") {
+						t.Errorf("Read = %q, %v; want connection reset", got, err)
+					}
+				} else if err != nil || string(got) != tt.want {
+					t.Errorf("ReadAll = %q, %v; want %q, nil", got, err, tt.want)
+				}
+				wantFlow := FiveTuple{Proto: layers.IPProtocolTCP, Src: netip.MustParseAddrPort(c.LocalAddr().String()), Dst: dst}
+				select {
+				case got := <-faultedFlow:
+					if got != wantFlow {
+						t.Errorf("faulted flow %v; want %v", got, wantFlow)
+					}
+				default:
+					t.Error("no fault injected")
+				}
+
+				// The node reconnects, and the new connection works.
+				c2, err := ts.dialTCP(ctx, dst)
+				if err != nil {
+					t.Fatalf("reconnecting: %v", err)
+				}
+				defer c2.Close()
+				if _, err := io.WriteString(c2, msg); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, len(msg))
+				c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(c2, buf); err != nil || string(buf) != msg {
+					t.Errorf("after reconnecting, read %q, %v; want %q", buf, err, msg)
+				}
+			})
+		}
+	}
+}
+
+func TestTCPConnectDelay(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			dialed := make(chan time.Time, 1)
+			s, n1 := newTCPTestServerConfig(t, Config{TCPStack: st, TCPConnectDelay: delay}, func(c net.Conn) {
+				dialed <- time.Now()
+				c.Close()
+			})
+			ts := newTestStack(t, s, n1)
+
+			start := time.Now()
+			c, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if d := time.Since(start); d < delay {
+				t.Errorf("connection established after %v; want at least %v", d, delay)
+			} else if d > delay+5*time.Second {
+				t.Errorf("connection established after %v; want about %v", d, delay)
+			}
+			if d := (<-dialed).Sub(start); d < delay {
+				t.Errorf("upstream dialed after %v; want at least %v", d, delay)
+			}
+		})
+	}
+}
+
+func TestCheckLeaks(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			for range 3 {
+				// Echo upstream.
+				s, n1 := newTCPTestServer(t, st, func(c net.Conn) {
+					defer c.Close()
+					io.Copy(c, c)
+				})
+				if err := s.CheckLeaks(); err == nil {
+					t.Error("CheckLeaks before Close succeeded")
+				}
+				ts := newTestStack(t, s, n1)
+
+				// Leave a DERP connection and an agent connection open.
+				c, err := ts.dialTCP(ctx, netip.AddrPortFrom(testDERPIP, 443))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				if _, err := c.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+					t.Fatal(err)
+				}
+				ac, err := ts.dialTCP(ctx, netip.AddrPortFrom(s.fakeIPs.TestAgent, 8008))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ac.Close()
+				if _, ok := s.takeAgentConn(ctx, n1.n); !ok {
+					t.Fatal("no agent connection")
+				}
+
+				s.Close()
+				if err := s.CheckLeaks(); err != nil {
+					t.Errorf("CheckLeaks: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPInterceptFunc(t *testing.T) {
+	for _, st := range tcpStacks {
+		t.Run(string(st), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			s, n1 := newTCPTestServer(t, st, func(c net.Conn) { c.Close() })
+			defer s.Close()
+			ts := newTestStack(t, s, n1)
+			web := netip.MustParseAddrPort("1.2.3.4:8443")
+			s.RegisterHTTPHandler(web, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello from "+r.URL.Path)
+			}))
+
+			// By default, connections to the port aren't intercepted.
+			dialCtx, dialCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			defer dialCancel()
+			if c, err := ts.dialTCP(dialCtx, web); err == nil {
+				c.Close()
+				t.Fatalf("dial %v succeeded without intercepting it", web)
+			}
+
+			s.SetTCPInterceptFunc(func(pkt gopacket.Packet) bool {
+				if tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && uint16(tcp.DstPort) == web.Port() {
+					return true
+				}
+				return s.DefaultInterceptTCP(pkt)
+			})
+			hc := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return ts.dialTCP(ctx, netip.MustParseAddrPort(addr))
+				},
+			}}
+			res, err := hc.Get("http://" + web.String() + "/foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(body), "hello from /foo"; got != want {
+				t.Errorf("got %q; want %q", got, want)
+			}
+
+			// The built-in interceptions still work.
+			c, err := ts.dialTCP(ctx, netip.MustParseAddrPort("1.2.3.4:123"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(c)
+			c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "Hello from Go\nGoodbye.\n"; string(got) != want {
+				t.Errorf("port 123 got %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+// mustStackPacket returns an IPv4 TCP packet with a 1200 byte payload, as
+// the network's gvisor stack would send it to node n1.
+func mustStackPacket(t testing.TB, n1 *Node) []byte {
+	t.Helper()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    testDERPIP.AsSlice(),
+		DstIP:    n1.n.lanIP.AsSlice(),
+	}
+	tcp := &layers.TCP{SrcPort: 443, DstPort: 5000, ACK: true, PSH: true, Seq: 1, Ack: 1, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(bytes.Repeat([]byte("x"), 1200))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// reserializeFromStack is the old, slower way that the gvisor reader loop
+// turned packets from the stack into Ethernet frames, by parsing them and
+// reserializing each layer after an Ethernet layer. It's kept as a
+// reference for frameFromStack.
+func reserializeFromStack(n *network, pkt *stack.PacketBuffer) []byte {
+	ipRaw := pkt.ToView().AsSlice()
+	goPkt := gopacket.NewPacket(ipRaw, layers.LayerTypeIPv4, gopacket.Lazy)
+	netLayer := goPkt.NetworkLayer()
+	dstIP, _ := netip.AddrFromSlice(netLayer.NetworkFlow().Dst().Raw())
+	dstMAC, _ := n.nodeMACOfIP(dstIP)
+	sls := []gopacket.SerializableLayer{&layers.Ethernet{
+		SrcMAC:       n.mac.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}}
+	for _, layer := range goPkt.Layers() {
+		if tcp, ok := layer.(*layers.TCP); ok {
+			tcp.SetNetworkLayerForChecksum(netLayer)
+		}
+		sls = append(sls, layer.(gopacket.SerializableLayer))
+	}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, sls...)
+	return buf.Bytes()
+}
+
+func newStackPacket(raw []byte) *stack.PacketBuffer {
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(raw)})
+}
+
+func TestFrameFromStack(t *testing.T) {
+	_, n1 := newTCPTestServer(t, TCPStackGVisor, func(c net.Conn) { c.Close() })
+	raw := mustStackPacket(t, n1)
+
+	pkt := newStackPacket(raw)
+	defer pkt.DecRef()
+	got, dstMAC, ok := n1.n.net.frameFromStack(pkt)
+	if !ok {
+		t.Fatal("frameFromStack failed")
+	}
+	if dstMAC != n1.mac {
+		t.Errorf("dst MAC = %v; want %v", dstMAC, n1.mac)
+	}
+	pkt2 := newStackPacket(raw)
+	defer pkt2.DecRef()
+	if want := reserializeFromStack(n1.n.net, pkt2); !bytes.Equal(got, want) {
+		t.Errorf("frame differs from reserialized frame:\n got %x\nwant %x", got, want)
+	}
+
+	// Packets to unknown nodes aren't framed.
+	raw[19]++ // last byte of the IPv4 destination
+	pkt3 := newStackPacket(raw)
+	defer pkt3.DecRef()
+	if _, _, ok := n1.n.net.frameFromStack(pkt3); ok {
+		t.Error("frameFromStack succeeded for a packet to an unknown node")
+	}
+}
+
+func BenchmarkFrameFromStack(b *testing.B) {
+	_, n1 := newTCPTestServer(b, TCPStackGVisor, func(c net.Conn) { c.Close() })
+	n := n1.n.net
+	raw := mustStackPacket(b, n1)
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			pkt := newStackPacket(raw)
+			if _, _, ok := n.frameFromStack(pkt); !ok {
+				b.Fatal("frameFromStack failed")
+			}
+			pkt.DecRef()
+		}
+	})
+	b.Run("reserialize", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			pkt := newStackPacket(raw)
+			reserializeFromStack(n, pkt)
+			pkt.DecRef()
+		}
+	})
+}
@@ -0,0 +1,381 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+const (
+	// throttleQueueBytes is the most a throttled link queues before dropping
+	// packets: about 200ms worth at 10Mbps, like a bufferbloated router.
+	throttleQueueBytes = 256 << 10
+
+	// fairQuantum is how many bytes each flow may send per round of fair
+	// queuing.
+	fairQuantum = 1514
+
+	// udpOverhead is the size of the IPv4 and UDP headers of a UDPPacket,
+	// which count towards the throttle's bandwidth.
+	udpOverhead = 28
+)
+
+// CoDel parameters, per RFC 8289.
+const (
+	codelTarget   = 5 * time.Millisecond
+	codelInterval = 100 * time.Millisecond
+)
+
+// throttle limits the bandwidth of packets arriving at a network from the
+// internet, queueing those that arrive faster than it can send them.
+//
+// By default it has a single drop-tail FIFO queue. With fair queuing, it
+// instead queues each flow separately, serves the flows by deficit round
+// robin, and drops packets from flows with a standing queue CoDel-style.
+// With priority queuing, it has a FIFO queue per 802.1p priority and serves
+// the highest priority queue with packets.
+type throttle struct {
+	n    *network
+	rate int64 // bits per second
+	fair bool
+	prio bool
+
+	mu       sync.Mutex
+	queued   int                    // bytes queued across all flows
+	fifo     flowQueue              // if !fair && !prio
+	prioQs   [8]flowQueue           // if prio; by priorityRank
+	flows    map[flowKey]*flowQueue // if fair; flows with packets queued
+	active   []*flowQueue           // of flows, in round-robin order
+	sending  *queuedPacket          // being sent, if any
+	sendDone time.Time              // when sending is sent, or the link went idle
+	timer    tstime.TimerController // fires at sendDone; nil until first used
+}
+
+// flowKey identifies a flow for fair queuing.
+type flowKey struct {
+	src, dst netip.AddrPort
+}
+
+type queuedPacket struct {
+	p        UDPPacket
+	size     int // on the wire, in bytes
+	enqueued time.Time
+}
+
+// flowQueue is a FIFO queue of packets, with the state for serving it by
+// deficit round robin and CoDel.
+type flowQueue struct {
+	key     flowKey
+	packets []queuedPacket
+	bytes   int
+	deficit int
+
+	firstAbove time.Time // when the sojourn time will have been above target for an interval
+	dropping   bool      // whether CoDel is in its dropping state
+	dropNext   time.Time // when CoDel next drops, if dropping
+	count      int       // packets dropped since entering the dropping state
+}
+
+// txTime returns how long the link takes to send size bytes.
+func (t *throttle) txTime(size int) time.Duration {
+	return time.Duration(int64(size) * 8 * int64(time.Second) / t.rate)
+}
+
+// enqueue queues p to be sent once the link is free of the packets queued
+// before it, or drops it if the queue is full.
+func (t *throttle) enqueue(p UDPPacket) {
+	p.Payload = bytes.Clone(p.Payload) // may alias a buffer the sender reuses
+	now := t.n.s.clock.Now()
+	qp := queuedPacket{p: p, size: len(p.Payload) + udpOverhead, enqueued: now}
+
+	t.mu.Lock()
+	var drops []UDPPacket
+	if t.fair {
+		k := flowKey{p.Src, p.Dst}
+		q, ok := t.flows[k]
+		if !ok {
+			if t.flows == nil {
+				t.flows = map[flowKey]*flowQueue{}
+			}
+			q = &flowQueue{key: k}
+			t.flows[k] = q
+			t.active = append(t.active, q)
+		}
+		q.push(qp)
+		t.queued += qp.size
+		// Like fq_codel, make room by dropping from the longest flow, so a
+		// bulk flow can't push out a sparse one.
+		for t.queued > throttleQueueBytes {
+			drops = append(drops, t.dropFromLongestLocked().p)
+		}
+	} else if t.prio {
+		t.prioQs[priorityRank(p.priority)].push(qp)
+		t.queued += qp.size
+		// Make room by dropping the newest packets of the lowest priority,
+		// which may be this one.
+		for t.queued > throttleQueueBytes {
+			drops = append(drops, t.dropLowestPriorityLocked().p)
+		}
+	} else if t.queued+qp.size > throttleQueueBytes {
+		drops = append(drops, p)
+	} else {
+		t.fifo.push(qp)
+		t.queued += qp.size
+	}
+	if t.sending == nil && t.sendDone.Before(now) {
+		t.sendDone = now // the link was idle
+	}
+	sent := t.serveLocked(now)
+	t.mu.Unlock()
+
+	for _, p := range drops {
+		t.n.s.noteDrop(DropQueueFull, p.Src, p.Dst)
+	}
+	t.finish(sent)
+}
+
+// serve is called when the packet being sent should be done.
+func (t *throttle) serve() {
+	t.mu.Lock()
+	sent := t.serveLocked(t.n.s.clock.Now())
+	t.mu.Unlock()
+	t.finish(sent)
+}
+
+// serveLocked moves the packets that the link is done sending by now out of
+// the queue, and sets the timer for the next. It returns the packets sent and
+// any dropped by CoDel. t.mu must be held.
+func (t *throttle) serveLocked(now time.Time) (sent []servedPacket) {
+	for {
+		if t.sending != nil {
+			if now.Before(t.sendDone) {
+				if t.timer == nil {
+					t.timer = t.n.s.afterFunc(t.sendDone.Sub(now), t.serve)
+				} else {
+					t.timer.Reset(t.sendDone.Sub(now))
+				}
+				return sent
+			}
+			sent = append(sent, servedPacket{p: t.sending.p})
+			t.sending = nil
+		}
+		// The next packet starts when the previous one is done, which is
+		// now if the link was idle, even if the timer fired late.
+		start := t.sendDone
+		qp, drops, ok := t.dequeueLocked(start)
+		for _, p := range drops {
+			sent = append(sent, servedPacket{p: p, dropped: true})
+		}
+		if !ok {
+			return sent
+		}
+		t.sending = &qp
+		t.sendDone = start.Add(t.txTime(qp.size))
+	}
+}
+
+type servedPacket struct {
+	p       UDPPacket
+	dropped bool // by CoDel
+}
+
+// finish delivers or notes the drop of the packets returned by serveLocked.
+func (t *throttle) finish(sent []servedPacket) {
+	for _, sp := range sent {
+		if sp.dropped {
+			t.n.s.noteDrop(DropAQM, sp.p.Src, sp.p.Dst)
+		} else {
+			t.n.deliverOverLink(sp.p)
+		}
+	}
+}
+
+// dequeueLocked returns the next packet to send at now, and any packets
+// dropped by CoDel on the way. t.mu must be held.
+func (t *throttle) dequeueLocked(now time.Time) (_ queuedPacket, drops []UDPPacket, ok bool) {
+	if t.prio {
+		for i := len(t.prioQs) - 1; i >= 0; i-- {
+			if qp, ok := t.prioQs[i].pop(); ok {
+				t.queued -= qp.size
+				return qp, nil, true
+			}
+		}
+		return queuedPacket{}, nil, false
+	}
+	if !t.fair {
+		qp, ok := t.fifo.pop()
+		if ok {
+			t.queued -= qp.size
+		}
+		return qp, nil, ok
+	}
+	for len(t.active) > 0 {
+		q := t.active[0]
+		if q.deficit <= 0 {
+			q.deficit += fairQuantum
+			t.active = append(t.active[1:], q)
+			continue
+		}
+		before := q.bytes
+		qp, qdrops, ok := q.codelPop(now)
+		t.queued -= before - q.bytes
+		drops = append(drops, qdrops...)
+		if !ok {
+			// Emptied, maybe by CoDel.
+			t.active = t.active[1:]
+			delete(t.flows, q.key)
+			continue
+		}
+		q.deficit -= qp.size
+		if len(q.packets) == 0 {
+			t.active = t.active[1:]
+			delete(t.flows, q.key)
+		}
+		return qp, drops, true
+	}
+	return queuedPacket{}, drops, false
+}
+
+// dropFromLongestLocked drops and returns the packet at the head of the flow
+// with the most bytes queued. t.mu must be held, and a packet queued.
+func (t *throttle) dropFromLongestLocked() queuedPacket {
+	var longest *flowQueue
+	for _, q := range t.active {
+		if longest == nil || q.bytes > longest.bytes {
+			longest = q
+		}
+	}
+	qp, _ := longest.pop()
+	t.queued -= qp.size
+	if len(longest.packets) == 0 {
+		i := 0
+		for t.active[i] != longest {
+			i++
+		}
+		t.active = append(t.active[:i], t.active[i+1:]...)
+		delete(t.flows, longest.key)
+	}
+	return qp
+}
+
+// dropLowestPriorityLocked drops and returns the newest packet of the lowest
+// priority with packets queued. t.mu must be held, and a packet queued.
+func (t *throttle) dropLowestPriorityLocked() queuedPacket {
+	for i := range t.prioQs {
+		q := &t.prioQs[i]
+		if len(q.packets) == 0 {
+			continue
+		}
+		last := len(q.packets) - 1
+		qp := q.packets[last]
+		q.packets[last] = queuedPacket{}
+		q.packets = q.packets[:last]
+		q.bytes -= qp.size
+		t.queued -= qp.size
+		return qp
+	}
+	panic("no packets queued")
+}
+
+// priorityRank returns the precedence of 802.1p priority p among the traffic
+// types of IEEE 802.1Q, from 0 for the lowest to 7, in which background (1)
+// is below best effort (0).
+func priorityRank(p uint8) int {
+	switch p {
+	case 0:
+		return 1
+	case 1:
+		return 0
+	}
+	return int(p & 7)
+}
+
+func (q *flowQueue) push(qp queuedPacket) {
+	q.packets = append(q.packets, qp)
+	q.bytes += qp.size
+}
+
+func (q *flowQueue) pop() (_ queuedPacket, ok bool) {
+	if len(q.packets) == 0 {
+		return queuedPacket{}, false
+	}
+	qp := q.packets[0]
+	q.packets[0] = queuedPacket{}
+	q.packets = q.packets[1:]
+	q.bytes -= qp.size
+	return qp, true
+}
+
+// codelPop returns the next packet of q to send at now, dropping packets
+// from its head per the CoDel algorithm of RFC 8289 while they've spent too
+// long queued.
+func (q *flowQueue) codelPop(now time.Time) (_ queuedPacket, drops []UDPPacket, ok bool) {
+	qp, ok := q.pop()
+	if !ok {
+		q.dropping = false
+		return qp, nil, false
+	}
+	okToDrop := q.codelOKToDrop(qp, now)
+	switch {
+	case q.dropping && !okToDrop:
+		q.dropping = false
+	case q.dropping:
+		for !now.Before(q.dropNext) && q.dropping {
+			drops = append(drops, qp.p)
+			q.count++
+			if qp, ok = q.pop(); !ok {
+				q.dropping = false
+				return qp, drops, false
+			}
+			if q.codelOKToDrop(qp, now) {
+				q.dropNext = codelControlLaw(q.dropNext, q.count)
+			} else {
+				q.dropping = false
+			}
+		}
+	case okToDrop:
+		drops = append(drops, qp.p)
+		if qp, ok = q.pop(); !ok {
+			return qp, drops, false
+		}
+		q.codelOKToDrop(qp, now)
+		q.dropping = true
+		// Resume near the previous drop rate if the flow only briefly left
+		// the dropping state.
+		if q.count > 2 && now.Sub(q.dropNext) < 16*codelInterval {
+			q.count -= 2
+		} else {
+			q.count = 1
+		}
+		q.dropNext = codelControlLaw(now, q.count)
+	}
+	return qp, drops, true
+}
+
+// codelOKToDrop reports whether CoDel may drop qp, dequeued at now, because
+// the flow's packets have been queued longer than the target for at least an
+// interval.
+func (q *flowQueue) codelOKToDrop(qp queuedPacket, now time.Time) bool {
+	if now.Sub(qp.enqueued) < codelTarget || q.bytes <= fairQuantum {
+		q.firstAbove = time.Time{}
+		return false
+	}
+	if q.firstAbove.IsZero() {
+		q.firstAbove = now.Add(codelInterval)
+		return false
+	}
+	return !now.Before(q.firstAbove)
+}
+
+// codelControlLaw returns when CoDel next drops after t, having dropped count
+// packets: sooner the more it has dropped.
+func codelControlLaw(t time.Time, count int) time.Time {
+	return t.Add(time.Duration(float64(codelInterval) / math.Sqrt(float64(count))))
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ExportTopology returns a Graphviz DOT graph of the server's current
+// topology, for documenting and debugging tests: the internet, each network
+// (its WAN IP, LAN prefix and NAT type) and its link to the internet, each
+// node (its MAC and current LAN IP) and its link to its network, and each
+// routed subnet and the node it's routed via.
+//
+// Render it with, for example, "dot -Tsvg".
+func (s *Server) ExportTopology() ([]byte, error) {
+	s.mu.Lock()
+	nodes := slices.Clone(s.nodes)
+	s.mu.Unlock()
+
+	nets := make([]*network, 0, len(s.networks))
+	for n := range s.networks {
+		nets = append(nets, n)
+	}
+	slices.SortFunc(nets, func(a, b *network) int { return a.wanIP.Compare(b.wanIP) })
+
+	var buf bytes.Buffer
+	buf.WriteString("graph vnet {\n")
+	buf.WriteString("\tinternet [shape=ellipse, label=\"internet\"];\n")
+	for _, n := range nets {
+		id := n.dotID()
+		fmt.Fprintf(&buf, "\t%s [shape=box, label=%s];\n", id,
+			dotLabel(n.wanIP.String(), n.lanIP.String(), string(n.natStyle.Load())+" NAT"))
+		fmt.Fprintf(&buf, "\tinternet -- %s [label=%s];\n", id, dotLabel("WAN "+n.wanIP.String()))
+	}
+	for _, nd := range nodes {
+		mac := nd.mac.Load()
+		n := nd.net
+		n.mu.Lock()
+		lanIP := nd.lanIP
+		n.mu.Unlock()
+		ipLabel := "no LAN IP"
+		if lanIP.IsValid() {
+			ipLabel = lanIP.String()
+		}
+		fmt.Fprintf(&buf, "\t%s [label=%s];\n", dotNodeID(mac), dotLabel(mac.String(), ipLabel))
+		fmt.Fprintf(&buf, "\t%s -- %s;\n", n.dotID(), dotNodeID(mac))
+	}
+	for _, n := range nets {
+		for _, sn := range n.subnets {
+			id := strconv.Quote("subnet " + sn.prefix.String())
+			fmt.Fprintf(&buf, "\t%s [shape=box, style=dashed, label=%s];\n", id, dotLabel(sn.prefix.String()))
+			fmt.Fprintf(&buf, "\t%s -- %s [label=%s];\n", dotNodeID(sn.via.mac.Load()), id, dotLabel("route "+sn.prefix.String()))
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// dotID returns the quoted ID of n in the graph of ExportTopology.
+func (n *network) dotID() string {
+	return strconv.Quote("net " + n.wanIP.String())
+}
+
+// dotNodeID returns the quoted ID of the node with the given MAC in the graph
+// of ExportTopology.
+func dotNodeID(mac MAC) string {
+	return strconv.Quote("node " + mac.String())
+}
+
+// dotLabel returns a quoted DOT label of the given lines.
+func dotLabel(lines ...string) string {
+	return strconv.Quote(strings.Join(lines, "\n"))
+}
@@ -15,24 +15,30 @@
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
 	"os/exec"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"go4.org/mem"
+	"go4.org/netipx"
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -40,13 +46,19 @@
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/waiter"
+	"tailscale.com/metrics"
+	"tailscale.com/net/netutil"
 	"tailscale.com/net/stun"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/set"
 )
@@ -54,34 +66,117 @@
 const nicID = 1
 const stunPort = 3478
 
+// PopulateDERPMapIPs adds the IP addresses of the DERP servers in the DERP
+// map reported by "tailscale debug derp-map" to those whose TCP connections
+// are intercepted and proxied to the real DERP servers. It requires a
+// tailscale binary in $PATH; hermetic tests can use [Config.SetDERPMap]
+// instead, or [Server.PopulateDERPMapFrom] with a saved map.
 func (s *Server) PopulateDERPMapIPs() error {
 	out, err := exec.Command("tailscale", "debug", "derp-map").Output()
 	if err != nil {
 		return fmt.Errorf("tailscale debug derp-map: %v", err)
 	}
+	return s.PopulateDERPMapFrom(bytes.NewReader(out))
+}
+
+// PopulateDERPMapFrom is like [Server.PopulateDERPMapIPs], but reads the DERP
+// map as JSON from r, such as a file or an embedded copy of the output of
+// "tailscale debug derp-map", rather than running the tailscale binary.
+func (s *Server) PopulateDERPMapFrom(r io.Reader) error {
 	var dm tailcfg.DERPMap
-	if err := json.Unmarshal(out, &dm); err != nil {
+	if err := json.NewDecoder(r).Decode(&dm); err != nil {
 		return fmt.Errorf("unmarshal DERPMap: %v", err)
 	}
+	return s.addDERPMapIPs(&dm)
+}
+
+// addDERPMapIPs adds the static IPv4 and IPv6 addresses of dm's DERP servers
+// to s.derpIPs. If any is invalid, none are added.
+func (s *Server) addDERPMapIPs(dm *tailcfg.DERPMap) error {
+	var ips []netip.Addr
 	for _, r := range dm.Regions {
+		if r == nil {
+			continue
+		}
 		for _, n := range r.Nodes {
+			if n == nil {
+				continue
+			}
 			if n.IPv4 != "" {
-				s.derpIPs.Add(netip.MustParseAddr(n.IPv4))
+				ip, err := netip.ParseAddr(n.IPv4)
+				if err != nil || !ip.Is4() {
+					return fmt.Errorf("DERP server %q has invalid IPv4 %q", n.Name, n.IPv4)
+				}
+				ips = append(ips, ip)
+			}
+			if n.IPv6 != "" {
+				ip, err := netip.ParseAddr(n.IPv6)
+				if err != nil || !ip.Is6() || ip.Is4In6() {
+					return fmt.Errorf("DERP server %q has invalid IPv6 %q", n.Name, n.IPv6)
+				}
+				ips = append(ips, ip)
 			}
 		}
 	}
+	s.derpMu.Lock()
+	defer s.derpMu.Unlock()
+	for _, ip := range ips {
+		s.derpIPs.Add(ip)
+	}
 	return nil
 }
 
+// AddDERPIP adds ip to the IPs of DERP servers whose TCP connections are
+// intercepted and proxied to the real DERP servers, such as after the DERP
+// map changes. It's safe to call while the server is handling traffic;
+// connections already intercepted are unaffected.
+func (s *Server) AddDERPIP(ip netip.Addr) {
+	s.derpMu.Lock()
+	defer s.derpMu.Unlock()
+	s.derpIPs.Add(ip.Unmap())
+}
+
+// RemoveDERPIP removes ip from the IPs of DERP servers, so that new TCP
+// connections to it are no longer intercepted. It's safe to call while the
+// server is handling traffic; connections already intercepted are unaffected.
+func (s *Server) RemoveDERPIP(ip netip.Addr) {
+	s.derpMu.Lock()
+	defer s.derpMu.Unlock()
+	s.derpIPs.Delete(ip.Unmap())
+}
+
+// isDERPIP reports whether ip is the IP of a DERP server whose TCP
+// connections are intercepted.
+func (s *Server) isDERPIP(ip netip.Addr) bool {
+	s.derpMu.Lock()
+	defer s.derpMu.Unlock()
+	return s.derpIPs.Contains(ip)
+}
+
 func (n *network) InitNAT(natType NAT) error {
 	ctor, ok := natTypes[natType]
 	if !ok {
 		return fmt.Errorf("unknown NAT type %q", natType)
 	}
-	t, err := ctor(n)
+	var t NATTable
+	var err error
+	if len(n.extraWANs) > 0 {
+		t, err = newMultiWANNAT(n, append([]netip.Addr{n.wanIP}, n.extraWANs...), n.wanPolicy, ctor)
+	} else {
+		t, err = ctor(n)
+	}
 	if err != nil {
 		return fmt.Errorf("error creating NAT type %q for network %v: %w", natType, n.wanIP, err)
 	}
+	if n.portFlapping > 0 {
+		t = &portFlappingNAT{NATTable: t, frac: n.portFlapping, rand: n.Rand(), timeout: n.natTimeout}
+	}
+	if n.churnEvery > 0 {
+		t = &churningNAT{NATTable: t, every: n.churnEvery, frac: n.churnFrac, rand: n.Rand()}
+	}
+	if n.s.logNAT {
+		t = &loggingNAT{NATTable: t, wanIP: n.wanIP, logf: n.s.logf}
+	}
 	n.setNATTable(t)
 	n.natStyle.Store(natType)
 	return nil
@@ -95,6 +190,8 @@ func (n *network) setNATTable(nt NATTable) {
 
 // SoleLANIP implements [IPPool].
 func (n *network) SoleLANIP() (netip.Addr, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if len(n.nodesByIP) != 1 {
 		return netip.Addr{}, false
 	}
@@ -107,10 +204,58 @@ func (n *network) SoleLANIP() (netip.Addr, bool) {
 // WANIP implements [IPPool].
 func (n *network) WANIP() netip.Addr { return n.wanIP }
 
+// Rand implements [IPPool].
+func (n *network) Rand() *rand.Rand { return n.s.rand }
+
+// MappingTimeout implements [IPPool].
+func (n *network) MappingTimeout() time.Duration { return n.natTimeout }
+
+// PortAllocation implements [IPPool].
+func (n *network) PortAllocation() (PortAllocation, uint16) { return n.portAlloc, n.basePort }
+
+// MaxFlows implements [IPPool].
+func (n *network) MaxFlows() (int, FlowLimitPolicy) { return n.maxFlows, n.flowPolicy }
+
+// handleTCP implements [tcpInterceptor] for the gvisor TCP stack by injecting
+// the packet into the network's gvisor stack.
+func (n *network) handleTCP(packet gopacket.Packet) {
+	if n.s.shutdownCtx.Err() != nil {
+		return // closed
+	}
+	ipp := packet.NetworkLayer()
+	proto := header.IPv4ProtocolNumber
+	if ipp.LayerType() == layers.LayerTypeIPv6 {
+		proto = header.IPv6ProtocolNumber
+	}
+	pktCopy := make([]byte, 0, len(ipp.LayerContents())+len(ipp.LayerPayload()))
+	pktCopy = append(pktCopy, ipp.LayerContents()...)
+	pktCopy = append(pktCopy, ipp.LayerPayload()...)
+	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(pktCopy),
+	})
+	n.linkEP.InjectInbound(proto, packetBuf)
+	packetBuf.DecRef()
+}
+
+// initStack initializes the network's TCP stack for intercepted
+// connections, per Config.TCPStack.
 func (n *network) initStack() error {
+	switch n.s.tcpStackType {
+	case TCPStackGo:
+		n.tcpStack = newGoTCPStack(n)
+		return nil
+	case TCPStackGVisor:
+		n.tcpStack = n
+		return n.initGVisorStack()
+	}
+	return fmt.Errorf("unknown TCP stack %q", n.s.tcpStackType)
+}
+
+func (n *network) initGVisorStack() error {
 	n.ns = stack.New(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocolFactory{
 			ipv4.NewProtocol,
+			ipv6.NewProtocol,
 			arp.NewProtocol,
 		},
 		TransportProtocols: []stack.TransportProtocolFactory{
@@ -118,11 +263,24 @@ func (n *network) initStack() error {
 			icmp.NewProtocol4,
 		},
 	})
-	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
+	sackEnabledOpt := tcpip.TCPSACKEnabled(n.s.tcpSACK) // TCP SACK is disabled by default in gvisor
 	tcpipErr := n.ns.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
 	if tcpipErr != nil {
 		return fmt.Errorf("SetTransportProtocolOption SACK: %v", tcpipErr)
 	}
+	if size := n.s.tcpReceiveBufferSize; size != 0 {
+		// Pin min, default, and max so auto-tuning doesn't move it.
+		opt := tcpip.TCPReceiveBufferSizeRangeOption{Min: size, Default: size, Max: size}
+		if tcpipErr := n.ns.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpipErr != nil {
+			return fmt.Errorf("SetTransportProtocolOption receive buffer: %v", tcpipErr)
+		}
+	}
+	if size := n.s.tcpSendBufferSize; size != 0 {
+		opt := tcpip.TCPSendBufferSizeRangeOption{Min: size, Default: size, Max: size}
+		if tcpipErr := n.ns.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpipErr != nil {
+			return fmt.Errorf("SetTransportProtocolOption send buffer: %v", tcpipErr)
+		}
+	}
 	n.linkEP = channel.New(512, 1500, tcpip.LinkAddress(n.mac.HWAddr()))
 	if tcpipProblem := n.ns.CreateNIC(nicID, n.linkEP); tcpipProblem != nil {
 		return fmt.Errorf("CreateNIC: %v", tcpipProblem)
@@ -148,16 +306,19 @@ func (n *network) initStack() error {
 			Destination: ipv4Subnet,
 			NIC:         nicID,
 		},
+		{
+			Destination: header.IPv6EmptySubnet,
+			NIC:         nicID,
+		},
 	})
 
-	const tcpReceiveBufferSize = 0 // default
 	const maxInFlightConnectionAttempts = 8192
-	tcpFwd := tcp.NewForwarder(n.ns, tcpReceiveBufferSize, maxInFlightConnectionAttempts, n.acceptTCP)
+	tcpFwd := tcp.NewForwarder(n.ns, n.s.tcpReceiveBufferSize, maxInFlightConnectionAttempts, n.acceptTCP) // 0 means default
 	n.ns.SetTransportProtocolHandler(tcp.ProtocolNumber, func(tei stack.TransportEndpointID, pb *stack.PacketBuffer) (handled bool) {
 		return tcpFwd.HandlePacket(tei, pb)
 	})
 
-	go func() {
+	n.s.goTracked(func() {
 		for {
 			pkt := n.linkEP.ReadContext(n.s.shutdownCtx)
 			if pkt == nil {
@@ -168,56 +329,57 @@ func (n *network) initStack() error {
 				continue
 			}
 
-			ipRaw := pkt.ToView().AsSlice()
-			goPkt := gopacket.NewPacket(
-				ipRaw,
-				layers.LayerTypeIPv4, gopacket.Lazy)
-			layerV4 := goPkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-
-			dstIP, _ := netip.AddrFromSlice(layerV4.DstIP)
-			node, ok := n.nodesByIP[dstIP]
+			frame, dstMAC, ok := n.frameFromStack(pkt)
+			pkt.DecRef()
 			if !ok {
-				log.Printf("no MAC for dest IP %v", dstIP)
 				continue
 			}
-			eth := &layers.Ethernet{
-				SrcMAC:       n.mac.HWAddr(),
-				DstMAC:       node.mac.HWAddr(),
-				EthernetType: layers.EthernetTypeIPv4,
-			}
-			buffer := gopacket.NewSerializeBuffer()
-			options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-			sls := []gopacket.SerializableLayer{
-				eth,
-			}
-			for _, layer := range goPkt.Layers() {
-				sl, ok := layer.(gopacket.SerializableLayer)
-				if !ok {
-					log.Fatalf("layer %s is not serializable", layer.LayerType().String())
-				}
-				switch gl := layer.(type) {
-				case *layers.TCP:
-					gl.SetNetworkLayerForChecksum(layerV4)
-				case *layers.UDP:
-					gl.SetNetworkLayerForChecksum(layerV4)
-				}
-				sls = append(sls, sl)
-			}
-
-			if err := gopacket.SerializeLayers(buffer, options, sls...); err != nil {
-				log.Printf("Serialize error: %v", err)
-				continue
-			}
-			if writeFunc, ok := n.writeFunc.Load(node.mac); ok {
-				writeFunc(buffer.Bytes())
+			n.noteSYNACK(frame)
+			if writeFunc, ok := n.writeFunc.Load(dstMAC); ok {
+				writeFunc(frame)
+				n.s.noteTapped(dstMAC, frame)
 			} else {
-				log.Printf("No writeFunc for %v", node.mac)
+				n.s.logf("No writeFunc for %v", dstMAC)
 			}
 		}
-	}()
+	})
 	return nil
 }
 
+// frameFromStack returns pkt, an IP packet that the network's gvisor stack
+// sent, as an Ethernet frame from the gateway to the node it's addressed to,
+// along with that node's MAC. The stack has already computed the packet's
+// checksums, so its bytes are used as-is.
+func (n *network) frameFromStack(pkt *stack.PacketBuffer) (frame []byte, dstMAC MAC, ok bool) {
+	const ethLen = header.EthernetMinimumSize
+	frame = make([]byte, ethLen, ethLen+pkt.Size())
+	for _, b := range pkt.AsSlices() {
+		frame = append(frame, b...)
+	}
+	ip := frame[ethLen:]
+	var dstIP netip.Addr
+	var etherType layers.EthernetType
+	switch {
+	case len(ip) >= header.IPv4MinimumSize && ip[0]>>4 == 4:
+		dstIP = netip.AddrFrom4([4]byte(ip[16:20]))
+		etherType = layers.EthernetTypeIPv4
+	case len(ip) >= header.IPv6MinimumSize && ip[0]>>4 == 6:
+		dstIP = netip.AddrFrom16([16]byte(ip[24:40]))
+		etherType = layers.EthernetTypeIPv6
+	default:
+		return nil, MAC{}, false
+	}
+	dstMAC, ok = n.nodeMACOfIP(dstIP)
+	if !ok {
+		n.s.logf("no MAC for dest IP %v", dstIP)
+		return nil, MAC{}, false
+	}
+	copy(frame[0:6], dstMAC[:])
+	copy(frame[6:12], n.mac[:])
+	binary.BigEndian.PutUint16(frame[12:14], uint16(etherType))
+	return frame, dstMAC, true
+}
+
 func netaddrIPFromNetstackIP(s tcpip.Address) netip.Addr {
 	switch s.Len() {
 	case 4:
@@ -235,73 +397,179 @@ func stringifyTEI(tei stack.TransportEndpointID) string {
 }
 
 func (n *network) acceptTCP(r *tcp.ForwarderRequest) {
+	// The forwarder runs this in its own goroutine. Count it like ours.
+	n.s.goroutines.Add(1)
+	defer n.s.goroutines.Add(-1)
+
 	reqDetails := r.ID()
 
-	log.Printf("AcceptTCP: %v", stringifyTEI(reqDetails))
+	n.s.logf("AcceptTCP: %v", stringifyTEI(reqDetails))
 	clientRemoteIP := netaddrIPFromNetstackIP(reqDetails.RemoteAddress)
 	destIP := netaddrIPFromNetstackIP(reqDetails.LocalAddress)
 	if !clientRemoteIP.IsValid() {
 		r.Complete(true) // sends a RST
 		return
 	}
+	h, ok := n.tcpTarget(
+		netip.AddrPortFrom(clientRemoteIP, reqDetails.RemotePort),
+		netip.AddrPortFrom(destIP, reqDetails.LocalPort))
+	if !ok {
+		r.Complete(true) // sends a RST
+		return
+	}
 
+	// CreateEndpoint completes the handshake, so delay it.
+	if !n.s.sleep(n.s.tcpConnectDelay) {
+		r.Complete(true) // sends a RST
+		return
+	}
+	up, ok := h.dialUpstream()
+	if !ok {
+		r.Complete(true) // sends a RST
+		return
+	}
 	var wq waiter.Queue
 	ep, err := r.CreateEndpoint(&wq)
 	if err != nil {
-		log.Printf("CreateEndpoint error for %s: %v", stringifyTEI(reqDetails), err)
+		n.s.logf("CreateEndpoint error for %s: %v", stringifyTEI(reqDetails), err)
+		if up != nil {
+			up.Close()
+		}
 		r.Complete(true) // sends a RST
 		return
 	}
 	ep.SocketOptions().SetKeepAlive(true)
 
-	if reqDetails.LocalPort == 123 {
-		r.Complete(false)
-		tc := gonet.NewTCPConn(&wq, ep)
-		io.WriteString(tc, "Hello from Go\nGoodbye.\n")
-		tc.Close()
-		return
+	// Track the endpoint for resetTCP until it's closed.
+	flow := [2]netip.AddrPort{
+		netip.AddrPortFrom(clientRemoteIP, reqDetails.RemotePort),
+		netip.AddrPortFrom(destIP, reqDetails.LocalPort),
 	}
+	n.gvisorEPs.Store(flow, ep)
+	hup := waiter.NewFunctionEntry(waiter.EventHUp, func(waiter.EventMask) {
+		n.gvisorEPs.Delete(flow)
+	})
+	wq.EventRegister(&hup)
 
-	if reqDetails.LocalPort == 8008 && destIP == fakeTestAgentIP {
-		r.Complete(false)
-		tc := gonet.NewTCPConn(&wq, ep)
-		node := n.nodesByIP[clientRemoteIP]
-		ac := &agentConn{node, tc}
-		n.s.addIdleAgentConn(ac)
-		return
+	r.Complete(false)
+	h.serve(gonet.NewTCPConn(&wq, ep), up)
+}
+
+func (n *network) close() {
+	n.linkEP.Close()
+	n.ns.Close()
+}
+
+func (n *network) resetTCP(src, dst netip.AddrPort) bool {
+	ep, ok := n.gvisorEPs.LoadAndDelete([2]netip.AddrPort{src, dst})
+	if ok {
+		ep.Abort() // sends a RST
+	}
+	return ok
+}
+
+func (n *network) resetHost(ip netip.Addr) {
+	var flows [][2]netip.AddrPort
+	n.gvisorEPs.Range(func(flow [2]netip.AddrPort, _ tcpip.Endpoint) bool {
+		if flow[0].Addr() == ip {
+			flows = append(flows, flow)
+		}
+		return true
+	})
+	for _, f := range flows {
+		n.resetTCP(f[0], f[1])
+	}
+}
+
+// tcpHandler serves an intercepted TCP connection; see network.tcpTarget.
+type tcpHandler struct {
+	// dial, if non-nil, dials the upstream server to proxy the connection
+	// to.
+	dial func() (net.Conn, error)
+
+	// serve serves the node's conn c, taking ownership of it and of up, the
+	// conn returned by dial, if any. It may block.
+	serve func(c, up net.Conn)
+}
+
+// dialUpstream calls h.dial, if non-nil. It reports false if the dial
+// failed, in which case the node's connection should be reset.
+func (h tcpHandler) dialUpstream() (up net.Conn, ok bool) {
+	if h.dial == nil {
+		return nil, true
+	}
+	up, err := h.dial()
+	return up, err == nil
+}
+
+// tcpTarget returns how to serve an intercepted TCP connection from src (a
+// node on n) to dst, or ok=false if the connection should be reset.
+//
+// It's shared by all TCP stack implementations; see Config.TCPStack. They
+// call h.dialUpstream before completing the node's handshake, resetting the
+// connection if it fails, as a real unreachable server would, and then
+// h.serve.
+func (n *network) tcpTarget(src, dst netip.AddrPort) (h tcpHandler, ok bool) {
+	destIP := dst.Addr()
+	n.noteTCPActivity(src, dst)
+	if hh, ok := n.s.httpHandler(dst); ok {
+		return tcpHandler{serve: func(c, _ net.Conn) {
+			hs := &http.Server{Handler: hh}
+			hs.Serve(netutil.NewOneConnListener(c, nil))
+		}}, true
+	}
+
+	if dst.Port() == 123 {
+		return tcpHandler{serve: func(c, _ net.Conn) {
+			io.WriteString(c, "Hello from Go\nGoodbye.\n")
+			c.Close()
+		}}, true
+	}
+
+	if dst.Port() == 8008 && destIP == n.s.fakeIPs.TestAgent {
+		node, ok := n.nodeByIP(src.Addr())
+		if !ok {
+			return tcpHandler{}, false
+		}
+		return tcpHandler{serve: func(c, _ net.Conn) {
+			n.s.addIdleAgentConn(&agentConn{node: node, tc: c, added: n.s.clock.Now()})
+		}}, true
 	}
 
 	var targetDial string
-	if n.s.derpIPs.Contains(destIP) {
-		targetDial = destIP.String() + ":" + strconv.Itoa(int(reqDetails.LocalPort))
-	} else if destIP == fakeControlplaneIP {
-		targetDial = "controlplane.tailscale.com:" + strconv.Itoa(int(reqDetails.LocalPort))
+	if n.s.isDERPIP(destIP) {
+		targetDial = dst.String()
+	} else if destIP == n.s.fakeIPs.Controlplane {
+		targetDial = cmp.Or(n.s.controlUpstream, "controlplane.tailscale.com:"+strconv.Itoa(int(dst.Port())))
+	}
+	if targetDial == "" {
+		return tcpHandler{}, false
 	}
-	if targetDial != "" {
-		c, err := net.Dial("tcp", targetDial)
+	dial := func() (net.Conn, error) {
+		c, err := n.s.dialUpstream(n.s.shutdownCtx, "tcp", targetDial)
 		if err != nil {
-			r.Complete(true)
-			log.Printf("Dial controlplane: %v", err)
-			return
+			n.s.logf("Dial %v: %v", targetDial, err)
 		}
-		defer c.Close()
-		tc := gonet.NewTCPConn(&wq, ep)
+		return c, err
+	}
+	return tcpHandler{dial: dial, serve: func(tc, c net.Conn) {
 		defer tc.Close()
-		r.Complete(false)
+		defer c.Close()
+		flow := FiveTuple{Proto: layers.IPProtocolTCP, Src: src, Dst: dst}
 		errc := make(chan error, 2)
-		go func() { _, err := io.Copy(tc, c); errc <- err }()
-		go func() { _, err := io.Copy(c, tc); errc <- err }()
+		n.s.goTracked(func() { errc <- n.proxyToNode(tc, c, flow) })
+		n.s.goTracked(func() { _, err := io.Copy(c, tc); errc <- err })
 		<-errc
-	} else {
-		r.Complete(true) // sends a RST
-	}
+	}}, true
 }
 
-var (
-	fakeDNSIP          = netip.AddrFrom4([4]byte{4, 11, 4, 11})
-	fakeControlplaneIP = netip.AddrFrom4([4]byte{52, 52, 0, 1})
-	fakeTestAgentIP    = netip.AddrFrom4([4]byte{52, 52, 0, 2})
-)
+// defaultFakeIPs are the fake service IPs used for the zero fields of
+// Config.FakeIPs.
+var defaultFakeIPs = FakeIPs{
+	DNS:          netip.AddrFrom4([4]byte{4, 11, 4, 11}),
+	Controlplane: netip.AddrFrom4([4]byte{52, 52, 0, 1}),
+	TestAgent:    netip.AddrFrom4([4]byte{52, 52, 0, 2}),
+}
 
 type EthernetPacket struct {
 	le *layers.Ethernet
@@ -316,6 +584,27 @@ func (ep EthernetPacket) DstMAC() MAC {
 	return MAC(ep.le.DstMAC)
 }
 
+// etherType returns the EtherType of the frame's payload, which for a frame
+// with an 802.1Q VLAN tag is that of the payload after the tag. The VLAN ID
+// is otherwise ignored: all nodes of a network are on the same LAN.
+func (ep EthernetPacket) etherType() layers.EthernetType {
+	if ep.le.EthernetType == layers.EthernetTypeDot1Q {
+		if tag, ok := ep.gp.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok {
+			return tag.Type
+		}
+	}
+	return ep.le.EthernetType
+}
+
+// priority returns the 802.1p priority of the frame from its 802.1Q VLAN
+// tag, or 0 (best effort) if it's untagged.
+func (ep EthernetPacket) priority() uint8 {
+	if tag, ok := ep.gp.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok {
+		return tag.Priority
+	}
+	return 0
+}
+
 type MAC [6]byte
 
 func (m MAC) IsBroadcast() bool {
@@ -338,15 +627,70 @@ func (m MAC) String() string {
 }
 
 type network struct {
-	s         *Server
-	mac       MAC
-	portmap   bool
-	wanIP     netip.Addr
-	lanIP     netip.Prefix // with host bits set (e.g. 192.168.2.1/24)
+	s        *Server
+	mac      MAC
+	services set.Set[NetworkService] // enabled on the router; immutable after init
+	firewall *firewall               // if non-nil, filters packets to the internet; immutable after init
+	wanIP    netip.Addr
+	lanIP    netip.Prefix // with host bits set (e.g. 192.168.2.1/24)
+
+	dnsOnGateway bool          // whether lanIP answers DNS in addition to the fake DNS IP
+	hostnameDNS  bool          // whether DNS answers nodes' DHCP hostnames; see Network.SetHostnameDNS
+	dns64        netip.Prefix  // if valid, the /96 in which AAAA answers are synthesized
+	nat64        netip.Prefix  // if valid, the /96 whose IPv6 packets are translated to IPv4
+	antiSpoof    bool          // whether spoofed sources are dropped; see Network.SetIngressFiltering
+	disableARP   bool          // whether the router doesn't do ARP; see Network.SetDisableARP
+	isolatedMACs bool          // whether its nodes' MACs are scoped to it; see Network.SetIsolatedMACs
+	arpDelay     time.Duration // before ARP replies are sent; see Network.SetARPDelay
+	dhcpPool     netip.Prefix  // if valid, nodes' lanIPs are leased from here by DHCP
+	latency      time.Duration // added to packets arriving from the WAN
+	jitter       time.Duration // max random variation of latency
+	duplication  float64       // fraction of packets from the WAN delivered twice
+	reordering   float64       // probability a packet from the WAN is held back
+	silentMTU    bool          // drop DF packets over mtu without ICMP
+	churnEvery   time.Duration // how often the NAT churns, or 0 for never
+	churnFrac    float64       // fraction of LAN hosts whose mappings churn
+	portFlapping float64       // fraction of outgoing packets given a random WAN port
+	natTimeout   time.Duration // how long NAT mappings may idle, or 0 for forever
+	extraWANs    []netip.Addr  // WAN IPs in addition to wanIP; immutable after init
+	wanPolicy    WANPolicy     // how outgoing traffic picks among multiple WAN IPs
+	subnets      []*subnet     // routed subnets behind nodes; immutable after init
+	throttle     *throttle     // limits bandwidth from the WAN, if non-nil
+
+	portAlloc PortAllocation // how the NAT picks the WAN ports of new mappings
+	basePort  uint16         // the first port, for SequentialPorts
+
+	maxFlows   int             // most mappings the NAT holds, or 0 for no limit
+	flowPolicy FlowLimitPolicy // what the NAT does with new flows when full
+
+	publicIPs map[netip.Addr]*node // nodes' public IPs; immutable after init
+
+	pmtuMu  sync.Mutex         // guards mtu and pathMTU
+	mtu     int                // of the WAN link, or 0 for no limit; see Server.SetMTU
+	pathMTU map[netip.Addr]int // by WAN destination; see Server.HandleICMPFromWAN
+
+	holdMu    sync.Mutex             // guards held and holdTimer
+	held      []UDPPacket            // packets held back for reordering
+	holdTimer tstime.TimerController // releases held; nil until first used
+
+	mu        sync.Mutex // guards nodesByIP, leases and hostnames
 	nodesByIP map[netip.Addr]*node
+	leases    map[MAC]netip.Addr // DHCP pool leases, offered or acked
+	hostnames map[string]MAC     // DHCP client hostnames, lowercase, if hostnameDNS
 
-	ns     *stack.Stack
-	linkEP *channel.Endpoint
+	tcpStack tcpInterceptor
+
+	// Used by the gvisor tcpInterceptor only:
+	ns        *stack.Stack
+	linkEP    *channel.Endpoint
+	gvisorEPs syncs.Map[[2]netip.AddrPort, tcpip.Endpoint] // by node addr, dst addr; until closed
+
+	handshakeMu sync.Mutex      // guards handshakes
+	handshakes  []*TCPHandshake // of intercepted TCP connections, oldest first
+
+	nat64Mu  sync.Mutex                  // guards nat64By4 and nat64By6
+	nat64By4 map[nat64Key]*nat64Session  // NAT64 sessions by IPv4 flow
+	nat64By6 map[nat64Key6]*nat64Session // NAT64 sessions by IPv6 source and IPv4 remote
 
 	natStyle syncs.AtomicValue[NAT]
 	natMu    sync.Mutex // held while using + changing natTable
@@ -355,6 +699,51 @@ type network struct {
 	// writeFunc is a map of MAC -> func to write to that MAC.
 	// It contains entries for connected nodes only.
 	writeFunc syncs.Map[MAC, func([]byte)] // MAC -> func to write to that MAC
+
+	// v6Neighbors maps the IPv6 addresses of nodes to their MACs. Nodes
+	// aren't assigned IPv6 addresses, so it's learned from the source of the
+	// IPv6 packets that the router intercepts.
+	v6Neighbors syncs.Map[netip.Addr, MAC]
+}
+
+// macKey is the key of a node in Server.nodeByMAC.
+type macKey struct {
+	net *network // nil unless the node's network has isolated MACs
+	mac MAC
+}
+
+// macKey returns the key of the node on n with the given MAC.
+func (n *network) macKey(mac MAC) macKey {
+	if n.isolatedMACs {
+		return macKey{n, mac}
+	}
+	return macKey{mac: mac}
+}
+
+// nodeForMAC returns the attached node on n with the given MAC, if any.
+func (n *network) nodeForMAC(mac MAC) (_ *node, ok bool) {
+	n.s.mu.Lock()
+	defer n.s.mu.Unlock()
+	node, ok := n.s.nodeByMAC[n.macKey(mac)]
+	if !ok || node.net != n {
+		return nil, false
+	}
+	return node, true
+}
+
+// noteV6Neighbor records that the node with MAC mac sent an IPv6 packet from
+// ip, updating v6Neighbors and the node's lanIP6.
+func (n *network) noteV6Neighbor(ip netip.Addr, mac MAC) {
+	if old, ok := n.v6Neighbors.Load(ip); !ok || old != mac {
+		n.v6Neighbors.Store(ip, mac)
+	}
+	node, ok := n.nodeForMAC(mac)
+	if !ok {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	node.lanIP6 = ip
 }
 
 func (n *network) registerWriter(mac MAC, f func([]byte)) {
@@ -365,37 +754,204 @@ func (n *network) registerWriter(mac MAC, f func([]byte)) {
 	}
 }
 
+// nodeMACOfIP returns the MAC of the node on n with the given IPv4 address
+// or, for an IPv6 address, that last sent an intercepted packet from it.
+func (n *network) nodeMACOfIP(ip netip.Addr) (_ MAC, ok bool) {
+	if ip.Is6() {
+		return n.v6Neighbors.Load(ip)
+	}
+	if node, ok := n.nodeByIP(ip); ok && n.canResolve(node) {
+		return node.mac.Load(), true
+	}
+	return MAC{}, false
+}
+
+// canResolve reports whether the router can resolve the MAC of node: always,
+// unless the network has ARP disabled and no static ARP entry for the node.
+func (n *network) canResolve(node *node) bool {
+	return !n.disableARP || node.staticARP
+}
+
 func (n *network) MACOfIP(ip netip.Addr) (_ MAC, ok bool) {
 	if n.lanIP.Addr() == ip {
 		return n.mac, true
 	}
-	if n, ok := n.nodesByIP[ip]; ok {
-		return n.mac, true
+	if n, ok := n.nodeByIP(ip); ok {
+		return n.mac.Load(), true
 	}
 	return MAC{}, false
 }
 
+// nodeByIP returns the node on this network with the given LAN IP, if any.
+func (n *network) nodeByIP(ip netip.Addr) (_ *node, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	node, ok := n.nodesByIP[ip]
+	return node, ok
+}
+
 type node struct {
-	mac   MAC
-	net   *network
-	lanIP netip.Addr // must be in net.lanIP prefix + unique in net
+	mac syncs.AtomicValue[MAC] // changed only by Server.ChangeNodeMAC
+	net *network
+	// lanIP must be in net.lanIP prefix + unique in net. If net has a DHCP
+	// pool it's zero until the node's DHCP request is acked, and is only
+	// changed with Server.mu and net.mu held.
+	lanIP netip.Addr
+	// lanIP6 is the IPv6 address the node was last seen using, or zero if
+	// none. Nodes aren't assigned IPv6 addresses, so it's learned like
+	// net.v6Neighbors. It's guarded by net.mu.
+	lanIP6 netip.Addr
+	// publicIP, if valid, is a public IP routed to the node as-is, in
+	// addition to its LAN IP. See Node.SetPublicIP.
+	publicIP netip.Addr
+	// staticARP is whether the router has a static ARP entry for the node,
+	// for when its network has ARP disabled. See Node.SetStaticARP.
+	staticARP bool
+	// clockSkew is how far off the node's clock is. See Node.SetClockSkew.
+	clockSkew time.Duration
+	// dhcpRoutes are the classless static routes that the node's DHCP
+	// responses carry. See Node.AddDHCPRoute.
+	dhcpRoutes []dhcpRoute
+
+	conns    atomic.Int32 // number of client conns currently serving this node
+	lastRecv atomic.Int64 // unix nanos of last frame received from the node, or 0
+
+	writerMu  sync.Mutex // guards writerGen and the claiming of the node's writer
+	writerGen uint64     // incremented each time a client conn claims the node
+
+	activity nodeActivity // see Server.NodeActivity
+}
+
+// lanIPs returns the node's IPv4 and IPv6 LAN addresses, either of which may
+// be invalid.
+func (n *node) lanIPs() (ip4, ip6 netip.Addr) {
+	n.net.mu.Lock()
+	defer n.net.mu.Unlock()
+	return n.lanIP, n.lanIP6
+}
+
+// claimWriter makes f the writer of frames to the node, replacing that of any
+// client conn that previously served it. It reports whether one had, meaning
+// the node has reconnected. The returned release func unregisters f, unless
+// a newer conn has since claimed the node, so that an old conn noticing it's
+// dead late doesn't cut off its replacement.
+func (n *node) claimWriter(f func([]byte)) (reconnect bool, release func()) {
+	n.writerMu.Lock()
+	defer n.writerMu.Unlock()
+	return n.claimWriterLocked(f)
+}
+
+// claimFreeWriter is like claimWriter, but only claims the node if it has no
+// writer, reporting whether it did.
+func (n *node) claimFreeWriter(f func([]byte)) (release func(), ok bool) {
+	n.writerMu.Lock()
+	defer n.writerMu.Unlock()
+	if _, ok := n.net.writeFunc.Load(n.mac.Load()); ok {
+		return nil, false
+	}
+	_, release = n.claimWriterLocked(f)
+	return release, true
+}
+
+// claimWriterLocked is claimWriter with n.writerMu held.
+func (n *node) claimWriterLocked(f func([]byte)) (reconnect bool, release func()) {
+	reconnect = n.writerGen > 0
+	n.writerGen++
+	gen := n.writerGen
+	n.net.registerWriter(n.mac.Load(), f)
+	return reconnect, func() {
+		n.writerMu.Lock()
+		defer n.writerMu.Unlock()
+		if n.writerGen == gen {
+			// The node's MAC may have changed since it was claimed.
+			n.net.registerWriter(n.mac.Load(), nil)
+		}
+	}
 }
 
 type Server struct {
 	shutdownCtx    context.Context
 	shutdownCancel context.CancelFunc
+	closeOnce      sync.Once
+	goroutines     atomic.Int64 // started by the server and still running; see CheckLeaks
 
-	derpIPs set.Set[netip.Addr]
+	// interceptTCP, if non-nil, replaces DefaultInterceptTCP.
+	// See SetTCPInterceptFunc.
+	interceptTCP syncs.AtomicValue[func(gopacket.Packet) bool]
 
-	nodes        []*node
-	nodeByMAC    map[MAC]*node
-	networks     set.Set[*network]
-	networkByWAN map[netip.Addr]*network
+	tcpFault syncs.AtomicValue[TCPFaultPolicy] // see SetTCPFaultPolicy
 
-	mu                sync.Mutex
+	httpMu       sync.Mutex // guards httpHandlers
+	httpHandlers map[netip.AddrPort]http.Handler
+
+	derpMu  sync.Mutex // guards derpIPs
+	derpIPs set.Set[netip.Addr]
+
+	// TCP stack tuning, from Config.
+	tcpReceiveBufferSize int // or 0 for default
+	tcpSendBufferSize    int // or 0 for default
+	tcpSACK              bool
+
+	connStaleAfter  time.Duration // see Config.ConnStaleAfter
+	tcpStackType    TCPStack
+	tcpConnectDelay time.Duration // see Config.TCPConnectDelay
+	controlUpstream string        // see Config.SetControlUpstream; empty for the default
+	rand            *rand.Rand    // seeded by Config.RandSeed; safe for concurrent use
+	dnsLatency      DNSLatency    // see Config.DNSLatency
+	fakeIPs         FakeIPs       // from Config.FakeIPs, with defaults filled in
+	clock           tstime.Clock
+	logNAT          bool // see Config.LogNAT
+
+	dueMu    sync.Mutex  // guards due
+	due      []func()    // timers due to run in AdvanceClock, in order
+	baseLogf logger.Logf // from Config.Logf; use Server.logf
+	logRing  *logRing    // or nil if not keeping recent logs
+
+	dnsFaultMu    sync.Mutex // guards dnsFault and dnsFaultUntil
+	dnsFault      DNSFault
+	dnsFaultUntil time.Time // when dnsFault ends, or zero for never
+
+	dnsSpoofMu sync.Mutex                 // guards dnsSpoofs
+	dnsSpoofs  map[dnsSpoofKey]netip.Addr // forged A answers, by node and query name
+
+	pathMu sync.Mutex // guards paths
+	paths  map[pathKey]PathPolicy
+
+	partMu    sync.Mutex                 // guards partition
+	partition map[*network]partitionSide // or nil if not partitioned
+
+	// dialUpstream dials the real DERP and control servers for intercepted
+	// TCP connections. Tests may replace it.
+	dialUpstream func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	networks set.Set[*network]
+	inet     internet // connects the networks; immutable after New
+
+	mu                sync.Mutex // guards the following
+	nodes             []*node
+	nodeByMAC         map[macKey]*node
 	agentConnWaiter   map[*node]chan<- struct{} // signaled after added to set
 	agentConns        set.Set[*agentConn]       //  not keyed by node; should be small/cheap enough to scan all
 	agentRoundTripper map[*node]*http.Transport
+
+	dropMu    sync.Mutex // guards dropHooks
+	dropHooks set.HandleSet[func(PacketDrop)]
+	drops     metrics.LabelMap // drop counts by DropReason
+
+	leaseMu    sync.Mutex // guards leaseHooks
+	leaseHooks set.HandleSet[func(MAC, netip.Addr)]
+
+	tapMu sync.Mutex // guards taps
+	taps  map[MAC]set.HandleSet[chan []byte]
+
+	probes probes // for AssertReachable
+
+	latencyMu    sync.Mutex // guards latencyStats
+	latencyStats map[NodePair]*LatencyHistogram
+
+	wgMu         sync.Mutex                      // guards wgPending and wgHandshakes
+	wgPending    map[uint32]wgPendingInit        // by initiator's sender index
+	wgHandshakes map[NodePair]WireGuardHandshake // by initiator and responder
 }
 
 func New(c *Config) (*Server, error) {
@@ -404,12 +960,19 @@ func New(c *Config) (*Server, error) {
 		shutdownCtx:    ctx,
 		shutdownCancel: cancel,
 
-		derpIPs: set.Of[netip.Addr](),
+		derpIPs:      set.Of[netip.Addr](),
+		dialUpstream: new(net.Dialer).DialContext,
 
-		nodeByMAC:    map[MAC]*node{},
-		networkByWAN: map[netip.Addr]*network{},
-		networks:     set.Of[*network](),
+		nodeByMAC: map[macKey]*node{},
+		networks:  set.Of[*network](),
+		drops:     metrics.LabelMap{Label: "reason"},
+		inet: internet{
+			byAddr:   map[netip.Addr]*network{},
+			services: map[uint16]udpService{},
+		},
 	}
+	s.inet.addService(stunPort, s.makeSTUNReply)
+	s.inet.addService(ntpPort, s.makeNTPReply)
 	if err := s.initFromConfig(c); err != nil {
 		return nil, err
 	}
@@ -421,6 +984,223 @@ func New(c *Config) (*Server, error) {
 	return s, nil
 }
 
+// Close shuts down the server's network stacks, closing their intercepted
+// TCP connections, and removes it from the registry (see [RegisterServer]).
+// It doesn't close client connections.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.shutdownCancel()
+		for n := range s.networks {
+			n.tcpStack.close()
+		}
+		unregisterServer(s)
+	})
+}
+
+// goTracked runs f in a new goroutine, which CheckLeaks expects to exit
+// once the server is closed.
+func (s *Server) goTracked(f func()) {
+	s.goroutines.Add(1)
+	go func() {
+		defer s.goroutines.Add(-1)
+		f()
+	}()
+}
+
+// CheckLeaks returns an error if any goroutine that the server started,
+// or any endpoint of a network's gvisor TCP stack, hasn't gone away since
+// Close, waiting a few seconds for them to. It's for tests, which should
+// call it after Close, which it otherwise returns an error for.
+func (s *Server) CheckLeaks() error {
+	if s.shutdownCtx.Err() == nil {
+		return errors.New("CheckLeaks called before Close")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := s.leaks()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// leaks returns an error describing what CheckLeaks found still running,
+// or nil if nothing is.
+func (s *Server) leaks() error {
+	var errs []error
+	if n := s.goroutines.Load(); n > 0 {
+		errs = append(errs, fmt.Errorf("%d goroutines still running", n))
+	}
+	for n := range s.networks {
+		if n.ns == nil {
+			continue
+		}
+		if eps := len(n.ns.RegisteredEndpoints()) + len(n.ns.CleanupEndpoints()); eps > 0 {
+			errs = append(errs, fmt.Errorf("network %v: %d gvisor TCP endpoints not released", n.wanIP, eps))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// nodeForMAC returns the attached node with the given MAC, if any. A node on
+// a network with isolated MACs (see [Network.SetIsolatedMACs]) is only found
+// if no other node has its MAC; callers that know the network should use
+// network.nodeForMAC instead.
+func (s *Server) nodeForMAC(mac MAC) (_ *node, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodeForMACLocked(mac)
+}
+
+// nodeForMACLocked is nodeForMAC with s.mu held.
+func (s *Server) nodeForMACLocked(mac MAC) (_ *node, ok bool) {
+	if n, ok := s.nodeByMAC[macKey{mac: mac}]; ok {
+		return n, true
+	}
+	var found *node
+	for k, n := range s.nodeByMAC {
+		if k.mac != mac {
+			continue
+		}
+		if found != nil {
+			return nil, false // ambiguous
+		}
+		found = n
+	}
+	return found, found != nil
+}
+
+// DetachNode removes the node with the given MAC from its network at runtime,
+// as if the device had been unplugged.
+//
+// Its LAN IP stops resolving via ARP, frames from any connection still
+// carrying its MAC are dropped, its NAT mappings, NAT64 sessions, IPv6
+// addresses and DHCP hostname are forgotten, its intercepted TCP connections
+// are reset, and its idle agent connections are closed.
+func (s *Server) DetachNode(mac MAC) error {
+	s.mu.Lock()
+	n, ok := s.nodeForMACLocked(mac)
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown node %v", mac)
+	}
+	delete(s.nodeByMAC, n.net.macKey(mac))
+	s.nodes = slices.DeleteFunc(s.nodes, func(n2 *node) bool { return n2 == n })
+	var acs []*agentConn
+	for ac := range s.agentConns {
+		if ac.node == n {
+			s.agentConns.Delete(ac)
+			acs = append(acs, ac)
+		}
+	}
+	delete(s.agentConnWaiter, n)
+	rt := s.agentRoundTripper[n]
+	delete(s.agentRoundTripper, n)
+	s.mu.Unlock()
+
+	for _, ac := range acs {
+		ac.tc.Close()
+	}
+	if rt != nil {
+		rt.CloseIdleConnections()
+	}
+
+	netw := n.net
+	netw.mu.Lock()
+	lanIP := n.lanIP
+	delete(netw.nodesByIP, lanIP)
+	delete(netw.leases, mac)
+	for name, m := range netw.hostnames {
+		if m == mac {
+			delete(netw.hostnames, name)
+		}
+	}
+	netw.mu.Unlock()
+	netw.registerWriter(mac, nil)
+
+	var ip6s []netip.Addr
+	netw.v6Neighbors.Range(func(ip netip.Addr, m MAC) bool {
+		if m == mac {
+			ip6s = append(ip6s, ip)
+		}
+		return true
+	})
+	for _, ip := range ip6s {
+		netw.v6Neighbors.Delete(ip)
+	}
+	netw.nat64Mu.Lock()
+	for k, se := range netw.nat64By4 {
+		if slices.Contains(ip6s, se.src6.Addr()) {
+			delete(netw.nat64By4, k)
+			delete(netw.nat64By6, nat64Key6{se.src6, se.key.remote})
+		}
+	}
+	netw.nat64Mu.Unlock()
+
+	for _, ip := range append(ip6s, lanIP) {
+		netw.tcpStack.resetHost(ip)
+	}
+
+	netw.natMu.Lock()
+	defer netw.natMu.Unlock()
+	netw.natTable.RemoveLANHost(lanIP)
+	return nil
+}
+
+// ChangeNodeMAC changes the MAC of the node with MAC oldMAC to newMAC, as when
+// a guest randomizes its MAC for privacy. A client connected for the node
+// stays connected, but must send frames from newMAC from then on.
+//
+// On a network with a DHCP pool (see [Network.SetDHCPPool]) the node is then
+// a new DHCP client: its lease, LAN IP and NAT mappings are released, and it
+// has no LAN IP until its next DHCP request is acked. Otherwise its LAN IP is
+// unchanged.
+//
+// The node's [Node] config keeps its original MAC.
+func (s *Server) ChangeNodeMAC(oldMAC, newMAC MAC) error {
+	if newMAC.IsBroadcast() || newMAC == (MAC{}) {
+		return fmt.Errorf("invalid MAC %v", newMAC)
+	}
+	s.mu.Lock()
+	n, ok := s.nodeForMACLocked(oldMAC)
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown node %v", oldMAC)
+	}
+	if _, ok := s.nodeByMAC[n.net.macKey(newMAC)]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("MAC %v is already in use", newMAC)
+	}
+	delete(s.nodeByMAC, n.net.macKey(oldMAC))
+	s.nodeByMAC[n.net.macKey(newMAC)] = n
+
+	netw := n.net
+	var releasedIP netip.Addr
+	netw.mu.Lock()
+	n.mac.Store(newMAC)
+	if netw.dhcpPool.IsValid() {
+		delete(netw.leases, oldMAC)
+		if n.lanIP.IsValid() {
+			releasedIP = n.lanIP
+			delete(netw.nodesByIP, n.lanIP)
+			n.lanIP = netip.Addr{}
+		}
+	}
+	netw.mu.Unlock()
+	s.mu.Unlock()
+
+	if f, ok := netw.writeFunc.LoadAndDelete(oldMAC); ok {
+		netw.writeFunc.Store(newMAC, f)
+	}
+	if releasedIP.IsValid() {
+		netw.natMu.Lock()
+		defer netw.natMu.Unlock()
+		netw.natTable.RemoveLANHost(releasedIP)
+	}
+	return nil
+}
+
 func (s *Server) HWAddr(mac MAC) net.HardwareAddr {
 	// TODO: cache
 	return net.HardwareAddr(mac[:])
@@ -431,11 +1211,11 @@ func (s *Server) HWAddr(mac MAC) net.HardwareAddr {
 func (s *Server) IPv4ForDNS(qname string) (netip.Addr, bool) {
 	switch qname {
 	case "dns":
-		return fakeDNSIP, true
+		return s.fakeIPs.DNS, true
 	case "test-driver.tailscale":
-		return fakeTestAgentIP, true
+		return s.fakeIPs.TestAgent, true
 	case "controlplane.tailscale.com":
-		return fakeControlplaneIP, true
+		return s.fakeIPs.Controlplane, true
 	}
 	return netip.Addr{}, false
 }
@@ -447,12 +1227,47 @@ func (s *Server) IPv4ForDNS(qname string) (netip.Addr, bool) {
 	ProtocolUnixDGRAM // for macOS Hypervisor.Framework and VZFileHandleNetworkDeviceAttachment
 )
 
-// serveConn serves a single connection from a client.
+// ServeUnixConn serves a single connection from a client over a unix socket.
+// It's like ServeConn but also supports ProtocolUnixDGRAM.
 func (s *Server) ServeUnixConn(uc *net.UnixConn, proto Protocol) {
-	log.Printf("Got conn %T %p", uc, uc)
-	defer uc.Close()
+	s.ServeConn(uc, proto)
+}
+
+// ServeConn serves a single connection from a client, such as a VM
+// connecting over TCP or VSOCK, until it's closed. The connection must be a
+// stream using ProtocolQEMU framing, unless it's a *net.UnixConn, which may
+// also use ProtocolUnixDGRAM.
+func (s *Server) ServeConn(c net.Conn, proto Protocol) {
+	s.serveConn(c, proto, nil)
+}
+
+// ServeNetworkConn is like ServeConn, but for a client of a node on the
+// network with WAN IP wanIP. Clients of nodes on networks with isolated MACs
+// (see [Network.SetIsolatedMACs]) must be served with it if another node
+// has the same MAC.
+func (s *Server) ServeNetworkConn(c net.Conn, proto Protocol, wanIP netip.Addr) {
+	onNet, ok := s.inet.networkAt(wanIP)
+	if !ok || onNet.wanIP != wanIP {
+		s.logf("[conn %p] no network with WAN IP %v", c, wanIP)
+		c.Close()
+		return
+	}
+	s.serveConn(c, proto, onNet)
+}
+
+// serveConn serves c for ServeConn and ServeNetworkConn. If onNet is
+// non-nil, the client is of a node on it.
+func (s *Server) serveConn(c net.Conn, proto Protocol, onNet *network) {
+	s.logf("Got conn %T %p", c, c)
+	defer c.Close()
+
+	uc, _ := c.(*net.UnixConn)
+	if proto == ProtocolUnixDGRAM && uc == nil {
+		s.logf("[conn %p] ProtocolUnixDGRAM requires a *net.UnixConn, not %T", c, c)
+		return
+	}
 
-	bw := bufio.NewWriterSize(uc, 2<<10)
+	bw := bufio.NewWriterSize(c, 2<<10)
 	var writeMu sync.Mutex
 	writePkt := func(pkt []byte) {
 		if pkt == nil {
@@ -463,16 +1278,16 @@ func (s *Server) ServeUnixConn(uc *net.UnixConn, proto Protocol) {
 		if proto == ProtocolQEMU {
 			hdr := binary.BigEndian.AppendUint32(bw.AvailableBuffer()[:0], uint32(len(pkt)))
 			if _, err := bw.Write(hdr); err != nil {
-				log.Printf("Write hdr: %v", err)
+				s.logf("Write hdr: %v", err)
 				return
 			}
 		}
 		if _, err := bw.Write(pkt); err != nil {
-			log.Printf("Write pkt: %v", err)
+			s.logf("Write pkt: %v", err)
 			return
 		}
 		if err := bw.Flush(); err != nil {
-			log.Printf("Flush: %v", err)
+			s.logf("Flush: %v", err)
 		}
 	}
 
@@ -484,19 +1299,22 @@ func (s *Server) ServeUnixConn(uc *net.UnixConn, proto Protocol) {
 		if proto == ProtocolUnixDGRAM {
 			n, _, err := uc.ReadFromUnix(buf)
 			if err != nil {
-				log.Printf("ReadFromUnix: %v", err)
+				s.logf("ReadFromUnix: %v", err)
 				continue
 			}
 			packetRaw = buf[:n]
 		} else if proto == ProtocolQEMU {
-			if _, err := io.ReadFull(uc, buf[:4]); err != nil {
-				log.Printf("ReadFull header: %v", err)
+			if _, err := io.ReadFull(c, buf[:4]); err != nil {
+				s.logf("ReadFull header: %v", err)
 				return
 			}
 			n := binary.BigEndian.Uint32(buf[:4])
-
-			if _, err := io.ReadFull(uc, buf[4:4+n]); err != nil {
-				log.Printf("ReadFull pkt: %v", err)
+			if n > uint32(len(buf)-4) {
+				s.logf("[conn %p] frame of %d bytes too large", c, n)
+				return
+			}
+			if _, err := io.ReadFull(c, buf[4:4+n]); err != nil {
+				s.logf("ReadFull pkt: %v", err)
 				return
 			}
 			packetRaw = buf[4 : 4+n] // raw ethernet frame
@@ -510,52 +1328,227 @@ func (s *Server) ServeUnixConn(uc *net.UnixConn, proto Protocol) {
 		ep := EthernetPacket{le, packet}
 
 		srcMAC := ep.SrcMAC()
+		var node *node
+		if onNet != nil {
+			node, ok = onNet.nodeForMAC(srcMAC)
+		} else {
+			node, ok = s.nodeForMAC(srcMAC)
+		}
+		if !ok {
+			// Either a MAC we never knew about, or a node that's
+			// since been detached.
+			s.logf("[conn %p] ignoring frame from unknown MAC %v", c, srcMAC)
+			continue
+		}
 		if srcNode == nil {
-			srcNode, ok = s.nodeByMAC[srcMAC]
-			if !ok {
-				log.Printf("[conn %p] ignoring frame from unknown MAC %v", uc, srcMAC)
-				continue
-			}
-			log.Printf("[conn %p] MAC %v is node %v", uc, srcMAC, srcNode.lanIP)
+			srcNode = node
+			ip4, _ := srcNode.lanIPs()
+			s.logf("[conn %p] MAC %v is node %v", c, srcMAC, ip4)
+			srcNode.conns.Add(1)
+			defer srcNode.conns.Add(-1)
 			netw = srcNode.net
-			netw.registerWriter(srcMAC, writePkt)
-			defer netw.registerWriter(srcMAC, nil)
-		} else {
-			if srcMAC != srcNode.mac {
-				log.Printf("[conn %p] ignoring frame from MAC %v, expected %v", uc, srcMAC, srcNode.mac)
-				continue
+			reconnect, release := srcNode.claimWriter(writePkt)
+			defer release()
+			if reconnect {
+				// The node's NAT mappings are keyed by its IP, which is
+				// unchanged, so they're kept. But its agent conns were
+				// to the previous incarnation of its NIC and may be dead.
+				s.logf("[conn %p] node %v reconnected; dropping its idle agent conns", c, ip4)
+				s.dropAgentConns(srcNode)
 			}
+		} else if node != srcNode {
+			s.logf("[conn %p] ignoring frame from MAC %v, expected %v", c, srcMAC, srcNode.mac.Load())
+			continue
 		}
+		srcNode.lastRecv.Store(s.clock.Now().UnixNano())
 		netw.HandleEthernetPacket(ep)
 	}
 }
 
-func (s *Server) routeUDPPacket(up UDPPacket) {
-	// Find which network owns this based on the destination IP
-	// and all the known networks' wan IPs.
+// NodeConnHealth is the liveness of a node's client connection, as reported
+// by [Server.ConnHealth].
+type NodeConnHealth struct {
+	MAC     MAC
+	LANIP   netip.Addr
+	LANIPv6 netip.Addr // see BannerEntry.LANIPv6
+
+	// Connected is whether a client conn is currently serving the node.
+	// A conn is associated with a node once it sends its first frame.
+	Connected bool
+
+	// LastRecv is when a frame was last received from the node,
+	// or the zero value if never.
+	LastRecv time.Time
+
+	// Stale is whether the node is connected but hasn't sent a frame
+	// within the Config.ConnStaleAfter interval, such as when the VM
+	// on the other end has hung or died without closing its conn.
+	Stale bool
+}
+
+// ConnHealth reports the liveness of each node's client connection.
+func (s *Server) ConnHealth() []NodeConnHealth {
+	s.mu.Lock()
+	nodes := slices.Clone(s.nodes)
+	s.mu.Unlock()
+
+	now := s.clock.Now()
+	ret := make([]NodeConnHealth, 0, len(nodes))
+	for _, n := range nodes {
+		lanIP, lanIP6 := n.lanIPs()
+		h := NodeConnHealth{
+			MAC:       n.mac.Load(),
+			LANIP:     lanIP,
+			LANIPv6:   lanIP6,
+			Connected: n.conns.Load() > 0,
+		}
+		if ns := n.lastRecv.Load(); ns != 0 {
+			h.LastRecv = time.Unix(0, ns)
+		}
+		h.Stale = h.Connected && now.Sub(h.LastRecv) > s.connStaleAfter
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+// NodeEndpoint returns an in-process client for the node with the given MAC,
+// for tests that want to act as the node's NIC without a unix socket.
+//
+// Each Write must be a single raw Ethernet frame from the node's MAC, and each
+// Read returns a single raw Ethernet frame delivered to the node. Reads block
+// until a frame arrives or the endpoint is closed. Frames delivered while the
+// reader is too far behind are dropped, as a real NIC's ring would.
+//
+// It returns an error if the node is unknown or already has a client.
+func (s *Server) NodeEndpoint(mac MAC) (io.ReadWriteCloser, error) {
+	n, ok := s.nodeForMAC(mac)
+	if !ok {
+		return nil, fmt.Errorf("unknown node %v", mac)
+	}
+	e := &nodeEndpoint{
+		s:      s,
+		node:   n,
+		frames: make(chan []byte, 1024),
+		closed: make(chan struct{}),
+	}
+	release, ok := n.claimFreeWriter(e.deliver)
+	if !ok {
+		return nil, fmt.Errorf("node %v already has a connected client", mac)
+	}
+	e.release = release
+	n.conns.Add(1)
+	return e, nil
+}
+
+// nodeEndpoint is the [io.ReadWriteCloser] returned by [Server.NodeEndpoint].
+type nodeEndpoint struct {
+	s      *Server
+	node   *node
+	frames chan []byte // frames delivered to the node
+
+	// release unregisters deliver as the node's writer, unless a client
+	// conn has since claimed the node.
+	release func()
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// deliver is the network's writeFunc for the endpoint's node.
+func (e *nodeEndpoint) deliver(frame []byte) {
+	select {
+	case e.frames <- bytes.Clone(frame):
+	case <-e.closed:
+	default:
+		e.s.logf("[endpoint %v] dropping frame; reader too slow", e.node.mac.Load())
+	}
+}
+
+func (e *nodeEndpoint) Read(p []byte) (int, error) {
+	select {
+	case frame := <-e.frames:
+		n := copy(p, frame)
+		if n < len(frame) {
+			return n, io.ErrShortBuffer
+		}
+		return n, nil
+	case <-e.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (e *nodeEndpoint) Write(frame []byte) (int, error) {
+	select {
+	case <-e.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+	le, ok := packet.LinkLayer().(*layers.Ethernet)
+	if !ok || len(le.SrcMAC) != 6 || len(le.DstMAC) != 6 {
+		return 0, errors.New("not an Ethernet frame")
+	}
+	ep := EthernetPacket{le, packet}
+	if ep.SrcMAC() != e.node.mac.Load() {
+		return 0, fmt.Errorf("frame from MAC %v; want %v", ep.SrcMAC(), e.node.mac.Load())
+	}
+	if n, ok := e.node.net.nodeForMAC(e.node.mac.Load()); !ok || n != e.node {
+		return 0, fmt.Errorf("node %v detached", e.node.mac.Load())
+	}
+	e.node.lastRecv.Store(e.s.clock.Now().UnixNano())
+	e.node.net.HandleEthernetPacket(ep)
+	return len(frame), nil
+}
+
+func (e *nodeEndpoint) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.release()
+		e.node.conns.Add(-1)
+	})
+	return nil
+}
 
-	// But certain things (like STUN) we do in-process.
-	if up.Dst.Port() == stunPort {
+// routeUDPPacket routes up across the internet to the network it's addressed
+// to, unless it's for one of the internet's in-process services, such as
+// STUN, in which case the service's reply is routed instead.
+func (s *Server) routeUDPPacket(up UDPPacket) {
+	s.noteWireGuardSent(up)
+	if svc, ok := s.inet.services[up.Dst.Port()]; ok {
 		// TODO(bradfitz): fake latency; time.AfterFunc the response
-		if res, ok := makeSTUNReply(up); ok {
+		if res, ok := svc(up); ok {
 			s.routeUDPPacket(res)
 		}
 		return
 	}
 
-	netw, ok := s.networkByWAN[up.Dst.Addr()]
+	netw, ok := s.inet.route(up.Dst.Addr())
 	if !ok {
-		log.Printf("no network to route UDP packet for %v", up.Dst)
+		s.logf("no network to route UDP packet for %v", up.Dst)
+		s.noteDrop(DropNoRoute, up.Src, up.Dst)
+		return
+	}
+	if s.partitioned(up.Src.Addr(), up.Dst.Addr()) {
+		s.noteDrop(DropPartition, up.Src, up.Dst)
 		return
 	}
-	netw.HandleUDPPacket(up)
+	if pp, ok := s.pathPolicy(up.Src.Addr(), up.Dst.Addr()); ok {
+		if pp.Drop {
+			s.noteDrop(DropPathPolicy, up.Src, up.Dst)
+			return
+		}
+		up.Payload = bytes.Clone(up.Payload) // may alias a buffer the sender reuses
+		s.afterFunc(pp.Delay, func() { netw.deliverFromWAN(up) })
+		return
+	}
+	netw.deliverFromWAN(up)
 }
 
 // writeEth writes a raw Ethernet frame to all (0, 1, or multiple) connected
 // clients on the network.
 //
-// This only delivers to client devices and not the virtual router/gateway
-// device.
+// This only delivers to client devices. Frames to the virtual router/gateway
+// device's MAC are handed to the router instead, as if received from the LAN.
 func (n *network) writeEth(res []byte) {
 	if len(res) < 12 {
 		return
@@ -565,18 +1558,46 @@ func (n *network) writeEth(res []byte) {
 	if dstMAC.IsBroadcast() {
 		n.writeFunc.Range(func(mac MAC, writeFunc func([]byte)) bool {
 			writeFunc(res)
+			n.s.noteTapped(mac, res)
 			return true
 		})
 		return
 	}
 	if srcMAC == dstMAC {
-		log.Printf("dropping write of packet from %v to itself", srcMAC)
+		n.s.logf("dropping write of packet from %v to itself", srcMAC)
+		n.s.noteDropFrame(DropSelfSend, res)
+		return
+	}
+	if dstMAC == n.mac {
+		// No client has the gateway's MAC. The frame is for the router.
+		n.handleEthForRouter(res)
 		return
 	}
 	if writeFunc, ok := n.writeFunc.Load(dstMAC); ok {
 		writeFunc(res)
+		n.s.noteTapped(dstMAC, res)
+		n.s.noteDelivered(res)
+		return
+	}
+	if _, ok := n.nodeForMAC(dstMAC); ok {
+		n.s.noteDropFrame(DropNotConnected, res)
+	}
+}
+
+// handleEthForRouter handles the raw Ethernet frame, addressed to the
+// gateway's MAC, as the router.
+func (n *network) handleEthForRouter(frame []byte) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+	le, ok := packet.LinkLayer().(*layers.Ethernet)
+	if !ok {
 		return
 	}
+	ep := EthernetPacket{le, packet}
+	if ep.etherType() != layers.EthernetTypeIPv4 {
+		n.s.logf("dropping non-IPv4 frame to the gateway: %v", ep.etherType())
+		return
+	}
+	n.HandleEthernetIPv4PacketForRouter(ep)
 }
 
 func (n *network) HandleEthernetPacket(ep EthernetPacket) {
@@ -585,21 +1606,47 @@ func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 	isBroadcast := dstMAC.IsBroadcast()
 	forRouter := dstMAC == n.mac || isBroadcast
 
-	switch ep.le.EthernetType {
+	switch ep.etherType() {
 	default:
-		log.Printf("Dropping non-IP packet: %v", ep.le.EthernetType)
+		n.s.logf("Dropping non-IP packet: %v", ep.etherType())
 		return
 	case layers.EthernetTypeARP:
+		if n.disableARP {
+			return
+		}
 		res, err := n.createARPResponse(packet)
 		if err != nil {
-			log.Printf("createARPResponse: %v", err)
+			n.s.logf("createARPResponse: %v", err)
+		} else if n.arpDelay > 0 {
+			n.s.afterFunc(n.arpDelay, func() { n.writeEth(res) })
 		} else {
 			n.writeEth(res)
 		}
 		return
 	case layers.EthernetTypeIPv6:
 		// One day. Low value for now. IPv4 NAT modes is the main thing
-		// this project wants to test.
+		// this project wants to test. But connections to DERP over IPv6
+		// are intercepted, as over IPv4, and networks may do NAT64.
+		if dstMAC != n.mac {
+			return
+		}
+		if ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+			if dst, _ := netip.AddrFromSlice(ip6.DstIP); !n.egressAllowed(packet, dst) {
+				n.s.noteDropFrame(DropFirewall, packet.Data())
+				return
+			}
+		}
+		if n.s.shouldInterceptTCP(packet) {
+			if ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+				if src, ok := netip.AddrFromSlice(ip6.SrcIP); ok {
+					n.noteV6Neighbor(src, ep.SrcMAC())
+				}
+			}
+			n.noteSYN(packet)
+			n.tcpStack.handleTCP(packet)
+		} else if n.nat64.IsValid() {
+			n.handleNAT64Out(ep)
+		}
 		return
 	case layers.EthernetTypeIPv4:
 		// Below
@@ -608,7 +1655,9 @@ func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 	// Send ethernet broadcasts and unicast ethernet frames to peers
 	// on the same network. This is all LAN traffic that isn't meant
 	// for the router/gw itself:
-	n.writeEth(ep.gp.Data())
+	if dstMAC != n.mac {
+		n.writeEth(ep.gp.Data())
+	}
 
 	if forRouter {
 		n.HandleEthernetIPv4PacketForRouter(ep)
@@ -620,11 +1669,23 @@ func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 // LAN IP here and wrapped in an ethernet layer and delivered
 // to the network.
 func (n *network) HandleUDPPacket(p UDPPacket) {
-	dst := n.doNATIn(p.Src, p.Dst)
-	if !dst.IsValid() {
+	if n.antiSpoof && isBogon(p.Src.Addr()) {
+		n.s.noteDrop(DropSpoofed, p.Src, p.Dst)
 		return
 	}
-	p.Dst = dst
+	if _, ok := n.publicIPs[p.Dst.Addr()]; !ok { // nodes' public IPs aren't NATed
+		dst := n.doNATIn(p.Src, p.Dst)
+		if !dst.IsValid() {
+			n.s.noteDrop(DropNoNATMapping, p.Src, p.Dst)
+			return
+		}
+		p.Dst = dst
+		if dst6, ok := n.nat64Session(dst, p.Src); ok {
+			n.writeNAT64In(p, dst6)
+			return
+		}
+	}
+	p.Options = forwardIPv4Options(p.Options, n.lanIP.Addr(), n.s.clock.Now())
 	n.WriteUDPPacketNoNAT(p)
 }
 
@@ -636,15 +1697,49 @@ func (n *network) HandleUDPPacket(p UDPPacket) {
 // same ethernet segment.
 func (n *network) WriteUDPPacketNoNAT(p UDPPacket) {
 	src, dst := p.Src, p.Dst
-	node, ok := n.nodesByIP[dst.Addr()]
+	node, ok := n.nodeByIP(dst.Addr())
 	if !ok {
-		log.Printf("no node for dest IP %v in UDP packet %v=>%v", dst.Addr(), p.Src, p.Dst)
+		node, ok = n.publicIPs[dst.Addr()]
+	}
+	if !ok {
+		n.s.logf("no node for dest IP %v in UDP packet %v=>%v", dst.Addr(), p.Src, p.Dst)
+		n.s.noteDrop(DropNoHost, src, dst)
+		return
+	}
+	if !n.canResolve(node) {
+		n.s.logf("no static ARP entry for dest IP %v in UDP packet %v=>%v", dst.Addr(), p.Src, p.Dst)
+		n.s.noteDrop(DropNoHost, src, dst)
 		return
 	}
+	if p.fragMTU > 0 {
+		frames, err := udpFragmentFrames(n.mac, node.mac.Load(), src, dst, p.Options, p.Payload, p.fragMTU, uint16(n.s.rand.Uint32()))
+		if err != nil {
+			n.s.logf("serializing UDP fragments: %v", err)
+			return
+		}
+		for _, f := range frames {
+			n.writeEth(f)
+		}
+	} else {
+		ethRaw, err := udpFrame(n.mac, node.mac.Load(), src, dst, p.Options, p.Payload) // from gateway
+		if err != nil {
+			n.s.logf("serializing UDP: %v", err)
+			return
+		}
+		n.writeEth(ethRaw)
+	}
+	if !p.sent.IsZero() && p.srcMAC != (MAC{}) {
+		n.s.recordLatency(NodePair{p.srcMAC, node.mac.Load()}, n.s.clock.Since(p.sent))
+	}
+	n.s.noteWireGuardDelivered(p, node.mac.Load())
+}
 
+// udpFrame returns a raw Ethernet frame of a UDP packet over IPv4, with the
+// given IPv4 header options, if any.
+func udpFrame(srcMAC, dstMAC MAC, src, dst netip.AddrPort, options []layers.IPv4Option, payload []byte) ([]byte, error) {
 	eth := &layers.Ethernet{
-		SrcMAC:       n.mac.HWAddr(), // of gateway
-		DstMAC:       node.mac.HWAddr(),
+		SrcMAC:       srcMAC.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
 		EthernetType: layers.EthernetTypeIPv4,
 	}
 	ip := &layers.IPv4{
@@ -653,6 +1748,7 @@ func (n *network) WriteUDPPacketNoNAT(p UDPPacket) {
 		Protocol: layers.IPProtocolUDP,
 		SrcIP:    src.Addr().AsSlice(),
 		DstIP:    dst.Addr().AsSlice(),
+		Options:  options,
 	}
 	udp := &layers.UDP{
 		SrcPort: layers.UDPPort(src.Port()),
@@ -660,14 +1756,153 @@ func (n *network) WriteUDPPacketNoNAT(p UDPPacket) {
 	}
 	udp.SetNetworkLayerForChecksum(ip)
 
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	if err := gopacket.SerializeLayers(buffer, options, eth, ip, udp, gopacket.Payload(p.Payload)); err != nil {
-		log.Printf("serializing UDP: %v", err)
+	return serializeFrame(eth, ip, udp, gopacket.Payload(payload))
+}
+
+// serializeBufs pools the gopacket.SerializeBuffers that serializeFrame uses.
+var serializeBufs = sync.Pool{
+	New: func() any { return gopacket.NewSerializeBuffer() },
+}
+
+// serializeFrame serializes the layers, fixing lengths and computing
+// checksums, and returns the resulting bytes, which the caller owns. It
+// serializes into a pooled buffer, so that the only allocation is of the
+// returned bytes.
+func serializeFrame(ls ...gopacket.SerializableLayer) ([]byte, error) {
+	buf := serializeBufs.Get().(gopacket.SerializeBuffer)
+	defer func() {
+		// Some layers (e.g. DHCPv4's unset addresses) skip bytes, assuming
+		// the buffer is zeroed, so zero what was written before reuse.
+		clear(buf.Bytes())
+		serializeBufs.Put(buf)
+	}()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// ipv4Frame returns a raw Ethernet frame of an IPv4 packet from src to dst of
+// the given protocol, carrying the given layers. If the first layer is a TCP
+// or UDP header, its checksum is computed.
+func ipv4Frame(srcMAC, dstMAC MAC, src, dst netip.Addr, proto layers.IPProtocol, payload ...gopacket.SerializableLayer) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    src.AsSlice(),
+		DstIP:    dst.AsSlice(),
+	}
+	if len(payload) > 0 {
+		switch l := payload[0].(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(ip)
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(ip)
+		}
+	}
+
+	return serializeFrame(append([]gopacket.SerializableLayer{eth, ip}, payload...)...)
+}
+
+// IPv4 option types that routers update when forwarding. See RFC 791.
+const (
+	ipv4OptRecordRoute = 7
+	ipv4OptTimestamp   = 68
+)
+
+// forwardIPv4Options returns a copy of the IPv4 header options opts of a packet
+// being forwarded out of the router interface with address ip, as a router
+// would: ip is appended to any record route option, and the time now (and ip,
+// if requested) to any timestamp option. Other options are preserved as-is.
+func forwardIPv4Options(opts []layers.IPv4Option, ip netip.Addr, now time.Time) []layers.IPv4Option {
+	if len(opts) == 0 {
+		return nil
+	}
+	ret := make([]layers.IPv4Option, len(opts))
+	for i, o := range opts {
+		o.OptionData = bytes.Clone(o.OptionData) // may alias the received packet
+		switch o.OptionType {
+		case ipv4OptRecordRoute:
+			recordRoute(o.OptionData, ip)
+		case ipv4OptTimestamp:
+			recordTimestamp(o.OptionData, ip, now)
+		}
+		ret[i] = o
+	}
+	return ret
+}
+
+// recordRoute appends ip to the record route option with data (the option
+// after its type and length bytes), if it has room.
+func recordRoute(data []byte, ip netip.Addr) {
+	if len(data) == 0 {
+		return
+	}
+	// The pointer is the 1-based offset of the next free slot in the whole
+	// option, so slot offsets in data are 3 less.
+	ptr := int(data[0])
+	i := ptr - 3
+	if ptr < 4 || i+4 > len(data) {
+		return // full or malformed
+	}
+	a := ip.As4()
+	copy(data[i:], a[:])
+	data[0] += 4
+}
+
+// recordTimestamp appends a timestamp for now to the timestamp option with
+// data (the option after its type and length bytes), per the option's flags. If
+// the option is full, its overflow count is incremented instead.
+func recordTimestamp(data []byte, ip netip.Addr, now time.Time) {
+	if len(data) < 2 {
 		return
 	}
-	ethRaw := buffer.Bytes()
-	n.writeEth(ethRaw)
+	const (
+		tsOnly         = 0 // timestamps only
+		tsAndAddr      = 1 // each timestamp preceded by the recording address
+		tsPrespecified = 3 // timestamps only from prespecified addresses
+	)
+	flag := data[1] & 0x0f
+	size := 4
+	if flag == tsAndAddr || flag == tsPrespecified {
+		size = 8
+	}
+	ptr := int(data[0])
+	i := ptr - 3
+	if ptr < 5 || i+size > len(data) {
+		if data[1]>>4 < 0x0f {
+			data[1] += 0x10 // overflow count
+		}
+		return
+	}
+
+	// Milliseconds since midnight UT.
+	now = now.UTC()
+	y, m, d := now.Date()
+	ms := uint32(now.Sub(time.Date(y, m, d, 0, 0, 0, 0, time.UTC)).Milliseconds())
+	a := ip.As4()
+	switch flag {
+	case tsOnly:
+		binary.BigEndian.PutUint32(data[i:], ms)
+	case tsAndAddr:
+		copy(data[i:], a[:])
+		binary.BigEndian.PutUint32(data[i+4:], ms)
+	case tsPrespecified:
+		if !bytes.Equal(data[i:i+4], a[:]) {
+			return // not our turn
+		}
+		binary.BigEndian.PutUint32(data[i+4:], ms)
+	default:
+		return
+	}
+	data[0] += byte(size)
 }
 
 // HandleEthernetIPv4PacketForRouter handles an IPv4 packet that is
@@ -687,13 +1922,46 @@ func (n *network) HandleEthernetIPv4PacketForRouter(ep EthernetPacket) {
 	toForward := dstIP != n.lanIP.Addr() && dstIP != netip.IPv4Unspecified()
 	udp, isUDP := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
 
+	if sn, ok := n.subnetFor(dstIP); ok {
+		n.handleSubnetPacket(ep, sn)
+		return
+	}
+
+	// The WAN link's MTU only limits packets with the don't fragment bit set;
+	// others are forwarded whole. A path MTU learned from ICMP also has the
+	// router fragment the others.
+	mtu := n.linkMTU()
+	var pathMTU int
+	if toForward {
+		pathMTU = n.pathMTUTo(dstIP)
+		if pathMTU > 0 && (mtu == 0 || pathMTU < mtu) {
+			mtu = pathMTU
+		}
+	}
+	if toForward && mtu > 0 && int(v4.Length) > mtu && v4.Flags&layers.IPv4DontFragment != 0 {
+		n.s.noteDropFrame(DropTooBig, packet.Data())
+		if n.silentMTU {
+			return
+		}
+		res, err := n.createICMPFragNeeded(ep.SrcMAC(), v4, mtu)
+		if err != nil {
+			n.s.logf("createICMPFragNeeded: %v", err)
+			return
+		}
+		writePkt(res)
+		return
+	}
+
 	if isDHCPRequest(packet) {
-		res, err := n.s.createDHCPResponse(packet)
+		res, leased, err := n.s.createDHCPResponse(n, packet)
 		if err != nil {
-			log.Printf("createDHCPResponse: %v", err)
+			n.s.logf("createDHCPResponse: %v", err)
 			return
 		}
 		writePkt(res)
+		if leased != nil {
+			leased()
+		}
 		return
 	}
 
@@ -702,72 +1970,240 @@ func (n *network) HandleEthernetIPv4PacketForRouter(ep EthernetPacket) {
 		return
 	}
 
-	if isDNSRequest(packet) {
-		// TODO(bradfitz): restrict this to 4.11.4.11? add DNS
-		// on gateway instead?
-		res, err := n.s.createDNSResponse(packet)
+	if n.isDNSRequest(packet) {
+		if spoof, ok := n.s.takeDNSSpoof(ep.SrcMAC(), packet); ok {
+			// The forged response wins the race.
+			writePkt(spoof)
+		}
+		res, err := n.s.createDNSResponse(n, packet)
 		if err != nil {
-			log.Printf("createDNSResponse: %v", err)
+			n.s.logf("createDNSResponse: %v", err)
 			return
 		}
-		writePkt(res)
+		if d := n.s.dnsDelay(); d > 0 {
+			n.s.afterFunc(d, func() { writePkt(res) })
+			return
+		}
+		writePkt(res)
+		return
+	}
+
+	if !toForward && isNATPMP(packet) {
+		if n.services.Contains(NATPMP) {
+			n.handleNATPMPRequest(UDPPacket{
+				Src:     netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)),
+				Dst:     netip.AddrPortFrom(dstIP, uint16(udp.DstPort)),
+				Payload: udp.Payload,
+			})
+		}
+		return
+	}
+
+	if !toForward && isPCP(packet) {
+		if n.services.Contains(PCP) {
+			n.handlePCPRequest(UDPPacket{
+				Src:     netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)),
+				Dst:     netip.AddrPortFrom(dstIP, uint16(udp.DstPort)),
+				Payload: udp.Payload,
+			})
+		}
 		return
 	}
 
-	if !toForward && isNATPMP(packet) {
-		n.handleNATPMPRequest(UDPPacket{
-			Src:     netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)),
-			Dst:     netip.AddrPortFrom(dstIP, uint16(udp.DstPort)),
-			Payload: udp.Payload,
-		})
+	if toForward && !n.egressAllowed(packet, dstIP) {
+		n.s.noteDropFrame(DropFirewall, packet.Data())
 		return
 	}
 
 	if toForward && isUDP {
 		src := netip.AddrPortFrom(srcIP, uint16(udp.SrcPort))
 		dst := netip.AddrPortFrom(dstIP, uint16(udp.DstPort))
-		src = n.doNATOut(src, dst)
+		if _, ok := n.publicIPs[srcIP]; !ok { // nodes' public IPs aren't NATed
+			lanSrc := src
+			if src = n.doNATOut(src, dst); !src.IsValid() {
+				n.s.noteDrop(DropNATTableFull, lanSrc, dst)
+				return
+			}
+		}
+		if n.antiSpoof && !n.isOwnWANSource(src.Addr()) {
+			n.s.noteDrop(DropSpoofed, src, dst)
+			return
+		}
 
 		n.s.routeUDPPacket(UDPPacket{
-			Src:     src,
-			Dst:     dst,
-			Payload: udp.Payload,
+			Src:      src,
+			Dst:      dst,
+			Payload:  udp.Payload,
+			Options:  forwardIPv4Options(v4.Options, n.wanIP, n.s.clock.Now()),
+			fragMTU:  pathMTU,
+			priority: ep.priority(),
+			srcMAC:   ep.SrcMAC(),
+			srcNet:   n,
 		})
 		return
 	}
 
 	if toForward && n.s.shouldInterceptTCP(packet) {
-		ipp := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-		pktCopy := make([]byte, 0, len(ipp.Contents)+len(ipp.Payload))
-		pktCopy = append(pktCopy, ipp.Contents...)
-		pktCopy = append(pktCopy, ipp.Payload...)
-		packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Payload: buffer.MakeWithData(pktCopy),
-		})
-		n.linkEP.InjectInbound(header.IPv4ProtocolNumber, packetBuf)
-		packetBuf.DecRef()
+		n.noteSYN(packet)
+		n.tcpStack.handleTCP(packet)
 		return
 	}
 
 	//log.Printf("Got packet: %v", packet)
 }
 
-func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
-	ethLayer := request.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
-	srcMAC, ok := macOf(ethLayer.SrcMAC)
+// dhcpHostname returns the lowercase hostname that the client sent in its
+// DHCP message d (option 12), or the empty string if none or it isn't a valid
+// DNS label.
+func dhcpHostname(d *layers.DHCPv4) string {
+	for _, opt := range d.Options {
+		if opt.Type != layers.DHCPOptHostname {
+			continue
+		}
+		name := strings.ToLower(string(opt.Data))
+		if dnsname.ValidLabel(name) != nil {
+			return ""
+		}
+		return name
+	}
+	return ""
+}
+
+// registerHostname makes n's DNS answer hostname with the LAN IP of the node
+// with MAC mac, replacing any hostname the node registered before.
+func (n *network) registerHostname(hostname string, mac MAC) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for name, m := range n.hostnames {
+		if m == mac {
+			delete(n.hostnames, name)
+		}
+	}
+	mak.Set(&n.hostnames, hostname, mac)
+}
+
+// lookupHostname returns the LAN IP of the node on n that registered the
+// hostname qname with DHCP, if any.
+func (n *network) lookupHostname(qname string) (_ netip.Addr, ok bool) {
+	n.mu.Lock()
+	mac, ok := n.hostnames[strings.ToLower(strings.TrimSuffix(qname, "."))]
+	n.mu.Unlock()
 	if !ok {
-		return nil, nil
+		return netip.Addr{}, false
 	}
-	node, ok := s.nodeByMAC[srcMAC]
+	node, ok := n.nodeForMAC(mac)
 	if !ok {
-		log.Printf("DHCP request from unknown node %v; ignoring", srcMAC)
-		return nil, nil
+		return netip.Addr{}, false
 	}
-	gwIP := node.net.lanIP.Addr()
+	ip, _ := node.lanIPs()
+	return ip, ip.IsValid()
+}
+
+// dhcpConfigOptions returns the DHCP options that configure a client on n:
+// its router, DNS servers and subnet mask.
+func dhcpConfigOptions(node *node) []layers.DHCPOption {
+	n := node.net
+	dns := n.s.fakeIPs.DNS.AsSlice()
+	if n.dnsOnGateway {
+		dns = append(n.lanIP.Addr().AsSlice(), dns...)
+	}
+	opts := []layers.DHCPOption{
+		{
+			Type:   layers.DHCPOptRouter,
+			Data:   n.lanIP.Addr().AsSlice(),
+			Length: 4,
+		},
+		{
+			Type:   layers.DHCPOptDNS,
+			Data:   dns,
+			Length: uint8(len(dns)),
+		},
+		{
+			Type:   layers.DHCPOptSubnetMask,
+			Data:   net.CIDRMask(n.lanIP.Bits(), 32),
+			Length: 4,
+		},
+	}
+	if len(node.dhcpRoutes) > 0 {
+		routes := classlessStaticRoutes(node.dhcpRoutes)
+		opts = append(opts, layers.DHCPOption{
+			Type:   layers.DHCPOptClasslessStaticRoute,
+			Data:   routes,
+			Length: uint8(len(routes)),
+		})
+	}
+	return opts
+}
+
+// dhcpRoute is a route in a DHCP classless static route option.
+type dhcpRoute struct {
+	dst netip.Prefix // IPv4, masked
+	via netip.Addr   // IPv4 router, or 0.0.0.0 for on-link
+}
+
+// classlessStaticRoutes returns the data of a classless static route option
+// (RFC 3442) for routes: for each, the prefix length, the significant octets
+// of the destination, and the router's address.
+func classlessStaticRoutes(routes []dhcpRoute) []byte {
+	var b []byte
+	for _, r := range routes {
+		dst := r.dst.Addr().As4()
+		via := r.via.As4()
+		b = append(b, byte(r.dst.Bits()))
+		b = append(b, dst[:(r.dst.Bits()+7)/8]...)
+		b = append(b, via[:]...)
+	}
+	return b
+}
 
+// createDHCPResponse returns the response to the DHCP request in request.
+//
+// If the request was forwarded by a DHCP relay agent, with its address in
+// giaddr, the client is the node with the request's client hardware address
+// rather than the frame's sender, and the response is unicast to the relay
+// agent's server port, as in RFC 2131 section 4.1.
+//
+// If the response ACKs a lease, leased is non-nil and must be called once
+// the response is sent, to run the hooks registered with OnDHCPLease.
+func (s *Server) createDHCPResponse(netw *network, request gopacket.Packet) (res []byte, leased func(), err error) {
+	ethLayer := request.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
 	ipLayer := request.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 	udpLayer := request.Layer(layers.LayerTypeUDP).(*layers.UDP)
-	dhcpLayer := request.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	dhcpLayer, ok := request.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	giaddr, _ := netip.AddrFromSlice(dhcpLayer.RelayAgentIP)
+	relayed := giaddr.IsValid() && !giaddr.Unmap().IsUnspecified()
+	clientHW := ethLayer.SrcMAC
+	if relayed {
+		clientHW = dhcpLayer.ClientHWAddr
+	}
+	srcMAC, ok := macOf(clientHW)
+	if !ok {
+		return nil, nil, nil
+	}
+	node, ok := netw.nodeForMAC(srcMAC)
+	if !ok {
+		s.logf("DHCP request from unknown node %v; ignoring", srcMAC)
+		return nil, nil, nil
+	}
+	gwIP := node.net.lanIP.Addr()
+
+	var msgType layers.DHCPMsgType
+	for _, opt := range dhcpLayer.Options {
+		if opt.Type == layers.DHCPOptMessageType && opt.Length > 0 {
+			msgType = layers.DHCPMsgType(opt.Data[0])
+		}
+	}
+	var yiaddr netip.Addr
+	if msgType != layers.DHCPMsgTypeInform {
+		yiaddr, err = s.dhcpLease(node, msgType == layers.DHCPMsgTypeRequest)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	response := &layers.DHCPv4{
 		Operation:    layers.DHCPOpReply,
@@ -776,7 +2212,8 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 		Xid:          dhcpLayer.Xid,
 		ClientHWAddr: dhcpLayer.ClientHWAddr,
 		Flags:        dhcpLayer.Flags,
-		YourClientIP: node.lanIP.AsSlice(),
+		YourClientIP: yiaddr.AsSlice(),
+		RelayAgentIP: dhcpLayer.RelayAgentIP,
 		Options: []layers.DHCPOption{
 			{
 				Type:   layers.DHCPOptServerID,
@@ -786,12 +2223,6 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 		},
 	}
 
-	var msgType layers.DHCPMsgType
-	for _, opt := range dhcpLayer.Options {
-		if opt.Type == layers.DHCPOptMessageType && opt.Length > 0 {
-			msgType = layers.DHCPMsgType(opt.Data[0])
-		}
-	}
 	switch msgType {
 	case layers.DHCPMsgTypeDiscover:
 		response.Options = append(response.Options, layers.DHCPOption{
@@ -811,22 +2242,21 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 				Data:   binary.BigEndian.AppendUint32(nil, 3600), // hour? sure.
 				Length: 4,
 			},
-			layers.DHCPOption{
-				Type:   layers.DHCPOptRouter,
-				Data:   gwIP.AsSlice(),
-				Length: 4,
-			},
-			layers.DHCPOption{
-				Type:   layers.DHCPOptDNS,
-				Data:   fakeDNSIP.AsSlice(),
-				Length: 4,
-			},
-			layers.DHCPOption{
-				Type:   layers.DHCPOptSubnetMask,
-				Data:   net.CIDRMask(node.net.lanIP.Bits(), 32),
-				Length: 4,
-			},
 		)
+		response.Options = append(response.Options, dhcpConfigOptions(node)...)
+		if hostname := dhcpHostname(dhcpLayer); netw.hostnameDNS && hostname != "" {
+			netw.registerHostname(hostname, srcMAC)
+		}
+		leased = func() { s.noteDHCPLease(srcMAC, yiaddr) }
+	case layers.DHCPMsgTypeInform:
+		// The client already has an address (RFC 2131 section 3.4), so
+		// ACK with just the configuration: no lease and no yiaddr.
+		response.Options = append(response.Options, layers.DHCPOption{
+			Type:   layers.DHCPOptMessageType,
+			Data:   []byte{byte(layers.DHCPMsgTypeAck)},
+			Length: 1,
+		})
+		response.Options = append(response.Options, dhcpConfigOptions(node)...)
 	}
 
 	eth := &layers.Ethernet{
@@ -847,20 +2277,147 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 		SrcPort: udpLayer.DstPort,
 		DstPort: udpLayer.SrcPort,
 	}
+	if relayed {
+		ip.DstIP = giaddr.Unmap().AsSlice()
+		udp.DstPort = 67
+	}
 	udp.SetNetworkLayerForChecksum(ip)
 
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	if err := gopacket.SerializeLayers(buffer, options,
-		eth,
-		ip,
-		udp,
-		response,
-	); err != nil {
-		return nil, err
+	res, err = serializeFrame(eth, ip, udp, response)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, leased, nil
+}
+
+// dhcpLease returns the address to offer node in a DHCP response. That's its
+// fixed LAN IP unless its network has a DHCP pool, in which case it's the
+// node's existing lease or else the next free address in the pool. If commit
+// is set, the node is also given the leased address as its LAN IP, and any
+// NAT mappings for its previous LAN IP are moved to it.
+func (s *Server) dhcpLease(node *node, commit bool) (netip.Addr, error) {
+	n := node.net
+	if !n.dhcpPool.IsValid() {
+		return node.lanIP, nil
+	}
+	ip, oldIP, err := s.assignDHCPLease(node, commit)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if oldIP.IsValid() {
+		n.natMu.Lock()
+		defer n.natMu.Unlock()
+		n.natTable.RenameLANHost(oldIP, ip)
+	}
+	return ip, nil
+}
+
+// assignDHCPLease is the part of dhcpLease that picks the lease and, if
+// commit is set, assigns it, with s.mu and node.net.mu locked. If commit
+// changed the node's LAN IP from a valid one, it returns that previous LAN IP
+// as oldIP.
+func (s *Server) assignDHCPLease(node *node, commit bool) (ip, oldIP netip.Addr, err error) {
+	n := node.net
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ip, ok := n.leases[node.mac.Load()]
+	if !ok {
+		if ip, ok = n.nextFreeLeaseLocked(); !ok {
+			return netip.Addr{}, netip.Addr{}, fmt.Errorf("DHCP pool %v exhausted", n.dhcpPool)
+		}
+		mak.Set(&n.leases, node.mac.Load(), ip)
+	}
+	if commit && node.lanIP != ip {
+		oldIP = node.lanIP
+		delete(n.nodesByIP, node.lanIP)
+		node.lanIP = ip
+		n.nodesByIP[ip] = node
+	}
+	return ip, oldIP, nil
+}
+
+// OnDHCPLease registers f to be called with a node's MAC and LAN IP each time
+// the router ACKs the node's DHCP request, after the ACK is sent. Tests can
+// use it to wait until a node is addressed. f is called from the goroutine
+// handling the node's packets. It returns a func that unregisters f.
+//
+// Leases are IPv4 only; see [Node.LANIPv6] for a node's IPv6 address.
+func (s *Server) OnDHCPLease(f func(mac MAC, ip netip.Addr)) (remove func()) {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	h := s.leaseHooks.Add(f)
+	return func() {
+		s.leaseMu.Lock()
+		defer s.leaseMu.Unlock()
+		delete(s.leaseHooks, h)
+	}
+}
+
+// noteDHCPLease calls the hooks registered with OnDHCPLease for the lease of
+// ip to the node with the given MAC.
+func (s *Server) noteDHCPLease(mac MAC, ip netip.Addr) {
+	s.leaseMu.Lock()
+	hooks := make([]func(MAC, netip.Addr), 0, len(s.leaseHooks))
+	for _, f := range s.leaseHooks {
+		hooks = append(hooks, f)
+	}
+	s.leaseMu.Unlock()
+
+	for _, f := range hooks {
+		f(mac, ip)
+	}
+}
+
+// ReleaseDHCPLease forgets the DHCP lease of the node with the given MAC, as
+// when it expires on the router, so its next DHCP request may be given a
+// different address. The node keeps its LAN IP until then; if it changes,
+// the node's NAT mappings move to its new address.
+//
+// It returns an error if the node is unknown or its network has no DHCP pool
+// (see [Network.SetDHCPPool]).
+func (s *Server) ReleaseDHCPLease(mac MAC) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodeForMACLocked(mac)
+	if !ok {
+		return fmt.Errorf("unknown node %v", mac)
+	}
+	netw := n.net
+	if !netw.dhcpPool.IsValid() {
+		return fmt.Errorf("network %v has no DHCP pool", netw.wanIP)
 	}
+	netw.mu.Lock()
+	defer netw.mu.Unlock()
+	delete(netw.leases, mac)
+	return nil
+}
 
-	return buffer.Bytes(), nil
+// nextFreeLeaseLocked returns the first address in n's DHCP pool that isn't
+// the gateway, the LAN's network or broadcast address, or in use. n.mu must
+// be held.
+func (n *network) nextFreeLeaseLocked() (_ netip.Addr, ok bool) {
+	lan := n.lanIP.Masked()
+	for ip := n.dhcpPool.Addr(); n.dhcpPool.Contains(ip); ip = ip.Next() {
+		if ip == n.lanIP.Addr() || ip == lan.Addr() || ip == netipx.PrefixLastIP(lan) {
+			continue
+		}
+		if _, ok := n.nodesByIP[ip]; ok {
+			continue
+		}
+		leased := false
+		for _, l := range n.leases {
+			if l == ip {
+				leased = true
+				break
+			}
+		}
+		if !leased {
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
 }
 
 func isDHCPRequest(pkt gopacket.Packet) bool {
@@ -869,7 +2426,8 @@ func isDHCPRequest(pkt gopacket.Packet) bool {
 		return false
 	}
 	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
-	return ok && udp.DstPort == 67 && udp.SrcPort == 68
+	// Relay agents send from the server port.
+	return ok && udp.DstPort == 67 && (udp.SrcPort == 68 || udp.SrcPort == 67)
 }
 
 func isIGMP(pkt gopacket.Packet) bool {
@@ -882,33 +2440,88 @@ func isMDNSQuery(pkt gopacket.Packet) bool {
 	return ok && udp.SrcPort == 5353 && udp.DstPort == 5353
 }
 
+// SetTCPInterceptFunc replaces the predicate that decides which TCP
+// packets from nodes the router intercepts, terminating their connections
+// itself (see [Server.DefaultInterceptTCP]), with f, which is passed a packet
+// starting at its Ethernet layer. To augment the built-in predicate rather
+// than replace it, f may call DefaultInterceptTCP. A nil f restores the
+// built-in predicate.
+//
+// Intercepted connections to destinations that the server doesn't serve,
+// such as those given to [Server.RegisterHTTPHandler], are reset.
+func (s *Server) SetTCPInterceptFunc(f func(pkt gopacket.Packet) bool) {
+	s.interceptTCP.Store(f)
+}
+
+// RegisterHTTPHandler makes h serve intercepted TCP connections to dst,
+// taking precedence over the server's built-in handling of dst. Connections
+// to dst are only intercepted if the TCP intercept predicate says so; see
+// [Server.SetTCPInterceptFunc]. A nil h unregisters dst's handler.
+func (s *Server) RegisterHTTPHandler(dst netip.AddrPort, h http.Handler) {
+	s.httpMu.Lock()
+	defer s.httpMu.Unlock()
+	if h == nil {
+		delete(s.httpHandlers, dst)
+		return
+	}
+	mak.Set(&s.httpHandlers, dst, h)
+}
+
+// httpHandler returns the handler registered for dst, if any.
+func (s *Server) httpHandler(dst netip.AddrPort) (_ http.Handler, ok bool) {
+	s.httpMu.Lock()
+	defer s.httpMu.Unlock()
+	h, ok := s.httpHandlers[dst]
+	return h, ok
+}
+
 func (s *Server) shouldInterceptTCP(pkt gopacket.Packet) bool {
+	if f := s.interceptTCP.Load(); f != nil {
+		return f(pkt)
+	}
+	return s.DefaultInterceptTCP(pkt)
+}
+
+// DefaultInterceptTCP is the built-in predicate for which TCP packets from
+// nodes the router intercepts: those to port 123 anywhere, to ports 80 and
+// 443 of the fake control plane and of DERP servers, and to port 8008 of the
+// fake test agent. Over IPv6, only those to DERP servers are intercepted.
+func (s *Server) DefaultInterceptTCP(pkt gopacket.Packet) bool {
 	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
 	if !ok {
 		return false
 	}
-	ipv4, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-	if !ok {
+	var dstIP netip.Addr
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		dstIP, _ = netip.AddrFromSlice(ip.DstIP.To4())
+	case *layers.IPv6:
+		dstIP, _ = netip.AddrFromSlice(ip.DstIP)
+		if !s.isDERPIP(dstIP) {
+			// Only DERP has IPv6 addresses.
+			return false
+		}
+	default:
 		return false
 	}
 	if tcp.DstPort == 123 {
 		return true
 	}
-	dstIP, _ := netip.AddrFromSlice(ipv4.DstIP.To4())
 	if tcp.DstPort == 80 || tcp.DstPort == 443 {
-		if dstIP == fakeControlplaneIP || s.derpIPs.Contains(dstIP) {
+		if dstIP == s.fakeIPs.Controlplane || s.isDERPIP(dstIP) {
 			return true
 		}
 	}
-	if tcp.DstPort == 8008 && dstIP == fakeTestAgentIP {
+	if tcp.DstPort == 8008 && dstIP == s.fakeIPs.TestAgent {
 		// Connection from cmd/tta.
 		return true
 	}
 	return false
 }
 
-// isDNSRequest reports whether pkt is a DNS request to the fake DNS server.
-func isDNSRequest(pkt gopacket.Packet) bool {
+// isDNSRequest reports whether pkt is a DNS request to the fake DNS server,
+// or to the gateway if it answers DNS.
+func (n *network) isDNSRequest(pkt gopacket.Packet) bool {
 	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
 	if !ok || udp.DstPort != 53 {
 		return false
@@ -918,7 +2531,7 @@ func isDNSRequest(pkt gopacket.Packet) bool {
 		return false
 	}
 	dstIP, ok := netip.AddrFromSlice(ip.DstIP)
-	if !ok || dstIP != fakeDNSIP {
+	if !ok || (dstIP != n.s.fakeIPs.DNS && !(n.dnsOnGateway && dstIP == n.lanIP.Addr())) {
 		return false
 	}
 	dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
@@ -930,12 +2543,20 @@ func isNATPMP(pkt gopacket.Packet) bool {
 	return ok && udp.DstPort == 5351 && len(udp.Payload) > 0 && udp.Payload[0] == 0 // version 0, not 2 for PCP
 }
 
-func makeSTUNReply(req UDPPacket) (res UDPPacket, ok bool) {
+func isPCP(pkt gopacket.Packet) bool {
+	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	return ok && udp.DstPort == 5351 && len(udp.Payload) > 0 && udp.Payload[0] == 2
+}
+
+func (s *Server) makeSTUNReply(req UDPPacket) (res UDPPacket, ok bool) {
 	txid, err := stun.ParseBindingRequest(req.Payload)
 	if err != nil {
-		log.Printf("invalid STUN request: %v", err)
+		s.logf("invalid STUN request: %v", err)
 		return res, false
 	}
+	if n, ok := req.sender(); ok {
+		n.activity.stunRequests.Add(1)
+	}
 	return UDPPacket{
 		Src:     req.Dst,
 		Dst:     req.Src,
@@ -943,10 +2564,11 @@ func makeSTUNReply(req UDPPacket) (res UDPPacket, ok bool) {
 	}, true
 }
 
-func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
-	ethLayer := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
-	ipLayer := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-	udpLayer := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+// createDNSResponse returns the fake DNS server's response to the DNS query
+// in pkt, from a node on netw, or nil if it shouldn't respond. If netw has a
+// DNS64 prefix, AAAA queries are answered with addresses synthesized in it.
+func (s *Server) createDNSResponse(netw *network, pkt gopacket.Packet) ([]byte, error) {
+	dns64 := netw.dns64
 	dnsLayer := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
 
 	if dnsLayer.OpCode != layers.DNSOpCodeQuery || dnsLayer.QR || len(dnsLayer.Questions) == 0 {
@@ -963,6 +2585,10 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 		OpCode:       layers.DNSOpCodeQuery,
 		ResponseCode: layers.DNSResponseCodeNoErr,
 	}
+	rcode, faulted := s.activeDNSFault()
+	if faulted {
+		response.ResponseCode = rcode
+	}
 
 	var names []string
 	for _, q := range dnsLayer.Questions {
@@ -977,11 +2603,25 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 		}
 
 		names = append(names, q.Type.String()+"/"+string(q.Name))
-		if q.Class != layers.DNSClassIN || q.Type != layers.DNSTypeA {
+		if faulted {
+			continue
+		}
+		if q.Class != layers.DNSClassIN {
+			continue
+		}
+		if q.Type != layers.DNSTypeA && !(q.Type == layers.DNSTypeAAAA && dns64.IsValid()) {
 			continue
 		}
 
-		if ip, ok := s.IPv4ForDNS(string(q.Name)); ok {
+		ip, ok := s.IPv4ForDNS(string(q.Name))
+		if !ok {
+			ip, ok = netw.lookupHostname(string(q.Name))
+		}
+		if ok {
+			if q.Type == layers.DNSTypeAAAA {
+				// There are no AAAA records, so synthesize one.
+				ip = dns64Addr(dns64, ip)
+			}
 			response.ANCount++
 			response.Answers = append(response.Answers, layers.DNSResourceRecord{
 				Name:  q.Name,
@@ -993,6 +2633,31 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 		}
 	}
 
+	frame, err := dnsResponseFrame(pkt, response)
+	if err != nil {
+		return nil, err
+	}
+
+	const debugDNS = false
+	if debugDNS {
+		if len(response.Answers) > 0 {
+			back := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+			s.logf("Generated: %v", back)
+		} else {
+			s.logf("made empty response for %q", names)
+		}
+	}
+
+	return frame, nil
+}
+
+// dnsResponseFrame returns a frame carrying response back to the sender of
+// pkt, a DNS query over IPv4 UDP.
+func dnsResponseFrame(pkt gopacket.Packet, response *layers.DNS) ([]byte, error) {
+	ethLayer := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ipLayer := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udpLayer := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+
 	eth2 := &layers.Ethernet{
 		SrcMAC:       ethLayer.DstMAC,
 		DstMAC:       ethLayer.SrcMAC,
@@ -1011,23 +2676,16 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 	}
 	udp2.SetNetworkLayerForChecksum(ip2)
 
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	if err := gopacket.SerializeLayers(buffer, options, eth2, ip2, udp2, response); err != nil {
-		return nil, err
-	}
-
-	const debugDNS = false
-	if debugDNS {
-		if len(response.Answers) > 0 {
-			back := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Lazy)
-			log.Printf("Generated: %v", back)
-		} else {
-			log.Printf("made empty response for %q", names)
-		}
-	}
+	return serializeFrame(eth2, ip2, udp2, response)
+}
 
-	return buffer.Bytes(), nil
+// dns64Addr returns the IPv4 address ip embedded in the IPv6 /96 prefix, per
+// RFC 6052.
+func dns64Addr(prefix netip.Prefix, ip netip.Addr) netip.Addr {
+	a := prefix.Addr().As16()
+	v4 := ip.As4()
+	copy(a[12:], v4[:])
+	return netip.AddrFrom16(a)
 }
 
 // doNATOut performs NAT on an outgoing packet from src to dst, where
@@ -1037,7 +2695,7 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 func (n *network) doNATOut(src, dst netip.AddrPort) (newSrc netip.AddrPort) {
 	n.natMu.Lock()
 	defer n.natMu.Unlock()
-	return n.natTable.PickOutgoingSrc(src, dst, time.Now())
+	return n.natTable.PickOutgoingSrc(src, dst, n.s.clock.Now())
 }
 
 // doNATIn performs NAT on an incoming packet from WAN src to WAN dst, returning
@@ -1045,7 +2703,48 @@ func (n *network) doNATOut(src, dst netip.AddrPort) (newSrc netip.AddrPort) {
 func (n *network) doNATIn(src, dst netip.AddrPort) (newDst netip.AddrPort) {
 	n.natMu.Lock()
 	defer n.natMu.Unlock()
-	return n.natTable.PickIncomingDst(src, dst, time.Now())
+	return n.natTable.PickIncomingDst(src, dst, n.s.clock.Now())
+}
+
+// createICMPFragNeeded returns an Ethernet frame to the node with MAC dstMAC
+// of an ICMP fragmentation needed message from the router for the too large
+// packet orig, giving mtu as the next-hop MTU.
+func (n *network) createICMPFragNeeded(dstMAC MAC, orig *layers.IPv4, mtu int) ([]byte, error) {
+	// Quote the original IP header and the first 8 bytes of its payload.
+	quote := orig.Contents
+	quote = append(quote[:len(quote):len(quote)], orig.Payload[:min(8, len(orig.Payload))]...)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       n.mac.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    n.lanIP.Addr().AsSlice(),
+		DstIP:    orig.SrcIP,
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+		Seq:      uint16(mtu), // the next-hop MTU field
+	}
+	return serializeFrame(eth, ip, icmp, gopacket.Payload(quote))
+}
+
+// WouldAcceptInbound reports whether the NAT of the network with WAN IP wanIP
+// would let in a packet from the internet from src to dst at time now. Unlike
+// sending the packet, it doesn't change the NAT's state. It reports false if
+// there's no such network.
+func (s *Server) WouldAcceptInbound(wanIP netip.Addr, src, dst netip.AddrPort, now time.Time) bool {
+	n, ok := s.inet.networkAt(wanIP)
+	if !ok {
+		return false
+	}
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+	return n.natTable.PeekIncomingDst(src, dst, now).IsValid()
 }
 
 func (n *network) createARPResponse(pkt gopacket.Packet) ([]byte, error) {
@@ -1088,13 +2787,7 @@ func (n *network) createARPResponse(pkt gopacket.Packet) ([]byte, error) {
 		DstProtAddress:    arpLayer.SourceProtAddress,
 	}
 
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	if err := gopacket.SerializeLayers(buffer, options, eth, a2); err != nil {
-		return nil, err
-	}
-
-	return buffer.Bytes(), nil
+	return serializeFrame(eth, a2)
 }
 
 func (n *network) handleNATPMPRequest(req UDPPacket) {
@@ -1107,7 +2800,7 @@ func (n *network) handleNATPMPRequest(req UDPPacket) {
 			128,  // response to op 0 (128+0)
 			0, 0, // result code success
 		)
-		res = binary.BigEndian.AppendUint32(res, uint32(time.Now().Unix()))
+		res = binary.BigEndian.AppendUint32(res, uint32(n.s.clock.Now().Unix()))
 		wan4 := n.wanIP.As4()
 		res = append(res, wan4[:]...)
 		n.WriteUDPPacketNoNAT(UDPPacket{
@@ -1118,10 +2811,54 @@ func (n *network) handleNATPMPRequest(req UDPPacket) {
 		return
 	}
 
-	log.Printf("TODO: handle NAT-PMP packet % 02x", req.Payload)
+	n.s.logf("TODO: handle NAT-PMP packet % 02x", req.Payload)
 	// TODO: handle NAT-PMP packet 00 01 00 00 ed 40 00 00 00 00 1c 20
 }
 
+// PCP opcodes and result codes. See RFC 6887.
+const (
+	pcpOpAnnounce        = 0
+	pcpResultSuccess     = 0
+	pcpResultMalformed   = 3
+	pcpResultUnsuppOp    = 5
+	pcpRequestHeaderSize = 24
+)
+
+// handlePCPRequest handles a PCP request to the router. Only ANNOUNCE is
+// supported so far; other opcodes get an UNSUPP_OPCODE response.
+func (n *network) handlePCPRequest(req UDPPacket) {
+	// https://www.rfc-editor.org/rfc/rfc6887#section-7.1
+	if len(req.Payload) < pcpRequestHeaderSize || req.Payload[1]&0x80 != 0 {
+		return // too short for a request, or a response
+	}
+	op := req.Payload[1] & 0x7f
+	result := byte(pcpResultSuccess)
+	switch {
+	case len(req.Payload)%4 != 0:
+		result = pcpResultMalformed
+	case op != pcpOpAnnounce:
+		// TODO: support MAP and PEER once the NAT tables support mappings.
+		result = pcpResultUnsuppOp
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc6887#section-7.2
+	res := make([]byte, 0, pcpRequestHeaderSize)
+	res = append(res,
+		2,       // version 2 (PCP)
+		0x80|op, // response to op
+		0,       // reserved
+		result,  // result code
+	)
+	res = binary.BigEndian.AppendUint32(res, 0)                              // lifetime
+	res = binary.BigEndian.AppendUint32(res, uint32(n.s.clock.Now().Unix())) // epoch time
+	res = append(res, make([]byte, 12)...)                                   // reserved
+	n.WriteUDPPacketNoNAT(UDPPacket{
+		Src:     req.Dst,
+		Dst:     req.Src,
+		Payload: res,
+	})
+}
+
 // UDPPacket is a UDP packet.
 //
 // For the purposes of this project, a UDP packet
@@ -1131,23 +2868,79 @@ type UDPPacket struct {
 	Src     netip.AddrPort
 	Dst     netip.AddrPort
 	Payload []byte // everything after UDP header
+
+	// Options are the options of the packet's IPv4 header, if any.
+	Options []layers.IPv4Option
+
+	fragMTU  int       // if non-zero, delivered in IPv4 fragments of at most this size
+	priority uint8     // 802.1p priority of the frame it was sent in
+	srcMAC   MAC       // of the node that sent it, if any
+	srcNet   *network  // of the node that sent it, if any
+	sent     time.Time // when it was sent, if its latency is being measured
 }
 
-func (s *Server) WriteStartingBanner(w io.Writer) {
-	fmt.Fprintf(w, "vnet serving clients:\n")
+// sender returns the node that sent p, if any.
+func (p UDPPacket) sender() (_ *node, ok bool) {
+	if p.srcNet == nil {
+		return nil, false
+	}
+	return p.srcNet.nodeForMAC(p.srcMAC)
+}
+
+// BannerEntry describes a node that the server serves, as returned by
+// [Server.StartingInfo].
+type BannerEntry struct {
+	MAC   MAC
+	LANIP netip.Addr // invalid if the node has none yet, such as before DHCP
+	WANIP netip.Addr // of the node's network
+	NAT   NAT        // of the node's network
+
+	// LANIPv6 is the IPv6 address the node was last seen using, such as to
+	// connect to DERP over IPv6, or invalid if none. The server doesn't
+	// assign nodes IPv6 addresses; it learns them.
+	LANIPv6 netip.Addr
+}
 
+// StartingInfo returns a BannerEntry for each of the server's nodes, in the
+// order they were added. It's the structured form of WriteStartingBanner.
+func (s *Server) StartingInfo() []BannerEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]BannerEntry, 0, len(s.nodes))
 	for _, n := range s.nodes {
-		fmt.Fprintf(w, "  %v %15v (%v, %v)\n", n.mac, n.lanIP, n.net.wanIP, n.net.natStyle.Load())
+		lanIP, lanIP6 := n.lanIPs()
+		ret = append(ret, BannerEntry{
+			MAC:     n.mac.Load(),
+			LANIP:   lanIP,
+			WANIP:   n.net.wanIP,
+			NAT:     n.net.natStyle.Load(),
+			LANIPv6: lanIP6,
+		})
+	}
+	return ret
+}
+
+// WriteStartingBanner writes a human-readable list of the server's nodes
+// to w.
+func (s *Server) WriteStartingBanner(w io.Writer) {
+	fmt.Fprintf(w, "vnet serving clients:\n")
+	for _, e := range s.StartingInfo() {
+		fmt.Fprintf(w, "  %v %15v (%v, %v)", e.MAC, e.LANIP, e.WANIP, e.NAT)
+		if e.LANIPv6.IsValid() {
+			fmt.Fprintf(w, " %v", e.LANIPv6)
+		}
+		fmt.Fprintln(w)
 	}
 }
 
 type agentConn struct {
-	node *node
-	tc   *gonet.TCPConn
+	node  *node
+	tc    net.Conn
+	added time.Time // when it became idle
 }
 
 func (s *Server) addIdleAgentConn(ac *agentConn) {
-	log.Printf("got agent conn from %v", ac.node.mac)
+	s.logf("got agent conn from %v", ac.node.mac.Load())
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -1196,6 +2989,70 @@ func (s *Server) takeAgentConnOne(n *node) (_ *agentConn, ok bool) {
 	return nil, false
 }
 
+// AgentConnInfo describes an idle test agent connection, as reported by
+// [Server.AgentConns].
+type AgentConnInfo struct {
+	MAC        MAC // of the node the agent runs on
+	LANIP      netip.Addr
+	LANIPv6    netip.Addr // see BannerEntry.LANIPv6
+	RemoteAddr net.Addr   // the agent's end of the conn
+	Added      time.Time  // when the conn was accepted
+}
+
+// AgentConns returns the idle test agent connections not yet taken by a
+// [Server.NodeAgentRoundTripper], ordered by node MAC and then by age.
+func (s *Server) AgentConns() []AgentConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]AgentConnInfo, 0, len(s.agentConns))
+	for ac := range s.agentConns {
+		lanIP, lanIP6 := ac.node.lanIPs()
+		ret = append(ret, AgentConnInfo{
+			MAC:        ac.node.mac.Load(),
+			LANIP:      lanIP,
+			LANIPv6:    lanIP6,
+			RemoteAddr: ac.tc.RemoteAddr(),
+			Added:      ac.added,
+		})
+	}
+	slices.SortFunc(ret, func(a, b AgentConnInfo) int {
+		if c := bytes.Compare(a.MAC[:], b.MAC[:]); c != 0 {
+			return c
+		}
+		return a.Added.Compare(b.Added)
+	})
+	return ret
+}
+
+// DropAgentConns closes all of n's idle test agent connections so they're
+// never handed out for a request, as when the agent has been restarted and
+// they're stale. Connections already in use are unaffected.
+func (s *Server) DropAgentConns(n *Node) {
+	s.dropAgentConns(n.n)
+}
+
+// dropAgentConns closes n's idle test agent connections, including those
+// kept idle by its agent round tripper.
+func (s *Server) dropAgentConns(n *node) {
+	s.mu.Lock()
+	var acs []*agentConn
+	for ac := range s.agentConns {
+		if ac.node == n {
+			s.agentConns.Delete(ac)
+			acs = append(acs, ac)
+		}
+	}
+	rt := s.agentRoundTripper[n]
+	s.mu.Unlock()
+
+	for _, ac := range acs {
+		ac.tc.Close()
+	}
+	if rt != nil {
+		rt.CloseIdleConnections()
+	}
+}
+
 func (s *Server) NodeAgentRoundTripper(ctx context.Context, n *Node) http.RoundTripper {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,4731 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/tsweb/varz"
+	"tailscale.com/util/set"
+)
+
+// testClient is a fake VM NIC attached to a Server with ServeUnixConn (or
+// ServeConn) using the QEMU stream protocol.
+type testClient struct {
+	t   testing.TB
+	mac MAC
+	c   net.Conn
+}
+
+func newTestClient(t testing.TB, s *Server, mac MAC) *testClient {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "vnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "s"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.DialUnix("unix", nil, ln.Addr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	sc, err := ln.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeUnixConn(sc, ProtocolQEMU)
+	return &testClient{t: t, mac: mac, c: c}
+}
+
+func (tc *testClient) writeFrame(frame []byte) {
+	tc.t.Helper()
+	pkt := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+	pkt = append(pkt, frame...)
+	if _, err := tc.c.Write(pkt); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// readFrame reads the next frame sent to the client, or returns ok=false if
+// none arrives within d.
+func (tc *testClient) readFrame(d time.Duration) (_ []byte, ok bool) {
+	tc.t.Helper()
+	tc.c.SetReadDeadline(time.Now().Add(d))
+	var hdr [4]byte
+	if _, err := io.ReadFull(tc.c, hdr[:]); err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil, false
+		}
+		tc.t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(tc.c, frame); err != nil {
+		tc.t.Fatal(err)
+	}
+	return frame, true
+}
+
+// readARPReply reads frames until it finds an ARP reply for ip, or returns
+// ok=false if none arrives within d.
+func (tc *testClient) readARPReply(ip netip.Addr, d time.Duration) (_ MAC, ok bool) {
+	tc.t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		frame, ok := tc.readFrame(time.Until(deadline))
+		if !ok {
+			return MAC{}, false
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+		arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+		if !ok || arp.Operation != layers.ARPReply {
+			continue
+		}
+		if got, _ := netip.AddrFromSlice(arp.SourceProtAddress); got == ip {
+			return MAC(arp.SourceHwAddress), true
+		}
+	}
+}
+
+// mustARPRequest returns an Ethernet frame from src (with IP srcIP) asking
+// who has ip.
+func mustARPRequest(t testing.TB, src MAC, srcIP, ip netip.Addr) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       src.HWAddr(),
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   src.HWAddr(),
+		SourceProtAddress: srcIP.AsSlice(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.AsSlice(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, arp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServeConn(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	gwIP := net1.lanIP.Addr()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeConn(sc, ProtocolQEMU)
+	}()
+	tc := &testClient{t: t, mac: n1.mac, c: cc}
+	tc.writeFrame(mustARPRequest(t, tc.mac, n1.n.lanIP, gwIP))
+	if got, ok := tc.readARPReply(gwIP, 5*time.Second); !ok || got != net1.mac {
+		t.Fatalf("ARP for gateway = %v, %v; want %v", got, ok, net1.mac)
+	}
+
+	// Closing the client's end ends ServeConn.
+	cc.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn didn't return after its conn closed")
+	}
+
+	// The datagram protocol needs a unix socket.
+	cc, sc = net.Pipe()
+	defer cc.Close()
+	go s.ServeConn(sc, ProtocolUnixDGRAM)
+	cc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cc.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read from ServeConn with ProtocolUnixDGRAM over a pipe = %v; want EOF", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", HardNAT)
+	n1 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	lan := netip.AddrPortFrom(n1.n.lanIP, 5000)
+
+	connect := func() *testClient {
+		cc, sc := net.Pipe()
+		t.Cleanup(func() { cc.Close() })
+		go s.ServeConn(sc, ProtocolQEMU)
+		return &testClient{t: t, mac: n1.mac, c: cc}
+	}
+	// stunReq has tc send a STUN request and returns the mapped address in the
+	// reply, which the hard NAT only lets in with the request's mapping.
+	stunReq := func(tc *testClient) netip.AddrPort {
+		t.Helper()
+		txid := stun.NewTxID()
+		frame, err := udpFrame(n1.mac, net1.mac, lan, probeSTUNAddr, nil, stun.Request(txid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.writeFrame(frame)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			frame, ok := tc.readFrame(time.Until(deadline))
+			if !ok {
+				t.Fatal("no STUN reply")
+			}
+			pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+			udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if !ok || udp.SrcPort != stunPort {
+				continue
+			}
+			gotTxID, addr, err := stun.ParseResponse(udp.Payload)
+			if err != nil || gotTxID != txid {
+				t.Fatalf("STUN reply = %v, %v; want txid %v", gotTxID, err, txid)
+			}
+			return addr
+		}
+	}
+
+	tc1 := connect()
+	mapped := stunReq(tc1)
+	agentEnd, sc := net.Pipe()
+	defer agentEnd.Close()
+	s.addIdleAgentConn(&agentConn{node: n1.n, tc: sc, added: time.Now()})
+
+	// The node reconnects before its old conn is noticed to be dead. Its
+	// mapping is kept, and its agent conn is dropped.
+	tc2 := connect()
+	if got := stunReq(tc2); got != mapped {
+		t.Errorf("after reconnecting, mapped address = %v; want %v", got, mapped)
+	}
+	if acs := s.AgentConns(); len(acs) != 0 {
+		t.Errorf("after reconnecting, agent conns = %v; want none", acs)
+	}
+	agentEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := agentEnd.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("reading from dropped agent conn = %v; want EOF", err)
+	}
+
+	// The old conn closing doesn't cut off the new one.
+	tc1.c.Close()
+	for deadline := time.Now().Add(5 * time.Second); n1.n.conns.Load() > 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("old conn not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := stunReq(tc2); got != mapped {
+		t.Errorf("after old conn closed, mapped address = %v; want %v", got, mapped)
+	}
+	if h := s.ConnHealth(); len(h) != 1 || !h[0].Connected {
+		t.Errorf("ConnHealth = %+v; want node connected", h)
+	}
+}
+
+func TestIsolatedMACs(t *testing.T) {
+	// The same guest image, and so MAC and LAN IP, on two networks.
+	mac := MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x07}
+	config := func(isolated bool) (_ *Config, nets [2]*Network, nodes [2]*Node) {
+		c := new(Config)
+		for i, wan := range []string{"2.1.1.1", "2.2.2.2"} {
+			nets[i] = c.AddNetwork(wan, "192.168.1.1/24", EasyNAT)
+			nets[i].SetIsolatedMACs(isolated)
+			nodes[i] = c.AddNode(nets[i])
+			nodes[i].SetMAC(mac)
+		}
+		return c, nets, nodes
+	}
+	c, _, _ := config(false)
+	if _, err := New(c); err == nil {
+		t.Fatal("New with a MAC on two networks without isolated MACs succeeded")
+	}
+
+	c, nets, nodes := config(true)
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.NodeEndpoint(mac); err == nil {
+		t.Error("NodeEndpoint of an ambiguous MAC succeeded")
+	}
+
+	for i, n := range nodes {
+		cc, sc := net.Pipe()
+		defer cc.Close()
+		go s.ServeNetworkConn(sc, ProtocolQEMU, nets[i].wanIP)
+		tc := &testClient{t: t, mac: mac, c: cc}
+
+		gwIP := nets[i].lanIP.Addr()
+		tc.writeFrame(mustARPRequest(t, mac, n.n.lanIP, gwIP))
+		if got, ok := tc.readARPReply(gwIP, 5*time.Second); !ok || got != nets[i].mac {
+			t.Fatalf("node %d: gateway ARP reply = %v, %t; want %v", i, got, ok, nets[i].mac)
+		}
+
+		txid := stun.NewTxID()
+		frame, err := udpFrame(mac, nets[i].mac, netip.AddrPortFrom(n.n.lanIP, 5000), probeSTUNAddr, nil, stun.Request(txid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.writeFrame(frame)
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			frame, ok := tc.readFrame(time.Until(deadline))
+			if !ok {
+				t.Fatalf("node %d: no STUN reply", i)
+			}
+			pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+			udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if !ok || udp.SrcPort != stunPort {
+				continue
+			}
+			if _, addr, err := stun.ParseResponse(udp.Payload); err != nil || addr.Addr() != nets[i].wanIP {
+				t.Errorf("node %d: STUN mapped address = %v, %v; want on %v", i, addr, err, nets[i].wanIP)
+			}
+			break
+		}
+		if a, err := s.NodeActivity(mac); err == nil {
+			t.Errorf("NodeActivity of an ambiguous MAC = %+v; want error", a)
+		}
+		if got := n.n.activity.stunRequests.Load(); got != 1 {
+			t.Errorf("node %d: STUN requests = %d; want 1", i, got)
+		}
+	}
+}
+
+func TestDetachNode(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip1, ip2 := n1.n.lanIP, n2.n.lanIP
+	gwIP := net1.lanIP.Addr()
+
+	c1 := newTestClient(t, s, n1.mac)
+	c2 := newTestClient(t, s, n2.mac)
+
+	c1.writeFrame(mustARPRequest(t, c1.mac, ip1, ip2))
+	if got, ok := c1.readARPReply(ip2, 5*time.Second); !ok || got != n2.mac {
+		t.Fatalf("before detach: ARP for %v = %v, %v; want %v", ip2, got, ok, n2.mac)
+	}
+
+	if err := s.DetachNode(n2.mac); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DetachNode(n2.mac); err == nil {
+		t.Fatal("second DetachNode succeeded; want error")
+	}
+
+	c1.writeFrame(mustARPRequest(t, c1.mac, ip1, ip2))
+	if got, ok := c1.readARPReply(ip2, 500*time.Millisecond); ok {
+		t.Fatalf("after detach: ARP for %v resolved to %v; want no reply", ip2, got)
+	}
+	c2.writeFrame(mustARPRequest(t, c2.mac, ip2, gwIP))
+	if _, ok := c2.readARPReply(gwIP, 500*time.Millisecond); ok {
+		t.Fatal("detached node's ARP request was answered; want dropped")
+	}
+
+	// The remaining node is unaffected.
+	c1.writeFrame(mustARPRequest(t, c1.mac, ip1, gwIP))
+	if got, ok := c1.readARPReply(gwIP, 5*time.Second); !ok || got != net1.mac {
+		t.Fatalf("ARP for gateway = %v, %v; want %v", got, ok, net1.mac)
+	}
+}
+
+func TestDetachNodeForgetsState(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	net1.SetHostnameDNS(true)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	netw := n1.n.net
+
+	ip6 := netip.MustParseAddr("fd00::2")
+	other6 := netip.MustParseAddr("fd00::3")
+	remote := netip.MustParseAddrPort("5.5.5.5:1000")
+	netw.noteV6Neighbor(ip6, n1.mac)
+	netw.noteV6Neighbor(other6, n2.mac)
+	lan, ok := netw.nat64SessionOut(netip.AddrPortFrom(ip6, 5000), remote)
+	if !ok {
+		t.Fatal("no NAT64 session")
+	}
+	netw.registerHostname("n1", n1.mac)
+
+	if err := s.DetachNode(n1.mac); err != nil {
+		t.Fatal(err)
+	}
+	if mac, ok := netw.v6Neighbors.Load(ip6); ok {
+		t.Errorf("after detach, %v is still neighbor %v", ip6, mac)
+	}
+	if mac, ok := netw.v6Neighbors.Load(other6); !ok || mac != n2.mac {
+		t.Errorf("other node's neighbor %v = %v, %v; want %v", other6, mac, ok, n2.mac)
+	}
+	if src6, ok := netw.nat64Session(lan, remote); ok {
+		t.Errorf("after detach, NAT64 session to %v from %v remains", remote, src6)
+	}
+	netw.mu.Lock()
+	_, ok = netw.hostnames["n1"]
+	netw.mu.Unlock()
+	if ok {
+		t.Error("after detach, hostname n1 is still registered")
+	}
+}
+
+// mustIPv4Frame returns an Ethernet frame carrying an IPv4 packet with the
+// given transport layer and payload, with lengths and checksums computed.
+func mustIPv4Frame(t testing.TB, srcMAC, dstMAC MAC, srcIP, dstIP netip.Addr, transport gopacket.SerializableLayer, payload []byte) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC.HWAddr(),
+		DstMAC:       dstMAC.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version: 4,
+		TTL:     64,
+		SrcIP:   srcIP.AsSlice(),
+		DstIP:   dstIP.AsSlice(),
+	}
+	switch tl := transport.(type) {
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+		tl.SetNetworkLayerForChecksum(ip)
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+		tl.SetNetworkLayerForChecksum(ip)
+	case *layers.ICMPv4:
+		ip.Protocol = layers.IPProtocolICMPv4
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, transport, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readTCP reads frames until it finds a TCP segment matching match, or
+// returns ok=false if none arrives within d.
+func (tc *testClient) readTCP(d time.Duration, match func(*layers.TCP) bool) (_ *layers.TCP, ok bool) {
+	tc.t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		frame, ok := tc.readFrame(time.Until(deadline))
+		if !ok {
+			return nil, false
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		if tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && match(tcp) {
+			return tcp, true
+		}
+	}
+}
+
+// synAck sends a SYN (offering SACK) through a new Server created from c and
+// returns the SYN-ACK from the intercepting TCP stack.
+func synAck(t *testing.T, c *Config) *layers.TCP {
+	t.Helper()
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(net1)
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := newTestClient(t, s, n1.mac)
+	syn := &layers.TCP{
+		SrcPort: 40000,
+		DstPort: 123,
+		Seq:     1000,
+		SYN:     true,
+		Window:  65535,
+		Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}},
+	}
+	tc.writeFrame(mustIPv4Frame(t, n1.mac, net1.mac, n1.n.lanIP, netip.MustParseAddr("1.2.3.4"), syn, nil))
+	sa, ok := tc.readTCP(5*time.Second, func(tcp *layers.TCP) bool { return tcp.SYN && tcp.ACK })
+	if !ok {
+		t.Fatal("no SYN-ACK")
+	}
+	return sa
+}
+
+func hasSACKPermitted(tcp *layers.TCP) bool {
+	for _, o := range tcp.Options {
+		if o.OptionType == layers.TCPOptionKindSACKPermitted {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTCPStackOptions(t *testing.T) {
+	def := synAck(t, &Config{})
+	small := synAck(t, &Config{TCPReceiveBufferSize: 2048})
+	t.Logf("SYN-ACK window: default=%v, with 2048 byte buffer=%v", def.Window, small.Window)
+	if small.Window > 2048 {
+		t.Errorf("SYN-ACK window with 2048 byte receive buffer = %v; want <= 2048", small.Window)
+	}
+	if small.Window >= def.Window {
+		t.Errorf("SYN-ACK window with small buffer (%v) not smaller than default (%v)", small.Window, def.Window)
+	}
+
+	if !hasSACKPermitted(def) {
+		t.Errorf("default SYN-ACK lacks SACK-permitted")
+	}
+	if noSACK := synAck(t, &Config{DisableTCPSACK: true}); hasSACKPermitted(noSACK) {
+		t.Errorf("SYN-ACK with DisableTCPSACK offers SACK-permitted")
+	}
+}
+
+func TestConnHealth(t *testing.T) {
+	c := Config{ConnStaleAfter: 250 * time.Millisecond}
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := func() NodeConnHealth {
+		t.Helper()
+		hs := s.ConnHealth()
+		if len(hs) != 1 || hs[0].MAC != n1.mac {
+			t.Fatalf("ConnHealth = %+v; want one entry for %v", hs, n1.mac)
+		}
+		return hs[0]
+	}
+	if h := health(); h.Connected || h.Stale || !h.LastRecv.IsZero() {
+		t.Fatalf("before connecting: %+v", h)
+	}
+
+	tc := newTestClient(t, s, n1.mac)
+	ping := func() {
+		tc.writeFrame(mustARPRequest(t, n1.mac, n1.n.lanIP, net1.lanIP.Addr()))
+		if _, ok := tc.readARPReply(net1.lanIP.Addr(), 5*time.Second); !ok {
+			t.Fatal("no ARP reply")
+		}
+	}
+	ping()
+	if h := health(); !h.Connected || h.Stale || h.LastRecv.IsZero() {
+		t.Fatalf("after frame: %+v; want connected and fresh", h)
+	}
+
+	time.Sleep(2 * c.ConnStaleAfter)
+	if h := health(); !h.Connected || !h.Stale {
+		t.Fatalf("after idle: %+v; want connected and stale", h)
+	}
+
+	ping()
+	if h := health(); h.Stale {
+		t.Fatalf("after new frame: %+v; want fresh", h)
+	}
+
+	tc.c.Close()
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if h := health(); h.Connected {
+			return fmt.Errorf("still connected: %+v", h)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeEndpoint(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NodeEndpoint(MAC{1, 2, 3, 4, 5, 6}); err == nil {
+		t.Fatal("NodeEndpoint for unknown MAC succeeded")
+	}
+	ep, err := s.NodeEndpoint(n1.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NodeEndpoint(n1.mac); err == nil {
+		t.Fatal("second NodeEndpoint for same node succeeded")
+	}
+
+	gwIP := net1.lanIP.Addr()
+	if _, err := ep.Write(mustARPRequest(t, n1.mac, n1.n.lanIP, gwIP)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1600)
+	n, err := ep.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := gopacket.NewPacket(buf[:n], layers.LayerTypeEthernet, gopacket.Default)
+	arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || arp.Operation != layers.ARPReply {
+		t.Fatalf("got %v; want ARP reply", pkt)
+	}
+	if got := MAC(arp.SourceHwAddress); got != net1.mac {
+		t.Errorf("ARP reply MAC = %v; want %v", got, net1.mac)
+	}
+	if got, _ := netip.AddrFromSlice(arp.SourceProtAddress); got != gwIP {
+		t.Errorf("ARP reply IP = %v; want %v", got, gwIP)
+	}
+
+	if _, err := ep.Write(mustARPRequest(t, MAC{1, 2, 3, 4, 5, 6}, n1.n.lanIP, gwIP)); err == nil {
+		t.Error("Write of frame from another MAC succeeded")
+	}
+
+	if err := ep.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ep.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close = %v; want net.ErrClosed", err)
+	}
+	ep2, err := s.NodeEndpoint(n1.mac)
+	if err != nil {
+		t.Fatalf("NodeEndpoint after Close: %v", err)
+	}
+
+	// A client conn may take the node over from an endpoint, which then
+	// closing doesn't cut off.
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go s.ServeConn(sc, ProtocolQEMU)
+	tc := &testClient{t: t, mac: n1.mac, c: cc}
+	tc.writeFrame(mustARPRequest(t, tc.mac, n1.n.lanIP, gwIP))
+	if _, ok := tc.readARPReply(gwIP, 5*time.Second); !ok {
+		t.Fatal("no ARP reply to client conn")
+	}
+	ep2.Close()
+	tc.writeFrame(mustARPRequest(t, tc.mac, n1.n.lanIP, gwIP))
+	if _, ok := tc.readARPReply(gwIP, 5*time.Second); !ok {
+		t.Error("no ARP reply to client conn after closing the endpoint it took over from")
+	}
+}
+
+// mustDNSQuery returns a serialized DNS query for the A record of name.
+func mustDNSQuery(t testing.TB, name string) []byte {
+	t.Helper()
+	return mustDNSQueryType(t, name, layers.DNSTypeA)
+}
+
+// mustDNSQueryType returns a serialized DNS query for the typ record of name.
+func mustDNSQueryType(t testing.TB, name string, typ layers.DNSType) []byte {
+	t.Helper()
+	q := &layers.DNS{
+		ID:        1,
+		RD:        true,
+		OpCode:    layers.DNSOpCodeQuery,
+		QDCount:   1,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: typ, Class: layers.DNSClassIN}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, q); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readDNSResponse reads frames until it finds a DNS response, returning it
+// and the IP it came from, or returns ok=false if none arrives within d.
+func (tc *testClient) readDNSResponse(d time.Duration) (_ *layers.DNS, from netip.Addr, ok bool) {
+	tc.t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		frame, ok := tc.readFrame(time.Until(deadline))
+		if !ok {
+			return nil, netip.Addr{}, false
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Lazy)
+		dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok || !dns.QR {
+			continue
+		}
+		ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		from, _ := netip.AddrFromSlice(ip.SrcIP)
+		return dns, from, true
+	}
+}
+
+func TestDNSOnGateway(t *testing.T) {
+	for _, onGateway := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DNSOnGateway=%t", onGateway), func(t *testing.T) {
+			var c Config
+			nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+			nw.SetDNSOnGateway(onGateway)
+			n1 := c.AddNode(nw)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc := newTestClient(t, s, n1.mac)
+			gw, src := nw.lanIP.Addr(), n1.n.lanIP
+
+			for _, server := range []netip.Addr{s.fakeIPs.DNS, gw} {
+				udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+				tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, src, server, udp, mustDNSQuery(t, "test-driver.tailscale")))
+				res, from, ok := tc.readDNSResponse(time.Second)
+				wantAnswer := server == s.fakeIPs.DNS || onGateway
+				if ok != wantAnswer {
+					t.Fatalf("query to %v: got response %t, want %t", server, ok, wantAnswer)
+				}
+				if !ok {
+					continue
+				}
+				if from != server {
+					t.Errorf("query to %v: response from %v", server, from)
+				}
+				if len(res.Answers) != 1 || !net.IP(res.Answers[0].IP).Equal(s.fakeIPs.TestAgent.AsSlice()) {
+					t.Errorf("query to %v: got answers %v, want %v", server, res.Answers, s.fakeIPs.TestAgent)
+				}
+			}
+		})
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	dns64 := netip.MustParsePrefix("64:ff9b::/96")
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DNS64=%t", enabled), func(t *testing.T) {
+			var c Config
+			nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+			if enabled {
+				nw.SetDNS64(dns64)
+			}
+			n1 := c.AddNode(nw)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc := newTestClient(t, s, n1.mac)
+
+			udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+			tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQueryType(t, "test-driver.tailscale", layers.DNSTypeAAAA)))
+			res, _, ok := tc.readDNSResponse(time.Second)
+			if !ok {
+				t.Fatal("no DNS response")
+			}
+			if !enabled {
+				if len(res.Answers) != 0 {
+					t.Errorf("got answers %v, want none", res.Answers)
+				}
+				return
+			}
+			want := dns64Addr(dns64, s.fakeIPs.TestAgent)
+			if len(res.Answers) != 1 || res.Answers[0].Type != layers.DNSTypeAAAA || !net.IP(res.Answers[0].IP).Equal(want.AsSlice()) {
+				t.Errorf("got answers %v, want %v", res.Answers, want)
+			}
+
+			// A queries are unaffected.
+			tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQuery(t, "test-driver.tailscale")))
+			res, _, ok = tc.readDNSResponse(time.Second)
+			if !ok {
+				t.Fatal("no DNS response to A query")
+			}
+			if len(res.Answers) != 1 || !net.IP(res.Answers[0].IP).Equal(s.fakeIPs.TestAgent.AsSlice()) {
+				t.Errorf("A query: got answers %v, want %v", res.Answers, s.fakeIPs.TestAgent)
+			}
+		})
+	}
+
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	nw.SetDNS64(netip.MustParsePrefix("64:ff9b::/64"))
+	c.AddNode(nw)
+	if _, err := New(&c); err == nil {
+		t.Error("New with a /64 DNS64 prefix succeeded; want error")
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	prefix := netip.MustParsePrefix("64:ff9b::/96")
+	var c Config
+	v6only := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	v6only.SetNAT64(prefix)
+	pub := c.AddNetwork("2.2.2.2", "5.0.0.1/24", NoNAT)
+	client := c.AddNode(v6only)
+	server := c.AddNode(pub)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, toClient := nodePackets(t, s, client)
+	_, toServer := nodePackets(t, s, server)
+
+	// The client sends over IPv6 to the server's address in the NAT64
+	// prefix, and it arrives over IPv4, NATed.
+	clientAddr := netip.MustParseAddrPort("[fd00::2]:5000")
+	serverIP := server.n.lanIP
+	serverAddr6 := netip.AddrPortFrom(dns64Addr(prefix, serverIP), 443)
+	frame, err := udp6Frame(client.mac, v6only.mac, clientAddr, serverAddr6, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.n.inject(frame)
+	p := nextPacket(toServer)
+	if p == nil {
+		t.Fatal("server got no packet")
+	}
+	ip, ok1 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp, ok2 := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok1 || !ok2 {
+		t.Fatalf("server got non-UDPv4 packet %v", p)
+	}
+	srcIP, _ := netip.AddrFromSlice(ip.SrcIP)
+	from := netip.AddrPortFrom(srcIP, uint16(udp.SrcPort))
+	if from.Addr() != v6only.wanIP || uint16(udp.DstPort) != 443 || string(udp.Payload) != "ping" {
+		t.Fatalf("server got %q from %v to port %v; want %q from %v to port 443", udp.Payload, from, udp.DstPort, "ping", v6only.wanIP)
+	}
+
+	// The server's reply arrives back at the client over IPv6.
+	if err := s.InjectUDP(server, 443, from, []byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	p = nextPacket(toClient)
+	if p == nil {
+		t.Fatal("client got no reply")
+	}
+	ip6, ok1 := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	udp, ok2 = p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok1 || !ok2 {
+		t.Fatalf("client got non-UDPv6 packet %v", p)
+	}
+	src6, _ := netip.AddrFromSlice(ip6.SrcIP)
+	dst6, _ := netip.AddrFromSlice(ip6.DstIP)
+	gotSrc, gotDst := netip.AddrPortFrom(src6, uint16(udp.SrcPort)), netip.AddrPortFrom(dst6, uint16(udp.DstPort))
+	if gotSrc != serverAddr6 || gotDst != clientAddr || string(udp.Payload) != "pong" {
+		t.Errorf("client got %q %v => %v; want %q %v => %v", udp.Payload, gotSrc, gotDst, "pong", serverAddr6, clientAddr)
+	}
+
+	// Without NAT64, the server's network drops IPv6 packets.
+	frame, err = udp6Frame(server.mac, pub.mac, netip.MustParseAddrPort("[fd00::3]:443"), netip.AddrPortFrom(dns64Addr(prefix, v6only.wanIP), 5000), []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.n.inject(frame)
+	if p := nextPacket(toClient); p != nil {
+		t.Errorf("client got packet %v from network without NAT64", p)
+	}
+}
+
+func TestNAT64WithIPv4Flows(t *testing.T) {
+	prefix := netip.MustParsePrefix("64:ff9b::/96")
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	c := Config{Clock: clock}
+	dual := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	dual.SetNAT64(prefix)
+	dual.SetNATTimeout(time.Minute)
+	pub := c.AddNetwork("2.2.2.2", "5.0.0.1/24", NoNAT)
+	client := c.AddNode(dual)
+	server := c.AddNode(pub)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, toClient := nodePackets(t, s, client)
+	_, toServer := nodePackets(t, s, server)
+
+	// serverGot returns the source and payload of the next packet to the
+	// server.
+	serverGot := func() (netip.AddrPort, string) {
+		t.Helper()
+		p := nextPacket(toServer)
+		if p == nil {
+			t.Fatal("server got no packet")
+		}
+		ip, ok1 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, ok2 := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok1 || !ok2 {
+			t.Fatalf("server got non-UDPv4 packet %v", p)
+		}
+		srcIP, _ := netip.AddrFromSlice(ip.SrcIP)
+		return netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)), string(udp.Payload)
+	}
+	// clientGot returns whether the next packet to the client is over IPv6
+	// and its payload.
+	clientGot := func() (is6 bool, payload string) {
+		t.Helper()
+		p := nextPacket(toClient)
+		if p == nil {
+			t.Fatal("client got no packet")
+		}
+		udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok {
+			t.Fatalf("client got non-UDP packet %v", p)
+		}
+		return p.Layer(layers.LayerTypeIPv6) != nil, string(udp.Payload)
+	}
+
+	// The client sends to the server from port 5000 both over IPv4 and,
+	// through NAT64, over IPv6.
+	serverIP := server.n.lanIP
+	if err := s.InjectUDP(client, 5000, netip.AddrPortFrom(serverIP, 443), []byte("v4")); err != nil {
+		t.Fatal(err)
+	}
+	from4, payload := serverGot()
+	if payload != "v4" {
+		t.Fatalf("server got %q; want %q", payload, "v4")
+	}
+	frame, err := udp6Frame(client.mac, dual.mac, netip.MustParseAddrPort("[fd00::2]:5000"), netip.AddrPortFrom(dns64Addr(prefix, serverIP), 443), []byte("v6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.n.inject(frame)
+	from6, payload := serverGot()
+	if payload != "v6" {
+		t.Fatalf("server got %q; want %q", payload, "v6")
+	}
+	if from4 == from6 {
+		t.Fatalf("IPv4 and NAT64 flows share the WAN address %v", from4)
+	}
+
+	// Replies to each flow go back over its own family.
+	for _, tt := range []struct {
+		to      netip.AddrPort
+		payload string
+		want6   bool
+	}{
+		{from4, "pong4", false},
+		{from6, "pong6", true},
+	} {
+		if err := s.InjectUDP(server, 443, tt.to, []byte(tt.payload)); err != nil {
+			t.Fatal(err)
+		}
+		if is6, payload := clientGot(); is6 != tt.want6 || payload != tt.payload {
+			t.Errorf("client got %q over IPv6=%t; want %q over IPv6=%t", payload, is6, tt.payload, tt.want6)
+		}
+	}
+
+	// The NAT64 session expires with the network's NAT timeout.
+	clock.Advance(2 * time.Minute)
+	if _, ok := dual.n.nat64Session(netip.AddrPortFrom(dual.lanIP.Addr(), 5000), netip.AddrPortFrom(serverIP, 443)); ok {
+		t.Error("NAT64 session still present after the NAT timeout")
+	}
+}
+
+// mustDHCPFrame returns a broadcast DHCP message of the given type from
+// mac, whose current address is ciaddr (which may be invalid), with any
+// extra options opts.
+func mustDHCPFrame(t testing.TB, mac MAC, msgType layers.DHCPMsgType, ciaddr netip.Addr, opts ...layers.DHCPOption) []byte {
+	t.Helper()
+	d := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          uint32(msgType)<<24 | uint32(mac[5]),
+		ClientIP:     ciaddr.AsSlice(),
+		ClientHWAddr: mac.HWAddr(),
+		Options: []layers.DHCPOption{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+		},
+	}
+	d.Options = append(d.Options, opts...)
+	d.Options = append(d.Options, layers.NewDHCPOption(layers.DHCPOptEnd, nil))
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, d); err != nil {
+		t.Fatal(err)
+	}
+	srcIP := ciaddr
+	if !srcIP.IsValid() {
+		srcIP = netip.IPv4Unspecified()
+	}
+	broadcast := MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	return mustIPv4Frame(t, mac, broadcast, srcIP, netip.AddrFrom4([4]byte{255, 255, 255, 255}),
+		&layers.UDP{SrcPort: 68, DstPort: 67}, buf.Bytes())
+}
+
+// readDHCPReply reads frames until it finds a DHCP reply to the client, and
+// returns it along with its options by type. It fails the test if none
+// arrives within d.
+func (tc *testClient) readDHCPReply(d time.Duration) (*layers.DHCPv4, map[layers.DHCPOpt][]byte) {
+	tc.t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		frame, ok := tc.readFrame(time.Until(deadline))
+		if !ok {
+			tc.t.Fatal("no DHCP reply")
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		// Skip other nodes' broadcasts, including our own.
+		reply, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		if !ok || reply.Operation != layers.DHCPOpReply || !bytes.Equal(reply.ClientHWAddr, tc.mac.HWAddr()) {
+			continue
+		}
+		opts := map[layers.DHCPOpt][]byte{}
+		for _, o := range reply.Options {
+			opts[o.Type] = o.Data
+		}
+		return reply, opts
+	}
+}
+
+func TestDHCPInform(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := newTestClient(t, s, n1.mac)
+	staticIP := n1.n.lanIP
+
+	tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeInform, staticIP))
+	ack, opts := tc.readDHCPReply(5 * time.Second)
+	if !ack.YourClientIP.Equal(net.IPv4zero) {
+		t.Errorf("yiaddr = %v; want 0.0.0.0", ack.YourClientIP)
+	}
+	if got := opts[layers.DHCPOptMessageType]; len(got) != 1 || layers.DHCPMsgType(got[0]) != layers.DHCPMsgTypeAck {
+		t.Errorf("message type = %v; want ACK", got)
+	}
+	if got := opts[layers.DHCPOptRouter]; !net.IP(got).Equal(nw.lanIP.Addr().AsSlice()) {
+		t.Errorf("router = %v; want %v", net.IP(got), nw.lanIP.Addr())
+	}
+	if got := opts[layers.DHCPOptDNS]; !net.IP(got).Equal(s.fakeIPs.DNS.AsSlice()) {
+		t.Errorf("DNS = %v; want %v", net.IP(got), s.fakeIPs.DNS)
+	}
+	if _, ok := opts[layers.DHCPOptLeaseTime]; ok {
+		t.Error("INFORM ACK has a lease time")
+	}
+}
+
+func TestDHCPRoutes(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(nw)
+	gw := nw.lanIP.Addr()
+	n1.AddDHCPRoute(netip.MustParsePrefix("0.0.0.0/0"), gw)
+	n1.AddDHCPRoute(netip.MustParsePrefix("10.0.0.0/8"), gw)
+	n1.AddDHCPRoute(netip.MustParsePrefix("100.64.0.0/10"), netip.MustParseAddr("192.168.1.50"))
+	n1.AddDHCPRoute(netip.MustParsePrefix("172.16.5.0/24"), netip.IPv4Unspecified())
+	n1.AddDHCPRoute(netip.MustParsePrefix("198.51.100.7/32"), gw)
+	n2 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	want := []byte{
+		0, 192, 168, 1, 1,
+		8, 10, 192, 168, 1, 1,
+		10, 100, 64, 192, 168, 1, 50,
+		24, 172, 16, 5, 0, 0, 0, 0,
+		32, 198, 51, 100, 7, 192, 168, 1, 1,
+	}
+	for _, msgType := range []layers.DHCPMsgType{layers.DHCPMsgTypeRequest, layers.DHCPMsgTypeInform} {
+		tc := newTestClient(t, s, n1.mac)
+		tc.writeFrame(mustDHCPFrame(t, n1.mac, msgType, netip.Addr{}))
+		_, opts := tc.readDHCPReply(5 * time.Second)
+		if got := opts[layers.DHCPOptClasslessStaticRoute]; !bytes.Equal(got, want) {
+			t.Errorf("%v: classless static routes = %v; want %v", msgType, got, want)
+		}
+		tc.c.Close()
+	}
+
+	tc := newTestClient(t, s, n2.mac)
+	tc.writeFrame(mustDHCPFrame(t, n2.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+	if _, opts := tc.readDHCPReply(5 * time.Second); opts[layers.DHCPOptClasslessStaticRoute] != nil {
+		t.Errorf("node without routes got classless static routes %v", opts[layers.DHCPOptClasslessStaticRoute])
+	}
+
+	var bad Config
+	bad.AddNode(bad.AddNetwork("2.1.1.1", "192.168.1.1/24")).AddDHCPRoute(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParseAddr("10.0.0.1"))
+	if _, err := New(&bad); err == nil {
+		t.Error("New with a DHCP route via a router off the LAN succeeded")
+	}
+}
+
+func TestDHCPRelay(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	relay := c.AddNode(nw)
+	client := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tc := newTestClient(t, s, relay.mac)
+
+	// The relay agent forwards the client's DISCOVER to the DHCP server,
+	// which is the gateway, with its own address in giaddr.
+	giaddr := relay.n.lanIP
+	d := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		HardwareOpts: 1,
+		Xid:          0x1234,
+		RelayAgentIP: giaddr.AsSlice(),
+		ClientHWAddr: client.mac.HWAddr(),
+		Options: []layers.DHCPOption{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeDiscover)}),
+			layers.NewDHCPOption(layers.DHCPOptEnd, nil),
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, d); err != nil {
+		t.Fatal(err)
+	}
+	tc.writeFrame(mustIPv4Frame(t, relay.mac, nw.mac, giaddr, nw.lanIP.Addr(),
+		&layers.UDP{SrcPort: 67, DstPort: 67}, buf.Bytes()))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		frame, ok := tc.readFrame(time.Until(deadline))
+		if !ok {
+			t.Fatal("no DHCP reply to relay agent")
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		reply, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		if !ok || reply.Operation != layers.DHCPOpReply {
+			continue
+		}
+		eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if got := MAC(eth.DstMAC); got != relay.mac {
+			t.Errorf("reply to MAC %v; want relay agent %v", got, relay.mac)
+		}
+		if !ip.DstIP.Equal(giaddr.AsSlice()) || udp.DstPort != 67 {
+			t.Errorf("reply to %v:%d; want %v:67", ip.DstIP, udp.DstPort, giaddr)
+		}
+		if !reply.RelayAgentIP.Equal(giaddr.AsSlice()) {
+			t.Errorf("reply giaddr = %v; want %v", reply.RelayAgentIP, giaddr)
+		}
+		if got := MAC(reply.ClientHWAddr); got != client.mac {
+			t.Errorf("reply chaddr = %v; want client %v", got, client.mac)
+		}
+		if !reply.YourClientIP.Equal(client.n.lanIP.AsSlice()) {
+			t.Errorf("yiaddr = %v; want client's %v", reply.YourClientIP, client.n.lanIP)
+		}
+		return
+	}
+}
+
+func TestHostnameDNS(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			var c Config
+			nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+			nw.SetHostnameDNS(enabled)
+			alice := c.AddNode(nw)
+			bob := c.AddNode(nw)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			bobClient := newTestClient(t, s, bob.mac)
+			lookup := func(name string) (netip.Addr, bool) {
+				t.Helper()
+				udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+				bobClient.writeFrame(mustIPv4Frame(t, bob.mac, nw.mac, bob.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQuery(t, name)))
+				res, _, ok := bobClient.readDNSResponse(time.Second)
+				if !ok {
+					t.Fatalf("no DNS response for %q", name)
+				}
+				if len(res.Answers) == 0 {
+					return netip.Addr{}, false
+				}
+				ip, _ := netip.AddrFromSlice(res.Answers[0].IP)
+				return ip.Unmap(), true
+			}
+			if ip, ok := lookup("alice"); ok {
+				t.Fatalf("alice resolved to %v before registering", ip)
+			}
+
+			tc := newTestClient(t, s, alice.mac)
+			tc.writeFrame(mustDHCPFrame(t, alice.mac, layers.DHCPMsgTypeRequest, netip.Addr{},
+				layers.NewDHCPOption(layers.DHCPOptHostname, []byte("Alice"))))
+			tc.readDHCPReply(5 * time.Second)
+
+			ip, ok := lookup("alice")
+			if !enabled {
+				if ok {
+					t.Errorf("alice resolved to %v with hostname DNS disabled", ip)
+				}
+				return
+			}
+			if !ok || ip != alice.n.lanIP {
+				t.Errorf("alice resolved to %v, %v; want %v", ip, ok, alice.n.lanIP)
+			}
+
+			// A new hostname replaces the old one.
+			tc.writeFrame(mustDHCPFrame(t, alice.mac, layers.DHCPMsgTypeRequest, netip.Addr{},
+				layers.NewDHCPOption(layers.DHCPOptHostname, []byte("alice2"))))
+			tc.readDHCPReply(5 * time.Second)
+			if ip, ok := lookup("alice"); ok {
+				t.Errorf("old hostname alice still resolves to %v", ip)
+			}
+			if ip, ok := lookup("ALICE2"); !ok || ip != alice.n.lanIP {
+				t.Errorf("alice2 resolved to %v, %v; want %v", ip, ok, alice.n.lanIP)
+			}
+		})
+	}
+}
+
+func TestOnDHCPLease(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	pool := netip.MustParsePrefix("192.168.1.200/29")
+	nw.SetDHCPPool(pool)
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	type lease struct {
+		mac MAC
+		ip  netip.Addr
+	}
+	leases := make(chan lease, 10)
+	remove := s.OnDHCPLease(func(mac MAC, ip netip.Addr) {
+		leases <- lease{mac, ip}
+	})
+	defer remove()
+
+	// The client doesn't read the replies: it's the callback that says when
+	// it has an address.
+	tc := newTestClient(t, s, n1.mac)
+	tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeDiscover, netip.Addr{}))
+	tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+	var got lease
+	select {
+	case got = <-leases:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no lease")
+	}
+	if got.mac != n1.mac || !pool.Contains(got.ip) {
+		t.Fatalf("lease of %v to %v; want one in %v to %v", got.ip, got.mac, pool, n1.mac)
+	}
+	tc.readDHCPReply(5 * time.Second) // the offer
+	ack, _ := tc.readDHCPReply(5 * time.Second)
+	if acked, _ := netip.AddrFromSlice(ack.YourClientIP.To4()); acked != got.ip {
+		t.Errorf("ACK of %v; callback got %v", acked, got.ip)
+	}
+
+	// The node can use its lease once the callback fires.
+	tc.writeFrame(mustARPRequest(t, n1.mac, got.ip, nw.lanIP.Addr()))
+	if _, ok := tc.readARPReply(nw.lanIP.Addr(), 5*time.Second); !ok {
+		t.Fatal("no ARP reply from gateway")
+	}
+
+	// Offers and INFORM ACKs aren't leases.
+	tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeDiscover, netip.Addr{}))
+	tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeInform, got.ip))
+	tc.readDHCPReply(5 * time.Second)
+	tc.readDHCPReply(5 * time.Second)
+	select {
+	case l := <-leases:
+		t.Errorf("unexpected lease %v", l)
+	default:
+	}
+}
+
+func TestDHCPPool(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	pool := netip.MustParsePrefix("192.168.1.200/29")
+	nw.SetDHCPPool(pool)
+	n1 := c.AddNode(nw)
+	n2 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1.n.lanIP.IsValid() || n2.n.lanIP.IsValid() {
+		t.Fatalf("nodes have LAN IPs %v, %v before DHCP", n1.n.lanIP, n2.n.lanIP)
+	}
+
+	var got []netip.Addr
+	for _, n := range []*Node{n1, n2} {
+		tc := newTestClient(t, s, n.mac)
+		tc.writeFrame(mustDHCPFrame(t, n.mac, layers.DHCPMsgTypeDiscover, netip.Addr{}))
+		offer, _ := tc.readDHCPReply(5 * time.Second)
+		offered, _ := netip.AddrFromSlice(offer.YourClientIP.To4())
+
+		tc.writeFrame(mustDHCPFrame(t, n.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+		ack, opts := tc.readDHCPReply(5 * time.Second)
+		if got := opts[layers.DHCPOptMessageType]; len(got) != 1 || layers.DHCPMsgType(got[0]) != layers.DHCPMsgTypeAck {
+			t.Fatalf("message type = %v; want ACK", got)
+		}
+		acked, _ := netip.AddrFromSlice(ack.YourClientIP.To4())
+		if acked != offered {
+			t.Errorf("node %v: acked %v; offered %v", n.mac, acked, offered)
+		}
+		if !pool.Contains(acked) {
+			t.Errorf("node %v: leased %v; not in pool %v", n.mac, acked, pool)
+		}
+		got = append(got, acked)
+
+		// The lease is the node's address now: it's reachable with ARP.
+		tc.writeFrame(mustARPRequest(t, n.mac, acked, nw.lanIP.Addr()))
+		if _, ok := tc.readARPReply(nw.lanIP.Addr(), 5*time.Second); !ok {
+			t.Fatalf("node %v: no ARP reply from gateway", n.mac)
+		}
+		if mac, ok := n.n.net.MACOfIP(acked); !ok || mac != n.mac {
+			t.Errorf("MACOfIP(%v) = %v, %v; want %v", acked, mac, ok, n.mac)
+		}
+	}
+	if got[0] == got[1] {
+		t.Errorf("both nodes leased %v", got[0])
+	}
+}
+
+func TestAssertReachable(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to []any // AddNetwork options; nil means from's network
+		wantErr  DropReason
+	}{
+		{
+			name: "same-lan",
+			from: []any{"2.1.1.1", "192.168.1.1/24", EasyNAT},
+		},
+		{
+			name: "easy-easy",
+			from: []any{"2.1.1.1", "192.168.1.1/24", EasyNAT},
+			to:   []any{"2.2.2.2", "10.2.0.1/16", EasyNAT},
+		},
+		{
+			name: "easy-hard",
+			from: []any{"2.1.1.1", "192.168.1.1/24", EasyNAT},
+			to:   []any{"2.2.2.2", "10.2.0.1/16", HardNAT},
+		},
+		{
+			name:    "hard-hard",
+			from:    []any{"2.1.1.1", "192.168.1.1/24", HardNAT},
+			to:      []any{"2.2.2.2", "10.2.0.1/16", HardNAT},
+			wantErr: DropNoNATMapping,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			fromNet := c.AddNetwork(tt.from...)
+			toNet := fromNet
+			if tt.to != nil {
+				toNet = c.AddNetwork(tt.to...)
+			}
+			from := c.AddNode(fromNet)
+			to := c.AddNode(toNet)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// The probe only arrives at a connected node.
+			if tt.wantErr == "" {
+				err := s.AssertReachable(ctx, from, to)
+				if err == nil || !strings.Contains(err.Error(), string(DropNotConnected)) {
+					t.Fatalf("to unconnected node: got %v; want error containing %q", err, DropNotConnected)
+				}
+			}
+
+			ep, err := s.NodeEndpoint(to.mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ep.Close()
+			err = s.AssertReachable(ctx, from, to)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), string(tt.wantErr)) {
+				t.Fatalf("got %v; want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDropStats(t *testing.T) {
+	var c Config
+	netA := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	netB := c.AddNetwork("2.2.2.2", "10.2.0.1/16", HardNAT)
+	a := c.AddNode(netA)
+	c.AddNode(netB)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	inject := func(dst netip.AddrPort, times int) {
+		t.Helper()
+		for range times {
+			if err := s.InjectUDP(a, 1234, dst, []byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// B's NAT firewalls unsolicited packets to its WAN IP.
+	inject(netip.MustParseAddrPort("2.2.2.2:4000"), 2)
+	// No network has 9.9.9.9.
+	inject(netip.MustParseAddrPort("9.9.9.9:4000"), 3)
+	s.SetPathPolicy(netA.WANIP(), netB.WANIP(), PathPolicy{Drop: true})
+	inject(netip.MustParseAddrPort("2.2.2.2:4000"), 1)
+
+	want := map[DropReason]uint64{
+		DropNoNATMapping: 2,
+		DropNoRoute:      3,
+		DropPathPolicy:   1,
+	}
+	if got := s.DropStats(); !maps.Equal(got, want) {
+		t.Errorf("DropStats = %v; want %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	varz.WritePrometheusExpvar(&buf, expvar.KeyValue{Key: "vnet", Value: s.ExpVar()})
+	wantLine := fmt.Sprintf("vnet_packets_dropped_reason{reason=%q} 3\n", DropNoRoute)
+	if !strings.Contains(buf.String(), wantLine) {
+		t.Errorf("metrics missing %q; got:\n%s", wantLine, buf.String())
+	}
+}
+
+func TestRestrictiveGuestWiFi(t *testing.T) {
+	var c Config
+	guest := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	guest.AddService(RestrictiveGuestWiFi)
+	home := c.AddNetwork("2.2.2.2", "10.2.0.1/16", EasyNAT)
+	g1 := c.AddNode(guest)
+	g2 := c.AddNode(guest)
+	c.AddNode(home)
+	s := newUpstreamTestServer(t, &c, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	defer s.Close()
+
+	// WireGuard and STUN over UDP, and TCP other than to ports 80 and 443,
+	// are blocked.
+	if err := s.InjectUDP(g1, 41641, netip.AddrPortFrom(home.WANIP(), 41641), []byte("wg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InjectUDP(g1, 41641, probeSTUNAddr, stun.Request(stun.NewTxID())); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InjectTCP(g1, 5000, netip.AddrPortFrom(testDERPIP, 22), layers.TCP{SYN: true, Window: 1024}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// UDP to DNS servers isn't.
+	if err := s.InjectUDP(g1, 5353, netip.MustParseAddrPort("9.9.9.9:53"), mustDNSQuery(t, "example.com")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[DropReason]uint64{
+		DropFirewall: 3,
+		DropNoRoute:  1,
+	}
+	if got := s.DropStats(); !maps.Equal(got, want) {
+		t.Errorf("DropStats = %v; want %v", got, want)
+	}
+
+	// The router's DNS server answers.
+	tc := newTestClient(t, s, g1.mac)
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	tc.writeFrame(mustIPv4Frame(t, g1.mac, guest.mac, g1.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQuery(t, "test-driver.tailscale")))
+	if res, _, ok := tc.readDNSResponse(5 * time.Second); !ok || len(res.Answers) != 1 {
+		t.Errorf("DNS response = %v, %v; want one answer", res, ok)
+	}
+
+	// DERP over port 443 works.
+	ts := newTestStack(t, s, g2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	checkDERPEcho(ctx, t, ts)
+}
+
+func TestNodeActivity(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	n1 := c.AddNode(nw)
+	n2 := c.AddNode(nw)
+	s := newUpstreamTestServer(t, &c, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Start up n1 like tailscaled: netcheck's STUN requests, then a control
+	// connection and a connection to its home DERP.
+	for range 2 {
+		if err := s.InjectUDP(n1, 41641, probeSTUNAddr, stun.Request(stun.NewTxID())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := newTestStack(t, s, n1)
+	for _, dst := range []netip.AddrPort{
+		netip.AddrPortFrom(s.fakeIPs.Controlplane, 80),
+		netip.AddrPortFrom(testDERPIP, 443),
+	} {
+		conn, err := ts.dialTCP(ctx, dst)
+		if err != nil {
+			t.Fatalf("dialing %v: %v", dst, err)
+		}
+		defer conn.Close()
+	}
+
+	want := NodeActivity{STUNRequests: 2, DERPConns: 1, ControlConns: 1}
+	if got, err := s.NodeActivity(n1.mac); err != nil || got != want {
+		t.Errorf("NodeActivity(n1) = %+v, %v; want %+v", got, err, want)
+	}
+	if got, err := s.NodeActivity(n2.mac); err != nil || got != (NodeActivity{}) {
+		t.Errorf("NodeActivity(n2) = %+v, %v; want none", got, err)
+	}
+	if _, err := s.NodeActivity(MAC{1}); err == nil {
+		t.Error("NodeActivity of unknown MAC succeeded")
+	}
+}
+
+func TestPathPolicy(t *testing.T) {
+	var c Config
+	netA := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	netB := c.AddNetwork("2.2.2.2", "10.2.0.1/16", EasyNAT)
+	a := c.AddNode(netA)
+	b := c.AddNode(netB)
+	s := newUpstreamTestServer(t, &c, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	defer s.Close()
+	ep, err := s.NodeEndpoint(a.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+	go io.Copy(io.Discard, ep)
+	ts := newTestStack(t, s, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// With B's packets to A dropped, the direct path only works from A to B.
+	s.SetPathPolicy(netB.WANIP(), netA.WANIP(), PathPolicy{Drop: true})
+	if err := s.AssertReachable(ctx, a, b); err != nil {
+		t.Errorf("A to B: %v", err)
+	}
+	if err := s.AssertReachable(ctx, b, a); err == nil || !strings.Contains(err.Error(), string(DropPathPolicy)) {
+		t.Errorf("B to A: got %v; want error containing %q", err, DropPathPolicy)
+	}
+
+	// Dropping both ways blocks direct UDP entirely, forcing DERP, which B
+	// can still reach.
+	s.SetPathPolicy(netA.WANIP(), netB.WANIP(), PathPolicy{Drop: true})
+	dropsBefore := s.DropStats()[DropPathPolicy]
+	for _, p := range [][2]*Node{{a, b}, {b, a}} {
+		if err := s.AssertReachable(ctx, p[0], p[1]); err == nil || !strings.Contains(err.Error(), string(DropPathPolicy)) {
+			t.Errorf("%v to %v: got %v; want error containing %q", p[0].mac, p[1].mac, err, DropPathPolicy)
+		}
+	}
+	if got := s.DropStats()[DropPathPolicy] - dropsBefore; got < 2 {
+		t.Errorf("%d more packets dropped by path policy; want at least 2", got)
+	}
+	checkDERPEcho(ctx, t, ts)
+	s.SetPathPolicy(netA.WANIP(), netB.WANIP(), PathPolicy{})
+
+	// A delay slows the path without breaking it.
+	const delay = 300 * time.Millisecond
+	s.SetPathPolicy(netB.WANIP(), netA.WANIP(), PathPolicy{Delay: delay})
+	start := time.Now()
+	if err := s.AssertReachable(ctx, b, a); err != nil {
+		t.Errorf("B to A with delay: %v", err)
+	} else if d := time.Since(start); d < delay {
+		t.Errorf("B to A with delay took %v; want at least %v", d, delay)
+	}
+
+	s.SetPathPolicy(netB.WANIP(), netA.WANIP(), PathPolicy{})
+	if err := s.AssertReachable(ctx, b, a); err != nil {
+		t.Errorf("B to A after clearing: %v", err)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	var c Config
+	netA := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	netB := c.AddNetwork("2.2.2.2", "10.2.0.1/16", EasyNAT)
+	netC := c.AddNetwork("2.3.3.3", "10.3.0.1/16", EasyNAT)
+	a := c.AddNode(netA)
+	b := c.AddNode(netB)
+	third := c.AddNode(netC)
+	s := newUpstreamTestServer(t, &c, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	defer s.Close()
+	for _, n := range []*Node{a, third} {
+		ep, err := s.NodeEndpoint(n.mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ep.Close()
+		go io.Copy(io.Discard, ep)
+	}
+	ts := newTestStack(t, s, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.Partition([]*Network{netA}, []*Network{netB}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][2]*Node{{a, b}, {b, a}} {
+		if err := s.AssertReachable(ctx, p[0], p[1]); err == nil || !strings.Contains(err.Error(), string(DropPartition)) {
+			t.Errorf("%v to %v: got %v; want error containing %q", p[0].mac, p[1].mac, err, DropPartition)
+		}
+	}
+	// The network in neither group can still reach both sides.
+	if err := s.AssertReachable(ctx, a, third); err != nil {
+		t.Errorf("A to C: %v", err)
+	}
+	if err := s.AssertReachable(ctx, b, third); err != nil {
+		t.Errorf("B to C: %v", err)
+	}
+
+	// B can still reach DERP, so A and B must fall back to it.
+	checkDERPEcho(ctx, t, ts)
+
+	if err := s.Partition([]*Network{netA}, []*Network{netA}); err == nil {
+		t.Error("Partition with a network in both groups succeeded")
+	}
+
+	s.Heal()
+	if err := s.AssertReachable(ctx, a, b); err != nil {
+		t.Errorf("A to B after healing: %v", err)
+	}
+	if err := s.AssertReachable(ctx, b, a); err != nil {
+		t.Errorf("B to A after healing: %v", err)
+	}
+}
+
+// BenchmarkUDPFrame measures serializing a UDP frame, as for each packet
+// delivered to a node, with the pooled buffer that udpFrame uses and, for
+// comparison, with a new buffer each time.
+func BenchmarkUDPFrame(b *testing.B) {
+	src := netip.MustParseAddrPort("2.1.1.1:5000")
+	dst := netip.MustParseAddrPort("192.168.1.101:41641")
+	payload := make([]byte, 1200)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := udpFrame(MAC{1}, MAC{2}, src, dst, nil, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src.Addr().AsSlice(), DstIP: dst.Addr().AsSlice()}
+			udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port()), DstPort: layers.UDPPort(dst.Port())}
+			udp.SetNetworkLayerForChecksum(ip)
+			eth := &layers.Ethernet{SrcMAC: MAC{1}.HWAddr(), DstMAC: MAC{2}.HWAddr(), EthernetType: layers.EthernetTypeIPv4}
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSerializeFrameConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src := netip.AddrPortFrom(netip.AddrFrom4([4]byte{2, 1, 1, byte(i)}), 5000)
+			dst := netip.MustParseAddrPort("192.168.1.101:41641")
+			payload := bytes.Repeat([]byte{byte(i)}, 100+i)
+			var frames [][]byte
+			for range 100 {
+				frame, err := udpFrame(MAC{1}, MAC{2}, src, dst, nil, payload)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				frames = append(frames, frame)
+			}
+			// Frames returned earlier aren't overwritten by later ones.
+			for _, f := range frames {
+				p := gopacket.NewPacket(f, layers.LayerTypeEthernet, gopacket.Default)
+				ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				udp, _ := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+				if ip == nil || udp == nil || ip.SrcIP[3] != byte(i) || !bytes.Equal(udp.Payload, payload) {
+					t.Errorf("goroutine %d: corrupt frame %x", i, f)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestForwardIPv4Options(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep1, err := s.NodeEndpoint(n1.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep1.Close()
+	ep2, err := s.NodeEndpoint(n2.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep2.Close()
+
+	const (
+		tsAndAddr = 1 // timestamp option flag
+		other     = 130
+	)
+	eth := &layers.Ethernet{
+		SrcMAC:       n1.mac.HWAddr(),
+		DstMAC:       net1.mac.HWAddr(),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    n1.n.lanIP.AsSlice(),
+		DstIP:    net2.wanIP.AsSlice(),
+		Options: []layers.IPv4Option{
+			// Record route with room for three addresses.
+			{OptionType: ipv4OptRecordRoute, OptionLength: 15, OptionData: append([]byte{4}, make([]byte, 12)...)},
+			// Timestamps with addresses, with room for two.
+			{OptionType: ipv4OptTimestamp, OptionLength: 20, OptionData: append([]byte{5, tsAndAddr}, make([]byte, 16)...)},
+			// An option routers don't touch.
+			{OptionType: other, OptionLength: 4, OptionData: []byte{1, 2}},
+		},
+	}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ep1.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, 1600)
+	n, err := ep2.Read(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := gopacket.NewPacket(frame[:n], layers.LayerTypeEthernet, gopacket.Default)
+	got, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		t.Fatalf("got %v; want IPv4 packet", pkt)
+	}
+	if app := pkt.ApplicationLayer(); app == nil || string(app.Payload()) != "hello" {
+		t.Fatalf("got packet %v; want UDP payload %q", pkt, "hello")
+	}
+	opts := map[uint8][]byte{}
+	for _, o := range got.Options {
+		opts[o.OptionType] = o.OptionData
+	}
+
+	// Each router records its outgoing interface: net1's WAN IP, then net2's
+	// LAN IP.
+	wan1, lan2 := net1.wanIP.As4(), net2.lanIP.Addr().As4()
+	wantRR := slices.Concat([]byte{12}, wan1[:], lan2[:], make([]byte, 4))
+	if rr := opts[ipv4OptRecordRoute]; !bytes.Equal(rr, wantRR) {
+		t.Errorf("record route = %v; want %v", rr, wantRR)
+	}
+	ts := opts[ipv4OptTimestamp]
+	if len(ts) != 18 || ts[0] != 21 || ts[1] != tsAndAddr {
+		t.Fatalf("timestamp option = %v; want two entries and no overflow", ts)
+	}
+	if !bytes.Equal(ts[2:6], wan1[:]) || !bytes.Equal(ts[10:14], lan2[:]) {
+		t.Errorf("timestamp addresses = %v, %v; want %v, %v", ts[2:6], ts[10:14], wan1, lan2)
+	}
+	if o := opts[other]; !bytes.Equal(o, []byte{1, 2}) {
+		t.Errorf("option %d = %v; want preserved", other, o)
+	}
+}
+
+func TestRecordTimestampOverflow(t *testing.T) {
+	ip := netip.MustParseAddr("2.1.1.1")
+	now := time.Date(2024, 1, 1, 1, 2, 3, 0, time.UTC)
+
+	// Room for one timestamp only.
+	data := []byte{5, 0, 0, 0, 0, 0}
+	recordTimestamp(data, ip, now)
+	if want := []byte{9, 0, 0x00, 0x38, 0xce, 0xf8}; !bytes.Equal(data, want) { // 3723000ms
+		t.Fatalf("after first = %v; want %v", data, want)
+	}
+	recordTimestamp(data, ip, now)
+	if data[0] != 9 || data[1] != 0x10 {
+		t.Errorf("after overflow, pointer = %d, overflow = %d; want 9, 1", data[0], data[1]>>4)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	const (
+		latency = 50 * time.Millisecond
+		jitter  = 10 * time.Millisecond
+		count   = 200
+	)
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	net2.SetLatency(latency, jitter)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep2, err := s.NodeEndpoint(n2.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep2.Close()
+
+	for i := range count {
+		if err := s.InjectUDP(n1, 5000, netip.AddrPortFrom(net2.wanIP, 6000), fmt.Appendf(nil, "%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 1600)
+	for range count {
+		if _, err := ep2.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pair := NodePair{n1.mac, n2.mac}
+	h := s.LatencyStats()[pair]
+	if h == nil || h.Count != count {
+		t.Fatalf("stats for %v = %+v; want %d packets", pair, h, count)
+	}
+	if mean := h.Mean(); mean < latency-3*time.Millisecond || mean > latency+5*time.Millisecond {
+		t.Errorf("mean = %v; want about %v", mean, latency)
+	}
+	// Uniform jitter over ±10ms has a standard deviation of about 5.8ms.
+	if sd := h.StdDev(); sd < 4*time.Millisecond || sd > 8*time.Millisecond {
+		t.Errorf("std dev = %v; want about 5.8ms", sd)
+	}
+	if h.Min < latency-jitter {
+		t.Errorf("min = %v; want at least %v", h.Min, latency-jitter)
+	}
+	var inRange int
+	for _, b := range h.Buckets {
+		if b.Le > latency-jitter && b.Le <= latency+jitter+5*time.Millisecond {
+			inRange += b.Count
+		}
+	}
+	if inRange < count*9/10 {
+		t.Errorf("%d of %d latencies in (%v, %v]; want most; buckets: %+v", inRange, count, latency-jitter, latency+jitter+5*time.Millisecond, h.Buckets)
+	}
+}
+
+func TestWireGuardHandshakeTiming(t *testing.T) {
+	const lat1, lat2 = 30 * time.Millisecond, 50 * time.Millisecond
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	net1.SetLatency(lat1, 0)
+	net2.SetLatency(lat2, 0)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, ch1 := nodePackets(t, s, n1)
+	_, ch2 := nodePackets(t, s, n2)
+
+	wgMessage := func(typ byte, size int, sender, receiver uint32) []byte {
+		b := make([]byte, size)
+		b[0] = typ
+		binary.LittleEndian.PutUint32(b[4:], sender)
+		binary.LittleEndian.PutUint32(b[8:], receiver)
+		return b
+	}
+	const idx1, idx2 = 0x1111, 0x2222
+
+	if err := s.InjectUDP(n1, 41641, netip.AddrPortFrom(net2.WANIP(), 41641), wgMessage(wgHandshakeInit, 148, idx1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	p := nextPacket(ch2)
+	if p == nil {
+		t.Fatal("handshake initiation not delivered")
+	}
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	initSrc := netip.AddrPortFrom(netip.AddrFrom4([4]byte(ip.SrcIP.To4())), uint16(udp.SrcPort))
+
+	if err := s.InjectUDP(n2, 41641, initSrc, wgMessage(wgHandshakeResponse, 92, idx2, idx1)); err != nil {
+		t.Fatal(err)
+	}
+	if nextPacket(ch1) == nil {
+		t.Fatal("handshake response not delivered")
+	}
+
+	pair := NodePair{n1.mac, n2.mac}
+	h, ok := s.WireGuardHandshakes()[pair]
+	if !ok {
+		t.Fatalf("no handshake recorded for %v; got %v", pair, s.WireGuardHandshakes())
+	}
+	const budget = lat1 + lat2 + 50*time.Millisecond
+	if d := h.Duration(); d < lat1+lat2 || d > budget {
+		t.Errorf("handshake took %v; want between %v and %v", d, lat1+lat2, budget)
+	}
+
+	// A rekey doesn't replace the first handshake.
+	if err := s.InjectUDP(n1, 41641, netip.AddrPortFrom(net2.WANIP(), 41641), wgMessage(wgHandshakeInit, 148, idx1+1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	nextPacket(ch2)
+	if err := s.InjectUDP(n2, 41641, initSrc, wgMessage(wgHandshakeResponse, 92, idx2+1, idx1+1)); err != nil {
+		t.Fatal(err)
+	}
+	nextPacket(ch1)
+	if got := s.WireGuardHandshakes(); len(got) != 1 || got[pair] != h {
+		t.Errorf("after rekey, handshakes = %v; want only the first, %v", got, h)
+	}
+}
+
+// newLinkTestServer returns a Server with a node n1 behind an easy NAT and a
+// node n2 behind a one-to-one NAT on network net2, with c and net2 configured
+// by configure, and a func that returns the UDP payloads delivered to n2, in order, once
+// none has arrived for a while.
+func newLinkTestServer(t testing.TB, configure func(c *Config, net2 *Network)) (s *Server, n1 *Node, net2 *Network, received func() []string) {
+	t.Helper()
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 = c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	configure(&c, net2)
+	n1 = c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep2, err := s.NodeEndpoint(n2.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ep2.Close() })
+	frames := make(chan []byte, 4096)
+	go func() {
+		buf := make([]byte, 1600)
+		for {
+			n, err := ep2.Read(buf)
+			if err != nil {
+				return
+			}
+			frames <- bytes.Clone(buf[:n])
+		}
+	}()
+	received = func() []string {
+		var ret []string
+		for {
+			select {
+			case f := <-frames:
+				pkt := gopacket.NewPacket(f, layers.LayerTypeEthernet, gopacket.Default)
+				if app := pkt.ApplicationLayer(); app != nil {
+					ret = append(ret, string(app.Payload()))
+				}
+			case <-time.After(500 * time.Millisecond):
+				return ret
+			}
+		}
+	}
+	return s, n1, net2, received
+}
+
+func TestDuplication(t *testing.T) {
+	const (
+		count = 500
+		frac  = 0.25
+	)
+	s, n1, net2, received := newLinkTestServer(t, func(_ *Config, n *Network) {
+		n.SetDuplication(frac)
+	})
+	for i := range count {
+		if err := s.InjectUDP(n1, 5000, netip.AddrPortFrom(net2.wanIP, 6000), fmt.Appendf(nil, "%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := received()
+	seen := map[string]int{}
+	for _, p := range got {
+		seen[p]++
+	}
+	if len(seen) != count {
+		t.Errorf("got %d distinct packets; want %d", len(seen), count)
+	}
+	for p, n := range seen {
+		if n > 2 {
+			t.Errorf("packet %q delivered %d times; want at most 2", p, n)
+		}
+	}
+	// Expect count*frac duplicates, with a standard deviation of about 10.
+	if dups, want := len(got)-count, int(count*frac); dups < want-50 || dups > want+50 {
+		t.Errorf("got %d duplicates of %d packets; want about %d", dups, count, want)
+	}
+}
+
+func TestReordering(t *testing.T) {
+	const count = 200
+	s, n1, net2, received := newLinkTestServer(t, func(_ *Config, n *Network) {
+		n.SetReordering(0.2)
+	})
+	for i := range count {
+		if err := s.InjectUDP(n1, 5000, netip.AddrPortFrom(net2.wanIP, 6000), fmt.Appendf(nil, "%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := received()
+	if len(got) != count {
+		t.Fatalf("got %d packets; want %d", len(got), count)
+	}
+	seen := map[int]bool{}
+	var reordered int
+	prev := -1
+	for _, p := range got {
+		i, err := strconv.Atoi(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[i] {
+			t.Fatalf("packet %d delivered twice", i)
+		}
+		seen[i] = true
+		if i < prev {
+			reordered++
+		}
+		prev = i
+	}
+	if reordered == 0 {
+		t.Errorf("no packets were reordered in %v", got)
+	}
+}
+
+func TestRandSeed(t *testing.T) {
+	// run sends numbered packets through a network that reorders them,
+	// returning the order they arrived in and the WAN source address the
+	// sender's NAT picked.
+	run := func(seed int64) (order []string, wanSrc netip.AddrPort) {
+		s, n1, net2, received := newLinkTestServer(t, func(c *Config, n *Network) {
+			c.RandSeed = seed
+			n.SetReordering(0.3)
+		})
+		for i := range 100 {
+			if err := s.InjectUDP(n1, 5000, netip.AddrPortFrom(net2.wanIP, 6000), fmt.Appendf(nil, "%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wanSrc = n1.n.net.doNATOut(netip.AddrPortFrom(n1.n.lanIP, 5000), netip.AddrPortFrom(net2.wanIP, 6000))
+		return received(), wanSrc
+	}
+	order1, src1 := run(42)
+	order2, src2 := run(42)
+	if !slices.Equal(order1, order2) {
+		t.Errorf("same seed, different orders:\n%v\n%v", order1, order2)
+	}
+	if src1 != src2 {
+		t.Errorf("same seed, different NAT mappings: %v, %v", src1, src2)
+	}
+	if order3, _ := run(43); slices.Equal(order1, order3) {
+		t.Errorf("different seeds, same order: %v", order1)
+	}
+}
+
+// nodePackets returns an endpoint for n and a channel of the packets delivered
+// to it.
+func TestFairQueuing(t *testing.T) {
+	const (
+		bandwidth  = 10e6 // bits per second
+		bulkSize   = 1000
+		sparseRate = 10 * time.Millisecond
+		sparseN    = 30
+	)
+	for _, fair := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fair=%v", fair), func(t *testing.T) {
+			var c Config
+			net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+			net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+			net2.SetBandwidth(bandwidth)
+			net2.SetFairQueuing(fair)
+			n1 := c.AddNode(net1)
+			n2 := c.AddNode(net2)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var aqmDrops atomic.Int32
+			defer s.AddDropHook(func(d PacketDrop) {
+				if d.Reason == DropAQM {
+					aqmDrops.Add(1)
+				}
+			})()
+			_, packets := nodePackets(t, s, n2)
+
+			// A bulk flow sends at about three times the bandwidth until the
+			// sparse flow is done, building a standing queue.
+			done := make(chan struct{})
+			bulkDone := make(chan struct{})
+			go func() {
+				defer close(bulkDone)
+				payload := make([]byte, bulkSize)
+				for {
+					for range 4 {
+						if err := s.InjectUDP(n1, 5000, netip.AddrPortFrom(net2.wanIP, 6000), payload); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+					select {
+					case <-done:
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+			}()
+			defer func() { <-bulkDone }()
+			defer close(done)
+
+			// A sparse flow sends a small packet every sparseRate, after the
+			// bulk flow has filled the queue.
+			time.Sleep(300 * time.Millisecond)
+			sent := make([]time.Time, sparseN)
+			sparseDone := make(chan struct{})
+			go func() {
+				defer close(sparseDone)
+				for i := range sparseN {
+					sent[i] = time.Now()
+					if err := s.InjectUDP(n1, 5001, netip.AddrPortFrom(net2.wanIP, 6001), fmt.Appendf(nil, "sparse-%d", i)); err != nil {
+						t.Error(err)
+						return
+					}
+					time.Sleep(sparseRate)
+				}
+			}()
+
+			// Without fair queuing, some sparse packets are dropped by the
+			// full queue, so wait for the queue to drain after the last.
+			var latencies []time.Duration
+			var drained <-chan time.Time
+		Recv:
+			for len(latencies) < sparseN {
+				select {
+				case pkt := <-packets:
+					app := pkt.ApplicationLayer()
+					if app == nil {
+						continue
+					}
+					i, ok := strings.CutPrefix(string(app.Payload()), "sparse-")
+					if !ok {
+						continue
+					}
+					n, err := strconv.Atoi(i)
+					if err != nil {
+						t.Fatal(err)
+					}
+					latencies = append(latencies, time.Since(sent[n]))
+				case <-sparseDone:
+					sparseDone = nil
+					drained = time.After(time.Second)
+				case <-drained:
+					break Recv
+				}
+			}
+			if len(latencies) < sparseN/2 || fair && len(latencies) < sparseN {
+				t.Fatalf("got %d of %d sparse packets", len(latencies), sparseN)
+			}
+			slices.Sort(latencies)
+			median := latencies[len(latencies)/2]
+			if fair {
+				if worst := latencies[len(latencies)-1]; worst > 30*time.Millisecond {
+					t.Errorf("with fair queuing, max sparse latency = %v; want bounded; latencies: %v", worst, latencies)
+				}
+				if aqmDrops.Load() == 0 {
+					t.Error("AQM dropped no bulk packets")
+				}
+			} else if median < 100*time.Millisecond {
+				// Queued behind the bulk flow.
+				t.Errorf("without fair queuing, median sparse latency = %v; want bufferbloat", median)
+			}
+		})
+	}
+}
+
+func nodePackets(t testing.TB, s *Server, n *Node) (io.Writer, <-chan gopacket.Packet) {
+	t.Helper()
+	ep, err := s.NodeEndpoint(n.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ep.Close() })
+	ch := make(chan gopacket.Packet, 16)
+	go func() {
+		buf := make([]byte, 1600)
+		for {
+			n, err := ep.Read(buf)
+			if err != nil {
+				return
+			}
+			ch <- gopacket.NewPacket(bytes.Clone(buf[:n]), layers.LayerTypeEthernet, gopacket.Default)
+		}
+	}()
+	return ep, ch
+}
+
+// nextPacket returns the next packet from ch, or nil if none arrives soon.
+func nextPacket(ch <-chan gopacket.Packet) gopacket.Packet {
+	select {
+	case p := <-ch:
+		return p
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestMTUBlackhole(t *testing.T) {
+	for _, silent := range []bool{false, true} {
+		t.Run(fmt.Sprintf("silent=%v", silent), func(t *testing.T) {
+			const mtu = 1280
+			var c Config
+			net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+			net1.SetMTU(mtu)
+			net1.SetSilentMTUBlackhole(silent)
+			net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+			n1 := c.AddNode(net1)
+			n2 := c.AddNode(net2)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ep1, from1 := nodePackets(t, s, n1)
+			_, from2 := nodePackets(t, s, n2)
+
+			send := func(size int, df bool) {
+				t.Helper()
+				eth := &layers.Ethernet{
+					SrcMAC:       n1.mac.HWAddr(),
+					DstMAC:       net1.mac.HWAddr(),
+					EthernetType: layers.EthernetTypeIPv4,
+				}
+				ip := &layers.IPv4{
+					Version:  4,
+					TTL:      64,
+					Protocol: layers.IPProtocolUDP,
+					SrcIP:    n1.n.lanIP.AsSlice(),
+					DstIP:    net2.wanIP.AsSlice(),
+				}
+				if df {
+					ip.Flags = layers.IPv4DontFragment
+				}
+				udp := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+				udp.SetNetworkLayerForChecksum(ip)
+				buf := gopacket.NewSerializeBuffer()
+				payload := make([]byte, size-28) // less IP and UDP headers
+				if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := ep1.Write(buf.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Packets within the MTU, and larger ones that may be
+			// fragmented, are forwarded.
+			for _, tt := range []struct {
+				size int
+				df   bool
+			}{{mtu, true}, {1400, false}} {
+				send(tt.size, tt.df)
+				if p := nextPacket(from2); p == nil || p.ApplicationLayer() == nil || len(p.ApplicationLayer().Payload()) != tt.size-28 {
+					t.Errorf("%d byte packet with DF=%v: got %v; want it forwarded", tt.size, tt.df, p)
+				}
+			}
+
+			// A larger DF packet isn't.
+			send(1400, true)
+			if p := nextPacket(from2); p != nil {
+				t.Errorf("oversized DF packet was forwarded: %v", p)
+			}
+			p := nextPacket(from1)
+			if silent {
+				if p != nil {
+					t.Errorf("got %v; want no response", p)
+				}
+				return
+			}
+			icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			if !ok {
+				t.Fatalf("got %v; want ICMP fragmentation needed", p)
+			}
+			if want := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded); icmp.TypeCode != want {
+				t.Errorf("ICMP type = %v; want %v", icmp.TypeCode, want)
+			}
+			if icmp.Seq != mtu {
+				t.Errorf("ICMP next-hop MTU = %d; want %d", icmp.Seq, mtu)
+			}
+		})
+	}
+}
+
+func TestSetMTU(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ep1, from1 := nodePackets(t, s, n1)
+	_, from2 := nodePackets(t, s, n2)
+
+	// send sends a 1400 byte packet with the don't fragment bit set from n1
+	// to n2 and reports whether it was forwarded, or else the next-hop MTU
+	// of the ICMP message n1 got back instead.
+	send := func() (forwarded bool, icmpMTU int) {
+		t.Helper()
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Flags:    layers.IPv4DontFragment,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    n1.n.lanIP.AsSlice(),
+			DstIP:    net2.wanIP.AsSlice(),
+		}
+		udp := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+		udp.SetNetworkLayerForChecksum(ip)
+		eth := &layers.Ethernet{SrcMAC: n1.mac.HWAddr(), DstMAC: net1.mac.HWAddr(), EthernetType: layers.EthernetTypeIPv4}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(make([]byte, 1400-28))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ep1.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if p := nextPacket(from2); p != nil {
+			return true, 0
+		}
+		if p := nextPacket(from1); p != nil {
+			if icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+				return false, int(icmp.Seq)
+			}
+		}
+		return false, 0
+	}
+
+	if ok, _ := send(); !ok {
+		t.Fatal("packet not forwarded with no MTU")
+	}
+	// The link's MTU drops mid-session.
+	if err := s.SetMTU(net1.wanIP, 1280); err != nil {
+		t.Fatal(err)
+	}
+	if ok, mtu := send(); ok || mtu != 1280 {
+		t.Errorf("after lowering MTU: forwarded = %v, ICMP MTU = %d; want dropped with MTU 1280", ok, mtu)
+	}
+	if err := s.SetMTU(net1.wanIP, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := send(); !ok {
+		t.Error("packet not forwarded after removing MTU")
+	}
+
+	if err := s.SetMTU(net1.wanIP, 40); err == nil {
+		t.Error("SetMTU below the IPv4 minimum succeeded")
+	}
+	if err := s.SetMTU(netip.MustParseAddr("9.9.9.9"), 1280); err == nil {
+		t.Error("SetMTU of unknown network succeeded")
+	}
+}
+
+func TestWouldAcceptInbound(t *testing.T) {
+	var (
+		wanIP = netip.MustParseAddr("2.1.1.1")
+		peer  = netip.MustParseAddrPort("5.5.5.5:1000")
+		other = netip.MustParseAddrPort("6.6.6.6:2000")
+	)
+	tests := []struct {
+		nat            NAT
+		fromPeer       bool // from peer, to the mapping made toward it
+		fromOther      bool // from another host, to that mapping
+		toUnmappedPort bool
+		beforeMapping  bool // from the peer, before any mapping
+	}{
+		{One2OneNAT, true, true, true, true},
+		{EasyNAT, true, true, false, false},
+		{HardNAT, true, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.nat), func(t *testing.T) {
+			var c Config
+			n1 := c.AddNode(c.AddNetwork(wanIP.String(), "192.168.1.1/24", tt.nat))
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			unmapped := netip.AddrPortFrom(wanIP, 1)
+			if got := s.WouldAcceptInbound(wanIP, peer, unmapped, now); got != tt.beforeMapping {
+				t.Errorf("before mapping: got %v; want %v", got, tt.beforeMapping)
+			}
+
+			mapped := n1.n.net.doNATOut(netip.AddrPortFrom(n1.n.lanIP, 5000), peer)
+			// Query twice to check the first has no side effects.
+			for range 2 {
+				if got := s.WouldAcceptInbound(wanIP, peer, mapped, now); got != tt.fromPeer {
+					t.Errorf("from peer: got %v; want %v", got, tt.fromPeer)
+				}
+				if got := s.WouldAcceptInbound(wanIP, other, mapped, now); got != tt.fromOther {
+					t.Errorf("from other: got %v; want %v", got, tt.fromOther)
+				}
+				if got := s.WouldAcceptInbound(wanIP, peer, unmapped, now); got != tt.toUnmappedPort {
+					t.Errorf("to unmapped port: got %v; want %v", got, tt.toUnmappedPort)
+				}
+			}
+			if s.WouldAcceptInbound(netip.MustParseAddr("3.3.3.3"), peer, mapped, now) {
+				t.Error("accepted for unknown network")
+			}
+		})
+	}
+}
+
+func TestDNSLatency(t *testing.T) {
+	const queries = 20
+	tests := []struct {
+		name     string
+		latency  DNSLatency
+		min, max time.Duration // of each query
+		mean     time.Duration // of all queries, if non-zero
+	}{
+		{
+			name:    "uniform",
+			latency: DNSLatency{Min: 20 * time.Millisecond, Max: 40 * time.Millisecond},
+			min:     20 * time.Millisecond,
+			max:     40 * time.Millisecond,
+		},
+		{
+			name:    "normal",
+			latency: DNSLatency{Mean: 30 * time.Millisecond, StdDev: 5 * time.Millisecond},
+			max:     60 * time.Millisecond, // 6 standard deviations
+			mean:    30 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{DNSLatency: tt.latency}
+			nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+			n1 := c.AddNode(nw)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc := newTestClient(t, s, n1.mac)
+
+			// Allow for scheduling delays beyond the configured maximum.
+			const slack = 20 * time.Millisecond
+			var total time.Duration
+			for range queries {
+				udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+				start := time.Now()
+				tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQuery(t, "test-driver.tailscale")))
+				if _, _, ok := tc.readDNSResponse(time.Second); !ok {
+					t.Fatal("no DNS response")
+				}
+				d := time.Since(start)
+				if d < tt.min || d > tt.max+slack {
+					t.Errorf("DNS latency %v; want in [%v, %v]", d, tt.min, tt.max)
+				}
+				total += d
+			}
+			if tt.mean != 0 {
+				if mean := total / queries; mean < tt.mean-5*time.Millisecond || mean > tt.mean+slack/2 {
+					t.Errorf("mean DNS latency %v; want about %v", mean, tt.mean)
+				}
+			}
+		})
+	}
+}
+
+func TestSubnetBehind(t *testing.T) {
+	var (
+		prefix = netip.MustParsePrefix("10.99.0.0/24")
+		host   = netip.MustParseAddr("10.99.0.5")
+	)
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	router := c.AddNode(nw)
+	client := c.AddNode(nw)
+	c.AddSubnetBehind(router, prefix, host)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerEP, toRouter := nodePackets(t, s, router)
+	_, toClient := nodePackets(t, s, client)
+
+	udpTo := func(p gopacket.Packet) (dst netip.AddrPort, payload string, ok bool) {
+		if p == nil {
+			return
+		}
+		ip, ok1 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, ok2 := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok1 || !ok2 {
+			return
+		}
+		dstIP, _ := netip.AddrFromSlice(ip.DstIP)
+		return netip.AddrPortFrom(dstIP, uint16(udp.DstPort)), string(udp.Payload), true
+	}
+
+	// The client's packet to the host is routed to the subnet router.
+	hostAddr := netip.AddrPortFrom(host, 7)
+	if err := s.InjectUDP(client, 5000, hostAddr, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	p := nextPacket(toRouter)
+	if dst, payload, ok := udpTo(p); !ok || dst != hostAddr || payload != "ping" {
+		t.Fatalf("subnet router got %v; want the client's packet to %v", p, hostAddr)
+	}
+	if eth := p.LinkLayer().(*layers.Ethernet); MAC(eth.SrcMAC) != nw.mac {
+		t.Errorf("routed frame from MAC %v; want gateway %v", MAC(eth.SrcMAC), nw.mac)
+	}
+	if p := nextPacket(toClient); p != nil {
+		t.Errorf("client got %v; want nothing", p)
+	}
+
+	// The subnet router forwards it to the host via its gateway, and the
+	// host's echo comes back to the subnet router.
+	frame := p.Data()
+	copy(frame[0:6], nw.mac[:])
+	copy(frame[6:12], router.mac[:])
+	if _, err := routerEP.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	p = nextPacket(toRouter)
+	clientAddr := netip.AddrPortFrom(client.n.lanIP, 5000)
+	if dst, payload, ok := udpTo(p); !ok || dst != clientAddr || payload != "ping" {
+		t.Fatalf("subnet router got %v; want the host's echo to %v", p, clientAddr)
+	}
+	if src := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4).SrcIP; !net.IP(src).Equal(host.AsSlice()) {
+		t.Errorf("echo from %v; want %v", src, host)
+	}
+
+	// Hosts not in the subnet's host list don't exist.
+	var drops []PacketDrop
+	defer s.AddDropHook(func(d PacketDrop) { drops = append(drops, d) })()
+	if err := s.InjectUDP(router, 5000, netip.MustParseAddrPort("10.99.0.6:7"), []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if p := nextPacket(toRouter); p != nil {
+		t.Errorf("got %v from a nonexistent host", p)
+	}
+	if len(drops) != 1 || drops[0].Reason != DropNoHost {
+		t.Errorf("drops = %v; want one %q", drops, DropNoHost)
+	}
+}
+
+func TestChangeNodeMAC(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	nw.SetDHCPPool(netip.MustParsePrefix("192.168.1.200/29"))
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := newTestClient(t, s, n1.mac)
+
+	// lease gets a lease by DHCP and checks the node can reach the gateway
+	// with it.
+	lease := func() netip.Addr {
+		t.Helper()
+		tc.writeFrame(mustDHCPFrame(t, tc.mac, layers.DHCPMsgTypeDiscover, netip.Addr{}))
+		tc.readDHCPReply(5 * time.Second)
+		tc.writeFrame(mustDHCPFrame(t, tc.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+		ack, _ := tc.readDHCPReply(5 * time.Second)
+		ip, _ := netip.AddrFromSlice(ack.YourClientIP.To4())
+		tc.writeFrame(mustARPRequest(t, tc.mac, ip, nw.lanIP.Addr()))
+		if _, ok := tc.readARPReply(nw.lanIP.Addr(), 5*time.Second); !ok {
+			t.Fatalf("MAC %v: no ARP reply from gateway", tc.mac)
+		}
+		if got, ok := n1.n.net.MACOfIP(ip); !ok || got != tc.mac {
+			t.Errorf("MACOfIP(%v) = %v, %v; want %v", ip, got, ok, tc.mac)
+		}
+		return ip
+	}
+	oldIP := lease()
+
+	newMAC := MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x99}
+	if err := s.ChangeNodeMAC(newMAC, n1.mac); err == nil {
+		t.Error("ChangeNodeMAC of unknown MAC succeeded")
+	}
+	if err := s.ChangeNodeMAC(n1.mac, newMAC); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n1.n.net.nodeByIP(oldIP); ok {
+		t.Errorf("old lease %v still resolves to a node", oldIP)
+	}
+	if _, ok := s.nodeForMAC(n1.mac); ok {
+		t.Errorf("old MAC %v still resolves to a node", n1.mac)
+	}
+
+	// Frames from the old MAC are ignored now.
+	tc.writeFrame(mustARPRequest(t, n1.mac, oldIP, nw.lanIP.Addr()))
+	if _, ok := tc.readARPReply(nw.lanIP.Addr(), 200*time.Millisecond); ok {
+		t.Error("got ARP reply for the old MAC")
+	}
+
+	// With the new MAC, the node re-DHCPs over the same conn and
+	// communicates again.
+	tc.mac = newMAC
+	lease()
+	if h := s.ConnHealth(); len(h) != 1 || h[0].MAC != newMAC || !h[0].Connected {
+		t.Errorf("ConnHealth = %+v; want connected node with MAC %v", h, newMAC)
+	}
+}
+
+func TestRegisterServer(t *testing.T) {
+	newServer := func() *Server {
+		var c Config
+		c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+		s, err := New(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := newServer()
+	name := t.Name()
+	RegisterServer(name, s)
+	RegisterServer(name, s) // re-registering is fine
+
+	// Helpers on other goroutines find it.
+	errc := make(chan error)
+	for range 4 {
+		go func() {
+			got, ok := LookupServer(name)
+			if !ok || got != s {
+				errc <- fmt.Errorf("LookupServer = %p, %v; want %p", got, ok, s)
+				return
+			}
+			if h := got.ConnHealth(); len(h) != 1 {
+				errc <- fmt.Errorf("ConnHealth = %+v; want one node", h)
+				return
+			}
+			errc <- nil
+		}()
+	}
+	for range 4 {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registering a second server under the same name didn't panic")
+			}
+		}()
+		s2 := newServer()
+		defer s2.Close()
+		RegisterServer(name, s2)
+	}()
+
+	s.Close()
+	if _, ok := LookupServer(name); ok {
+		t.Error("closed server still registered")
+	}
+	RegisterServer(name, s)
+	if _, ok := LookupServer(name); ok {
+		t.Error("registered closed server")
+	}
+}
+
+func TestDropAgentConns(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var agentEnds []net.Conn
+	addConn := func(n *Node) {
+		c1, c2 := net.Pipe()
+		agentEnds = append(agentEnds, c2)
+		s.addIdleAgentConn(&agentConn{node: n.n, tc: c1, added: time.Now()})
+	}
+	addConn(n1)
+	addConn(n1)
+	addConn(n2)
+
+	conns := s.AgentConns()
+	var got []MAC
+	for _, ci := range conns {
+		got = append(got, ci.MAC)
+	}
+	if want := []MAC{n1.mac, n1.mac, n2.mac}; !slices.Equal(got, want) {
+		t.Fatalf("AgentConns MACs = %v; want %v", got, want)
+	}
+	if conns[0].LANIP != n1.n.lanIP || conns[0].Added.After(conns[1].Added) {
+		t.Errorf("AgentConns = %+v; want n1's LAN IP, oldest first", conns)
+	}
+
+	s.DropAgentConns(n1)
+	if conns := s.AgentConns(); len(conns) != 1 || conns[0].MAC != n2.mac {
+		t.Fatalf("after drop, AgentConns = %+v; want only n2's", conns)
+	}
+	for _, c := range agentEnds[:2] {
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read from dropped conn's agent end = %v; want EOF", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, ok := s.takeAgentConn(ctx, n1.n); ok {
+		t.Error("takeAgentConn for n1 returned a dropped conn; want it to block")
+	}
+	if _, ok := s.takeAgentConnOne(n2.n); !ok {
+		t.Error("n2's conn was dropped too")
+	}
+}
+
+func TestDHCPRenumberMovesNAT(t *testing.T) {
+	peer := netip.MustParseAddrPort("5.5.5.5:1000")
+	for _, nat := range []NAT{EasyNAT, HardNAT} {
+		t.Run(string(nat), func(t *testing.T) {
+			var c Config
+			nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", nat)
+			nw.SetDHCPPool(netip.MustParsePrefix("192.168.1.200/29"))
+			n1 := c.AddNode(nw)
+			n2 := c.AddNode(nw)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if err := s.ReleaseDHCPLease(MAC{1}); err == nil {
+				t.Error("ReleaseDHCPLease of unknown node succeeded")
+			}
+
+			tc1 := newTestClient(t, s, n1.mac)
+			tc2 := newTestClient(t, s, n2.mac)
+			lease := func(tc *testClient) netip.Addr {
+				tc.writeFrame(mustDHCPFrame(t, tc.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+				ack, _ := tc.readDHCPReply(5 * time.Second)
+				ip, _ := netip.AddrFromSlice(ack.YourClientIP.To4())
+				return ip
+			}
+
+			oldIP := lease(tc1)
+			mapped := n1.n.net.doNATOut(netip.AddrPortFrom(oldIP, 5000), peer)
+
+			if err := s.ReleaseDHCPLease(n1.mac); err != nil {
+				t.Fatal(err)
+			}
+			newIP := lease(tc1)
+			if newIP == oldIP {
+				t.Fatalf("node kept %v after its lease was released", oldIP)
+			}
+			// The other node is now free to take the old address.
+			if ip2 := lease(tc2); ip2 != oldIP {
+				t.Fatalf("second node leased %v; want %v", ip2, oldIP)
+			}
+
+			want := netip.AddrPortFrom(newIP, 5000)
+			if got := n1.n.net.doNATIn(peer, mapped); got != want {
+				t.Errorf("return traffic goes to %v; want %v", got, want)
+			}
+			if got := n1.n.net.doNATOut(want, peer); got != mapped {
+				t.Errorf("outgoing from new address mapped to %v; want existing %v", got, mapped)
+			}
+		})
+	}
+}
+
+func TestPathMTUFromICMP(t *testing.T) {
+	const pmtu = 576
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep1, from1 := nodePackets(t, s, n1)
+	_, from2 := nodePackets(t, s, n2)
+
+	send := func(size int, df bool) {
+		t.Helper()
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    n1.n.lanIP.AsSlice(),
+			DstIP:    net2.wanIP.AsSlice(),
+		}
+		if df {
+			ip.Flags = layers.IPv4DontFragment
+		}
+		udp := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+		udp.SetNetworkLayerForChecksum(ip)
+		eth := &layers.Ethernet{
+			SrcMAC:       n1.mac.HWAddr(),
+			DstMAC:       net1.mac.HWAddr(),
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		buf := gopacket.NewSerializeBuffer()
+		payload := bytes.Repeat([]byte{'x'}, size-28) // less IP and UDP headers
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ep1.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Before any ICMP, a large packet arrives whole.
+	send(1400, false)
+	if p := nextPacket(from2); p == nil || p.ApplicationLayer() == nil || len(p.ApplicationLayer().Payload()) != 1400-28 {
+		t.Fatalf("got %v; want whole 1400 byte packet", p)
+	}
+
+	// A router on the path reports a smaller next-hop MTU, quoting the
+	// forwarded packet.
+	quoted := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      60,
+		Length:   1400,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net1.wanIP.AsSlice(),
+		DstIP:    net2.wanIP.AsSlice(),
+	}
+	icmpPkt := func(mtu uint16, to netip.Addr) []byte {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    netip.MustParseAddr("3.3.3.3").AsSlice(),
+			DstIP:    to.AsSlice(),
+		}
+		icmp := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded),
+			Seq:      mtu,
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, quoted, gopacket.Payload(make([]byte, 8))); err != nil {
+			t.Fatal(err)
+		}
+		quote := bytes.Clone(buf.Bytes())
+		buf = gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, icmp, gopacket.Payload(quote)); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	if err := s.HandleICMPFromWAN(icmpPkt(pmtu, netip.MustParseAddr("3.4.5.6"))); err == nil {
+		t.Error("ICMP to unknown network succeeded")
+	}
+	if err := s.HandleICMPFromWAN(icmpPkt(pmtu, net1.wanIP)); err != nil {
+		t.Fatal(err)
+	}
+	// A later, larger MTU doesn't raise it again.
+	if err := s.HandleICMPFromWAN(icmpPkt(1000, net1.wanIP)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Now the same packet is fragmented to fit the path MTU.
+	send(1400, false)
+	var got []byte
+	for {
+		p := nextPacket(from2)
+		if p == nil {
+			t.Fatalf("fragments ended after %d bytes", len(got))
+		}
+		v4, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ok {
+			t.Fatalf("got %v; want IPv4 fragment", p)
+		}
+		if int(v4.Length) > pmtu {
+			t.Errorf("fragment of %d bytes; want at most %d", v4.Length, pmtu)
+		}
+		if int(v4.FragOffset)*8 != len(got) {
+			t.Fatalf("fragment offset %d; want %d", int(v4.FragOffset)*8, len(got))
+		}
+		got = append(got, v4.Payload...)
+		if v4.Flags&layers.IPv4MoreFragments == 0 {
+			break
+		}
+	}
+	if len(got) != 1400-20 || !bytes.Equal(got[8:], bytes.Repeat([]byte{'x'}, 1400-28)) {
+		t.Errorf("reassembled %d bytes; want the 1380 byte UDP datagram", len(got))
+	}
+
+	// A DF packet over the path MTU gets a fragmentation needed reply
+	// instead, and one within it is forwarded.
+	send(1000, true)
+	if p := nextPacket(from2); p != nil {
+		t.Errorf("oversized DF packet was forwarded: %v", p)
+	}
+	p := nextPacket(from1)
+	if p == nil {
+		t.Fatal("no reply to oversized DF packet")
+	}
+	if icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); !ok || icmp.Seq != pmtu {
+		t.Errorf("got %v; want ICMP fragmentation needed with MTU %d", p, pmtu)
+	}
+	send(pmtu, true)
+	if p := nextPacket(from2); p == nil || p.ApplicationLayer() == nil || len(p.ApplicationLayer().Payload()) != pmtu-28 {
+		t.Errorf("got %v; want whole %d byte packet", p, pmtu)
+	}
+}
+
+func TestExportTopology(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", HardNAT)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	c.AddSubnetBehind(n2, netip.MustParsePrefix("172.16.0.0/24"))
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dot, err := s.ExportTopology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(dot)
+	for _, want := range []string{
+		`graph vnet {`,
+		`internet -- "net 2.1.1.1" [label="WAN 2.1.1.1"];`,
+		`internet -- "net 2.2.2.2" [label="WAN 2.2.2.2"];`,
+		`"net 2.1.1.1" [shape=box, label="2.1.1.1\n192.168.1.1/24\neasy NAT"];`,
+		`"net 2.2.2.2" [shape=box, label="2.2.2.2\n10.2.0.1/16\nhard NAT"];`,
+		fmt.Sprintf(`"net 2.1.1.1" -- "node %v";`, n1.mac),
+		fmt.Sprintf(`"net 2.2.2.2" -- "node %v";`, n2.mac),
+		fmt.Sprintf(`"node %v" [label="%v\n%v"];`, n1.mac, n1.mac, n1.n.lanIP),
+		fmt.Sprintf(`"node %v" -- "subnet 172.16.0.0/24" [label="route 172.16.0.0/24"];`, n2.mac),
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("topology missing %s; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, fmt.Sprintf(`"net 2.2.2.2" -- "node %v"`, n1.mac)) {
+		t.Errorf("node on wrong network; got:\n%s", got)
+	}
+}
+
+func TestNATChurn(t *testing.T) {
+	peer := netip.MustParseAddrPort("5.5.5.5:1000")
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var c Config
+	c.RandSeed = 1
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	nw.SetNATChurn(10*time.Second, 1)
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nt := n1.n.net.natTable
+	lan := netip.AddrPortFrom(n1.n.lanIP, 5000)
+
+	// Return traffic works until the NAT churns, then works again once the
+	// host sends and gets a new mapping, until the next churn.
+	var delivered []bool
+	for i := range 4 {
+		at := t0.Add(time.Duration(i) * 10 * time.Second)
+		mapped := nt.PickOutgoingSrc(lan, peer, at)
+		delivered = append(delivered, nt.PickIncomingDst(peer, mapped, at.Add(time.Second)) == lan)
+		delivered = append(delivered, nt.PickIncomingDst(peer, mapped, at.Add(11*time.Second)) == lan)
+	}
+	if want := []bool{true, false, true, false, true, false, true, false}; !slices.Equal(delivered, want) {
+		t.Errorf("return traffic delivered = %v; want %v", delivered, want)
+	}
+
+	// With a fraction, only some hosts' mappings churn.
+	c = Config{RandSeed: 1}
+	nw = c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	nw.SetNATChurn(10*time.Second, 0.5)
+	var nodes []*Node
+	for range 20 {
+		nodes = append(nodes, c.AddNode(nw))
+	}
+	s2, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	nt = nodes[0].n.net.natTable
+	mapped := map[netip.AddrPort]netip.AddrPort{}
+	for _, n := range nodes {
+		lan := netip.AddrPortFrom(n.n.lanIP, 5000)
+		mapped[lan] = nt.PickOutgoingSrc(lan, peer, t0)
+	}
+	var kept int
+	for lan, wan := range mapped {
+		if nt.PickIncomingDst(peer, wan, t0.Add(10*time.Second)) == lan {
+			kept++
+		}
+	}
+	if kept == 0 || kept == len(nodes) {
+		t.Errorf("%d of %d hosts kept their mappings; want some but not all", kept, len(nodes))
+	}
+
+	c = Config{}
+	c.AddNetwork("2.1.1.1", "192.168.1.1/24").SetNATChurn(time.Second, 2)
+	if _, err := New(&c); err == nil {
+		t.Error("New with churn fraction 2 succeeded")
+	}
+}
+
+func TestNATPortFlapping(t *testing.T) {
+	peer := netip.MustParseAddrPort("5.5.5.5:1000")
+	other := netip.MustParseAddrPort("6.6.6.6:1000")
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var c Config
+	c.RandSeed = 1
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	nw.SetNATPortFlapping(0.25)
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nt := n1.n.net.natTable
+	lan := netip.AddrPortFrom(n1.n.lanIP, 5000)
+
+	// Most of the flow's packets leave from its mapped port, and some from
+	// others, all of which the peer's replies get through.
+	ports := map[uint16]int{}
+	for i := range 40 {
+		at := t0.Add(time.Duration(i) * time.Second)
+		wanSrc := nt.PickOutgoingSrc(lan, peer, at)
+		ports[wanSrc.Port()]++
+		if got := nt.PickIncomingDst(peer, wanSrc, at); got != lan {
+			t.Fatalf("packet %d: reply to %v went to %v; want %v", i, wanSrc, got, lan)
+		}
+	}
+	if len(ports) < 2 {
+		t.Fatalf("flow used ports %v; want some flapping", ports)
+	}
+	var mappedPort uint16
+	for port, n := range ports {
+		if n > ports[mappedPort] {
+			mappedPort = port
+		}
+	}
+	if n := ports[mappedPort]; n < 20 || n == 40 {
+		t.Errorf("flow used its mapped port for %d of 40 packets; want most but not all (ports %v)", n, ports)
+	}
+
+	// Flapped ports are tracked per remote, unlike the easy NAT's mapping.
+	at := t0.Add(40 * time.Second)
+	for port := range ports {
+		wanSrc := netip.AddrPortFrom(nw.WANIP(), port)
+		got := nt.PickIncomingDst(other, wanSrc, at)
+		if want := port == mappedPort; got.IsValid() != want {
+			t.Errorf("packet from %v to %v went to %v; want delivered = %v", other, wanSrc, got, want)
+		}
+	}
+
+	c = Config{}
+	c.AddNetwork("2.1.1.1", "192.168.1.1/24").SetNATPortFlapping(-1)
+	if _, err := New(&c); err == nil {
+		t.Error("New with port flapping fraction -1 succeeded")
+	}
+}
+
+func TestMaxFlows(t *testing.T) {
+	peer := netip.MustParseAddrPort("5.5.5.5:1000")
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, nat := range []NAT{EasyNAT, HardNAT} {
+		for _, policy := range []FlowLimitPolicy{RejectNewFlows, EvictOldestFlow} {
+			t.Run(fmt.Sprintf("%v/%v", nat, policy), func(t *testing.T) {
+				var c Config
+				nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", nat)
+				nw.SetMaxFlows(2, policy)
+				nw.SetNATTimeout(time.Minute)
+				n1 := c.AddNode(nw)
+				s, err := New(&c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				nt := n1.n.net.natTable
+				src := func(port uint16) netip.AddrPort { return netip.AddrPortFrom(n1.n.lanIP, port) }
+				// Flows differ in both source port and peer, as hard NATs
+				// map per LAN IP and destination.
+				peer := func(i byte) netip.AddrPort { return netip.AddrPortFrom(netip.AddrFrom4([4]byte{5, 5, 5, i}), 1000) }
+
+				// Fill the table, with the first flow the least recently used.
+				wan1 := nt.PickOutgoingSrc(src(5001), peer(1), t0)
+				wan2 := nt.PickOutgoingSrc(src(5002), peer(2), t0.Add(time.Second))
+				if !wan1.IsValid() || !wan2.IsValid() {
+					t.Fatalf("filling the table: got %v, %v", wan1, wan2)
+				}
+
+				wan3 := nt.PickOutgoingSrc(src(5003), peer(3), t0.Add(2*time.Second))
+				switch policy {
+				case RejectNewFlows:
+					if wan3.IsValid() {
+						t.Errorf("new flow in full table mapped to %v; want rejected", wan3)
+					}
+					if got := nt.PickOutgoingSrc(src(5001), peer(1), t0.Add(3*time.Second)); got != wan1 {
+						t.Errorf("existing flow mapped to %v; want %v", got, wan1)
+					}
+					// Expired mappings make room.
+					if got := nt.PickOutgoingSrc(src(5003), peer(3), t0.Add(2*time.Minute)); !got.IsValid() {
+						t.Error("new flow rejected after the others expired")
+					}
+				case EvictOldestFlow:
+					if !wan3.IsValid() {
+						t.Fatal("new flow rejected; want the oldest evicted")
+					}
+					at := t0.Add(3 * time.Second)
+					if got := nt.PeekIncomingDst(peer(1), wan1, at); got.IsValid() {
+						t.Errorf("evicted flow still delivers to %v", got)
+					}
+					if got := nt.PeekIncomingDst(peer(2), wan2, at); got != src(5002) {
+						t.Errorf("second flow delivers to %v; want %v", got, src(5002))
+					}
+					if got := nt.PeekIncomingDst(peer(3), wan3, at); got != src(5003) {
+						t.Errorf("new flow delivers to %v; want %v", got, src(5003))
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("drop-stats", func(t *testing.T) {
+		var c Config
+		nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+		nw.SetMaxFlows(1, RejectNewFlows)
+		n1 := c.AddNode(nw)
+		s, err := New(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		for port := range uint16(3) {
+			if err := s.InjectUDP(n1, 5000+port, peer, []byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := s.DropStats()[DropNATTableFull]; got != 2 {
+			t.Errorf("%q drops = %d; want 2", DropNATTableFull, got)
+		}
+	})
+
+	t.Run("one2one", func(t *testing.T) {
+		var c Config
+		nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT)
+		nw.SetMaxFlows(1, RejectNewFlows)
+		c.AddNode(nw)
+		if _, err := New(&c); err == nil {
+			t.Error("New with MaxFlows on a one-to-one NAT succeeded")
+		}
+	})
+}
+
+func TestSequentialPorts(t *testing.T) {
+	peer := netip.MustParseAddrPort("5.5.5.5:1000")
+	peer2 := netip.MustParseAddrPort("6.6.6.6:1000")
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const base = 40000
+
+	for _, nat := range []NAT{EasyNAT, HardNAT} {
+		t.Run(string(nat), func(t *testing.T) {
+			var c Config
+			nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", nat)
+			nw.SetPortAllocation(SequentialPorts, base)
+			n1 := c.AddNode(nw)
+			n2 := c.AddNode(nw)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			nt := n1.n.net.natTable
+
+			// New mappings get the next port in turn, whichever host
+			// they're for, while existing ones keep theirs.
+			flows := []struct{ src, dst netip.AddrPort }{
+				{netip.AddrPortFrom(n1.n.lanIP, 5000), peer},
+				{netip.AddrPortFrom(n2.n.lanIP, 5000), peer},
+				{netip.AddrPortFrom(n1.n.lanIP, 5001), peer2},
+				{netip.AddrPortFrom(n1.n.lanIP, 5000), peer},
+			}
+			var got []uint16
+			for _, f := range flows {
+				got = append(got, nt.PickOutgoingSrc(f.src, f.dst, t0).Port())
+			}
+			if want := []uint16{base, base + 1, base + 2, base}; !slices.Equal(got, want) {
+				t.Errorf("mapped ports = %v; want %v", got, want)
+			}
+		})
+	}
+
+	// After 65535, ports wrap around to the base port, once it's free.
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	nw.SetPortAllocation(SequentialPorts, 65534)
+	nw.SetNATTimeout(time.Minute)
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nt := n1.n.net.natTable
+	var got []uint16
+	for i := range 3 {
+		src := netip.AddrPortFrom(n1.n.lanIP, uint16(5000+i))
+		got = append(got, nt.PickOutgoingSrc(src, peer, t0.Add(time.Duration(i)*40*time.Second)).Port())
+	}
+	if want := []uint16{65534, 65535, 65534}; !slices.Equal(got, want) {
+		t.Errorf("from base 65534, mapped ports = %v; want %v", got, want)
+	}
+
+	c = Config{}
+	c.AddNetwork("2.1.1.1", "192.168.1.1/24").SetPortAllocation(SequentialPorts, 0)
+	if _, err := New(&c); err == nil {
+		t.Error("New with sequential ports from base 0 succeeded")
+	}
+}
+
+func TestRandomPorts(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Each new mapping takes one draw from the seeded source, so easy and
+	// hard NATs with the same seed pick the same ports.
+	mappedPorts := func(nat NAT) []uint16 {
+		c := Config{RandSeed: 1}
+		n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", nat))
+		s, err := New(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		nt := n1.n.net.natTable
+		var ports []uint16
+		for i := range 4 {
+			src := netip.AddrPortFrom(n1.n.lanIP, uint16(5000+i))
+			dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte{5, 5, 5, byte(i + 1)}), 1000)
+			ports = append(ports, nt.PickOutgoingSrc(src, dst, t0).Port())
+		}
+		return ports
+	}
+	easy, hard := mappedPorts(EasyNAT), mappedPorts(HardNAT)
+	if !slices.Equal(hard, easy) {
+		t.Errorf("hard NAT mapped ports = %v; want %v, as the easy NAT's with the same seed", hard, easy)
+	}
+}
+
+func TestMultiWAN(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wans := []netip.Addr{
+		netip.MustParseAddr("2.1.1.1"),
+		netip.MustParseAddr("2.1.1.2"),
+		netip.MustParseAddr("2.1.1.3"),
+	}
+	newTable := func(t *testing.T, policy WANPolicy) (NATTable, []*Node) {
+		var c Config
+		nw := c.AddNetwork(wans[0].String(), "192.168.1.1/24", EasyNAT)
+		for _, ip := range wans[1:] {
+			nw.AddWANIP(ip)
+		}
+		nw.SetWANPolicy(policy)
+		var nodes []*Node
+		for range 6 {
+			nodes = append(nodes, c.AddNode(nw))
+		}
+		s, err := New(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		return nodes[0].n.net.natTable, nodes
+	}
+	peer := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{5, 5, 5, byte(i)}), 1000)
+	}
+
+	t.Run("sticky", func(t *testing.T) {
+		nt, nodes := newTable(t, StickyPerLANSocket)
+		used := map[netip.Addr]bool{}
+		for _, n := range nodes {
+			lan := netip.AddrPortFrom(n.n.lanIP, 41641)
+			var wan netip.Addr
+			for i := range 20 {
+				mapped := nt.PickOutgoingSrc(lan, peer(i), t0)
+				if i == 0 {
+					wan = mapped.Addr()
+				} else if mapped.Addr() != wan {
+					t.Fatalf("%v to %v left from %v; want %v, like its first flow", lan, peer(i), mapped.Addr(), wan)
+				}
+				if got := nt.PickIncomingDst(peer(i), mapped, t0); got != lan {
+					t.Errorf("reply from %v to %v went to %v; want %v", peer(i), mapped, got, lan)
+				}
+			}
+			used[wan] = true
+		}
+		// The LAN sockets are spread across the WAN IPs.
+		if len(used) != len(wans) {
+			t.Errorf("LAN sockets used WAN IPs %v; want all of %v", used, wans)
+		}
+	})
+
+	t.Run("flow", func(t *testing.T) {
+		nt, nodes := newTable(t, SpreadPerFlow)
+		lan := netip.AddrPortFrom(nodes[0].n.lanIP, 41641)
+		used := map[netip.Addr]bool{}
+		for i := range 20 {
+			mapped := nt.PickOutgoingSrc(lan, peer(i), t0)
+			if again := nt.PickOutgoingSrc(lan, peer(i), t0); again != mapped {
+				t.Errorf("flow to %v mapped to %v, then %v", peer(i), mapped, again)
+			}
+			used[mapped.Addr()] = true
+		}
+		if len(used) < 2 {
+			t.Errorf("one LAN socket's flows used WAN IPs %v; want several", used)
+		}
+	})
+
+	// End to end, peers see the sticky socket at the same WAN IP and their
+	// replies get back.
+	var c Config
+	nw := c.AddNetwork(wans[0].String(), "192.168.1.1/24", EasyNAT)
+	nw.AddWANIP(wans[1])
+	nw.SetWANPolicy(StickyPerLANSocket)
+	client := c.AddNode(nw)
+	peer1 := c.AddNode(c.AddNetwork("5.5.5.1", "192.168.2.1/24", One2OneNAT))
+	peer2 := c.AddNode(c.AddNetwork("5.5.5.2", "192.168.3.1/24", One2OneNAT))
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, toClient := nodePackets(t, s, client)
+	_, toPeer1 := nodePackets(t, s, peer1)
+	_, toPeer2 := nodePackets(t, s, peer2)
+	var seen []netip.AddrPort
+	for _, p := range []struct {
+		node *Node
+		ch   <-chan gopacket.Packet
+	}{{peer1, toPeer1}, {peer2, toPeer2}} {
+		if err := s.InjectUDP(client, 41641, netip.AddrPortFrom(p.node.Network().WANIP(), 41641), []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		pkt := nextPacket(p.ch)
+		if pkt == nil {
+			t.Fatalf("ping to %v not delivered", p.node.Network().WANIP())
+		}
+		ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		src := netip.AddrPortFrom(netip.AddrFrom4([4]byte(ip.SrcIP.To4())), uint16(udp.SrcPort))
+		seen = append(seen, src)
+		if err := s.InjectUDP(p.node, 41641, src, []byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		if nextPacket(toClient) == nil {
+			t.Errorf("pong from %v to %v not delivered", p.node.Network().WANIP(), src)
+		}
+	}
+	if seen[0] != seen[1] {
+		t.Errorf("peers saw the client at %v and %v; want the same", seen[0], seen[1])
+	}
+
+	c = Config{}
+	c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT).SetWANPolicy("random")
+	if _, err := New(&c); err == nil {
+		t.Error("New with unknown WAN policy succeeded")
+	}
+	c = Config{}
+	c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT).AddWANIP(netip.MustParseAddr("2.1.1.1"))
+	if _, err := New(&c); err == nil {
+		t.Error("New with duplicate WAN IP succeeded")
+	}
+}
+
+func TestDisableARP(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable=%t", disable), func(t *testing.T) {
+			var c Config
+			hardened := c.AddNetwork("2.1.1.1", "5.0.0.1/24", NoNAT)
+			hardened.SetDisableARP(disable)
+			peerNet := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+			seeded := c.AddNode(hardened)
+			seeded.SetStaticARP(true)
+			unseeded := c.AddNode(hardened)
+			peer := c.AddNode(peerNet)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			fromSeeded, toSeeded := nodePackets(t, s, seeded)
+			_, toUnseeded := nodePackets(t, s, unseeded)
+			_, toPeer := nodePackets(t, s, peer)
+
+			// ARP requests go unanswered when ARP is disabled.
+			gwIP := hardened.lanIP.Addr()
+			if _, err := fromSeeded.Write(mustARPRequest(t, seeded.mac, seeded.n.lanIP, gwIP)); err != nil {
+				t.Fatal(err)
+			}
+			var answered bool
+			if p := nextPacket(toSeeded); p != nil {
+				arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+				answered = ok && arp.Operation == layers.ARPReply
+			}
+			if answered == disable {
+				t.Errorf("ARP request answered = %t; want %t", answered, !disable)
+			}
+
+			// A node with a static entry for the gateway can still send
+			// through it.
+			frame, err := udpFrame(seeded.mac, hardened.mac, netip.AddrPortFrom(seeded.n.lanIP, 443), netip.AddrPortFrom(peerNet.wanIP, 5000), nil, []byte("hi"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fromSeeded.Write(frame); err != nil {
+				t.Fatal(err)
+			}
+			if nextPacket(toPeer) == nil {
+				t.Error("packet from seeded node via gateway not delivered")
+			}
+
+			// The router delivers only to nodes it has static entries for.
+			for _, tt := range []struct {
+				node *Node
+				ch   <-chan gopacket.Packet
+				want bool
+			}{
+				{seeded, toSeeded, true},
+				{unseeded, toUnseeded, !disable},
+			} {
+				if err := s.InjectUDP(peer, 5000, netip.AddrPortFrom(tt.node.n.lanIP, 443), []byte("hi")); err != nil {
+					t.Fatal(err)
+				}
+				if got := nextPacket(tt.ch) != nil; got != tt.want {
+					t.Errorf("packet to %v delivered = %t; want %t", tt.node.n.lanIP, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestARPDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net1.SetARPDelay(delay)
+	n1 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tc := newTestClient(t, s, n1.mac)
+
+	gwIP := net1.lanIP.Addr()
+	start := time.Now()
+	tc.writeFrame(mustARPRequest(t, n1.mac, n1.n.lanIP, gwIP))
+	if _, ok := tc.readARPReply(gwIP, delay/2); ok {
+		t.Fatalf("ARP reply arrived before the %v delay", delay)
+	}
+	if _, ok := tc.readARPReply(gwIP, 5*time.Second); !ok {
+		t.Fatal("no ARP reply")
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("ARP reply after %v; want at least %v", d, delay)
+	}
+}
+
+func TestInternetRouting(t *testing.T) {
+	var c Config
+	natted := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	natted.AddWANIP(netip.MustParseAddr("2.1.1.2"))
+	routed := c.AddNetwork("2.2.2.2", "5.0.0.1/24", NoNAT)
+	n1 := c.AddNode(natted)
+	n1.SetPublicIP(netip.MustParseAddr("3.0.0.7"))
+	c.AddNode(routed)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tt := range []struct {
+		ip   string
+		want *Network // or nil for no route
+	}{
+		{"2.1.1.1", natted},
+		{"2.1.1.2", natted},
+		{"3.0.0.7", natted},
+		{"2.2.2.2", routed},
+		{"5.0.0.9", routed},
+		{"192.168.1.101", nil},
+		{"203.0.113.1", nil},
+	} {
+		got, ok := s.inet.route(netip.MustParseAddr(tt.ip))
+		if tt.want == nil {
+			if ok {
+				t.Errorf("route(%v) = network %v; want none", tt.ip, got.wanIP)
+			}
+		} else if !ok || got != tt.want.n {
+			t.Errorf("route(%v) = %v, %t; want network %v", tt.ip, got, ok, tt.want.wanIP)
+		}
+	}
+	if _, ok := s.inet.networkAt(netip.MustParseAddr("5.0.0.9")); ok {
+		t.Error("networkAt found a network at a routed LAN IP")
+	}
+
+	// The internet's services answer at any address, routed or not; other
+	// packets to unrouted addresses are dropped.
+	_, toN1 := nodePackets(t, s, n1)
+	if err := s.InjectUDP(n1, 5000, netip.MustParseAddrPort("203.0.113.1:3478"), stun.Request(stun.NewTxID())); err != nil {
+		t.Fatal(err)
+	}
+	p := nextPacket(toN1)
+	if p == nil {
+		t.Fatal("no STUN reply")
+	}
+	if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || udp.SrcPort != stunPort {
+		t.Errorf("got %v; want STUN reply", p)
+	}
+	if err := s.InjectUDP(n1, 5000, netip.MustParseAddrPort("203.0.113.1:9"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.DropStats()[DropNoRoute]; got != 1 {
+		t.Errorf("no-route drops = %d; want 1", got)
+	}
+}
+
+func TestNoNAT(t *testing.T) {
+	var c Config
+	pub := c.AddNetwork("2.1.1.1", "5.0.0.1/24", NoNAT)
+	priv := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	server := c.AddNode(pub)
+	client := c.AddNode(priv)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, toServer := nodePackets(t, s, server)
+	_, toClient := nodePackets(t, s, client)
+
+	srcOf := func(p gopacket.Packet) netip.AddrPort {
+		if p == nil {
+			return netip.AddrPort{}
+		}
+		ip, ok1 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, ok2 := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok1 || !ok2 {
+			return netip.AddrPort{}
+		}
+		src, _ := netip.AddrFromSlice(ip.SrcIP)
+		return netip.AddrPortFrom(src, uint16(udp.SrcPort))
+	}
+
+	// Unsolicited traffic to the server's LAN IP reaches it.
+	serverIP := server.n.lanIP
+	if serverIP != netip.MustParseAddr("5.0.0.101") {
+		t.Fatalf("server IP = %v; want 5.0.0.101", serverIP)
+	}
+	if err := s.InjectUDP(client, 5000, netip.AddrPortFrom(serverIP, 443), []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srcOf(nextPacket(toServer)), netip.AddrPortFrom(priv.wanIP, 5000); got != want {
+		t.Errorf("server got packet from %v; want %v", got, want)
+	}
+
+	// The server's traffic leaves with its own IP and port.
+	if err := s.InjectUDP(server, 443, netip.AddrPortFrom(priv.wanIP, 5000), []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srcOf(nextPacket(toClient)), netip.AddrPortFrom(serverIP, 443); got != want {
+		t.Errorf("client got packet from %v; want %v", got, want)
+	}
+
+	c = Config{}
+	c.AddNetwork("2.1.1.1", "5.0.0.1/24", NoNAT)
+	c.AddNetwork("5.0.0.9", "192.168.1.1/24")
+	if _, err := New(&c); err == nil {
+		t.Error("New with a WAN IP in a NoNAT LAN succeeded")
+	}
+}
+
+func TestIngressFiltering(t *testing.T) {
+	for _, filter := range []bool{false, true} {
+		t.Run(fmt.Sprintf("filter=%t", filter), func(t *testing.T) {
+			var c Config
+			// The spoofer's network routes its private LAN, un-NATed.
+			spoofNet := c.AddNetwork("2.1.1.1", "10.9.0.1/24", NoNAT)
+			spoofNet.SetIngressFiltering(filter)
+			victimNet := c.AddNetwork("2.2.2.2", "192.168.1.1/24", One2OneNAT)
+			victimNet.SetIngressFiltering(filter)
+			spoofer := c.AddNode(spoofNet)
+			victim := c.AddNode(victimNet)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			_, toVictim := nodePackets(t, s, victim)
+			var mu sync.Mutex
+			var drops []PacketDrop
+			defer s.AddDropHook(func(d PacketDrop) {
+				mu.Lock()
+				defer mu.Unlock()
+				drops = append(drops, d)
+			})()
+			spoofed := func() (n int) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, d := range drops {
+					if d.Reason == DropSpoofed {
+						n++
+					}
+				}
+				return n
+			}
+
+			// A packet from the spoofer's private LAN IP reaches the victim's
+			// network with a bogon source.
+			if err := s.InjectUDP(spoofer, 5000, netip.AddrPortFrom(victimNet.wanIP, 443), []byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+			if got := nextPacket(toVictim) != nil; got == filter {
+				t.Errorf("bogon-sourced packet delivered = %t; want %t", got, !filter)
+			}
+
+			// A packet with a source that's not the spoofer network's own
+			// doesn't leave it.
+			frame, err := udpFrame(spoofer.mac, spoofNet.mac, netip.MustParseAddrPort("8.8.8.8:53"), netip.AddrPortFrom(victimNet.wanIP, 443), nil, []byte("hi"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			spoofer.n.inject(frame)
+			if got := nextPacket(toVictim) != nil; got == filter {
+				t.Errorf("spoofed packet delivered = %t; want %t", got, !filter)
+			}
+
+			want := 0
+			if filter {
+				want = 2
+			}
+			if got := spoofed(); got != want {
+				t.Errorf("got %d %q drops; want %d", got, DropSpoofed, want)
+			}
+		})
+	}
+}
+
+func TestNodePublicIP(t *testing.T) {
+	var c Config
+	home := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	other := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	server := c.AddNode(home)
+	publicIP := netip.MustParseAddr("2.1.1.50")
+	server.SetPublicIP(publicIP)
+	client := c.AddNode(other)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, toServer := nodePackets(t, s, server)
+	_, toClient := nodePackets(t, s, client)
+
+	udpAddrs := func(p gopacket.Packet) (src, dst netip.AddrPort) {
+		if p == nil {
+			return
+		}
+		ip, ok1 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, ok2 := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok1 || !ok2 {
+			return
+		}
+		srcIP, _ := netip.AddrFromSlice(ip.SrcIP)
+		dstIP, _ := netip.AddrFromSlice(ip.DstIP)
+		return netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)), netip.AddrPortFrom(dstIP, uint16(udp.DstPort))
+	}
+
+	// Unsolicited traffic to the public IP reaches the server as-is.
+	if err := s.InjectUDP(client, 5000, netip.AddrPortFrom(publicIP, 443), []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	src, dst := udpAddrs(nextPacket(toServer))
+	if wantSrc, wantDst := netip.AddrPortFrom(other.wanIP, 5000), netip.AddrPortFrom(publicIP, 443); src != wantSrc || dst != wantDst {
+		t.Errorf("server got %v => %v; want %v => %v", src, dst, wantSrc, wantDst)
+	}
+
+	// The server's packets from its public IP leave un-NATed, and its
+	// packets from its LAN IP are NATed as usual.
+	for _, from := range []netip.Addr{publicIP, server.n.lanIP} {
+		frame, err := udpFrame(server.mac, home.mac, netip.AddrPortFrom(from, 443), netip.AddrPortFrom(other.wanIP, 5000), nil, []byte("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.n.inject(frame)
+		wantSrc := publicIP
+		if from != publicIP {
+			wantSrc = home.wanIP
+		}
+		if src, _ := udpAddrs(nextPacket(toClient)); src.Addr() != wantSrc {
+			t.Errorf("from %v, client got packet from %v; want %v", from, src, wantSrc)
+		}
+	}
+
+	c = Config{}
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetPublicIP(netip.MustParseAddr("2.1.1.1"))
+	if _, err := New(&c); err == nil {
+		t.Error("New with a public IP that's a WAN IP succeeded")
+	}
+}
+
+func TestNATLog(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	c := Config{
+		Clock:  clock,
+		LogNAT: true,
+		Logf: func(format string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net1.SetNATTimeout(30 * time.Second)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	n1 := c.AddNode(net1)
+	c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	natLogs := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		var ret []string
+		for _, l := range logs {
+			if strings.HasPrefix(l, "nat[2.1.1.1]: ") {
+				ret = append(ret, l)
+			}
+		}
+		return ret
+	}
+
+	dst := netip.AddrPortFrom(net2.wanIP, 6000)
+	if err := s.InjectUDP(n1, 5000, dst, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	got := natLogs()
+	if len(got) != 1 || !strings.HasPrefix(got[0], "nat[2.1.1.1]: session created UDP 192.168.1.101:5000 -> 2.2.2.2:6000 via 2.1.1.1:") || !strings.HasSuffix(got[0], " at 2024-01-01T00:00:00Z") {
+		t.Fatalf("after first packet, NAT logs = %q; want one session created", got)
+	}
+	wanSrc := strings.Fields(got[0])[8]
+
+	// Traffic within the timeout keeps the session open.
+	s.AdvanceClock(20 * time.Second)
+	if err := s.InjectUDP(n1, 5000, dst, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if got := natLogs(); len(got) != 1 {
+		t.Fatalf("after refresh, NAT logs = %q; want no more", got)
+	}
+
+	// Once it has idled for the timeout, the NAT's next packet closes it.
+	s.AdvanceClock(30 * time.Second)
+	if s.WouldAcceptInbound(net1.wanIP, dst, netip.MustParseAddrPort(wanSrc), clock.Now()) {
+		t.Error("expired mapping still accepts return traffic")
+	}
+	if err := s.InjectUDP(n1, 5001, dst, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	got = natLogs()
+	want := "nat[2.1.1.1]: session closed UDP 192.168.1.101:5000 -> 2.2.2.2:6000 via " + wanSrc + " at 2024-01-01T00:00:50Z"
+	if len(got) != 3 || got[1] != want || !strings.Contains(got[2], "session created UDP 192.168.1.101:5001 ") {
+		t.Errorf("after expiry, NAT logs = %q; want %q, then a new session", got, want)
+	}
+}
+
+func TestDNSFaultWindow(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	c := Config{Clock: clock}
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tc := newTestClient(t, s, n1.mac)
+
+	query := func() *layers.DNS {
+		t.Helper()
+		udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+		tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQuery(t, "test-driver.tailscale")))
+		res, _, ok := tc.readDNSResponse(5 * time.Second)
+		if !ok {
+			t.Fatal("no DNS response")
+		}
+		return res
+	}
+
+	s.SetDNSFault(DNSFault{RCode: layers.DNSResponseCodeServFail, For: 5 * time.Second})
+	for _, d := range []time.Duration{0, 4 * time.Second} {
+		s.AdvanceClock(d)
+		if res := query(); res.ResponseCode != layers.DNSResponseCodeServFail || len(res.Answers) != 0 {
+			t.Errorf("inside window: rcode %v with %d answers; want SERVFAIL with none", res.ResponseCode, len(res.Answers))
+		}
+	}
+	s.AdvanceClock(time.Second)
+	if res := query(); res.ResponseCode != layers.DNSResponseCodeNoErr || len(res.Answers) != 1 {
+		t.Errorf("after window: rcode %v with %d answers; want NOERROR with one", res.ResponseCode, len(res.Answers))
+	}
+
+	// Without a duration, the fault lasts until cleared.
+	s.SetDNSFault(DNSFault{RCode: layers.DNSResponseCodeServFail})
+	s.AdvanceClock(time.Hour)
+	if res := query(); res.ResponseCode != layers.DNSResponseCodeServFail {
+		t.Errorf("open-ended fault: rcode %v; want SERVFAIL", res.ResponseCode)
+	}
+	s.SetDNSFault(DNSFault{})
+	if res := query(); res.ResponseCode != layers.DNSResponseCodeNoErr {
+		t.Errorf("cleared fault: rcode %v; want NOERROR", res.ResponseCode)
+	}
+}
+
+func TestInjectDNSSpoof(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tc := newTestClient(t, s, n1.mac)
+
+	// query sends an A query for the test agent and returns the answers of
+	// the responses that arrive, in order.
+	query := func() (answers []netip.Addr) {
+		t.Helper()
+		udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+		tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQuery(t, "test-driver.tailscale")))
+		wait := 5 * time.Second
+		for {
+			res, from, ok := tc.readDNSResponse(wait)
+			if !ok {
+				return answers
+			}
+			wait = 200 * time.Millisecond
+			if res.ID != 1 || from != s.fakeIPs.DNS || len(res.Answers) != 1 {
+				t.Fatalf("response from %v with ID %d and %d answers; want one answer to ID 1 from %v", from, res.ID, len(res.Answers), s.fakeIPs.DNS)
+			}
+			ip, _ := netip.AddrFromSlice(res.Answers[0].IP)
+			answers = append(answers, ip)
+		}
+	}
+
+	evil := netip.MustParseAddr("6.6.6.6")
+	if err := s.InjectDNSSpoof(n1.mac, "Test-Driver.tailscale.", evil); err != nil {
+		t.Fatal(err)
+	}
+	// The forged answer arrives first, then the real one.
+	if got, want := query(), []netip.Addr{evil, s.fakeIPs.TestAgent}; !slices.Equal(got, want) {
+		t.Errorf("answers with spoof = %v; want %v", got, want)
+	}
+	// It's one-shot.
+	if got, want := query(), []netip.Addr{s.fakeIPs.TestAgent}; !slices.Equal(got, want) {
+		t.Errorf("answers after spoof = %v; want %v", got, want)
+	}
+
+	if err := s.InjectDNSSpoof(MAC{1}, "x", evil); err == nil {
+		t.Error("InjectDNSSpoof for unknown node succeeded")
+	}
+	if err := s.InjectDNSSpoof(n1.mac, "x", netip.MustParseAddr("::1")); err == nil {
+		t.Error("InjectDNSSpoof with IPv6 answer succeeded")
+	}
+}
+
+func TestTapNode(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tc := newTestClient(t, s, n1.mac)
+	tap, stop := s.TapNode(n1.mac)
+	defer stop()
+
+	tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+	// The client still gets its ACK.
+	ack, _ := tc.readDHCPReply(5 * time.Second)
+	if got := net.IP(ack.YourClientIP).String(); got != n1.n.lanIP.String() {
+		t.Fatalf("client got address %v; want %v", got, n1.n.lanIP)
+	}
+
+	// And so does the tap, byte for byte as delivered.
+	timeout := time.After(5 * time.Second)
+	for {
+		var frame []byte
+		select {
+		case frame = <-tap:
+		case <-timeout:
+			t.Fatal("no DHCP ACK on tap")
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		d, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		if !ok || d.Operation != layers.DHCPOpReply {
+			continue // such as the node's own broadcast request
+		}
+		if !bytes.Equal(d.ClientHWAddr, n1.mac.HWAddr()) {
+			t.Errorf("tapped DHCP reply for %v; want %v", d.ClientHWAddr, n1.mac)
+		}
+		if !net.IP(d.YourClientIP).Equal(ack.YourClientIP) || d.Xid != ack.Xid {
+			t.Errorf("tapped reply %+v differs from delivered %+v", d, ack)
+		}
+		break
+	}
+
+	// Stopping closes the channel, after anything already queued, and
+	// delivery carries on without the tap.
+	stop()
+	stop() // no-op
+	for range tap {
+	}
+	tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+	tc.readDHCPReply(5 * time.Second)
+}
+
+func TestPriorityQueuing(t *testing.T) {
+	for _, prio := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prio=%v", prio), func(t *testing.T) {
+			var c Config
+			net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+			net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+			net2.SetBandwidth(1e6) // about 8ms per packet
+			net2.SetPriorityQueuing(prio)
+			n1 := c.AddNode(net1)
+			n2 := c.AddNode(net2)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			ep1, _ := nodePackets(t, s, n1)
+			_, from2 := nodePackets(t, s, n2)
+
+			send := func(priority uint8, name string) {
+				t.Helper()
+				eth := &layers.Ethernet{
+					SrcMAC:       n1.mac.HWAddr(),
+					DstMAC:       net1.mac.HWAddr(),
+					EthernetType: layers.EthernetTypeDot1Q,
+				}
+				tag := &layers.Dot1Q{Priority: priority, VLANIdentifier: 10, Type: layers.EthernetTypeIPv4}
+				ip := &layers.IPv4{
+					Version:  4,
+					TTL:      64,
+					Protocol: layers.IPProtocolUDP,
+					SrcIP:    n1.n.lanIP.AsSlice(),
+					DstIP:    net2.wanIP.AsSlice(),
+				}
+				udp := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+				udp.SetNetworkLayerForChecksum(ip)
+				payload := append([]byte(name), make([]byte, 1000-len(name))...)
+				buf := gopacket.NewSerializeBuffer()
+				if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, tag, ip, udp, gopacket.Payload(payload)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := ep1.Write(buf.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Saturate the link with background traffic, then send high
+			// priority traffic behind it.
+			var sent []string
+			for i := range 4 {
+				name := fmt.Sprintf("bk%d", i)
+				send(1, name)
+				sent = append(sent, name)
+			}
+			for i := range 4 {
+				name := fmt.Sprintf("vo%d", i)
+				send(6, name)
+				sent = append(sent, name)
+			}
+
+			var got []string
+			for range sent {
+				p := nextPacket(from2)
+				if p == nil || p.ApplicationLayer() == nil {
+					t.Fatalf("got %v after %q; want more packets", p, got)
+				}
+				got = append(got, string(bytes.TrimRight(p.ApplicationLayer().Payload(), "\x00")))
+			}
+			want := sent
+			if prio {
+				// The first background packet was already being sent.
+				want = []string{"bk0", "vo0", "vo1", "vo2", "vo3", "bk1", "bk2", "bk3"}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("delivered %q; want %q", got, want)
+			}
+		})
+	}
+
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	nw.SetBandwidth(1e6)
+	nw.SetFairQueuing(true)
+	nw.SetPriorityQueuing(true)
+	if _, err := New(&c); err == nil {
+		t.Error("New with both fair and priority queuing succeeded")
+	}
+}
+
+func TestNetworkServices(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", PCP)
+	n1 := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tc := newTestClient(t, s, n1.mac)
+	gw := nw.lanIP.Addr()
+
+	// readPortmapReply returns the payload of the next reply from the
+	// router's port mapping port, if any arrives within d.
+	readPortmapReply := func(d time.Duration) ([]byte, bool) {
+		deadline := time.Now().Add(d)
+		for {
+			frame, ok := tc.readFrame(time.Until(deadline))
+			if !ok {
+				return nil, false
+			}
+			pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+			if udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP); ok && udp.SrcPort == 5351 {
+				return udp.Payload, true
+			}
+		}
+	}
+	send := func(payload []byte) {
+		udp := &layers.UDP{SrcPort: 5350, DstPort: 5351}
+		tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, gw, udp, payload))
+	}
+
+	// NAT-PMP isn't enabled, so its external address request is ignored.
+	send([]byte{0, 0})
+	if res, ok := readPortmapReply(500 * time.Millisecond); ok {
+		t.Errorf("got NAT-PMP reply % 02x; want none", res)
+	}
+
+	// A PCP ANNOUNCE succeeds.
+	announce := make([]byte, 24)
+	announce[0] = 2           // version
+	ip16 := n1.n.lanIP.As16() // IPv4-mapped
+	copy(announce[8:], ip16[:])
+	send(announce)
+	res, ok := readPortmapReply(5 * time.Second)
+	if !ok {
+		t.Fatal("no PCP reply")
+	}
+	if len(res) != 24 || res[0] != 2 || res[1] != 0x80 || res[3] != 0 {
+		t.Errorf("PCP ANNOUNCE reply = % 02x; want successful response", res)
+	}
+
+	// Other PCP opcodes aren't supported yet.
+	mapReq := append(bytes.Clone(announce), make([]byte, 36)...)
+	mapReq[1] = 1 // MAP
+	send(mapReq)
+	if res, ok := readPortmapReply(5 * time.Second); !ok || res[1] != 0x81 || res[3] != 5 {
+		t.Errorf("PCP MAP reply = % 02x, %v; want UNSUPP_OPCODE response", res, ok)
+	}
+}
+
+func TestRecentLogs(t *testing.T) {
+	var logged atomic.Int32
+	c := Config{
+		LogRingSize: 3,
+		Logf: func(format string, args ...any) {
+			logged.Add(1)
+			t.Logf(format, args...)
+		},
+	}
+	n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := s.RecentLogs(10); len(got) != 0 {
+		t.Fatalf("RecentLogs before any logging = %q; want none", got)
+	}
+
+	// Each packet to an unknown network logs a line.
+	var want []string
+	for i := range 5 {
+		dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte{9, 9, 9, byte(i)}), 53)
+		if err := s.InjectUDP(n1, 5000, dst, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, fmt.Sprintf("no network to route UDP packet for %v", dst))
+	}
+	if got := logged.Load(); got != 5 {
+		t.Errorf("Logf called %d times; want 5", got)
+	}
+	if got := s.RecentLogs(10); !slices.Equal(got, want[2:]) {
+		t.Errorf("RecentLogs(10) = %q; want %q", got, want[2:])
+	}
+	if got := s.RecentLogs(2); !slices.Equal(got, want[3:]) {
+		t.Errorf("RecentLogs(2) = %q; want %q", got, want[3:])
+	}
+}
+
+func TestFakeIPs(t *testing.T) {
+	custom := FakeIPs{
+		DNS:          netip.MustParseAddr("100.100.0.53"),
+		Controlplane: netip.MustParseAddr("100.100.0.1"),
+		TestAgent:    netip.MustParseAddr("100.100.0.2"),
+	}
+	sets := []FakeIPs{{}, custom}
+	resolved := []FakeIPs{defaultFakeIPs, custom} // with defaults filled in
+	for i, fakeIPs := range sets {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			c := Config{FakeIPs: fakeIPs}
+			nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+			n1 := c.AddNode(nw)
+			s, err := New(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			want, other := resolved[i], resolved[1-i]
+			if s.fakeIPs != want {
+				t.Fatalf("fake IPs = %+v; want %+v", s.fakeIPs, want)
+			}
+			tc := newTestClient(t, s, n1.mac)
+
+			tc.writeFrame(mustDHCPFrame(t, n1.mac, layers.DHCPMsgTypeRequest, netip.Addr{}))
+			_, opts := tc.readDHCPReply(5 * time.Second)
+			if got := opts[layers.DHCPOptDNS]; !net.IP(got).Equal(want.DNS.AsSlice()) {
+				t.Errorf("DHCP DNS = %v; want %v", net.IP(got), want.DNS)
+			}
+
+			// This server's DNS answers with this server's agent IP; the
+			// other server's DNS IP isn't a DNS server here.
+			for _, dnsIP := range []netip.Addr{want.DNS, other.DNS} {
+				udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+				tc.writeFrame(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, dnsIP, udp, mustDNSQuery(t, "test-driver.tailscale")))
+				res, _, ok := tc.readDNSResponse(500 * time.Millisecond)
+				if dnsIP != want.DNS {
+					if ok {
+						t.Errorf("query to other server's DNS IP %v answered", dnsIP)
+					}
+					continue
+				}
+				if !ok || len(res.Answers) != 1 || !net.IP(res.Answers[0].IP).Equal(want.TestAgent.AsSlice()) {
+					t.Errorf("test-driver.tailscale = %v, %v; want %v", res, ok, want.TestAgent)
+				}
+			}
+			if ip, ok := s.IPv4ForDNS("controlplane.tailscale.com"); !ok || ip != want.Controlplane {
+				t.Errorf("controlplane IP = %v, %v; want %v", ip, ok, want.Controlplane)
+			}
+		})
+	}
+
+	c := Config{FakeIPs: FakeIPs{DNS: netip.MustParseAddr("192.168.1.53")}}
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+	if _, err := New(&c); err == nil {
+		t.Error("New with fake DNS IP on the LAN succeeded")
+	}
+}
+
+func TestInjectPackets(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	n1 := c.AddNode(net1)
+	peer := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, toPeer := nodePackets(t, s, peer)
+	_, toN2 := nodePackets(t, s, n2)
+
+	// UDP to the internet leaves net1 from its WAN IP.
+	if err := s.InjectUDP(n1, 5000, netip.AddrPortFrom(net2.wanIP, 6000), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	p := nextPacket(toN2)
+	if p == nil {
+		t.Fatal("no UDP packet arrived")
+	}
+	ip, ok1 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp, ok2 := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok1 || !ok2 {
+		t.Fatalf("got %v; want UDP", p)
+	}
+	if src, _ := netip.AddrFromSlice(ip.SrcIP); src != net1.wanIP {
+		t.Errorf("UDP from %v; want NATed to %v", src, net1.wanIP)
+	}
+	if dst, _ := netip.AddrFromSlice(ip.DstIP); dst != n2.n.lanIP || udp.DstPort != 6000 {
+		t.Errorf("UDP to %v:%d; want %v:6000", dst, udp.DstPort, n2.n.lanIP)
+	}
+	if string(udp.Payload) != "hello" {
+		t.Errorf("UDP payload = %q; want %q", udp.Payload, "hello")
+	}
+
+	// TCP and ICMP to a LAN peer go to it directly.
+	peerIP := peer.n.lanIP
+	if err := s.InjectTCP(n1, 5000, netip.AddrPortFrom(peerIP, 80), layers.TCP{SYN: true, Seq: 1234, Window: 1024}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if p = nextPacket(toPeer); p == nil {
+		t.Fatal("no TCP segment arrived")
+	}
+	if tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP); !ok || !tcp.SYN || tcp.Seq != 1234 || tcp.SrcPort != 5000 || tcp.DstPort != 80 {
+		t.Errorf("peer got %v; want the TCP SYN", p)
+	}
+	echo := layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 2}
+	if err := s.InjectICMP(n1, peerIP, echo, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if p = nextPacket(toPeer); p == nil {
+		t.Fatal("no ICMP message arrived")
+	}
+	if icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); !ok || icmp.TypeCode != echo.TypeCode || icmp.Seq != 2 || string(icmp.Payload) != "ping" {
+		t.Errorf("peer got %v; want the ICMP echo request", p)
+	}
+}
+
+func TestWriteEthToGateway(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(nw)
+	peer := c.AddNode(nw)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, toN1 := nodePackets(t, s, n1)
+	_, toPeer := nodePackets(t, s, peer)
+
+	// A node's frame to the gateway that reaches writeEth, such as one
+	// forwarded at layer 2, is handled by the router: here, its DNS server.
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	n1.n.net.writeEth(mustIPv4Frame(t, n1.mac, nw.mac, n1.n.lanIP, s.fakeIPs.DNS, udp, mustDNSQuery(t, "test-driver.tailscale")))
+	p := nextPacket(toN1)
+	if p == nil {
+		t.Fatal("no DNS response")
+	}
+	res, ok := p.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok || len(res.Answers) != 1 || !net.IP(res.Answers[0].IP).Equal(s.fakeIPs.TestAgent.AsSlice()) {
+		t.Errorf("got %v; want a DNS response with %v", p, s.fakeIPs.TestAgent)
+	}
+	if p := nextPacket(toPeer); p != nil {
+		t.Errorf("peer got %v; want nothing", p)
+	}
+}
+
+func TestAdvanceClock(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	c := Config{Clock: clock}
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net1.SetNATTimeout(30 * time.Second)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT)
+	net2.SetLatency(100*time.Millisecond, 0)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, toN2 := nodePackets(t, s, n2)
+
+	// The packet is held for the link latency until the clock gets there.
+	dst := netip.AddrPortFrom(net2.wanIP, 6000)
+	if err := s.InjectUDP(n1, 5000, dst, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	s.AdvanceClock(99 * time.Millisecond)
+	if p := nextPacket(toN2); p != nil {
+		t.Fatalf("got %v before the latency elapsed", p)
+	}
+	s.AdvanceClock(time.Millisecond)
+	p := nextPacket(toN2)
+	if p == nil {
+		t.Fatal("no packet after the latency elapsed")
+	}
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	srcIP, _ := netip.AddrFromSlice(ip.SrcIP)
+	mapped := netip.AddrPortFrom(srcIP, uint16(udp.SrcPort))
+
+	// The NAT mapping expires exactly at the timeout.
+	s.AdvanceClock(30*time.Second - 101*time.Millisecond)
+	if !s.WouldAcceptInbound(net1.wanIP, dst, mapped, clock.Now()) {
+		t.Fatal("mapping expired before its timeout")
+	}
+	s.AdvanceClock(time.Millisecond)
+	if s.WouldAcceptInbound(net1.wanIP, dst, mapped, clock.Now()) {
+		t.Error("mapping didn't expire at its timeout")
+	}
+
+	// Conn health is judged on the same clock.
+	ep, err := s.NodeEndpoint(n1.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+	if _, err := ep.Write(mustARPRequest(t, n1.mac, n1.n.lanIP, net1.lanIP.Addr())); err != nil {
+		t.Fatal(err)
+	}
+	if h := s.ConnHealth()[0]; !h.LastRecv.Equal(clock.Now()) || h.Stale {
+		t.Errorf("after frame at %v: %+v; want fresh frame at the clock's time", clock.Now(), h)
+	}
+	s.AdvanceClock(time.Minute)
+	if h := s.ConnHealth()[0]; !h.Stale {
+		t.Errorf("a minute after the last frame: %+v; want stale", h)
+	}
+}
+
+func TestSetDERPMap(t *testing.T) {
+	c := &Config{}
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+	c.SetDERPMap(&tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{
+				{Name: "1a", IPv4: "9.9.9.9"},
+				{Name: "1b", IPv6: "2001:db8::1"},
+			}},
+			2: {RegionID: 2, Nodes: []*tailcfg.DERPNode{
+				{Name: "2a", IPv4: "9.9.9.10"},
+			}},
+		},
+	})
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	src := netip.MustParseAddr("192.168.1.2")
+	for _, tt := range []struct {
+		dst  string
+		port layers.TCPPort
+		want bool
+	}{
+		{"9.9.9.9", 443, true},
+		{"9.9.9.10", 80, true},
+		{"9.9.9.9", 22, false},
+		{"9.9.9.11", 443, false},
+	} {
+		frame := mustIPv4Frame(t, MAC{}, MAC{}, src, netip.MustParseAddr(tt.dst), &layers.TCP{SrcPort: 1234, DstPort: tt.port, SYN: true}, nil)
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		if got := s.shouldInterceptTCP(pkt); got != tt.want {
+			t.Errorf("shouldInterceptTCP(%v:%v) = %v; want %v", tt.dst, tt.port, got, tt.want)
+		}
+	}
+
+	c.SetDERPMap(&tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "1a", IPv4: "not-an-ip"}}},
+		},
+	})
+	if _, err := New(c); err == nil {
+		t.Error("New with an invalid DERP IP succeeded")
+	}
+}
+
+func TestPopulateDERPMapFrom(t *testing.T) {
+	c := &Config{}
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// As output by "tailscale debug derp-map", abridged.
+	const derpMapJSON = `{
+		"Regions": {
+			"1": {
+				"RegionID": 1,
+				"RegionCode": "nyc",
+				"Nodes": [
+					{"Name": "1f", "RegionID": 1, "HostName": "derp1f.tailscale.com", "IPv4": "199.38.181.104", "IPv6": "2607:f740:f::bc"},
+					{"Name": "1g", "RegionID": 1, "HostName": "derp1g.tailscale.com", "IPv4": "209.177.145.120"}
+				]
+			},
+			"2": {
+				"RegionID": 2,
+				"RegionCode": "sfo",
+				"Nodes": [
+					{"Name": "2v6", "RegionID": 2, "HostName": "derp2v6.tailscale.com", "IPv6": "2001:19f0:ac01::1"}
+				]
+			}
+		}
+	}`
+	if err := s.PopulateDERPMapFrom(strings.NewReader(derpMapJSON)); err != nil {
+		t.Fatal(err)
+	}
+	want := set.Of(
+		netip.MustParseAddr("199.38.181.104"),
+		netip.MustParseAddr("2607:f740:f::bc"),
+		netip.MustParseAddr("209.177.145.120"),
+		netip.MustParseAddr("2001:19f0:ac01::1"),
+	)
+	if !maps.Equal(s.derpIPs, want) {
+		t.Errorf("derpIPs = %v; want %v", s.derpIPs.Slice(), want.Slice())
+	}
+
+	if err := s.PopulateDERPMapFrom(strings.NewReader("not json")); err == nil {
+		t.Error("PopulateDERPMapFrom with invalid JSON succeeded")
+	}
+}
+
+func TestNodeLANIP(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	n1 := c.AddNode(nw)
+	n2 := c.AddNode(nw)
+	n3 := c.AddNode(c.AddNetwork("2.2.2.2")) // default LAN
+	dhcp := c.AddNetwork("2.3.3.3", "10.0.0.1/24")
+	dhcp.SetDHCPPool(netip.MustParsePrefix("10.0.0.200/29"))
+	n4 := c.AddNode(dhcp)
+
+	want := map[*Node]string{
+		n1: "192.168.1.101",
+		n2: "192.168.1.102",
+		n3: "192.168.0.103",
+		n4: "", // leased by DHCP
+	}
+	check := func(when string) {
+		t.Helper()
+		for n, w := range want {
+			ip, ok := n.LANIP()
+			if w == "" {
+				if ok {
+					t.Errorf("%s: node %v LANIP = %v; want none", when, n.mac, ip)
+				}
+				continue
+			}
+			if !ok || ip != netip.MustParseAddr(w) {
+				t.Errorf("%s: node %v LANIP = %v, %v; want %v", when, n.mac, ip, ok, w)
+			}
+			if wantIP := nw.lanIP.Addr().As4(); n.Network() == nw {
+				wantIP[3] = 101 + n.mac[5]
+				if ip != netip.AddrFrom4(wantIP) {
+					t.Errorf("%s: node %v LANIP = %v; want 101 + mac[5]", when, n.mac, ip)
+				}
+			}
+		}
+	}
+	check("before New")
+	if _, err := New(&c); err != nil {
+		t.Fatal(err)
+	}
+	check("after New")
+}
+
+func TestNetworkAccessors(t *testing.T) {
+	var c Config
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+	nw2 := c.AddNetwork("2.2.2.2") // default LAN
+	c.AddNode(nw1)
+	c.AddNode(nw2)
+	if p := nw2.LANPrefix(); p.IsValid() {
+		t.Errorf("before New, LANPrefix of network without one = %v; want invalid", p)
+	}
+	if _, err := New(&c); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		nw         *Network
+		wantWAN    string
+		wantPrefix string
+	}{
+		{nw1, "2.1.1.1", "192.168.1.1/24"},
+		{nw2, "2.2.2.2", "192.168.0.0/24"},
+	} {
+		if got := tt.nw.WANIP(); got != netip.MustParseAddr(tt.wantWAN) {
+			t.Errorf("WANIP = %v; want %v", got, tt.wantWAN)
+		}
+		if got := tt.nw.LANPrefix(); got != netip.MustParsePrefix(tt.wantPrefix) {
+			t.Errorf("network %v: LANPrefix = %v; want %v", tt.wantWAN, got, tt.wantPrefix)
+		}
+	}
+}
+
+// newBenchServer returns a Server with two nodes on separate networks
+// behind the given NAT type, the second with a client that discards
+// everything delivered to it.
+func newBenchServer(t testing.TB, nat NAT) (s *Server, from, to *Node) {
+	t.Helper()
+	var c Config
+	from = c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", nat))
+	to = c.AddNode(c.AddNetwork("2.2.2.2", "192.168.2.1/24", nat))
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	ep, err := s.NodeEndpoint(to.mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ep.Close() })
+	go io.Copy(io.Discard, ep)
+	return s, from, to
+}
+
+func TestBenchUDP(t *testing.T) {
+	s, from, to := newBenchServer(t, EasyNAT)
+	res, err := s.BenchUDP(from, to, 1000, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(res)
+	if res.Sent < 150 || res.Sent > 250 {
+		t.Errorf("sent %d packets; want about 200", res.Sent)
+	}
+	if res.Delivered != res.Sent || res.Dropped != 0 {
+		t.Errorf("delivered %d of %d packets; want all", res.Delivered, res.Sent)
+	}
+
+	// Without a client, nothing is delivered.
+	s.DetachNode(to.mac)
+	if _, err := s.BenchUDP(from, to, 1000, 50*time.Millisecond); err == nil {
+		t.Error("BenchUDP to a detached node succeeded")
+	}
+}
+
+func BenchmarkBenchUDP(b *testing.B) {
+	for _, nat := range []NAT{EasyNAT, One2OneNAT} {
+		b.Run(string(nat), func(b *testing.B) {
+			s, from, to := newBenchServer(b, nat)
+			var delivered int64
+			var elapsed time.Duration
+			for range b.N {
+				res, err := s.BenchUDP(from, to, 0, 100*time.Millisecond)
+				if err != nil {
+					b.Fatal(err)
+				}
+				delivered += res.Delivered
+				elapsed += res.Elapsed
+			}
+			b.ReportMetric(float64(delivered)/elapsed.Seconds(), "pkts/s")
+		})
+	}
+}
+
+func TestStartingInfo(t *testing.T) {
+	var c Config
+	net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	net2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", HardNAT)
+	n1 := c.AddNode(net1)
+	n2 := c.AddNode(net2)
+	n3 := c.AddNode(net1)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got := s.StartingInfo()
+	want := []BannerEntry{
+		{MAC: n1.mac, LANIP: n1.n.lanIP, WANIP: net1.WANIP(), NAT: EasyNAT},
+		{MAC: n2.mac, LANIP: n2.n.lanIP, WANIP: net2.WANIP(), NAT: HardNAT},
+		{MAC: n3.mac, LANIP: n3.n.lanIP, WANIP: net1.WANIP(), NAT: EasyNAT},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("StartingInfo = %+v; want %+v", got, want)
+	}
+	for _, e := range got {
+		if !net1.LANPrefix().Contains(e.LANIP) && !net2.LANPrefix().Contains(e.LANIP) {
+			t.Errorf("node %v LAN IP %v not on its network", e.MAC, e.LANIP)
+		}
+	}
+
+	var buf bytes.Buffer
+	s.WriteStartingBanner(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1+len(want) {
+		t.Fatalf("banner has %d lines; want %d:\n%s", len(lines), 1+len(want), buf.String())
+	}
+	for i, e := range want {
+		if l := lines[1+i]; !strings.Contains(l, e.MAC.String()) || !strings.Contains(l, e.LANIP.String()) || !strings.Contains(l, string(e.NAT)) {
+			t.Errorf("banner line %q doesn't describe %+v", l, e)
+		}
+	}
+}
+
+// timeFromNTP returns the time of the 64-bit NTP timestamp ts.
+func timeFromNTP(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nanos := (ts & 0xffffffff) * 1e9 >> 32
+	return time.Unix(secs, int64(nanos))
+}
+
+func TestNTPClockSkew(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: t0})
+	c := Config{Clock: clock}
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	synced := c.AddNode(nw)
+	skewed := c.AddNode(nw)
+	const skew = -90 * time.Minute
+	skewed.SetClockSkew(skew)
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ntpServer := netip.MustParseAddrPort("4.4.4.4:123")
+	for _, tt := range []struct {
+		node *Node
+		want time.Time
+	}{
+		{synced, t0},
+		{skewed, t0.Add(skew)},
+	} {
+		_, ch := nodePackets(t, s, tt.node)
+		req := make([]byte, ntpPacketLen)
+		req[0] = 4<<3 | 3 // version 4, client mode
+		binary.BigEndian.PutUint64(req[40:], 0x1122334455667788)
+		if err := s.InjectUDP(tt.node, 5123, ntpServer, req); err != nil {
+			t.Fatal(err)
+		}
+		p := nextPacket(ch)
+		if p == nil {
+			t.Fatalf("no NTP reply to %v", tt.node.mac)
+		}
+		udp := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		res := udp.Payload
+		if len(res) != ntpPacketLen || res[0]&0x7 != 4 || res[0]>>3&0x7 != 4 {
+			t.Fatalf("reply to %v is not an NTPv4 server reply: %x", tt.node.mac, res)
+		}
+		if got := binary.BigEndian.Uint64(res[24:]); got != 0x1122334455667788 {
+			t.Errorf("origin timestamp = %x; want the request's transmit timestamp", got)
+		}
+		got := timeFromNTP(binary.BigEndian.Uint64(res[40:]))
+		if d := got.Sub(tt.want); d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("NTP time for %v = %v; want %v", tt.node.mac, got.UTC(), tt.want)
+		}
+	}
+}
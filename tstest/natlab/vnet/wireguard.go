@@ -0,0 +1,138 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"encoding/binary"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// WireGuard message types, the first byte of their UDP payloads.
+const (
+	wgHandshakeInit     = 1
+	wgHandshakeResponse = 2
+	wgCookieReply       = 3
+	wgTransportData     = 4
+)
+
+// maxPendingWireGuardInits is how many unanswered WireGuard handshake
+// initiations the server remembers. Older ones are forgotten first.
+const maxPendingWireGuardInits = 256
+
+// wireGuardMessageType returns the type of the WireGuard message in the UDP
+// payload b, and whether b looks like one at all.
+func wireGuardMessageType(b []byte) (typ byte, ok bool) {
+	if len(b) < 4 || b[1] != 0 || b[2] != 0 || b[3] != 0 {
+		return 0, false
+	}
+	switch b[0] {
+	case wgHandshakeInit:
+		ok = len(b) == 148
+	case wgHandshakeResponse:
+		ok = len(b) == 92
+	case wgCookieReply:
+		ok = len(b) == 64
+	case wgTransportData:
+		ok = len(b) >= 32 && len(b)%16 == 0
+	}
+	return b[0], ok
+}
+
+// WireGuardHandshake is the timing of the first WireGuard handshake between
+// a pair of nodes on different networks, as observed by the router and
+// reported by [Server.WireGuardHandshakes].
+type WireGuardHandshake struct {
+	// InitSent is when the handshake initiation left the initiator's
+	// network.
+	InitSent time.Time
+
+	// ResponseDelivered is when the handshake response was delivered to
+	// the initiator.
+	ResponseDelivered time.Time
+}
+
+// Duration returns how long the handshake took to complete: a round trip
+// across the internet, including the latencies of both networks.
+func (h WireGuardHandshake) Duration() time.Duration {
+	return h.ResponseDelivered.Sub(h.InitSent)
+}
+
+// wgPendingInit is a WireGuard handshake initiation awaiting its response.
+type wgPendingInit struct {
+	initiator MAC
+	sent      time.Time
+}
+
+// WireGuardHandshakes returns the first completed WireGuard handshake between
+// each pair of nodes, keyed by initiator and then responder, such as for tests
+// to assert that connection setup stays within a time budget. Later
+// handshakes, such as rekeys, aren't recorded. Handshakes are measured from
+// the initiation that the response answers, so an initiation that was lost
+// and retried isn't counted. Nodes on the same LAN handshake without the
+// router and aren't measured.
+func (s *Server) WireGuardHandshakes() map[NodePair]WireGuardHandshake {
+	s.wgMu.Lock()
+	defer s.wgMu.Unlock()
+	ret := make(map[NodePair]WireGuardHandshake, len(s.wgHandshakes))
+	for pair, h := range s.wgHandshakes {
+		ret[pair] = h
+	}
+	return ret
+}
+
+// noteWireGuardSent notes p if it's a WireGuard handshake initiation sent by
+// a node across the internet.
+func (s *Server) noteWireGuardSent(p UDPPacket) {
+	if p.srcMAC == (MAC{}) {
+		return
+	}
+	if typ, ok := wireGuardMessageType(p.Payload); !ok || typ != wgHandshakeInit {
+		return
+	}
+	sender := binary.LittleEndian.Uint32(p.Payload[4:8])
+	s.wgMu.Lock()
+	defer s.wgMu.Unlock()
+	if _, ok := s.wgPending[sender]; !ok && len(s.wgPending) >= maxPendingWireGuardInits {
+		// Forget the oldest.
+		var oldest uint32
+		var oldestSent time.Time
+		for idx, in := range s.wgPending {
+			if oldestSent.IsZero() || in.sent.Before(oldestSent) {
+				oldest, oldestSent = idx, in.sent
+			}
+		}
+		delete(s.wgPending, oldest)
+	}
+	mak.Set(&s.wgPending, sender, wgPendingInit{initiator: p.srcMAC, sent: s.clock.Now()})
+}
+
+// noteWireGuardDelivered notes p, a UDP packet delivered to the node with MAC
+// dst, if it's the WireGuard handshake response to an initiation noted by
+// noteWireGuardSent.
+func (s *Server) noteWireGuardDelivered(p UDPPacket, dst MAC) {
+	if p.srcMAC == (MAC{}) {
+		return
+	}
+	if typ, ok := wireGuardMessageType(p.Payload); !ok || typ != wgHandshakeResponse {
+		return
+	}
+	receiver := binary.LittleEndian.Uint32(p.Payload[8:12])
+	s.wgMu.Lock()
+	defer s.wgMu.Unlock()
+	in, ok := s.wgPending[receiver]
+	if !ok || in.initiator != dst {
+		return
+	}
+	delete(s.wgPending, receiver)
+	pair := NodePair{Src: dst, Dst: p.srcMAC}
+	if _, ok := s.wgHandshakes[pair]; ok {
+		return
+	}
+	mak.Set(&s.wgHandshakes, pair, WireGuardHandshake{
+		InitSent:          in.sent,
+		ResponseDelivered: s.clock.Now(),
+	})
+}